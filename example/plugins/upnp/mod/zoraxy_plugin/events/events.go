@@ -32,6 +32,12 @@ const (
 	EventBlacklistToggled EventName = "blacklistToggled"
 	// EventAccessRuleCreated is emitted when a new access ruleset is created
 	EventAccessRuleCreated EventName = "accessRuleCreated"
+	// EventCertRenewed is emitted when a certificate is renewed successfully
+	EventCertRenewed EventName = "certRenewed"
+	// EventCertRenewalFailed is emitted when a certificate renewal attempt failed
+	EventCertRenewalFailed EventName = "certRenewalFailed"
+	// EventCertExpiringSoon is emitted when a certificate reaches one of the configured expiry lead times
+	EventCertExpiringSoon EventName = "certExpiringSoon"
 	// A custom event emitted by a plugin, with the intention of being broadcast
 	// to the designated recipient(s)
 	EventCustom EventName = "customEvent"
@@ -45,6 +51,9 @@ var validEventNames = map[EventName]bool{
 	EventBlacklistedIPBlocked: true,
 	EventBlacklistToggled:     true,
 	EventAccessRuleCreated:    true,
+	EventCertRenewed:          true,
+	EventCertRenewalFailed:    true,
+	EventCertExpiringSoon:     true,
 	EventCustom:               true,
 	EventDummy:                true,
 	// Add more event types as needed
@@ -105,6 +114,54 @@ func (e *AccessRuleCreatedEvent) GetEventSource() string {
 	return "accesslist-api"
 }
 
+// CertRenewedEvent represents an event when a certificate is renewed
+type CertRenewedEvent struct {
+	CertName string   `json:"cert_name"` // Name of the certificate in the cert store
+	Domains  []string `json:"domains"`
+	NotAfter int64    `json:"not_after"` // Unix timestamp of the new expiry date
+	Source   string   `json:"source"`    // The component that renewed the certificate, e.g. acme-autorenew
+}
+
+func (e *CertRenewedEvent) GetName() EventName {
+	return EventCertRenewed
+}
+
+func (e *CertRenewedEvent) GetEventSource() string {
+	return e.Source
+}
+
+// CertRenewalFailedEvent represents an event when a certificate renewal attempt failed
+type CertRenewalFailedEvent struct {
+	CertName string   `json:"cert_name"`
+	Domains  []string `json:"domains"`
+	Error    string   `json:"error"`
+	Source   string   `json:"source"`
+}
+
+func (e *CertRenewalFailedEvent) GetName() EventName {
+	return EventCertRenewalFailed
+}
+
+func (e *CertRenewalFailedEvent) GetEventSource() string {
+	return e.Source
+}
+
+// CertExpiringSoonEvent represents an event when a certificate is about to expire
+type CertExpiringSoonEvent struct {
+	CertName string   `json:"cert_name"`
+	Domains  []string `json:"domains"`
+	NotAfter int64    `json:"not_after"` // Unix timestamp of the expiry date
+	DaysLeft int      `json:"days_left"`
+}
+
+func (e *CertExpiringSoonEvent) GetName() EventName {
+	return EventCertExpiringSoon
+}
+
+func (e *CertExpiringSoonEvent) GetEventSource() string {
+	return "cert-expiry-monitor"
+}
+
 type CustomEvent struct {
 	SourcePlugin string         `json:"source_plugin"`
 	Recipients   []string       `json:"recipients"`
@@ -165,6 +222,33 @@ func ParseEvent(jsonData []byte, event *Event) error {
 			return err
 		}
 		event.Data = &payload.Data
+	case EventCertRenewed:
+		type tempData struct {
+			Data CertRenewedEvent `json:"data"`
+		}
+		var payload tempData
+		if err := json.Unmarshal(jsonData, &payload); err != nil {
+			return err
+		}
+		event.Data = &payload.Data
+	case EventCertRenewalFailed:
+		type tempData struct {
+			Data CertRenewalFailedEvent `json:"data"`
+		}
+		var payload tempData
+		if err := json.Unmarshal(jsonData, &payload); err != nil {
+			return err
+		}
+		event.Data = &payload.Data
+	case EventCertExpiringSoon:
+		type tempData struct {
+			Data CertExpiringSoonEvent `json:"data"`
+		}
+		var payload tempData
+		if err := json.Unmarshal(jsonData, &payload); err != nil {
+			return err
+		}
+		event.Data = &payload.Data
 	case EventCustom:
 		type tempData struct {
 			Data CustomEvent `json:"data"`
@@ -42,6 +42,7 @@ func RegisterHTTPProxyAPIs(authRouter *auth.RouterDef) {
 	authRouter.HandleFunc("/api/proxy/setIncoming", HandleIncomingPortSet)
 	authRouter.HandleFunc("/api/proxy/useHttpsRedirect", HandleUpdateHttpsRedirect)
 	authRouter.HandleFunc("/api/proxy/listenPort80", HandleUpdatePort80Listener)
+	authRouter.HandleFunc("/api/proxy/proxyProtocol", HandleInboundProxyProtocol)
 	authRouter.HandleFunc("/api/proxy/requestIsProxied", HandleManagementProxyCheck)
 	authRouter.HandleFunc("/api/proxy/developmentMode", HandleDevelopmentModeChange)
 	/* Reverse proxy upstream (load balance) */
@@ -68,6 +69,11 @@ func RegisterHTTPProxyAPIs(authRouter *auth.RouterDef) {
 	authRouter.HandleFunc("/api/proxy/auth/exceptions/list", ListProxyBasicAuthExceptionPaths)
 	authRouter.HandleFunc("/api/proxy/auth/exceptions/add", AddProxyBasicAuthExceptionPaths)
 	authRouter.HandleFunc("/api/proxy/auth/exceptions/delete", RemoveProxyBasicAuthExceptionPaths)
+	authRouter.HandleFunc("/api/proxy/auth/groups", UpdateProxyBasicAuthGroups)
+	authRouter.HandleFunc("/api/proxy/auth/ldap", UpdateProxyBasicAuthLDAP)
+	authRouter.HandleFunc("/api/proxy/auth/oidc", UpdateProxyOIDCSettings)
+	authRouter.HandleFunc("/api/proxy/auth/portal", UpdateProxySSOPortalUsers)
+	authRouter.HandleFunc("/api/proxy/auth/jwt", UpdateProxyJWTSettings)
 	/* Per-host cache settings */
 	authRouter.HandleFunc("/api/proxy/cache/get", HandleGetHostCacheSettings)
 	authRouter.HandleFunc("/api/proxy/cache/set", HandleSetHostCacheSettings)
@@ -80,6 +86,7 @@ func RegisterTLSAPIs(authRouter *auth.RouterDef) {
 	authRouter.HandleFunc("/api/cert/tlsMinVersion", handleSetTlsMinVersion)
 	authRouter.HandleFunc("/api/cert/resolve", handleCertTryResolve)
 	authRouter.HandleFunc("/api/cert/setPreferredCertificate", handleSetDomainPreferredCertificate)
+	authRouter.HandleFunc("/api/cert/tlsProfile", handleProxyTlsProfile)
 
 	//Certificate store functions
 	authRouter.HandleFunc("/api/cert/setDefault", tlsCertManager.SetCertAsDefault)
@@ -97,6 +104,43 @@ func RegisterTLSAPIs(authRouter *auth.RouterDef) {
 func RegisterAuthenticationHandlerAPIs(authRouter *auth.RouterDef) {
 	authRouter.HandleFunc("/api/sso/forward-auth", forwardAuthRouter.HandleAPIOptions)
 	authRouter.HandleFunc("/api/sso/OAuth2", oauth2Router.HandleSetOAuth2Settings)
+	authRouter.HandleFunc("/api/sso/oidc/providers", oauth2Router.HandleListProviders)
+	authRouter.HandleFunc("/api/sso/oidc/providers/add", oauth2Router.HandleAddProvider)
+	authRouter.HandleFunc("/api/sso/oidc/providers/edit", oauth2Router.HandleEditProvider)
+	authRouter.HandleFunc("/api/sso/oidc/providers/remove", oauth2Router.HandleRemoveProvider)
+
+	/* Built-in SSO portal */
+	authRouter.HandleFunc("/api/sso/portal/settings", ssoPortal.HandleSettings)
+	authRouter.HandleFunc("/api/sso/portal/users", ssoPortal.HandleListUsers)
+	authRouter.HandleFunc("/api/sso/portal/users/logout", ssoPortal.HandleLogoutUser)
+
+	/* LDAP / Active Directory */
+	authRouter.HandleFunc("/api/sso/ldap/settings", ldapAuthenticator.HandleSettings)
+	authRouter.HandleFunc("/api/sso/ldap/test", ldapAuthenticator.HandleTestLogin)
+
+	/* User Directory for basic auth */
+	authRouter.HandleFunc("/api/auth/userdir/users", userDirectory.HandleListUsers)
+	authRouter.HandleFunc("/api/auth/userdir/users/add", userDirectory.HandleAddUser)
+	authRouter.HandleFunc("/api/auth/userdir/users/edit", userDirectory.HandleEditUser)
+	authRouter.HandleFunc("/api/auth/userdir/users/remove", userDirectory.HandleRemoveUser)
+	authRouter.HandleFunc("/api/auth/userdir/groups", userDirectory.HandleListGroups)
+	authRouter.HandleFunc("/api/auth/userdir/groups/add", userDirectory.HandleAddGroup)
+	authRouter.HandleFunc("/api/auth/userdir/groups/edit", userDirectory.HandleEditGroup)
+	authRouter.HandleFunc("/api/auth/userdir/groups/remove", userDirectory.HandleRemoveGroup)
+	authRouter.HandleFunc("/api/auth/userdir/htpasswd/import", userDirectory.HandleImportHtpasswd)
+	authRouter.HandleFunc("/api/auth/userdir/htpasswd/export", userDirectory.HandleExportHtpasswd)
+
+	/* Management accounts and roles */
+	authRouter.HandleFunc("/api/auth/rbac/me", authAgent.HandleGetOwnPermission)
+	authRouter.HandleFunc("/api/auth/rbac/users", authAgent.HandleListManagementUsers)
+	authRouter.HandleFunc("/api/auth/rbac/users/add", authAgent.HandleAddManagementUser)
+	authRouter.HandleFunc("/api/auth/rbac/users/edit", authAgent.HandleEditManagementUser)
+	authRouter.HandleFunc("/api/auth/rbac/users/remove", authAgent.HandleRemoveManagementUser)
+	authRouter.HandleFunc("/api/auth/rbac/audit", authAgent.HandleListAuditLog)
+	//Personal API tokens for automation
+	authRouter.HandleFunc("/api/auth/tokens/list", authAgent.HandleListAPITokens)
+	authRouter.HandleFunc("/api/auth/tokens/create", authAgent.HandleCreateAPIToken)
+	authRouter.HandleFunc("/api/auth/tokens/revoke", authAgent.HandleRevokeAPIToken)
 }
 
 // Register the APIs for redirection rules management functions
@@ -174,6 +218,9 @@ func RegisterStreamProxyAPIs(authRouter *auth.RouterDef) {
 	authRouter.HandleFunc("/api/streamprox/config/stop", streamProxyManager.HandleStopProxy)
 	authRouter.HandleFunc("/api/streamprox/config/delete", streamProxyManager.HandleRemoveProxy)
 	authRouter.HandleFunc("/api/streamprox/config/status", streamProxyManager.HandleGetProxyStatus)
+	authRouter.HandleFunc("/api/streamprox/config/targets", streamProxyManager.HandleGetTargetStatus)
+	authRouter.HandleFunc("/api/streamprox/config/sessions", streamProxyManager.HandleListSessions)
+	authRouter.HandleFunc("/api/streamprox/config/sessions/close", streamProxyManager.HandleCloseSession)
 }
 
 // Register the APIs for mDNS service management functions
@@ -197,9 +244,23 @@ func RegisterACMEAndAutoRenewerAPIs(authRouter *auth.RouterDef) {
 	authRouter.HandleFunc("/api/acme/autoRenew/listDomains", acmeAutoRenewer.HandleLoadAutoRenewDomains)
 	authRouter.HandleFunc("/api/acme/autoRenew/renewPolicy", acmeAutoRenewer.HandleRenewPolicy)
 	authRouter.HandleFunc("/api/acme/autoRenew/renewNow", acmeAutoRenewer.HandleRenewNow)
+	authRouter.HandleFunc("/api/acme/autoRenew/schedule", acmeAutoRenewer.HandleGetRenewSchedule)
+	authRouter.HandleFunc("/api/acme/autoRenew/profile", acmeAutoRenewer.HandleCAProfile)
 	authRouter.HandleFunc("/api/acme/dns/providers", acmedns.HandleServeProvidersJson)
 	/* ACME Wizard */
 	authRouter.HandleFunc("/api/acme/wizard", acmewizard.HandleGuidedStepCheck)
+
+	//Local CA
+	authRouter.HandleFunc("/api/localca/status", localCA.HandleGetStatus)
+	authRouter.HandleFunc("/api/localca/config", localCA.HandleSetConfig)
+	authRouter.HandleFunc("/api/localca/root", localCA.HandleDownloadRoot)
+	authRouter.HandleFunc("/api/localca/regenerate", localCA.HandleRegenerateCA)
+	authRouter.HandleFunc("/api/localca/import", localCA.HandleImportCA)
+	authRouter.HandleFunc("/api/localca/issue", localCA.HandleIssueCertificate)
+
+	//Certificate expiry notification
+	authRouter.HandleFunc("/api/cert/notify/config", certNotifier.HandleConfig)
+	authRouter.HandleFunc("/api/cert/notify/check", certNotifier.HandleCheckNow)
 }
 
 // Register the APIs for Static Web Server management functions
@@ -233,6 +294,11 @@ func RegisterNetworkUtilsAPIs(authRouter *auth.RouterDef) {
 	authRouter.HandleFunc("/api/tools/whois", netutils.HandleWhois)
 	authRouter.HandleFunc("/api/tools/webssh", HandleCreateProxySession)
 	authRouter.HandleFunc("/api/tools/websshSupported", HandleWebSshSupportCheck)
+	authRouter.HandleFunc("/api/tools/webssh/sessions", HandleListWebSshSessions)
+	authRouter.HandleFunc("/api/tools/webssh/sessions/close", HandleCloseWebSshSession)
+	authRouter.HandleFunc("/api/tools/webssh/hostkeys", HandleListWebSshHostKeys)
+	authRouter.HandleFunc("/api/tools/webssh/hostkeys/remove", HandleRemoveWebSshHostKey)
+	authRouter.HandleFunc("/api/tools/webssh/audit", HandleWebSshAuditLog)
 	authRouter.HandleFunc("/api/tools/wol", HandleWakeOnLan)
 	authRouter.HandleFunc("/api/tools/smtp/get", HandleSMTPGet)
 	authRouter.HandleFunc("/api/tools/smtp/set", HandleSMTPSet)
@@ -265,8 +331,11 @@ func RegisterPluginAPIs(authRouter *auth.RouterDef) {
 }
 
 // Register the APIs for Auth functions, due to scoping issue some functions are defined here
-func RegisterAuthAPIs(requireAuth bool, targetMux *http.ServeMux) {
+func RegisterAuthAPIs(requireAuth bool, targetMux *http.ServeMux, authRouter *auth.RouterDef) {
 	targetMux.HandleFunc("/api/auth/login", authAgent.HandleLogin)
+	targetMux.HandleFunc("/api/auth/login/2fa", authAgent.HandleTwoFactorLogin)
+	targetMux.HandleFunc("/api/auth/login/webauthn/begin", authAgent.HandleWebAuthnLoginBegin)
+	targetMux.HandleFunc("/api/auth/login/webauthn/finish", authAgent.HandleWebAuthnLoginFinish)
 	targetMux.HandleFunc("/api/auth/logout", authAgent.HandleLogout)
 	targetMux.HandleFunc("/api/auth/checkLogin", func(w http.ResponseWriter, r *http.Request) {
 		if requireAuth {
@@ -297,13 +366,24 @@ func RegisterAuthAPIs(requireAuth bool, targetMux *http.ServeMux) {
 			utils.SendErrorResponse(w, "Root management account already exists")
 		}
 	})
-	targetMux.HandleFunc("/api/auth/changePassword", func(w http.ResponseWriter, r *http.Request) {
+	//Self service APIs of the logged in user, allowed for all roles
+	authRouter.HandleFunc("/api/auth/changePassword", func(w http.ResponseWriter, r *http.Request) {
+		if auth.IsAPITokenRequest(r) {
+			//Password can only be changed with a session login
+			utils.SendErrorResponse(w, "Password cannot be changed with an API token")
+			return
+		}
 		username, err := authAgent.GetUserName(w, r)
 		if err != nil {
 			http.Error(w, "401 - Unauthorized", http.StatusUnauthorized)
 			return
 		}
 
+		if authAgent.IsExternalUser(username) {
+			utils.SendErrorResponse(w, "Password of directory accounts must be changed in the directory")
+			return
+		}
+
 		oldPassword, err := utils.PostPara(r, "oldPassword")
 		if err != nil {
 			utils.SendErrorResponse(w, "empty current password")
@@ -332,6 +412,16 @@ func RegisterAuthAPIs(requireAuth bool, targetMux *http.ServeMux) {
 		authAgent.UnregisterUser(username)
 		authAgent.CreateUserAccount(username, newPassword, "")
 	})
+
+	//Two-factor authentication management, handlers only change the logged in user
+	authRouter.HandleFunc("/api/auth/2fa/status", authAgent.HandleTwoFactorStatus)
+	authRouter.HandleFunc("/api/auth/2fa/totp/enroll", authAgent.HandleTOTPEnroll)
+	authRouter.HandleFunc("/api/auth/2fa/totp/confirm", authAgent.HandleTOTPConfirm)
+	authRouter.HandleFunc("/api/auth/2fa/totp/disable", authAgent.HandleTOTPDisable)
+	authRouter.HandleFunc("/api/auth/2fa/recovery/regenerate", authAgent.HandleRecoveryCodesRegenerate)
+	authRouter.HandleFunc("/api/auth/2fa/webauthn/register/begin", authAgent.HandleWebAuthnRegisterBegin)
+	authRouter.HandleFunc("/api/auth/2fa/webauthn/register/finish", authAgent.HandleWebAuthnRegisterFinish)
+	authRouter.HandleFunc("/api/auth/2fa/webauthn/remove", authAgent.HandleWebAuthnRemove)
 }
 
 /* Register all the APIs */
@@ -343,6 +433,7 @@ func initAPIs(targetMux *http.ServeMux) {
 		DeniedHandler: func(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "401 - Unauthorized", http.StatusUnauthorized)
 		},
+		ResourceScopeCheck: checkProxyRuleScope,
 	})
 
 	// Register the standard web services URLs
@@ -362,7 +453,7 @@ func initAPIs(targetMux *http.ServeMux) {
 	targetMux.Handle("/", advHandler)
 
 	//Register the APIs
-	RegisterAuthAPIs(requireAuth, targetMux)
+	RegisterAuthAPIs(requireAuth, targetMux, authRouter)
 	RegisterHTTPProxyAPIs(authRouter)
 	RegisterTLSAPIs(authRouter)
 	RegisterAuthenticationHandlerAPIs(authRouter)
@@ -6,6 +6,7 @@ import (
 	"path/filepath"
 	"strings"
 
+	"imuslab.com/zoraxy/mod/tlscert"
 	"imuslab.com/zoraxy/mod/utils"
 )
 
@@ -208,3 +209,96 @@ func handleSetDomainPreferredCertificate(w http.ResponseWriter, r *http.Request)
 
 	utils.SendOK(w)
 }
+
+// Handle the GET and SET of the TLS profile of a proxy endpoint
+func handleProxyTlsProfile(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		type TlsProfileOptions struct {
+			Presets      []*tlscert.TlsProfile `json:"presets"`
+			CipherSuites []string              `json:"cipher_suites"`
+			Curves       []string              `json:"curves"`
+			Current      *tlscert.TlsProfile   `json:"current"`
+		}
+
+		result := TlsProfileOptions{
+			Presets:      tlscert.ListTlsProfilePresets(),
+			CipherSuites: tlscert.ListSupportedCipherSuites(),
+			Curves:       tlscert.ListSupportedCurves(),
+		}
+
+		//Include the current profile of the endpoint if given
+		ep, err := utils.GetPara(r, "ep")
+		if err == nil {
+			ept, err := dynamicProxyRouter.LoadProxy(ep)
+			if err != nil {
+				utils.SendErrorResponse(w, err.Error())
+				return
+			}
+			if ept.TlsOptions != nil {
+				result.Current = ept.TlsOptions.TlsProfile
+			}
+		}
+
+		js, _ := json.Marshal(result)
+		utils.SendJSONResponse(w, string(js))
+		return
+	} else if r.Method != http.MethodPost {
+		http.Error(w, "405 - Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ep, err := utils.PostPara(r, "ep")
+	if err != nil {
+		utils.SendErrorResponse(w, "Invalid ep given")
+		return
+	}
+
+	newProfile := &tlscert.TlsProfile{}
+	profileJson, err := utils.PostPara(r, "profile")
+	if err != nil {
+		//Only preset is given
+		preset, _ := utils.PostPara(r, "preset")
+		newProfile, err = tlscert.GetTlsProfilePreset(tlscert.TlsProfilePreset(preset))
+		if err != nil {
+			utils.SendErrorResponse(w, err.Error())
+			return
+		}
+		newProfile.DisableHTTP2, _ = utils.PostBool(r, "disableHttp2")
+	} else {
+		err = json.Unmarshal([]byte(profileJson), newProfile)
+		if err != nil {
+			utils.SendErrorResponse(w, "Invalid TLS profile given")
+			return
+		}
+	}
+
+	err = newProfile.Validate()
+	if err != nil {
+		utils.SendErrorResponse(w, "Invalid TLS profile given: "+err.Error())
+		return
+	}
+
+	ept, err := dynamicProxyRouter.LoadProxy(ep)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	if ept.TlsOptions == nil {
+		ept.TlsOptions = tlscert.GetDefaultHostSpecificTlsBehavior()
+	}
+
+	if newProfile.IsDefault() {
+		//Fallback to global TLS options
+		newProfile = nil
+	}
+	ept.TlsOptions.TlsProfile = newProfile
+
+	err = SaveReverseProxyConfig(ept)
+	if err != nil {
+		utils.SendErrorResponse(w, "Failed to save TLS profile: "+err.Error())
+		return
+	}
+
+	utils.SendOK(w)
+}
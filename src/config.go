@@ -81,8 +81,8 @@ func LoadReverseProxyConfig(configFilepath string) error {
 
 		dynamicProxyRouter.SetProxyRouteAsRoot(rootProxyEndpoint)
 
-	case dynamicproxy.ProxyTypeHost:
-		//This is a host config file
+	case dynamicproxy.ProxyTypeHost, dynamicproxy.ProxyTypeTlsPassthrough:
+		//This is a host or TLS passthrough config file
 		readyProxyEndpoint, err := dynamicProxyRouter.PrepareProxyRoute(&thisConfigEndpoint)
 		if err != nil {
 			return err
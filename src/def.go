@@ -19,6 +19,10 @@ import (
 	"imuslab.com/zoraxy/mod/acme"
 	"imuslab.com/zoraxy/mod/auth"
 	"imuslab.com/zoraxy/mod/auth/sso/forward"
+	"imuslab.com/zoraxy/mod/auth/sso/jwtauth"
+	"imuslab.com/zoraxy/mod/auth/sso/ldapauth"
+	"imuslab.com/zoraxy/mod/auth/sso/portal"
+	"imuslab.com/zoraxy/mod/auth/userdir"
 	"imuslab.com/zoraxy/mod/database"
 	"imuslab.com/zoraxy/mod/dockerux"
 	"imuslab.com/zoraxy/mod/dynamicproxy/loadbalance"
@@ -38,6 +42,8 @@ import (
 	"imuslab.com/zoraxy/mod/hoststats"
 	"imuslab.com/zoraxy/mod/streamproxy"
 	"imuslab.com/zoraxy/mod/tlscert"
+	"imuslab.com/zoraxy/mod/tlscert/certnotify"
+	"imuslab.com/zoraxy/mod/tlscert/localca"
 	"imuslab.com/zoraxy/mod/uptime"
 	"imuslab.com/zoraxy/mod/webserv"
 )
@@ -78,6 +84,8 @@ const (
 	CONF_PLUGIN_GROUPS = CONF_FOLDER + "/plugin_groups.json"
 	CONF_GEODB_PATH    = CONF_FOLDER + "/geodb"
 	CONF_LOG_CONFIG    = CONF_FOLDER + "/log_conf.json"
+	CONF_LOCAL_CA      = CONF_FOLDER + "/localca"
+	CONF_CERT_NOTIFY   = CONF_FOLDER + "/cert_notify.json"
 )
 
 /* System Startup Flags */
@@ -85,6 +93,7 @@ var (
 	webUIPort                  = flag.String("port", ":8000", "Management web interface listening port")
 	databaseBackend            = flag.String("db", "auto", "Database backend to use (leveldb, boltdb, auto) Note that fsdb will be used on unsupported platforms like RISCV")
 	noauth                     = flag.Bool("noauth", false, "Disable authentication for management interface")
+	disableTwoFactor           = flag.Bool("disable2fa", false, "Disable two-factor authentication of the management interface, for recovering a locked out account")
 	showver                    = flag.Bool("version", false, "Show version of this server")
 	allowSshLoopback           = flag.Bool("sshlb", false, "Allow loopback web ssh connection (DANGER)")
 	allowMdnsScanning          = flag.Bool("mdns", true, "Enable mDNS scanner and transponder")
@@ -152,6 +161,8 @@ var (
 	streamProxyManager *streamproxy.Manager      //Stream Proxy Manager for TCP / UDP forwarding
 	acmeHandler        *acme.ACMEHandler         //Handler for ACME Certificate renew
 	acmeAutoRenewer    *acme.AutoRenewer         //Handler for ACME auto renew ticking
+	localCA            *localca.LocalCA          //Local private CA for internal hostnames
+	certNotifier       *certnotify.Notifier      //Certificate expiry and renewal notifier
 	staticWebServer    *webserv.WebServer        //Static web server for hosting simple stuffs
 	forwardProxy       *forwardproxy.Handler     //HTTP Forward proxy, basically VPN for web browser
 	loadBalancer       *loadbalance.RouteManager //Global scope loadbalancer, store the state of the lb routing
@@ -161,8 +172,12 @@ var (
 	pluginApiKeyManager *auth.APIKeyManager //API key manager for plugin authentication
 
 	//Authentication Provider
-	forwardAuthRouter *forward.AuthRouter  // Forward Auth router for Authelia/Authentik/etc authentication
-	oauth2Router      *oauth2.OAuth2Router //OAuth2Router router for OAuth2Router authentication
+	forwardAuthRouter *forward.AuthRouter     // Forward Auth router for Authelia/Authentik/etc authentication
+	oauth2Router      *oauth2.OAuth2Router    //OAuth2Router router for OAuth2Router authentication
+	userDirectory     *userdir.Directory      //Shared users and groups for proxy basic auth
+	ssoPortal         *portal.Portal          //Built-in SSO portal using the Zoraxy user accounts
+	jwtValidator      *jwtauth.Validator      //Bearer token validator for endpoints using JWT auth
+	ldapAuthenticator *ldapauth.Authenticator //LDAP / Active Directory login for basic auth and the management panel
 
 	//Helper modules
 	EmailSender       *email.Sender         //Email sender that handle email sending
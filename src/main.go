@@ -44,6 +44,7 @@ import (
 	"github.com/google/uuid"
 	"github.com/gorilla/csrf"
 	"imuslab.com/zoraxy/mod/geodb"
+	"imuslab.com/zoraxy/mod/tlscert/localca"
 	"imuslab.com/zoraxy/mod/update"
 	"imuslab.com/zoraxy/mod/utils"
 )
@@ -120,8 +121,11 @@ func main() {
 
 	// Create a entry mux to accept all management interface requests
 	entryMux := http.NewServeMux()
-	entryMux.Handle("/plugin/", pluginAPIMux)            //For plugins API access
-	entryMux.Handle("/", csrfMiddleware(webminPanelMux)) //For webmin UI access, require csrf token
+	entryMux.Handle("/plugin/", pluginAPIMux)                                 //For plugins API access
+	entryMux.Handle("/", skipCSRFForAPIToken(csrfMiddleware(webminPanelMux))) //For webmin UI access, require csrf token or API token
+
+	//Local CA ACME directory, requests are authenticated by JWS account keys instead of CSRF token
+	entryMux.HandleFunc(localca.ACMEPathPrefix+"/", localCA.HandleACME)
 
 	// Start the reverse proxy server in go routine
 	go func() {
@@ -45,6 +45,7 @@ type CertificateInfoJSON struct {
 	UseDNS      bool     `json:"dns"`        //Use DNS challenge
 	PropTimeout int      `json:"prop_time"`  //Propagation timeout
 	DNSServers  []string `json:"dnsServers"` // DNS servers
+	Profile     string   `json:"profile"`    //Certificate profile requested from the CA
 }
 
 // ACMEUser represents a user in the ACME system.
@@ -105,6 +106,16 @@ func (a *ACMEHandler) Close() error {
 
 // ObtainCert obtains a certificate for the specified domains.
 func (a *ACMEHandler) ObtainCert(domains []string, certificateName string, email string, caName string, caUrl string, skipTLS bool, useDNS bool, propagationTimeout int, dnsServers string) (bool, error) {
+	return a.obtainCert(domains, certificateName, email, caName, caUrl, skipTLS, useDNS, propagationTimeout, dnsServers, "")
+}
+
+// RenewCert obtains a new certificate that replaces the certificate with the given ARI cert ID.
+// Set replacesCertID to empty string if the CA do not support ARI
+func (a *ACMEHandler) RenewCert(domains []string, certificateName string, email string, caName string, caUrl string, skipTLS bool, useDNS bool, propagationTimeout int, dnsServers string, replacesCertID string) (bool, error) {
+	return a.obtainCert(domains, certificateName, email, caName, caUrl, skipTLS, useDNS, propagationTimeout, dnsServers, replacesCertID)
+}
+
+func (a *ACMEHandler) obtainCert(domains []string, certificateName string, email string, caName string, caUrl string, skipTLS bool, useDNS bool, propagationTimeout int, dnsServers string, replacesCertID string) (bool, error) {
 	a.Logf("Obtaining certificate for: "+strings.Join(domains, ", "), nil)
 
 	// generate private key
@@ -127,18 +138,7 @@ func (a *ACMEHandler) ObtainCert(domains []string, certificateName string, email
 	// Ref: https://github.com/go-acme/lego/blob/6af2c756ac73a9cb401621afca722d0f4112b1b8/lego/client_config.go#L74
 	if skipTLS {
 		a.Logf("Ignoring TLS/SSL Verification Error for ACME Server", nil)
-		config.HTTPClient.Transport = &http.Transport{
-			Proxy: http.ProxyFromEnvironment,
-			DialContext: (&net.Dialer{
-				Timeout:   30 * time.Second,
-				KeepAlive: 30 * time.Second,
-			}).DialContext,
-			TLSHandshakeTimeout:   30 * time.Second,
-			ResponseHeaderTimeout: 30 * time.Second,
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true,
-			},
-		}
+		config.HTTPClient.Transport = newInsecureTransport()
 	}
 
 	//Fallback to Let's Encrypt if it is not set
@@ -146,24 +146,13 @@ func (a *ACMEHandler) ObtainCert(domains []string, certificateName string, email
 		caName = "Let's Encrypt"
 	}
 
-	// setup the custom ACME url endpoint.
-	if caUrl != "" {
-		config.CADirURL = caUrl
+	if caDirURL := a.resolveCADirURL(caName, caUrl); caDirURL != "" {
+		config.CADirURL = caDirURL
 	}
-
-	// if not custom ACME url, load it from ca.json
 	if caName == "custom" {
 		a.Logf("Using Custom ACME "+caUrl+" for CA Directory URL", nil)
 	} else {
-		caLinkOverwrite, err := loadCAApiServerFromName(caName)
-		if err == nil {
-			config.CADirURL = caLinkOverwrite
-			a.Logf("Using "+caLinkOverwrite+" for CA Directory URL", nil)
-		} else {
-			// (caName == "" || caUrl == "") will use default acme
-			config.CADirURL = a.DefaultAcmeServer
-			a.Logf("Using Default ACME "+a.DefaultAcmeServer+" for CA Directory URL", nil)
-		}
+		a.Logf("Using "+config.CADirURL+" for CA Directory URL", nil)
 	}
 
 	config.Certificate.KeyType = certcrypto.RSA2048
@@ -300,9 +289,15 @@ func (a *ACMEHandler) ObtainCert(domains []string, certificateName string, email
 	adminUser.Registration = reg
 
 	// obtain the certificate
+	profile := a.resolveCertProfile(caName)
+	if profile != "" {
+		a.Logf("Requesting certificate profile "+profile, nil)
+	}
 	request := certificate.ObtainRequest{
-		Domains: domains,
-		Bundle:  true,
+		Domains:        domains,
+		Bundle:         true,
+		Profile:        profile,
+		ReplacesCertID: replacesCertID,
 	}
 	certificates, err := client.Certificate.Obtain(request)
 	if err != nil {
@@ -331,6 +326,7 @@ func (a *ACMEHandler) ObtainCert(domains []string, certificateName string, email
 		UseDNS:      useDNS,
 		PropTimeout: propagationTimeout,
 		DNSServers:  dnsNameservers,
+		Profile:     profile,
 	}
 
 	certInfoBytes, err := json.Marshal(certInfo)
@@ -348,6 +344,52 @@ func (a *ACMEHandler) ObtainCert(domains []string, certificateName string, email
 	return true, nil
 }
 
+// Resolve the ACME directory URL of a CA. Custom CA use the given caUrl and
+// CA not listed in ca.json fallback to the default ACME server
+func (a *ACMEHandler) resolveCADirURL(caName string, caUrl string) string {
+	if caName == "custom" {
+		return caUrl
+	}
+	caLinkOverwrite, err := loadCAApiServerFromName(caName)
+	if err == nil {
+		return caLinkOverwrite
+	}
+	return a.DefaultAcmeServer
+}
+
+// Get the certificate profile to request from the CA. The user selected
+// profile (if any) takes priority over the default profile in ca.json
+func (a *ACMEHandler) resolveCertProfile(caName string) string {
+	profileDef := GetCAProfiles(caName)
+	if profileDef == nil {
+		return ""
+	}
+	if a.Database.TableExists("acme") && a.Database.KeyExists("acme", caName+"_profile") {
+		var selected string
+		err := a.Database.Read("acme", caName+"_profile", &selected)
+		if err == nil && (selected == "" || IsSupportedProfile(caName, selected)) {
+			return selected
+		}
+	}
+	return profileDef.Default
+}
+
+// Create a HTTP transport that skip TLS verification of the ACME server
+func newInsecureTransport() *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   30 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+	}
+}
+
 // CheckCertificate returns a list of domains that are in expired certificates.
 // It will return all domains that is in expired certificates
 // *** if there is a vaild certificate contains the domain and there is a expired certificate contains the same domain
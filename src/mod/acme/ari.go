@@ -0,0 +1,59 @@
+package acme
+
+/*
+	ari.go
+
+	ACME Renewal Information (RFC 9773) support. The CA tells
+	us when a certificate should be renewed with a suggested
+	renewal window instead of a fixed number of days before expiry
+*/
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+
+	"github.com/go-acme/lego/v4/acme/api"
+	"github.com/go-acme/lego/v4/certificate"
+	"github.com/go-acme/lego/v4/lego"
+)
+
+// ErrNoARI is returned when the CA does not provide renewal information
+var ErrNoARI = api.ErrNoARI
+
+// GetRenewalInfo query the CA for the suggested renewal window of a certificate
+func (a *ACMEHandler) GetRenewalInfo(cert *x509.Certificate, caName string, caUrl string, skipTLS bool) (*certificate.RenewalInfoResponse, error) {
+	if cert == nil {
+		return nil, errors.New("certificate is nil")
+	}
+
+	//Renewal info is fetched without account, use a throwaway key for the client
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	config := lego.NewConfig(&ACMEUser{key: privateKey})
+	if skipTLS {
+		config.HTTPClient.Transport = newInsecureTransport()
+	}
+
+	if caName == "" {
+		caName = "Let's Encrypt"
+	}
+	if caDirURL := a.resolveCADirURL(caName, caUrl); caDirURL != "" {
+		config.CADirURL = caDirURL
+	}
+
+	client, err := lego.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	return client.Certificate.GetRenewalInfo(certificate.RenewalInfoRequest{Cert: cert})
+}
+
+// GetARICertID return the ARI certificate identifier used to mark a new order as replacement
+func GetARICertID(cert *x509.Certificate) (string, error) {
+	return certificate.MakeARICertID(cert)
+}
@@ -9,9 +9,12 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
+	"imuslab.com/zoraxy/mod/eventsystem"
 	"imuslab.com/zoraxy/mod/info/logger"
+	"imuslab.com/zoraxy/mod/plugins/zoraxy_plugin/events"
 	"imuslab.com/zoraxy/mod/utils"
 )
 
@@ -38,11 +41,19 @@ type AutoRenewer struct {
 	EarlyRenewDays    int //How many days before cert expire to renew certificate
 	TickerstopChan    chan bool
 	Logger            *logger.Logger //System wide logger
+
+	ScheduleFilePath  string                    //Path to persist the renewal schedule
+	Schedule          map[string]*RenewSchedule //Cert name to its renewal schedule
+	scheduleLock      sync.Mutex
+	scheduleTimer     *time.Timer //One-shot timer for renewals due before the next tick
+	scheduleTimerLock sync.Mutex
+	renewLock         sync.Mutex //Prevent concurrent renew by ticker, timer and API
 }
 
 type ExpiredCerts struct {
-	Domains  []string
-	Filepath string
+	Domains        []string
+	Filepath       string
+	ReplacesCertID string //ARI cert ID of the certificate to be replaced, if supported by CA
 }
 
 // Create an auto renew agent, require config filepath and auto scan & renew interval (seconds)
@@ -91,7 +102,9 @@ func NewAutoRenewer(config string, certFolder string, renewCheckInterval int64,
 		RenewTickInterval: renewCheckInterval,
 		EarlyRenewDays:    earlyRenewDays,
 		Logger:            logger,
+		ScheduleFilePath:  getScheduleFilePath(config),
 	}
+	thisRenewer.loadSchedule()
 
 	thisRenewer.Logf("ACME early renew set to "+fmt.Sprint(earlyRenewDays)+" days and check interval set to "+fmt.Sprint(renewCheckInterval)+" seconds", nil)
 
@@ -141,6 +154,7 @@ func (a *AutoRenewer) StopAutoRenewTicker() {
 	if a.TickerstopChan != nil {
 		a.TickerstopChan <- true
 	}
+	a.stopScheduleTimer()
 
 	a.TickerstopChan = nil
 }
@@ -287,9 +301,13 @@ func (a *AutoRenewer) HandleACMEEmail(w http.ResponseWriter, r *http.Request) {
 }
 
 // Check and renew certificates. This check all the certificates in the
-// certificate folder and return a list of certs that is renewed in this call
+// certificate folder and return a list of certs that is renewed in this call.
+// A certificate is renewed when its scheduled renewal time (see schedule.go) is reached
 // Return string array with length 0 when no cert is expired
 func (a *AutoRenewer) CheckAndRenewCertificates() ([]string, error) {
+	a.renewLock.Lock()
+	defer a.renewLock.Unlock()
+
 	certFolder := a.CertFolder
 	files, err := os.ReadDir(certFolder)
 	if err != nil {
@@ -298,16 +316,21 @@ func (a *AutoRenewer) CheckAndRenewCertificates() ([]string, error) {
 	}
 
 	expiredCertList := []*ExpiredCerts{}
+	scheduledCerts := []string{}
 	if a.RenewerConfig.RenewAll {
 		//Scan and renew all
 		for _, file := range files {
 			if filepath.Ext(file.Name()) == ".crt" || filepath.Ext(file.Name()) == ".pem" {
 				//This is a public key file
-				certBytes, err := os.ReadFile(filepath.Join(certFolder, file.Name()))
+				fileName := file.Name()
+				certName := fileName[:len(fileName)-len(filepath.Ext(fileName))]
+				certPath := filepath.Join(certFolder, fileName)
+				scheduledCerts = append(scheduledCerts, certName)
+				certBytes, err := os.ReadFile(certPath)
 				if err != nil {
 					continue
 				}
-				if CertExpireSoon(certBytes, a.EarlyRenewDays) || CertIsExpired(certBytes) {
+				if a.shouldRenew(certName, certPath, certBytes) {
 					//This cert is expired
 					DNSName, err := ExtractDomains(certBytes)
 					if err != nil {
@@ -317,8 +340,9 @@ func (a *AutoRenewer) CheckAndRenewCertificates() ([]string, error) {
 					}
 
 					expiredCertList = append(expiredCertList, &ExpiredCerts{
-						Filepath: filepath.Join(certFolder, file.Name()),
-						Domains:  DNSName,
+						Filepath:       certPath,
+						Domains:        DNSName,
+						ReplacesCertID: a.getReplacesCertID(certName),
 					})
 				}
 			}
@@ -330,11 +354,13 @@ func (a *AutoRenewer) CheckAndRenewCertificates() ([]string, error) {
 			certName := fileName[:len(fileName)-len(filepath.Ext(fileName))]
 			if contains(a.RenewerConfig.FilesToRenew, certName) {
 				//This is the one to auto renew
-				certBytes, err := os.ReadFile(filepath.Join(certFolder, file.Name()))
+				certPath := filepath.Join(certFolder, fileName)
+				scheduledCerts = append(scheduledCerts, certName)
+				certBytes, err := os.ReadFile(certPath)
 				if err != nil {
 					continue
 				}
-				if CertExpireSoon(certBytes, a.EarlyRenewDays) || CertIsExpired(certBytes) {
+				if a.shouldRenew(certName, certPath, certBytes) {
 					//This cert is expired
 					DNSName, err := ExtractDomains(certBytes)
 					if err != nil {
@@ -344,15 +370,36 @@ func (a *AutoRenewer) CheckAndRenewCertificates() ([]string, error) {
 					}
 
 					expiredCertList = append(expiredCertList, &ExpiredCerts{
-						Filepath: filepath.Join(certFolder, file.Name()),
-						Domains:  DNSName,
+						Filepath:       certPath,
+						Domains:        DNSName,
+						ReplacesCertID: a.getReplacesCertID(certName),
 					})
 				}
 			}
 		}
 	}
 
-	return a.renewExpiredDomains(expiredCertList)
+	renewedCertFiles, err := a.renewExpiredDomains(expiredCertList)
+
+	//Update the schedule and wake up for renewals due before the next tick
+	a.pruneSchedule(scheduledCerts)
+	if err := a.saveSchedule(); err != nil {
+		a.Logf("Failed to save renewal schedule", err)
+	}
+	a.armNextRenewal()
+
+	return renewedCertFiles, err
+}
+
+// Get the ARI cert ID of a scheduled certificate, return empty string if the CA do not support ARI
+func (a *AutoRenewer) getReplacesCertID(certName string) string {
+	a.scheduleLock.Lock()
+	defer a.scheduleLock.Unlock()
+	schedule, ok := a.Schedule[certName]
+	if !ok {
+		return ""
+	}
+	return schedule.ReplacesCertID
 }
 
 // Close the auto renewer
@@ -360,6 +407,7 @@ func (a *AutoRenewer) Close() {
 	if a.TickerstopChan != nil {
 		a.TickerstopChan <- true
 	}
+	a.stopScheduleTimer()
 }
 
 // Renew the certificate by filename extract all DNS name from the
@@ -406,18 +454,47 @@ func (a *AutoRenewer) renewExpiredDomains(certs []*ExpiredCerts) ([]string, erro
 			a.Logf("Could not extract SANs from PEM for "+fileName+", using original domains", errSan)
 		}
 
-		_, err = a.AcmeHandler.ObtainCert(expiredCert.Domains, certName, a.RenewerConfig.Email, certInfo.AcmeName, certInfo.AcmeUrl, certInfo.SkipTLS, certInfo.UseDNS, certInfo.PropTimeout, dnsServers)
+		_, err = a.AcmeHandler.RenewCert(expiredCert.Domains, certName, a.RenewerConfig.Email, certInfo.AcmeName, certInfo.AcmeUrl, certInfo.SkipTLS, certInfo.UseDNS, certInfo.PropTimeout, dnsServers, expiredCert.ReplacesCertID)
 		if err != nil {
 			a.Logf("Renew "+fileName+"("+strings.Join(expiredCert.Domains, ",")+") failed", err)
+			emitCertRenewalFailed(certName, expiredCert.Domains, err)
 		} else {
 			a.Logf("Successfully renewed "+filepath.Base(expiredCert.Filepath), nil)
 			renewedCertFiles = append(renewedCertFiles, filepath.Base(expiredCert.Filepath))
+			emitCertRenewed(certName, expiredCert.Domains, expiredCert.Filepath)
 		}
 	}
 
 	return renewedCertFiles, nil
 }
 
+// Notify the event subscribers that a certificate is renewed
+func emitCertRenewed(certName string, domains []string, certFilepath string) {
+	if eventsystem.Publisher == nil {
+		return
+	}
+	notAfter, _ := ExtractExpiryDateFromPEM(certFilepath)
+	eventsystem.Publisher.Emit(&events.CertRenewedEvent{
+		CertName: certName,
+		Domains:  domains,
+		NotAfter: notAfter.Unix(),
+		Source:   "acme-autorenew",
+	})
+}
+
+// Notify the event subscribers that a certificate renewal failed
+func emitCertRenewalFailed(certName string, domains []string, renewErr error) {
+	if eventsystem.Publisher == nil {
+		return
+	}
+	eventsystem.Publisher.Emit(&events.CertRenewalFailedEvent{
+		CertName: certName,
+		Domains:  domains,
+		Error:    renewErr.Error(),
+		Source:   "acme-autorenew",
+	})
+}
+
 // Write the current renewer config to file
 func (a *AutoRenewer) saveRenewConfigToFile() error {
 	js, _ := json.MarshalIndent(a.RenewerConfig, "", " ")
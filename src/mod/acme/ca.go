@@ -17,6 +17,13 @@ import (
 type CaDef struct {
 	Production map[string]string
 	Test       map[string]string
+	Profiles   map[string]*CaProfileDef //Certificate profiles supported by the CA, see draft-aaron-acme-profiles
+}
+
+// Certificate profiles offered by a CA
+type CaProfileDef struct {
+	Default   string   `json:"default"`   //Profile to use if user did not select one
+	Available []string `json:"available"` //Profiles that can be selected
 }
 
 //go:embed ca.json
@@ -54,3 +61,20 @@ func IsSupportedCA(caName string) bool {
 	_, err := loadCAApiServerFromName(caName)
 	return err == nil
 }
+
+// Get the certificate profiles definition of a CA, return nil if the CA do not support profiles
+func GetCAProfiles(caName string) *CaProfileDef {
+	if strings.HasPrefix(caName, "Buypass AS") {
+		caName = "Buypass"
+	}
+	return caDef.Profiles[caName]
+}
+
+// Check if the profile is offered by the given CA
+func IsSupportedProfile(caName string, profile string) bool {
+	profileDef := GetCAProfiles(caName)
+	if profileDef == nil {
+		return false
+	}
+	return contains(profileDef.Available, profile)
+}
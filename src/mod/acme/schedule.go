@@ -0,0 +1,366 @@
+package acme
+
+/*
+	schedule.go
+
+	Renewal schedule for the auto renewer. Each certificate get a
+	renewal time picked randomly inside the renewal window suggested
+	by the CA (ARI), or a window computed from its expiry date if the
+	CA do not support ARI. The schedule is persisted to disk so
+	restarting Zoraxy will not renew all certificates at once.
+*/
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"imuslab.com/zoraxy/mod/utils"
+)
+
+const (
+	ScheduleSourceARI    = "ari"    //Renewal window suggested by the CA
+	ScheduleSourceExpiry = "expiry" //Renewal window computed from the certificate expiry date
+
+	defaultARIRetryAfter = 6 * time.Hour //Poll interval if the CA did not send Retry-After
+	minARIRetryAfter     = 1 * time.Hour
+	maxARIRetryAfter     = 24 * time.Hour
+)
+
+var errNotACMECert = errors.New("certificate not issued by a known ACME CA")
+
+// RenewSchedule is the planned renewal of a certificate
+type RenewSchedule struct {
+	Serial         string    //Serial number of the certificate this schedule belongs to
+	NotAfter       time.Time //Expiry date of the certificate
+	WindowStart    time.Time //Start of the renewal window
+	WindowEnd      time.Time //End of the renewal window
+	RenewAt        time.Time //Randomly selected renewal time inside the window
+	NextCheck      time.Time //Re-evaluate the schedule (e.g. query ARI again) after this time
+	Source         string    //ari or expiry
+	ReplacesCertID string    `json:",omitempty"` //ARI cert ID of the certificate, send with the renewal order
+	ExplanationURL string    `json:",omitempty"` //Optional explanation of the window provided by the CA
+}
+
+// Get the schedule file path from the renewer config file path
+func getScheduleFilePath(configFilePath string) string {
+	return strings.TrimSuffix(configFilePath, filepath.Ext(configFilePath)) + "_schedule.json"
+}
+
+// Load the renewal schedule from disk, start with an empty schedule if not found or malformed
+func (a *AutoRenewer) loadSchedule() {
+	a.Schedule = map[string]*RenewSchedule{}
+	if !utils.FileExists(a.ScheduleFilePath) {
+		return
+	}
+	content, err := os.ReadFile(a.ScheduleFilePath)
+	if err != nil {
+		a.Logf("Failed to read renewal schedule", err)
+		return
+	}
+	schedule := map[string]*RenewSchedule{}
+	err = json.Unmarshal(content, &schedule)
+	if err != nil {
+		a.Logf("Malformed renewal schedule, rebuilding", err)
+		return
+	}
+	a.Schedule = schedule
+}
+
+// Write the renewal schedule to disk
+func (a *AutoRenewer) saveSchedule() error {
+	a.scheduleLock.Lock()
+	js, err := json.MarshalIndent(a.Schedule, "", " ")
+	a.scheduleLock.Unlock()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(a.ScheduleFilePath, js, 0640)
+}
+
+// Check if the certificate is due for renewal according to its schedule.
+// A new schedule is planned if the certificate changed or the schedule needs re-evaluation
+func (a *AutoRenewer) shouldRenew(certName string, certPath string, certBytes []byte) bool {
+	block, _ := pem.Decode(certBytes)
+	if block == nil {
+		return false
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return false
+	}
+	//Expired certificates are renewed regardless of the schedule
+	schedule := a.planRenewal(certName, certPath, cert)
+	return time.Now().After(cert.NotAfter) || !time.Now().Before(schedule.RenewAt)
+}
+
+// Get or create the renewal schedule of a certificate
+func (a *AutoRenewer) planRenewal(certName string, certPath string, cert *x509.Certificate) *RenewSchedule {
+	now := time.Now()
+	serial := cert.SerialNumber.Text(16)
+
+	a.scheduleLock.Lock()
+	existing, ok := a.Schedule[certName]
+	a.scheduleLock.Unlock()
+	if ok && existing.Serial != serial {
+		//Certificate replaced, start over
+		existing = nil
+	}
+	if existing != nil && now.Before(existing.NextCheck) {
+		return existing
+	}
+
+	schedule, err := a.scheduleFromARI(certPath, cert, existing)
+	if err != nil {
+		//Ask the CA again later if ARI failed temporarily, otherwise keep until the renewal window
+		retry := time.Duration(0)
+		if !errors.Is(err, ErrNoARI) && !errors.Is(err, errNotACMECert) {
+			a.Logf("Unable to get renewal info for "+certName+", fallback to expiry based schedule", err)
+			retry = defaultARIRetryAfter
+		}
+		schedule = a.scheduleFromExpiry(cert, existing, retry)
+	}
+
+	a.scheduleLock.Lock()
+	a.Schedule[certName] = schedule
+	a.scheduleLock.Unlock()
+	return schedule
+}
+
+// Create a schedule from the renewal window suggested by the CA
+func (a *AutoRenewer) scheduleFromARI(certPath string, cert *x509.Certificate, existing *RenewSchedule) (*RenewSchedule, error) {
+	certName := strings.TrimSuffix(filepath.Base(certPath), filepath.Ext(certPath))
+	certInfo, err := LoadCertInfoJSON(filepath.Join(filepath.Dir(certPath), certName+".json"))
+	if err != nil {
+		//Not requested by Zoraxy, check if the issuer is a known CA
+		if len(cert.Issuer.Organization) == 0 || !IsSupportedCA(cert.Issuer.Organization[0]) {
+			return nil, errNotACMECert
+		}
+		certInfo = &CertificateInfoJSON{AcmeName: cert.Issuer.Organization[0]}
+	}
+
+	info, err := a.AcmeHandler.GetRenewalInfo(cert, certInfo.AcmeName, certInfo.AcmeUrl, certInfo.SkipTLS)
+	if err != nil {
+		return nil, err
+	}
+	if info.SuggestedWindow.Start.IsZero() || info.SuggestedWindow.End.Before(info.SuggestedWindow.Start) {
+		return nil, errors.New("invalid suggested renewal window")
+	}
+	certID, err := GetARICertID(cert)
+	if err != nil {
+		return nil, err
+	}
+
+	retry := info.RetryAfter
+	if retry <= 0 {
+		retry = defaultARIRetryAfter
+	} else if retry < minARIRetryAfter {
+		retry = minARIRetryAfter
+	} else if retry > maxARIRetryAfter {
+		retry = maxARIRetryAfter
+	}
+
+	schedule := &RenewSchedule{
+		Serial:         cert.SerialNumber.Text(16),
+		NotAfter:       cert.NotAfter,
+		WindowStart:    info.SuggestedWindow.Start,
+		WindowEnd:      info.SuggestedWindow.End,
+		NextCheck:      time.Now().Add(retry),
+		Source:         ScheduleSourceARI,
+		ReplacesCertID: certID,
+		ExplanationURL: info.ExplanationURL,
+	}
+	schedule.RenewAt = pickRenewTime(schedule, existing)
+	return schedule, nil
+}
+
+// Create a schedule from the certificate expiry date. The renewal lead time is the
+// configured early renew days, but no more than 1/3 of the certificate lifetime so
+// short-lived certificates (e.g. 6 days profile) are not renewed on every check.
+// Set retry to 0 to keep the schedule until the renewal window starts
+func (a *AutoRenewer) scheduleFromExpiry(cert *x509.Certificate, existing *RenewSchedule, retry time.Duration) *RenewSchedule {
+	lead := time.Duration(a.EarlyRenewDays) * 24 * time.Hour
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	if lifetime > 0 && lead > lifetime/3 {
+		lead = lifetime / 3
+	}
+
+	//Spread renewals over a window before the renewal point
+	jitter := lead / 10
+	if jitter > 24*time.Hour {
+		jitter = 24 * time.Hour
+	}
+
+	windowEnd := cert.NotAfter.Add(-lead)
+	schedule := &RenewSchedule{
+		Serial:      cert.SerialNumber.Text(16),
+		NotAfter:    cert.NotAfter,
+		WindowStart: windowEnd.Add(-jitter),
+		WindowEnd:   windowEnd,
+		Source:      ScheduleSourceExpiry,
+	}
+	schedule.RenewAt = pickRenewTime(schedule, existing)
+	if retry > 0 {
+		schedule.NextCheck = time.Now().Add(retry)
+	} else {
+		schedule.NextCheck = schedule.WindowStart
+	}
+	return schedule
+}
+
+// Pick a random renewal time inside the window. The previously picked time is
+// kept if the window did not change, so re-evaluation will not move the renewal around
+func pickRenewTime(schedule *RenewSchedule, existing *RenewSchedule) time.Time {
+	if existing != nil && existing.WindowStart.Equal(schedule.WindowStart) && existing.WindowEnd.Equal(schedule.WindowEnd) {
+		return existing.RenewAt
+	}
+	renewAt := schedule.WindowStart
+	if window := schedule.WindowEnd.Sub(schedule.WindowStart); window > 0 {
+		renewAt = renewAt.Add(time.Duration(rand.Int63n(int64(window))))
+	}
+	return renewAt
+}
+
+// Remove schedules of certificates that are no longer in the renew list
+func (a *AutoRenewer) pruneSchedule(certNames []string) {
+	a.scheduleLock.Lock()
+	defer a.scheduleLock.Unlock()
+	for certName := range a.Schedule {
+		if !contains(certNames, certName) {
+			delete(a.Schedule, certName)
+		}
+	}
+}
+
+// Arm a one-shot timer if the next renewal is due before the next tick,
+// so certificates with short renewal windows are renewed on time
+func (a *AutoRenewer) armNextRenewal() {
+	//Renewal checks run from the ticker, the timer and the API at the same time
+	a.scheduleTimerLock.Lock()
+	defer a.scheduleTimerLock.Unlock()
+	if a.scheduleTimer != nil {
+		a.scheduleTimer.Stop()
+		a.scheduleTimer = nil
+	}
+	if !a.RenewerConfig.Enabled {
+		return
+	}
+
+	now := time.Now()
+	var next time.Time
+	a.scheduleLock.Lock()
+	for _, schedule := range a.Schedule {
+		if schedule.RenewAt.After(now) && (next.IsZero() || schedule.RenewAt.Before(next)) {
+			next = schedule.RenewAt
+		}
+	}
+	a.scheduleLock.Unlock()
+
+	if next.IsZero() || next.Sub(now) >= time.Duration(a.RenewTickInterval)*time.Second {
+		//The ticker will handle it
+		return
+	}
+
+	a.Logf("Next certificate renewal scheduled at "+next.Format(time.RFC3339), nil)
+	a.scheduleTimer = time.AfterFunc(next.Sub(now), func() {
+		a.CheckAndRenewCertificates()
+	})
+}
+
+// Stop the one-shot renewal timer if armed
+func (a *AutoRenewer) stopScheduleTimer() {
+	a.scheduleTimerLock.Lock()
+	defer a.scheduleTimerLock.Unlock()
+	if a.scheduleTimer != nil {
+		a.scheduleTimer.Stop()
+		a.scheduleTimer = nil
+	}
+}
+
+// HandleGetRenewSchedule return the renewal schedule of all certificates
+func (a *AutoRenewer) HandleGetRenewSchedule(w http.ResponseWriter, r *http.Request) {
+	type scheduleEntry struct {
+		CertName string
+		*RenewSchedule
+	}
+
+	results := []*scheduleEntry{}
+	a.scheduleLock.Lock()
+	for certName, schedule := range a.Schedule {
+		results = append(results, &scheduleEntry{
+			CertName:      certName,
+			RenewSchedule: schedule,
+		})
+	}
+	a.scheduleLock.Unlock()
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].RenewAt.Before(results[j].RenewAt)
+	})
+
+	js, _ := json.Marshal(results)
+	utils.SendJSONResponse(w, string(js))
+}
+
+// HandleCAProfile get or set the certificate profile requested from a CA
+func (a *AutoRenewer) HandleCAProfile(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		type profileInfo struct {
+			Default   string
+			Available []string
+			Selected  string
+		}
+
+		results := map[string]*profileInfo{}
+		for caName, profileDef := range caDef.Profiles {
+			results[caName] = &profileInfo{
+				Default:   profileDef.Default,
+				Available: profileDef.Available,
+				Selected:  a.AcmeHandler.resolveCertProfile(caName),
+			}
+		}
+		js, _ := json.Marshal(results)
+		utils.SendJSONResponse(w, string(js))
+		return
+	} else if r.Method != http.MethodPost {
+		http.Error(w, "405 - Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	caName, err := utils.PostPara(r, "ca")
+	if err != nil {
+		utils.SendErrorResponse(w, "ca not set")
+		return
+	}
+	if GetCAProfiles(caName) == nil {
+		utils.SendErrorResponse(w, "this CA does not support certificate profiles")
+		return
+	}
+
+	//Empty profile use the CA default
+	profile, _ := utils.PostPara(r, "profile")
+	if profile != "" && !IsSupportedProfile(caName, profile) {
+		utils.SendErrorResponse(w, fmt.Sprintf("profile %s is not offered by %s", profile, caName))
+		return
+	}
+
+	if !a.AcmeHandler.Database.TableExists("acme") {
+		a.AcmeHandler.Database.NewTable("acme")
+	}
+	if profile == "" {
+		a.AcmeHandler.Database.Delete("acme", caName+"_profile")
+	} else {
+		a.AcmeHandler.Database.Write("acme", caName+"_profile", profile)
+	}
+
+	utils.SendOK(w)
+}
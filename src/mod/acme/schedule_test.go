@@ -0,0 +1,104 @@
+package acme
+
+import (
+	"crypto/x509"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestRenewer(t *testing.T, earlyRenewDays int) *AutoRenewer {
+	t.Helper()
+	a := &AutoRenewer{
+		ConfigFilePath:    filepath.Join(t.TempDir(), "acme_conf.json"),
+		EarlyRenewDays:    earlyRenewDays,
+		RenewerConfig:     &AutoRenewConfig{},
+		Schedule:          map[string]*RenewSchedule{},
+		RenewTickInterval: 86400,
+	}
+	a.ScheduleFilePath = getScheduleFilePath(a.ConfigFilePath)
+	return a
+}
+
+func TestScheduleFromExpiry(t *testing.T) {
+	a := newTestRenewer(t, 30)
+	now := time.Now()
+
+	//90 days certificate renew 30 days before expiry
+	cert := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    now.Add(-10 * 24 * time.Hour),
+		NotAfter:     now.Add(80 * 24 * time.Hour),
+	}
+	schedule := a.scheduleFromExpiry(cert, nil, 0)
+	if !schedule.WindowEnd.Equal(cert.NotAfter.Add(-30 * 24 * time.Hour)) {
+		t.Errorf("unexpected window end %v", schedule.WindowEnd)
+	}
+	if schedule.RenewAt.Before(schedule.WindowStart) || schedule.RenewAt.After(schedule.WindowEnd) {
+		t.Errorf("renew time %v outside window", schedule.RenewAt)
+	}
+
+	//6 days short-lived certificate renew with 1/3 lifetime left
+	shortLived := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		NotBefore:    now,
+		NotAfter:     now.Add(6 * 24 * time.Hour),
+	}
+	schedule = a.scheduleFromExpiry(shortLived, nil, 0)
+	if !schedule.WindowEnd.Equal(shortLived.NotAfter.Add(-2 * 24 * time.Hour)) {
+		t.Errorf("short-lived certificate should renew 2 days before expiry, got window end %v", schedule.WindowEnd)
+	}
+	if !schedule.RenewAt.After(now) {
+		t.Error("short-lived certificate should not be renewed immediately")
+	}
+}
+
+func TestPickRenewTimeKeepsExistingSchedule(t *testing.T) {
+	now := time.Now()
+	existing := &RenewSchedule{
+		WindowStart: now,
+		WindowEnd:   now.Add(48 * time.Hour),
+	}
+	existing.RenewAt = pickRenewTime(existing, nil)
+
+	sameWindow := &RenewSchedule{WindowStart: existing.WindowStart, WindowEnd: existing.WindowEnd}
+	if !pickRenewTime(sameWindow, existing).Equal(existing.RenewAt) {
+		t.Error("renew time should not change if the window did not change")
+	}
+
+	movedWindow := &RenewSchedule{WindowStart: now.Add(-2 * time.Hour), WindowEnd: now.Add(-time.Hour)}
+	renewAt := pickRenewTime(movedWindow, existing)
+	if renewAt.Before(movedWindow.WindowStart) || renewAt.After(movedWindow.WindowEnd) {
+		t.Errorf("renew time %v outside the new window", renewAt)
+	}
+}
+
+func TestSchedulePersistence(t *testing.T) {
+	a := newTestRenewer(t, 30)
+	cert := &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+	}
+	a.Schedule["example.com"] = a.scheduleFromExpiry(cert, nil, 0)
+	if err := a.saveSchedule(); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded := newTestRenewer(t, 30)
+	reloaded.ScheduleFilePath = a.ScheduleFilePath
+	reloaded.loadSchedule()
+	schedule, ok := reloaded.Schedule["example.com"]
+	if !ok {
+		t.Fatal("schedule not restored from disk")
+	}
+	if !schedule.RenewAt.Equal(a.Schedule["example.com"].RenewAt) {
+		t.Error("restored renew time does not match")
+	}
+
+	//Same serial within next check time should reuse the schedule without asking the CA
+	if planned := reloaded.planRenewal("example.com", "example.com.pem", cert); planned != schedule {
+		t.Error("expected persisted schedule to be reused")
+	}
+}
@@ -78,6 +78,23 @@ func ExtractDomainsFromPEM(pemFilePath string) ([]string, error) {
 	return domains, nil
 }
 
+// ExtractExpiryDateFromPEM reads a PEM certificate file and returns its expiry date
+func ExtractExpiryDateFromPEM(pemFilePath string) (time.Time, error) {
+	certBytes, err := os.ReadFile(pemFilePath)
+	if err != nil {
+		return time.Time{}, err
+	}
+	block, _ := pem.Decode(certBytes)
+	if block == nil {
+		return time.Time{}, errors.New("no certificate found in " + pemFilePath)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return cert.NotAfter, nil
+}
+
 // Check if a cert is expired by public key
 func CertIsExpired(certBytes []byte) bool {
 	block, _ := pem.Decode(certBytes)
@@ -0,0 +1,379 @@
+package auth
+
+/*
+	apitoken.go
+
+	Personal API tokens for automation against the management API.
+	A token belongs to a management user and can only call the
+	endpoints and methods in its scopes, within the role of its owner.
+	Only the hash of the token secret is stored in database
+*/
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"imuslab.com/zoraxy/mod/netutils"
+	"imuslab.com/zoraxy/mod/utils"
+)
+
+const (
+	apiTokenTable          = "api_tokens"
+	apiTokenPrefix         = "zrx_"
+	apiTokenLastUsedPeriod = time.Minute //Interval between writing the last used time to database
+)
+
+var (
+	ErrInvalidAPIToken = errors.New("invalid or expired API token")
+)
+
+// APITokenScope permit a token to call an endpoint
+type APITokenScope struct {
+	Methods  []string //Allowed HTTP methods, empty for all methods
+	Endpoint string   //API path, end with * to match all paths with the prefix
+}
+
+// APIToken is a personal API token of a management user
+type APIToken struct {
+	ID         string
+	Name       string
+	Owner      string //Username of the management user
+	SecretHash string //Hex encoded sha256 of the token secret
+	Scopes     []*APITokenScope
+	CreatedAt  int64
+	ExpiresAt  int64 //Unix timestamp, 0 for never expire
+	LastUsed   int64
+	LastUsedIP string
+}
+
+// APITokenInfo is the token info shown to the user
+type APITokenInfo struct {
+	ID         string
+	Name       string
+	Owner      string
+	Scopes     []*APITokenScope
+	CreatedAt  int64
+	ExpiresAt  int64
+	LastUsed   int64
+	LastUsedIP string
+}
+
+type apiTokenContextKey struct{}
+
+var apiTokenLock sync.Mutex
+
+func (t *APIToken) Info() *APITokenInfo {
+	return &APITokenInfo{
+		ID:         t.ID,
+		Name:       t.Name,
+		Owner:      t.Owner,
+		Scopes:     t.Scopes,
+		CreatedAt:  t.CreatedAt,
+		ExpiresAt:  t.ExpiresAt,
+		LastUsed:   t.LastUsed,
+		LastUsedIP: t.LastUsedIP,
+	}
+}
+
+// Allow check if the token scopes include the endpoint and method
+func (t *APIToken) Allow(endpoint string, method string) bool {
+	for _, scope := range t.Scopes {
+		if len(scope.Methods) > 0 && !slices.Contains(scope.Methods, method) {
+			continue
+		}
+		if pattern, isPrefix := strings.CutSuffix(scope.Endpoint, "*"); isPrefix {
+			if strings.HasPrefix(endpoint, pattern) {
+				return true
+			}
+		} else if endpoint == scope.Endpoint {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseAPITokenScopes parse scopes with one scope per line in the format of
+// "GET,POST /api/proxy/*", the methods can be omitted to allow all methods
+func ParseAPITokenScopes(scopes string) ([]*APITokenScope, error) {
+	results := []*APITokenScope{}
+	for _, line := range strings.FieldsFunc(scopes, func(r rune) bool { return r == '\n' || r == ';' }) {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		scope := &APITokenScope{Methods: []string{}}
+		if len(fields) == 2 {
+			for _, method := range strings.Split(fields[0], ",") {
+				method = strings.ToUpper(strings.TrimSpace(method))
+				if method == "*" {
+					scope.Methods = []string{}
+					break
+				}
+				if method != "" {
+					scope.Methods = append(scope.Methods, method)
+				}
+			}
+			fields = fields[1:]
+		}
+		if len(fields) != 1 || !strings.HasPrefix(fields[0], "/") {
+			return nil, errors.New("invalid scope: " + strings.TrimSpace(line))
+		}
+		scope.Endpoint = fields[0]
+		results = append(results, scope)
+	}
+	if len(results) == 0 {
+		return nil, errors.New("at least one scope is required")
+	}
+	return results, nil
+}
+
+// IsAPITokenRequest check if the request is authenticated with a bearer token
+func IsAPITokenRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+// Get the token that authenticated the request, nil for session login
+func requestAPIToken(r *http.Request) *APIToken {
+	token, _ := r.Context().Value(apiTokenContextKey{}).(*APIToken)
+	return token
+}
+
+func hashAPITokenSecret(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+func (a *AuthAgent) loadAPIToken(id string) (*APIToken, error) {
+	token := APIToken{}
+	if err := a.Database.Read(apiTokenTable, id, &token); err != nil || token.ID == "" {
+		return nil, ErrInvalidAPIToken
+	}
+	return &token, nil
+}
+
+// ListAPITokens list the tokens of the user, or all tokens if username is empty
+func (a *AuthAgent) ListAPITokens(username string) []*APIToken {
+	results := []*APIToken{}
+	entries, _ := a.Database.ListTable(apiTokenTable)
+	for _, keypairs := range entries {
+		token := APIToken{}
+		if err := json.Unmarshal(keypairs[1], &token); err != nil {
+			continue
+		}
+		if username == "" || token.Owner == username {
+			results = append(results, &token)
+		}
+	}
+	slices.SortFunc(results, func(x, y *APIToken) int {
+		return int(y.CreatedAt - x.CreatedAt)
+	})
+	return results
+}
+
+// CreateAPIToken create a token for the user, the returned token string is only available once
+func (a *AuthAgent) CreateAPIToken(username string, name string, scopes []*APITokenScope, expiresAt time.Time) (string, *APIToken, error) {
+	if !a.UserExists(username) {
+		return "", nil, errors.New("user not found")
+	}
+	idBytes := make([]byte, 8)
+	secretBytes := make([]byte, 32)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", nil, err
+	}
+	if _, err := rand.Read(secretBytes); err != nil {
+		return "", nil, err
+	}
+	id := hex.EncodeToString(idBytes)
+	secret := base64.RawURLEncoding.EncodeToString(secretBytes)
+	token := &APIToken{
+		ID:         id,
+		Name:       name,
+		Owner:      username,
+		SecretHash: hashAPITokenSecret(secret),
+		Scopes:     scopes,
+		CreatedAt:  time.Now().Unix(),
+	}
+	if !expiresAt.IsZero() {
+		token.ExpiresAt = expiresAt.Unix()
+	}
+	if err := a.Database.Write(apiTokenTable, id, token); err != nil {
+		return "", nil, err
+	}
+	return apiTokenPrefix + id + "_" + secret, token, nil
+}
+
+// RevokeAPIToken remove a token
+func (a *AuthAgent) RevokeAPIToken(id string) error {
+	if _, err := a.loadAPIToken(id); err != nil {
+		return errors.New("token not found")
+	}
+	return a.Database.Delete(apiTokenTable, id)
+}
+
+// RemoveUserAPITokens revoke all tokens of the user
+func (a *AuthAgent) RemoveUserAPITokens(username string) {
+	for _, token := range a.ListAPITokens(username) {
+		a.Database.Delete(apiTokenTable, token.ID)
+	}
+}
+
+// ValidateAPIToken check the bearer token of the request and update its last used time
+func (a *AuthAgent) ValidateAPIToken(r *http.Request) (*APIToken, error) {
+	tokenString := strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	id, secret, ok := strings.Cut(strings.TrimPrefix(tokenString, apiTokenPrefix), "_")
+	if !strings.HasPrefix(tokenString, apiTokenPrefix) || !ok {
+		return nil, ErrInvalidAPIToken
+	}
+	token, err := a.loadAPIToken(id)
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(token.SecretHash), []byte(hashAPITokenSecret(secret))) != 1 {
+		return nil, ErrInvalidAPIToken
+	}
+	now := time.Now()
+	if token.ExpiresAt > 0 && now.Unix() >= token.ExpiresAt {
+		return nil, ErrInvalidAPIToken
+	}
+	if !a.UserExists(token.Owner) || !a.checkExternalUser(token.Owner) {
+		return nil, ErrInvalidAPIToken
+	}
+
+	clientIP := netutils.GetRequesterIPUntrusted(r)
+	if now.Unix()-token.LastUsed >= int64(apiTokenLastUsedPeriod.Seconds()) || token.LastUsedIP != clientIP {
+		apiTokenLock.Lock()
+		//Reload so a revoke at the same time is not undone
+		if latest, err := a.loadAPIToken(id); err == nil {
+			latest.LastUsed = now.Unix()
+			latest.LastUsedIP = clientIP
+			a.Database.Write(apiTokenTable, id, latest)
+		}
+		apiTokenLock.Unlock()
+	}
+	return token, nil
+}
+
+// Attach the token to the request so the token owner is used as the logged in user
+func withAPIToken(r *http.Request, token *APIToken) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), apiTokenContextKey{}, token))
+}
+
+/*
+	Token management APIs, only usable with a session login
+	so a leaked token cannot create more tokens
+*/
+
+// Get the session user managing tokens, reply error for token requests
+func (a *AuthAgent) apiTokenManager(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if requestAPIToken(r) != nil {
+		utils.SendErrorResponse(w, "API tokens cannot be managed with an API token")
+		return "", false
+	}
+	username, err := a.GetUserName(w, r)
+	if err != nil {
+		http.Error(w, "401 - Unauthorized", http.StatusUnauthorized)
+		return "", false
+	}
+	return username, true
+}
+
+// HandleListAPITokens list the tokens of the current user, admins can list all tokens with GET all=true
+func (a *AuthAgent) HandleListAPITokens(w http.ResponseWriter, r *http.Request) {
+	username, ok := a.apiTokenManager(w, r)
+	if !ok {
+		return
+	}
+	owner := username
+	if all, _ := utils.GetPara(r, "all"); all == "true" && a.GetUserPermission(username).Role == RoleAdmin {
+		owner = ""
+	}
+	results := []*APITokenInfo{}
+	for _, token := range a.ListAPITokens(owner) {
+		results = append(results, token.Info())
+	}
+	js, _ := json.Marshal(results)
+	utils.SendJSONResponse(w, string(js))
+}
+
+// HandleCreateAPIToken create a token for the current user.
+// Require POST name and scopes (one "METHODS /path" per line), optional expires in days
+func (a *AuthAgent) HandleCreateAPIToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "405 - Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	username, ok := a.apiTokenManager(w, r)
+	if !ok {
+		return
+	}
+	name, err := utils.PostPara(r, "name")
+	if err != nil {
+		utils.SendErrorResponse(w, "token name not defined")
+		return
+	}
+	scopeString, err := utils.PostPara(r, "scopes")
+	if err != nil {
+		utils.SendErrorResponse(w, "token scopes not defined")
+		return
+	}
+	scopes, err := ParseAPITokenScopes(scopeString)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	expiresAt := time.Time{}
+	if days, err := utils.PostInt(r, "expires"); err == nil && days != 0 {
+		if days < 0 {
+			utils.SendErrorResponse(w, "invalid expiry")
+			return
+		}
+		expiresAt = time.Now().AddDate(0, 0, days)
+	}
+
+	tokenString, token, err := a.CreateAPIToken(username, name, scopes, expiresAt)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	a.Logger.PrintAndLog("auth", "API token "+name+" created for "+username, nil)
+	js, _ := json.Marshal(map[string]interface{}{
+		"Token": tokenString,
+		"Info":  token.Info(),
+	})
+	utils.SendJSONResponse(w, string(js))
+}
+
+// HandleRevokeAPIToken revoke a token of the current user (or any token for admins), require POST id
+func (a *AuthAgent) HandleRevokeAPIToken(w http.ResponseWriter, r *http.Request) {
+	username, ok := a.apiTokenManager(w, r)
+	if !ok {
+		return
+	}
+	id, err := utils.PostPara(r, "id")
+	if err != nil {
+		utils.SendErrorResponse(w, "token id not defined")
+		return
+	}
+	token, err := a.loadAPIToken(id)
+	if err != nil || (token.Owner != username && a.GetUserPermission(username).Role != RoleAdmin) {
+		utils.SendErrorResponse(w, "token not found")
+		return
+	}
+	if err := a.RevokeAPIToken(id); err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	a.Logger.PrintAndLog("auth", "API token "+token.Name+" of "+token.Owner+" revoked by "+username, nil)
+	utils.SendOK(w)
+}
@@ -0,0 +1,163 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseAPITokenScopes(t *testing.T) {
+	scopes, err := ParseAPITokenScopes("GET,post /api/proxy/*\n/api/stats/summary; * /api/cert/list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := &APIToken{Scopes: scopes}
+	tests := []struct {
+		endpoint string
+		method   string
+		want     bool
+	}{
+		{"/api/proxy/add", http.MethodPost, true},
+		{"/api/proxy/list", http.MethodGet, true},
+		{"/api/proxy/del", http.MethodDelete, false},
+		{"/api/stats/summary", http.MethodPut, true},
+		{"/api/stats/summary2", http.MethodGet, false},
+		{"/api/cert/list", http.MethodGet, true},
+		{"/api/cert/upload", http.MethodPost, false},
+	}
+	for _, test := range tests {
+		if got := token.Allow(test.endpoint, test.method); got != test.want {
+			t.Errorf("%s %s: expected %v, got %v", test.method, test.endpoint, test.want, got)
+		}
+	}
+
+	for _, invalid := range []string{"", "GET", "GET POST /api/proxy/list", "GET api/proxy/list"} {
+		if _, err := ParseAPITokenScopes(invalid); err == nil {
+			t.Errorf("invalid scopes %q accepted", invalid)
+		}
+	}
+}
+
+func TestAPITokenRouter(t *testing.T) {
+	a := newTwoFactorTestAgent(t)
+	a.CreateUserAccount("viewer", "password", "")
+	a.SetUserPermission("viewer", &UserPermission{Role: RoleViewer})
+
+	mux := http.NewServeMux()
+	router := NewManagedHTTPRouter(RouterOption{
+		AuthAgent:   a,
+		RequireAuth: true,
+		TargetMux:   mux,
+		DeniedHandler: func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "401 - Unauthorized", http.StatusUnauthorized)
+		},
+	})
+	a.LoginRedirectionHandler = func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "401 - Unauthorized", http.StatusUnauthorized)
+	}
+	for _, endpoint := range []string{"/api/proxy/list", "/api/proxy/add", "/api/fs/list"} {
+		router.HandleFunc(endpoint, func(w http.ResponseWriter, r *http.Request) {
+			username, _ := a.GetUserName(w, r)
+			w.Write([]byte(username))
+		})
+	}
+	router.HandleFunc("/api/auth/tokens/create", a.HandleCreateAPIToken)
+	router.HandleFunc("/api/auth/2fa/webauthn/register/begin", a.HandleWebAuthnRegisterBegin)
+
+	request := func(method string, target string, bearer string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, target, nil)
+		if bearer != "" {
+			r.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	//Create a token from the management API with session login
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/api/auth/tokens/create", nil)
+	r.Form = url.Values{"name": {"ci"}, "scopes": {"GET /api/proxy/list\nPOST /api/proxy/add\n/api/fs/*"}, "expires": {"30"}}
+	r.AddCookie(loginCookie(a, "admin"))
+	mux.ServeHTTP(w, r)
+	created := struct {
+		Token string
+		Info  *APITokenInfo
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil || created.Token == "" {
+		t.Fatalf("token not created: %s", w.Body.String())
+	}
+	if created.Info.ExpiresAt < time.Now().AddDate(0, 0, 29).Unix() {
+		t.Errorf("unexpected expiry %d", created.Info.ExpiresAt)
+	}
+
+	if w := request(http.MethodGet, "/api/proxy/list", created.Token); w.Code != http.StatusOK || w.Body.String() != "admin" {
+		t.Errorf("token request got %d %s", w.Code, w.Body.String())
+	}
+	if w := request(http.MethodPost, "/api/proxy/list", created.Token); w.Code != http.StatusForbidden {
+		t.Errorf("request outside of scope got %d", w.Code)
+	}
+	if entries := a.ListAuditLog(0); len(entries) != 1 || entries[0].Token != "ci" {
+		t.Errorf("unexpected audit log %+v", entries)
+	}
+	if w := request(http.MethodGet, "/api/proxy/list", created.Token+"x"); w.Code != http.StatusUnauthorized {
+		t.Errorf("wrong secret got %d", w.Code)
+	}
+
+	//Bearer requests never fallback to the session cookie
+	if w := request(http.MethodGet, "/api/proxy/list", "zrx_invalid", loginCookie(a, "admin")); w.Code != http.StatusUnauthorized {
+		t.Errorf("invalid token with session cookie got %d", w.Code)
+	}
+
+	//Last used time is tracked
+	tokens := a.ListAPITokens("admin")
+	if len(tokens) != 1 || tokens[0].LastUsed == 0 || tokens[0].LastUsedIP == "" {
+		t.Errorf("last used not tracked %+v", tokens)
+	}
+
+	//Token of a viewer is still limited by the role
+	viewerToken, _, err := a.CreateAPIToken("viewer", "viewer", []*APITokenScope{{Endpoint: "/api/*"}}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := request(http.MethodGet, "/api/proxy/list", viewerToken); w.Code != http.StatusOK {
+		t.Errorf("viewer token read got %d", w.Code)
+	}
+	if w := request(http.MethodPost, "/api/proxy/add", viewerToken); w.Code != http.StatusForbidden {
+		t.Errorf("viewer token write got %d", w.Code)
+	}
+
+	//Tokens cannot create more tokens even when scoped for it
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodPost, "/api/auth/tokens/create", nil)
+	r.Form = url.Values{"name": {"more"}, "scopes": {"/api/*"}}
+	r.Header.Set("Authorization", "Bearer "+viewerToken)
+	mux.ServeHTTP(w, r)
+	if len(a.ListAPITokens("")) != 2 {
+		t.Errorf("token created with API token: %s", w.Body.String())
+	}
+
+	//Tokens cannot add a passkey to login interactively
+	if w := request(http.MethodPost, "/api/auth/2fa/webauthn/register/begin", viewerToken); !strings.Contains(w.Body.String(), "error") {
+		t.Errorf("passkey registration with API token got %d %s", w.Code, w.Body.String())
+	}
+
+	//Expired and revoked tokens are rejected
+	expiredToken, _, _ := a.CreateAPIToken("admin", "expired", []*APITokenScope{{Endpoint: "/api/*"}}, time.Now().Add(-time.Minute))
+	if w := request(http.MethodGet, "/api/proxy/list", expiredToken); w.Code != http.StatusUnauthorized {
+		t.Errorf("expired token got %d", w.Code)
+	}
+	if err := a.RevokeAPIToken(created.Info.ID); err != nil {
+		t.Fatal(err)
+	}
+	if w := request(http.MethodGet, "/api/proxy/list", created.Token); w.Code != http.StatusUnauthorized {
+		t.Errorf("revoked token got %d", w.Code)
+	}
+}
@@ -0,0 +1,107 @@
+package auth
+
+/*
+	audit.go
+
+	Audit log of management API requests
+	denied by the role based access control
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"imuslab.com/zoraxy/mod/netutils"
+	"imuslab.com/zoraxy/mod/utils"
+)
+
+const (
+	auditTable          = "auth_audit"
+	auditRetentionDays  = 90  //Remove audit entries older than this on startup
+	defaultAuditListMax = 200 //Number of entries returned when no limit is given
+)
+
+type AuditEntry struct {
+	Timestamp int64 //Unix timestamp of the request
+	Username  string
+	Role      Role
+	ClientIP  string
+	Method    string
+	Endpoint  string
+	Token     string //Name of the API token used, empty for session login
+	Reason    string //Why the request is denied
+}
+
+// Record a denied request to the audit log
+func (a *AuthAgent) recordDenied(r *http.Request, username string, role Role, reason string) {
+	now := time.Now()
+	entry := AuditEntry{
+		Timestamp: now.Unix(),
+		Username:  username,
+		Role:      role,
+		ClientIP:  netutils.GetRequesterIPUntrusted(r),
+		Method:    r.Method,
+		Endpoint:  r.URL.Path,
+		Reason:    reason,
+	}
+	if token := requestAPIToken(r); token != nil {
+		entry.Token = token.Name
+	}
+	a.Logger.PrintAndLog("audit", fmt.Sprintf("[denied] %s (%s, %s) %s %s: %s", username, role, entry.ClientIP, r.Method, r.URL.Path, reason), nil)
+
+	//Key start with nano timestamp so entries are in time order
+	key := fmt.Sprintf("%020d/%s", now.UnixNano(), username)
+	a.Database.Write(auditTable, key, entry)
+}
+
+// ListAuditLog list the latest denied requests, newest first
+func (a *AuthAgent) ListAuditLog(limit int) []*AuditEntry {
+	if limit <= 0 {
+		limit = defaultAuditListMax
+	}
+	entries, _ := a.Database.ListTable(auditTable)
+	//Keys start with the nano timestamp, sort by key for entries in the same second
+	sort.SliceStable(entries, func(i, j int) bool {
+		return string(entries[i][0]) > string(entries[j][0])
+	})
+	results := []*AuditEntry{}
+	for _, keypairs := range entries {
+		entry := AuditEntry{}
+		if err := json.Unmarshal(keypairs[1], &entry); err != nil {
+			continue
+		}
+		results = append(results, &entry)
+	}
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+// Remove the audit entries older than the retention period
+func (a *AuthAgent) pruneAuditLog() {
+	cutoff := time.Now().AddDate(0, 0, -auditRetentionDays).UnixNano()
+	entries, _ := a.Database.ListTable(auditTable)
+	for _, keypairs := range entries {
+		key := string(keypairs[0])
+		if len(key) < 20 {
+			continue
+		}
+		timestamp, err := strconv.ParseInt(key[:20], 10, 64)
+		if err == nil && timestamp < cutoff {
+			a.Database.Delete(auditTable, key)
+		}
+	}
+}
+
+// HandleListAuditLog return the latest denied requests, optional GET limit
+func (a *AuthAgent) HandleListAuditLog(w http.ResponseWriter, r *http.Request) {
+	limit, _ := utils.GetPara(r, "limit")
+	limitInt, _ := strconv.Atoi(limit)
+	js, _ := json.Marshal(a.ListAuditLog(limitInt))
+	utils.SendJSONResponse(w, string(js))
+}
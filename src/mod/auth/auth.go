@@ -7,15 +7,14 @@ package auth
 
 import (
 	"crypto/rand"
-	"crypto/sha512"
 	"errors"
 	"net/http"
 	"net/mail"
 	"strings"
-
-	"encoding/hex"
+	"sync"
 
 	"github.com/gorilla/sessions"
+	"github.com/jellydator/ttlcache/v3"
 	db "imuslab.com/zoraxy/mod/database"
 	"imuslab.com/zoraxy/mod/info/logger"
 	"imuslab.com/zoraxy/mod/utils"
@@ -28,6 +27,18 @@ type AuthAgent struct {
 	Database                *db.Database
 	LoginRedirectionHandler func(http.ResponseWriter, *http.Request)
 	Logger                  *logger.Logger
+
+	//Two-factor authentication
+	TwoFactorDisabled  bool                                        //Skip the second factor on login, for emergency recovery
+	pendingLogins      *ttlcache.Cache[string, *pendingLogin]      //Password accepted logins waiting for the second factor
+	pendingTOTP        *ttlcache.Cache[string, string]             //Username to TOTP secret waiting for confirmation
+	webauthnChallenges *ttlcache.Cache[string, *webauthnChallenge] //Challenges waiting for the authenticator response
+	twoFactorFailures  *ttlcache.Cache[string, int]                //Wrong second factor codes by username
+	totpGuard          *TOTPGuard
+	twoFactorLock      sync.Mutex
+
+	//External directory for management login, e.g. LDAP
+	ExternalAuthenticator ExternalAuthenticator
 }
 
 type AuthEndpoints struct {
@@ -55,6 +66,10 @@ func NewAuthenticationAgent(sessionName string, key []byte, sysdb *db.Database,
 		LoginRedirectionHandler: loginRedirectionHandler,
 		Logger:                  systemLogger,
 	}
+	newAuthAgent.initTwoFactor()
+	sysdb.NewTable(auditTable)
+	newAuthAgent.pruneAuditLog()
+	sysdb.NewTable(apiTokenTable)
 
 	//Return the authAgent
 	return &newAuthAgent
@@ -122,6 +137,18 @@ func (a *AuthAgent) HandleLogin(w http.ResponseWriter, r *http.Request) {
 	//The database contain this user information. Check its password if it is correct
 	if passwordCorrect {
 		//Password correct
+		if a.TwoFactorRequired(username) {
+			//Login is finished after the second factor is verified
+			if a.twoFactorLocked(username) {
+				a.Logger.PrintAndLog("auth", username+" login request rejected: too many wrong verification codes", nil)
+				utils.SendErrorResponse(w, errTwoFactorLocked)
+				return
+			}
+			a.Logger.PrintAndLog("auth", username+" password accepted, waiting for second factor", nil)
+			a.sendTwoFactorChallenge(w, username, rememberme)
+			return
+		}
+
 		// Set user as authenticated
 		a.LoginUserByRequest(w, r, username, rememberme)
 
@@ -144,20 +171,40 @@ func (a *AuthAgent) ValidateUsernameAndPassword(username string, password string
 
 // validate the username and password, return reasons if the auth failed
 func (a *AuthAgent) ValidateUsernameAndPasswordWithReason(username string, password string) (bool, string) {
-	hashedPassword := Hash(password)
+	if a.useExternalLogin(username) {
+		if !a.validateExternalLogin(username, password) {
+			return false, "Invalid username or password"
+		}
+		return true, ""
+	}
+
 	var passwordInDB string
 	err := a.Database.Read("auth", "passhash/"+username, &passwordInDB)
 	if err != nil {
-		//User not found or db exception
+		//User not found or db exception. Verify against a dummy hash so the response time is the same
+		VerifyPassword(password, dummyPasswordHash)
 		a.Logger.PrintAndLog("auth", username+" login with incorrect password", nil)
 		return false, "Invalid username or password"
 	}
 
-	if passwordInDB == hashedPassword {
-		return true, ""
-	} else {
+	passwordCorrect, needsRehash := VerifyPassword(password, passwordInDB)
+	if !passwordCorrect {
 		return false, "Invalid username or password"
 	}
+
+	if needsRehash {
+		//Upgrade legacy or weak hash to the current format
+		newHash, err := HashPassword(password)
+		if err == nil {
+			err = a.Database.Write("auth", "passhash/"+username, newHash)
+		}
+		if err != nil {
+			a.Logger.PrintAndLog("auth", "Unable to upgrade password hash of "+username, err)
+		} else {
+			a.Logger.PrintAndLog("auth", "Password hash of "+username+" upgraded to "+string(PasswordHashArgon2id), nil)
+		}
+	}
+	return true, ""
 }
 
 // Login the user by creating a valid session for this user
@@ -216,6 +263,10 @@ func (a *AuthAgent) Logout(w http.ResponseWriter, r *http.Request) error {
 
 // Get the current session username from request
 func (a *AuthAgent) GetUserName(w http.ResponseWriter, r *http.Request) (string, error) {
+	if token := requestAPIToken(r); token != nil {
+		//Request authenticated with API token
+		return token.Owner, nil
+	}
 	if a.CheckAuth(r) {
 		//This user has logged in.
 		session, _ := a.SessionStore.Get(r, a.SessionName)
@@ -228,10 +279,8 @@ func (a *AuthAgent) GetUserName(w http.ResponseWriter, r *http.Request) (string,
 
 // Get the current session user email from request
 func (a *AuthAgent) GetUserEmail(w http.ResponseWriter, r *http.Request) (string, error) {
-	if a.CheckAuth(r) {
+	if username, err := a.GetUserName(w, r); err == nil {
 		//This user has logged in.
-		session, _ := a.SessionStore.Get(r, a.SessionName)
-		username := session.Values["username"].(string)
 		userEmail := ""
 		err := a.Database.Read("auth", "email/"+username, &userEmail)
 		if err != nil {
@@ -335,6 +384,10 @@ func (a *AuthAgent) HandleRegisterWithoutEmail(w http.ResponseWriter, r *http.Re
 
 // Check authentication from request header's session value
 func (a *AuthAgent) CheckAuth(r *http.Request) bool {
+	if IsAPITokenRequest(r) {
+		//Bearer requests skip CSRF check, never fallback to the session cookie
+		return requestAPIToken(r) != nil
+	}
 	session, err := a.SessionStore.Get(r, a.SessionName)
 	if err != nil {
 		return false
@@ -364,7 +417,7 @@ func (a *AuthAgent) HandleUnregister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = a.UnregisterUser(username)
+	err = a.DeleteUser(username)
 	if err != nil {
 		utils.SendErrorResponse(w, err.Error())
 		return
@@ -388,6 +441,19 @@ func (a *AuthAgent) UnregisterUser(username string) error {
 	return nil
 }
 
+// DeleteUser remove the account with its role, second factors, API tokens and directory record.
+// UnregisterUser only remove the password and is used when the password is changed
+func (a *AuthAgent) DeleteUser(username string) error {
+	if err := a.UnregisterUser(username); err != nil {
+		return err
+	}
+	a.RemoveTwoFactor(username)
+	a.RemoveUserAPITokens(username)
+	a.Database.Delete("auth", "role/"+username)
+	a.Database.Delete("auth", "external/"+username)
+	return nil
+}
+
 // Get the number of users in the system
 func (a *AuthAgent) GetUserCounts() int {
 	entries, _ := a.Database.ListTable("auth")
@@ -461,8 +527,11 @@ func (a *AuthAgent) CreateUserAccount(newusername string, password string, email
 	}
 
 	key := newusername
-	hashedPassword := Hash(password)
-	err := a.Database.Write("auth", "passhash/"+key, hashedPassword)
+	hashedPassword, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+	err = a.Database.Write("auth", "passhash/"+key, hashedPassword)
 	if err != nil {
 		return err
 	}
@@ -478,8 +547,9 @@ func (a *AuthAgent) CreateUserAccount(newusername string, password string, email
 }
 
 // Hash the given raw string into sha512 hash
+//
+// Deprecated: unsalted SHA-512 is not safe for passwords, use HashPassword.
+// Only kept for verifying the legacy password hashes
 func Hash(raw string) string {
-	h := sha512.New()
-	h.Write([]byte(raw))
-	return hex.EncodeToString(h.Sum(nil))
+	return legacyHash(raw)
 }
@@ -0,0 +1,155 @@
+package auth
+
+/*
+	credentialcache.go
+
+	Cache of verified credentials, so basic auth do not
+	pay the password hashing cost on every request. Entries
+	are keyed by HMAC of the username, password and stored
+	hash with a random per-process key, so the raw password
+	is never kept in memory and changing the stored hash
+	invalidate the entry
+
+	Failed logins are counted by client IP, so clients guessing
+	passwords are blocked before they can use up the CPU and
+	memory with password hashing
+*/
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCredentialCacheTTL = 5 * time.Minute  //Time a verified credential is trusted without rehashing
+	maxCredentialCacheEntries = 10000            //Cache is cleared when it grow over this size
+	maxFailedVerifications    = 10               //Failed logins from an IP before it is blocked
+	failedVerificationWindow  = 10 * time.Minute //Time a failed login is counted for
+)
+
+type failedVerifications struct {
+	count  int
+	expire time.Time
+}
+
+type CredentialCache struct {
+	ttl      time.Duration
+	key      []byte                          //Random HMAC key of this cache
+	entries  map[string]time.Time            //HMAC of credential to expire time
+	failures map[string]*failedVerifications //Failed logins by client IP
+	lock     sync.Mutex
+}
+
+// NewCredentialCache create a verified credential cache, ttl <= 0 for the default 5 minutes
+func NewCredentialCache(ttl time.Duration) *CredentialCache {
+	if ttl <= 0 {
+		ttl = defaultCredentialCacheTTL
+	}
+	key := make([]byte, 32)
+	rand.Read(key)
+	return &CredentialCache{
+		ttl:      ttl,
+		key:      key,
+		entries:  map[string]time.Time{},
+		failures: map[string]*failedVerifications{},
+	}
+}
+
+func (c *CredentialCache) entryKey(username string, password string, encodedHash string) string {
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte(username))
+	mac.Write([]byte{0})
+	mac.Write([]byte(password))
+	mac.Write([]byte{0})
+	mac.Write([]byte(encodedHash))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify check the password against the stored hash, using the cached result if the same
+// credential was verified recently. needsRehash is only reported when the hash is computed
+func (c *CredentialCache) Verify(username string, password string, encodedHash string) (ok bool, needsRehash bool) {
+	entryKey := c.entryKey(username, password, encodedHash)
+	now := time.Now()
+	c.lock.Lock()
+	expire, found := c.entries[entryKey]
+	c.lock.Unlock()
+	if found && now.Before(expire) {
+		return true, false
+	}
+
+	ok, needsRehash = VerifyPassword(password, encodedHash)
+	if !ok {
+		return false, false
+	}
+
+	c.lock.Lock()
+	if len(c.entries) >= maxCredentialCacheEntries {
+		c.removeExpired(now)
+		if len(c.entries) >= maxCredentialCacheEntries {
+			c.entries = map[string]time.Time{}
+		}
+	}
+	c.entries[entryKey] = now.Add(c.ttl)
+	c.lock.Unlock()
+	return true, needsRehash
+}
+
+// Blocked check if the client has too many failed logins recently
+func (c *CredentialCache) Blocked(clientIP string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	failure, found := c.failures[clientIP]
+	return found && time.Now().Before(failure.expire) && failure.count >= maxFailedVerifications
+}
+
+// RecordFailure count a failed login of the client, the count expire after the window
+// since the last failure
+func (c *CredentialCache) RecordFailure(clientIP string) {
+	now := time.Now()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	failure, found := c.failures[clientIP]
+	if !found || now.After(failure.expire) {
+		if len(c.failures) >= maxCredentialCacheEntries {
+			for ip, f := range c.failures {
+				if now.After(f.expire) {
+					delete(c.failures, ip)
+				}
+			}
+			if len(c.failures) >= maxCredentialCacheEntries {
+				c.failures = map[string]*failedVerifications{}
+			}
+		}
+		failure = &failedVerifications{}
+		c.failures[clientIP] = failure
+	}
+	failure.count++
+	failure.expire = now.Add(failedVerificationWindow)
+}
+
+// ResetFailures clear the failed logins of the client after a successful login
+func (c *CredentialCache) ResetFailures(clientIP string) {
+	c.lock.Lock()
+	delete(c.failures, clientIP)
+	c.lock.Unlock()
+}
+
+// Clear all cached credentials
+func (c *CredentialCache) Clear() {
+	c.lock.Lock()
+	c.entries = map[string]time.Time{}
+	c.lock.Unlock()
+}
+
+// Remove expired entries, caller must hold the lock
+func (c *CredentialCache) removeExpired(now time.Time) {
+	for k, expire := range c.entries {
+		if now.After(expire) {
+			delete(c.entries, k)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package auth
+
+/*
+	external.go
+
+	Management login with accounts from an external directory
+	like LDAP. A local account is created on the first login so
+	sessions, roles and second factors work as with local users,
+	but its password is always checked against the directory
+*/
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+)
+
+// ExternalAuthenticator verify management logins against an external directory
+type ExternalAuthenticator interface {
+	//Name of the directory shown in logs, e.g. LDAP
+	Name() string
+	//Check if the directory is enabled for management login
+	ManagementLoginEnabled() bool
+	//Verify the password and return the role of the user from its groups
+	AuthenticateManagementUser(username string, password string) (Role, error)
+	//Check the user is still in the directory and return its current role, for logins without password
+	LookupManagementUser(username string) (Role, error)
+}
+
+// IsExternalUser check if the account is created from the external directory
+func (a *AuthAgent) IsExternalUser(username string) bool {
+	return a.Database.KeyExists("auth", "external/"+username)
+}
+
+// Get the external directory of the account, empty for local accounts
+func (a *AuthAgent) userSource(username string) string {
+	source := ""
+	a.Database.Read("auth", "external/"+username, &source)
+	return source
+}
+
+// Check if the login should be verified by the external directory
+func (a *AuthAgent) useExternalLogin(username string) bool {
+	if a.IsExternalUser(username) {
+		return true
+	}
+	//Local accounts always take precedence over directory users with the same name
+	return !a.UserExists(username) && a.ExternalAuthenticator != nil && a.ExternalAuthenticator.ManagementLoginEnabled()
+}
+
+// Verify the login with the external directory and sync the local account
+func (a *AuthAgent) validateExternalLogin(username string, password string) bool {
+	if a.ExternalAuthenticator == nil || !a.ExternalAuthenticator.ManagementLoginEnabled() {
+		//Directory disabled after the account is created
+		VerifyPassword(password, dummyPasswordHash)
+		return false
+	}
+	source := a.ExternalAuthenticator.Name()
+	role, err := a.ExternalAuthenticator.AuthenticateManagementUser(username, password)
+	if err != nil {
+		a.Logger.PrintAndLog("auth", username+" "+source+" login failed", err)
+		return false
+	}
+	return a.syncExternalUser(username, source, role)
+}
+
+// Check if the directory account is still allowed without its password, used by passkey
+// logins, API tokens and sessions so removed users and group changes take effect. Local
+// accounts are always allowed
+func (a *AuthAgent) checkExternalUser(username string) bool {
+	if !a.IsExternalUser(username) {
+		return true
+	}
+	if a.ExternalAuthenticator == nil || !a.ExternalAuthenticator.ManagementLoginEnabled() {
+		return false
+	}
+	source := a.ExternalAuthenticator.Name()
+	role, err := a.ExternalAuthenticator.LookupManagementUser(username)
+	if err != nil {
+		a.Logger.PrintAndLog("auth", username+" is no longer allowed by "+source, err)
+		return false
+	}
+	return a.syncExternalUser(username, source, role)
+}
+
+// Create the local account of the directory user or update its role from the directory groups
+func (a *AuthAgent) syncExternalUser(username string, source string, role Role) bool {
+	if !a.UserExists(username) {
+		if username == "" || strings.ContainsAny(username, "/ ") {
+			return false
+		}
+		//The local password is never used, set a random one
+		randomPassword := make([]byte, 32)
+		rand.Read(randomPassword)
+		if err := a.CreateUserAccount(username, base64.RawURLEncoding.EncodeToString(randomPassword), ""); err != nil {
+			a.Logger.PrintAndLog("auth", "Unable to create account for "+source+" user "+username, err)
+			return false
+		}
+		a.Database.Write("auth", "external/"+username, source)
+		if err := a.SetUserPermission(username, &UserPermission{Role: role}); err != nil {
+			//Accounts without role record are admins, never keep it
+			a.DeleteUser(username)
+			return false
+		}
+		a.Logger.PrintAndLog("auth", "Account created for "+source+" user "+username+" as "+string(role), nil)
+		return true
+	}
+
+	//Follow the group changes in the directory
+	if current := a.GetUserPermission(username); current.Role != role {
+		if err := a.SetUserPermission(username, &UserPermission{Role: role}); err != nil {
+			a.Logger.PrintAndLog("auth", "Unable to change role of "+source+" user "+username, err)
+		} else {
+			a.Logger.PrintAndLog("auth", "Role of "+source+" user "+username+" changed to "+string(role), nil)
+		}
+	}
+	return true
+}
@@ -0,0 +1,166 @@
+package auth
+
+/*
+	passwordhash.go
+
+	Versioned password hash format. New passwords are hashed
+	with Argon2id in the PHC string format:
+
+	$argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>
+
+	bcrypt hashes ($2a$, $2b$, $2y$) are also accepted.
+	Legacy unsalted SHA-512 hex hashes are still verified
+	so they can be upgraded on the next successful login
+*/
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Argon2id parameters for new hashes
+const (
+	argon2Memory  = 64 * 1024 //Memory in KiB
+	argon2Time    = 3         //Number of passes
+	argon2Threads = 2
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+
+	maxConcurrentArgon2 = 4 //Argon2id evaluations running at the same time, each use argon2Memory
+)
+
+// Slots of the running Argon2id evaluations, so a burst of logins cannot run out of memory
+var argon2Slots = make(chan struct{}, maxConcurrentArgon2)
+
+// Derive the Argon2id key, waiting for a free slot if too many are running
+func argon2IDKey(password []byte, salt []byte, time uint32, memory uint32, threads uint8, keyLen uint32) []byte {
+	argon2Slots <- struct{}{}
+	defer func() { <-argon2Slots }()
+	return argon2.IDKey(password, salt, time, memory, threads, keyLen)
+}
+
+// Hash format of a stored password hash
+type PasswordHashFormat string
+
+const (
+	PasswordHashArgon2id     PasswordHashFormat = "argon2id"
+	PasswordHashBcrypt       PasswordHashFormat = "bcrypt"
+	PasswordHashLegacySHA512 PasswordHashFormat = "sha512"
+	PasswordHashUnknown      PasswordHashFormat = ""
+)
+
+// Hash used for comparing against when the user does not exist, so the response
+// time does not reveal if a username is valid
+var dummyPasswordHash, _ = HashPassword("zoraxy-dummy-password")
+
+// HashPassword hash the given password with Argon2id and a random salt
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, argon2Memory, argon2Time, argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// GetPasswordHashFormat return the format of the stored password hash
+func GetPasswordHashFormat(encoded string) PasswordHashFormat {
+	switch {
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		return PasswordHashArgon2id
+	case strings.HasPrefix(encoded, "$2a$"), strings.HasPrefix(encoded, "$2b$"), strings.HasPrefix(encoded, "$2y$"):
+		return PasswordHashBcrypt
+	case len(encoded) == sha512.Size*2 && isHex(encoded):
+		return PasswordHashLegacySHA512
+	}
+	return PasswordHashUnknown
+}
+
+// VerifyPassword check the password against the stored hash in constant time.
+// needsRehash is true if the password is correct but the hash should be upgraded
+func VerifyPassword(password string, encoded string) (ok bool, needsRehash bool) {
+	switch GetPasswordHashFormat(encoded) {
+	case PasswordHashArgon2id:
+		params, salt, key, err := decodeArgon2idHash(encoded)
+		if err != nil {
+			return false, false
+		}
+		computed := argon2IDKey([]byte(password), salt, params.time, params.memory, params.threads, uint32(len(key)))
+		if subtle.ConstantTimeCompare(computed, key) != 1 {
+			return false, false
+		}
+		//Upgrade hashes created with weaker parameters
+		weaker := params.memory < argon2Memory || params.time < argon2Time || len(key) < argon2KeyLen
+		return true, weaker
+	case PasswordHashBcrypt:
+		if bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password)) != nil {
+			return false, false
+		}
+		return true, false
+	case PasswordHashLegacySHA512:
+		computed := legacyHash(password)
+		if subtle.ConstantTimeCompare([]byte(computed), []byte(strings.ToLower(encoded))) != 1 {
+			return false, false
+		}
+		return true, true
+	}
+	return false, false
+}
+
+type argon2Params struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+}
+
+// Decode an Argon2id hash in PHC string format
+func decodeArgon2idHash(encoded string) (*argon2Params, []byte, []byte, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, nil, nil, errors.New("invalid argon2id hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, nil, nil, errors.New("unsupported argon2id version")
+	}
+	params := &argon2Params{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads); err != nil {
+		return nil, nil, nil, errors.New("invalid argon2id parameters")
+	}
+	if params.memory == 0 || params.time == 0 || params.threads == 0 {
+		return nil, nil, nil, errors.New("invalid argon2id parameters")
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return nil, nil, nil, errors.New("invalid argon2id hash")
+	}
+	return params, salt, key, nil
+}
+
+func isHex(s string) bool {
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// Legacy unsalted SHA-512 password hash
+func legacyHash(raw string) string {
+	h := sha512.New()
+	h.Write([]byte(raw))
+	return hex.EncodeToString(h.Sum(nil))
+}
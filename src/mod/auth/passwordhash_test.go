@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestPasswordHashFormats(t *testing.T) {
+	argonHash, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(argonHash, "$argon2id$v=19$") {
+		t.Fatalf("unexpected hash format: %s", argonHash)
+	}
+	otherHash, _ := HashPassword("secret")
+	if otherHash == argonHash {
+		t.Error("hashes of the same password should use different salts")
+	}
+
+	bcryptHash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	tests := []struct {
+		name        string
+		hash        string
+		needsRehash bool
+	}{
+		{"argon2id", argonHash, false},
+		{"bcrypt", string(bcryptHash), false},
+		{"legacy sha512", legacyHash("secret"), true},
+	}
+	for _, tt := range tests {
+		ok, needsRehash := VerifyPassword("secret", tt.hash)
+		if !ok || needsRehash != tt.needsRehash {
+			t.Errorf("%s: got ok=%v needsRehash=%v", tt.name, ok, needsRehash)
+		}
+		if ok, _ := VerifyPassword("wrong", tt.hash); ok {
+			t.Errorf("%s: wrong password accepted", tt.name)
+		}
+	}
+
+	for _, invalid := range []string{"", "plaintext", "$argon2id$v=19$m=0,t=0,p=0$$", "$argon2id$broken"} {
+		if ok, _ := VerifyPassword("", invalid); ok {
+			t.Errorf("invalid hash %q accepted", invalid)
+		}
+	}
+
+	//Hashes with weaker parameters are upgraded
+	salt := []byte("saltsaltsaltsalt")
+	weakHash := "$argon2id$v=19$m=1024,t=1,p=1$" + base64.RawStdEncoding.EncodeToString(salt) + "$" +
+		base64.RawStdEncoding.EncodeToString(argon2.IDKey([]byte("secret"), salt, 1, 1024, 1, 32))
+	if ok, needsRehash := VerifyPassword("secret", weakHash); !ok || !needsRehash {
+		t.Errorf("weak argon2id hash: got ok=%v needsRehash=%v", ok, needsRehash)
+	}
+}
+
+func TestCredentialCache(t *testing.T) {
+	cache := NewCredentialCache(0)
+	legacy := legacyHash("secret")
+
+	ok, needsRehash := cache.Verify("user", "secret", legacy)
+	if !ok || !needsRehash {
+		t.Fatalf("expected verified legacy hash to need rehash, got ok=%v needsRehash=%v", ok, needsRehash)
+	}
+	if ok, _ := cache.Verify("user", "wrong", legacy); ok {
+		t.Error("wrong password accepted from cache")
+	}
+	if ok, _ := cache.Verify("other", "secret", legacy); !ok {
+		t.Error("other user with correct password rejected")
+	}
+
+	//Changing the stored hash invalidate the cached entry
+	newHash, _ := HashPassword("changed")
+	if ok, _ := cache.Verify("user", "secret", newHash); ok {
+		t.Error("old password accepted after hash changed")
+	}
+
+	cache.Clear()
+	if len(cache.entries) != 0 {
+		t.Error("cache not cleared")
+	}
+}
+
+func TestCredentialCacheFailures(t *testing.T) {
+	cache := NewCredentialCache(0)
+	for i := 0; i < maxFailedVerifications; i++ {
+		if cache.Blocked("192.0.2.1") {
+			t.Fatalf("client blocked after %d failures", i)
+		}
+		cache.RecordFailure("192.0.2.1")
+	}
+	if !cache.Blocked("192.0.2.1") {
+		t.Error("client not blocked after too many failures")
+	}
+	if cache.Blocked("192.0.2.2") {
+		t.Error("other client blocked")
+	}
+	cache.ResetFailures("192.0.2.1")
+	if cache.Blocked("192.0.2.1") {
+		t.Error("client still blocked after reset")
+	}
+
+	//Failures are forgotten after the window
+	for i := 0; i < maxFailedVerifications; i++ {
+		cache.RecordFailure("192.0.2.1")
+	}
+	cache.failures["192.0.2.1"].expire = time.Now().Add(-time.Second)
+	if cache.Blocked("192.0.2.1") {
+		t.Error("client blocked after the failures expired")
+	}
+}
+
+func TestArgon2ConcurrencyLimit(t *testing.T) {
+	encoded, _ := HashPassword("secret")
+	//Take all slots, verification must wait for a free one
+	for i := 0; i < maxConcurrentArgon2; i++ {
+		argon2Slots <- struct{}{}
+	}
+	done := make(chan bool)
+	go func() {
+		ok, _ := VerifyPassword("secret", encoded)
+		done <- ok
+	}()
+	select {
+	case <-done:
+		t.Fatal("verification ran without a free slot")
+	case <-time.After(100 * time.Millisecond):
+	}
+	<-argon2Slots
+	if ok := <-done; !ok {
+		t.Error("correct password rejected")
+	}
+	for i := 1; i < maxConcurrentArgon2; i++ {
+		<-argon2Slots
+	}
+}
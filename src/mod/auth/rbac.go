@@ -0,0 +1,433 @@
+package auth
+
+/*
+	rbac.go
+
+	Role based access control of the management APIs.
+	Viewers can only read, operators can change the proxy
+	configuration (optionally limited to rules with some tags)
+	and admins can also access the host system and accounts.
+
+	Accounts without a role are admins, so upgrading from
+	a version without roles does not lock anyone out
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+
+	"imuslab.com/zoraxy/mod/utils"
+)
+
+type Role string
+
+const (
+	RoleViewer   Role = "viewer"
+	RoleOperator Role = "operator"
+	RoleAdmin    Role = "admin"
+)
+
+// AccessLevel is the permission required by a management API
+type AccessLevel int
+
+const (
+	AccessRead  AccessLevel = iota //View configurations and statistics
+	AccessWrite                    //Change the proxy configurations
+	AccessAdmin                    //Access the host system, secrets and accounts
+)
+
+// UserPermission is the role of a management user
+type UserPermission struct {
+	Role Role
+	Tags []string //Proxy rule tags an operator is limited to, empty for all rules
+}
+
+// Endpoints that never change anything, allowed for viewers with any method
+var readOnlyEndpoints = []string{
+	"/api/proxy/status",
+	"/api/proxy/list",
+	"/api/proxy/listTags",
+	"/api/proxy/detail",
+	"/api/proxy/requestIsProxied",
+	"/api/proxy/upstream/list",
+	"/api/proxy/vdir/list",
+	"/api/proxy/header/list",
+	"/api/proxy/auth/exceptions/list",
+	"/api/proxy/cache/get",
+	"/api/cert/resolve",
+	"/api/cert/getCommonName",
+	"/api/cert/list",
+	"/api/cert/listdomains",
+	"/api/cert/checkDefault",
+	"/api/redirect/list",
+	"/api/access/list",
+	"/api/blacklist/list",
+	"/api/whitelist/list",
+	"/api/quickban/list",
+	"/api/pathrule/list",
+	"/api/stats/summary",
+	"/api/stats/countries",
+	"/api/stats/netstat",
+	"/api/stats/netstatgraph",
+	"/api/stats/listnic",
+	"/api/stats/hosts",
+	"/api/stats/host",
+	"/api/stats/host/bandwidth",
+	"/api/analytic/list",
+	"/api/analytic/load",
+	"/api/analytic/loadRange",
+	"/api/analytic/exportRange",
+	"/api/utm/list",
+	"/api/streamprox/config/list",
+	"/api/streamprox/config/status",
+	"/api/streamprox/config/targets",
+	"/api/streamprox/config/sessions",
+	"/api/mdns/list",
+	"/api/acme/listExpiredDomains",
+	"/api/acme/autoRenew/listDomains",
+	"/api/acme/autoRenew/schedule",
+	"/api/acme/dns/providers",
+	"/api/webserv/status",
+	"/api/docker/available",
+	"/api/docker/containers",
+	"/api/info/geoip",
+	"/api/auth/rbac/me",
+}
+
+// Endpoints returning the current setting on GET and changing it with other methods
+var settingEndpoints = []string{
+	"/api/proxy/useHttpsRedirect",
+	"/api/proxy/listenPort80",
+	"/api/proxy/proxyProtocol",
+	"/api/proxy/updateCredentials",
+	"/api/proxy/header/handleHSTS",
+	"/api/proxy/header/handleHopByHop",
+	"/api/proxy/header/handleHostOverwrite",
+	"/api/proxy/header/handlePermissionPolicy",
+	"/api/proxy/header/handleWsHeaderBehavior",
+	"/api/proxy/auth/groups",
+	"/api/proxy/auth/ldap",
+	"/api/proxy/auth/oidc",
+	"/api/proxy/auth/portal",
+	"/api/proxy/auth/jwt",
+	"/api/cert/tls",
+	"/api/cert/tlsProfile",
+	"/api/cert/notify/config",
+	"/api/acme/autoRenew/enable",
+	"/api/acme/autoRenew/email",
+	"/api/acme/autoRenew/profile",
+}
+
+// Endpoints giving access to the host system, secrets or accounts
+var adminEndpointPrefixes = []string{
+	"/api/auth/",
+	"/api/sso/",
+	"/api/fs/",
+	"/api/conf/",
+	"/api/plugins/",
+	"/api/log/",
+	"/api/logger/",
+	"/api/localca/",
+	"/api/info/pprof",
+	"/api/cert/download",
+	"/api/tools/webssh",
+	"/api/tools/smtp/",
+	"/api/tools/fwdproxy/",
+	"/web.ssh/",
+	"/plugin.ui/",
+}
+
+// Self service endpoints of the logged in user under the admin prefixes,
+// the handlers only change the account of the calling user
+var selfServiceEndpoints = []string{
+	"/api/auth/changePassword",
+	"/api/auth/2fa/status",
+	"/api/auth/2fa/totp/enroll",
+	"/api/auth/2fa/totp/confirm",
+	"/api/auth/2fa/totp/disable",
+	"/api/auth/2fa/recovery/regenerate",
+	"/api/auth/2fa/webauthn/register/begin",
+	"/api/auth/2fa/webauthn/register/finish",
+	"/api/auth/2fa/webauthn/remove",
+	"/api/auth/tokens/list",
+	"/api/auth/tokens/create",
+	"/api/auth/tokens/revoke",
+}
+
+// RequiredAccessLevel return the access level required to call the endpoint with the method
+func RequiredAccessLevel(endpoint string, method string) AccessLevel {
+	if slices.Contains(readOnlyEndpoints, endpoint) || slices.Contains(selfServiceEndpoints, endpoint) {
+		return AccessRead
+	}
+	for _, prefix := range adminEndpointPrefixes {
+		if strings.HasPrefix(endpoint, prefix) {
+			return AccessAdmin
+		}
+	}
+	if (method == http.MethodGet || method == http.MethodHead) && slices.Contains(settingEndpoints, endpoint) {
+		return AccessRead
+	}
+	return AccessWrite
+}
+
+// Allow check if the role can access APIs of the given level
+func (p *UserPermission) Allow(level AccessLevel) bool {
+	switch p.Role {
+	case RoleAdmin:
+		return true
+	case RoleOperator:
+		return level <= AccessWrite
+	case RoleViewer:
+		return level == AccessRead
+	}
+	return false
+}
+
+// Scoped check if the operator is limited to some proxy rules
+func (p *UserPermission) Scoped() bool {
+	return p.Role == RoleOperator && len(p.Tags) > 0
+}
+
+// GetUserPermission return the role of the user, users without role are admins
+func (a *AuthAgent) GetUserPermission(username string) *UserPermission {
+	permission := UserPermission{}
+	if err := a.Database.Read("auth", "role/"+username, &permission); err != nil || permission.Role == "" {
+		return &UserPermission{Role: RoleAdmin, Tags: []string{}}
+	}
+	if permission.Tags == nil {
+		permission.Tags = []string{}
+	}
+	return &permission
+}
+
+// SetUserPermission change the role of the user. The last admin cannot be removed
+func (a *AuthAgent) SetUserPermission(username string, permission *UserPermission) error {
+	switch permission.Role {
+	case RoleAdmin, RoleViewer:
+		permission.Tags = []string{}
+	case RoleOperator:
+		tags := []string{}
+		for _, tag := range permission.Tags {
+			tag = strings.TrimSpace(tag)
+			if tag != "" && !slices.Contains(tags, tag) {
+				tags = append(tags, tag)
+			}
+		}
+		permission.Tags = tags
+	default:
+		return errors.New("invalid role")
+	}
+	if !a.UserExists(username) {
+		return errors.New("user not found")
+	}
+	if permission.Role != RoleAdmin && a.isLastAdmin(username) {
+		return errors.New("at least one admin account is required")
+	}
+	return a.Database.Write("auth", "role/"+username, permission)
+}
+
+// Check if the user is the only admin left
+func (a *AuthAgent) isLastAdmin(username string) bool {
+	if a.GetUserPermission(username).Role != RoleAdmin {
+		return false
+	}
+	for _, user := range a.ListUsers() {
+		if user != username && a.GetUserPermission(user).Role == RoleAdmin {
+			return false
+		}
+	}
+	return true
+}
+
+// Check the permission of the logged in user on the endpoint, the denied attempt is audited and replied
+func (router *RouterDef) checkPermission(w http.ResponseWriter, r *http.Request, endpoint string) bool {
+	a := router.option.AuthAgent
+	username, err := a.GetUserName(w, r)
+	if err != nil || !a.UserExists(username) || !a.checkExternalUser(username) {
+		//Account removed after login, users without role record would be treated as admin
+		router.option.DeniedHandler(w, r)
+		return false
+	}
+	permission := a.GetUserPermission(username)
+	level := RequiredAccessLevel(endpoint, r.Method)
+	reason := ""
+	if !permission.Allow(level) {
+		reason = "role " + string(permission.Role) + " is not allowed to use this API"
+	} else if level == AccessWrite && permission.Scoped() {
+		if router.option.ResourceScopeCheck == nil {
+			reason = "API is not limited to tagged resources"
+		} else if err := router.option.ResourceScopeCheck(r, permission.Tags); err != nil {
+			reason = err.Error()
+		}
+	}
+	if reason == "" {
+		return true
+	}
+
+	a.denyRequest(w, r, username, permission.Role, reason)
+	return false
+}
+
+// CheckUserAccess check if the logged in user can access the management resource outside of the
+// managed router, like the web SSH and plugin UIs. The denied attempt is audited and replied
+func (a *AuthAgent) CheckUserAccess(w http.ResponseWriter, r *http.Request, endpoint string) bool {
+	username, err := a.GetUserName(w, r)
+	if err != nil || !a.UserExists(username) || !a.checkExternalUser(username) {
+		http.Error(w, "401 - Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	permission := a.GetUserPermission(username)
+	if !permission.Allow(RequiredAccessLevel(endpoint, r.Method)) {
+		a.denyRequest(w, r, username, permission.Role, "role "+string(permission.Role)+" is not allowed to access "+endpoint)
+		return false
+	}
+	return true
+}
+
+// Audit the denied request and reply permission denied
+func (a *AuthAgent) denyRequest(w http.ResponseWriter, r *http.Request, username string, role Role, reason string) {
+	a.recordDenied(r, username, role, reason)
+	js, _ := json.Marshal(map[string]string{"error": "Permission denied: " + reason})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	w.Write(js)
+}
+
+/*
+	Management user APIs, registered on admin only endpoints
+*/
+
+// ManagementUser is a management account with its role
+type ManagementUser struct {
+	Username  string
+	Role      Role
+	Tags      []string
+	TwoFactor bool
+	Source    string //External directory of the account, empty for local accounts
+}
+
+// Parse POST role and tags
+func permissionFromRequest(r *http.Request) (*UserPermission, error) {
+	role, err := utils.PostPara(r, "role")
+	if err != nil {
+		return nil, errors.New("role not defined")
+	}
+	tags, _ := utils.PostPara(r, "tags")
+	permission := &UserPermission{Role: Role(role), Tags: []string{}}
+	if tags != "" {
+		permission.Tags = strings.Split(tags, ",")
+	}
+	return permission, nil
+}
+
+// HandleGetOwnPermission return the role of the current user
+func (a *AuthAgent) HandleGetOwnPermission(w http.ResponseWriter, r *http.Request) {
+	username, err := a.GetUserName(w, r)
+	if err != nil {
+		http.Error(w, "401 - Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	js, _ := json.Marshal(a.GetUserPermission(username))
+	utils.SendJSONResponse(w, string(js))
+}
+
+// HandleListManagementUsers list all management accounts with their roles
+func (a *AuthAgent) HandleListManagementUsers(w http.ResponseWriter, r *http.Request) {
+	users := []*ManagementUser{}
+	for _, username := range a.ListUsers() {
+		permission := a.GetUserPermission(username)
+		users = append(users, &ManagementUser{
+			Username:  username,
+			Role:      permission.Role,
+			Tags:      permission.Tags,
+			TwoFactor: a.totpSecret(username) != "" || len(a.webauthnCredentials(username)) > 0,
+			Source:    a.userSource(username),
+		})
+	}
+	slices.SortFunc(users, func(x, y *ManagementUser) int {
+		return strings.Compare(x.Username, y.Username)
+	})
+	js, _ := json.Marshal(users)
+	utils.SendJSONResponse(w, string(js))
+}
+
+// HandleAddManagementUser create a management account, require POST username, password, role and optional tags
+func (a *AuthAgent) HandleAddManagementUser(w http.ResponseWriter, r *http.Request) {
+	username, err := utils.PostPara(r, "username")
+	if err != nil || strings.ContainsAny(username, "/ ") {
+		utils.SendErrorResponse(w, "invalid username")
+		return
+	}
+	password, err := utils.PostPara(r, "password")
+	if err != nil {
+		utils.SendErrorResponse(w, "password not defined")
+		return
+	}
+	permission, err := permissionFromRequest(r)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	if permission.Role != RoleAdmin && permission.Role != RoleOperator && permission.Role != RoleViewer {
+		utils.SendErrorResponse(w, "invalid role")
+		return
+	}
+	if err := a.CreateUserAccount(username, password, ""); err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	if err := a.SetUserPermission(username, permission); err != nil {
+		a.UnregisterUser(username)
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	a.Logger.PrintAndLog("auth", "Management account "+username+" created with role "+string(permission.Role), nil)
+	utils.SendOK(w)
+}
+
+// HandleEditManagementUser change the role of a management account, require POST username, role and optional tags
+func (a *AuthAgent) HandleEditManagementUser(w http.ResponseWriter, r *http.Request) {
+	username, err := utils.PostPara(r, "username")
+	if err != nil {
+		utils.SendErrorResponse(w, "username not defined")
+		return
+	}
+	permission, err := permissionFromRequest(r)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	if err := a.SetUserPermission(username, permission); err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	a.Logger.PrintAndLog("auth", "Role of "+username+" changed to "+string(permission.Role), nil)
+	utils.SendOK(w)
+}
+
+// HandleRemoveManagementUser remove a management account, require POST username
+func (a *AuthAgent) HandleRemoveManagementUser(w http.ResponseWriter, r *http.Request) {
+	username, err := utils.PostPara(r, "username")
+	if err != nil {
+		utils.SendErrorResponse(w, "username not defined")
+		return
+	}
+	currentUser, _ := a.GetUserName(w, r)
+	if username == currentUser {
+		utils.SendErrorResponse(w, "cannot remove the current account")
+		return
+	}
+	if a.isLastAdmin(username) {
+		utils.SendErrorResponse(w, "at least one admin account is required")
+		return
+	}
+	if err := a.DeleteUser(username); err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	a.Logger.PrintAndLog("auth", "Management account "+username+" removed", nil)
+	utils.SendOK(w)
+}
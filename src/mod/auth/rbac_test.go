@@ -0,0 +1,200 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestRequiredAccessLevel(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		method   string
+		want     AccessLevel
+	}{
+		{"/api/proxy/list", http.MethodGet, AccessRead},
+		{"/api/proxy/detail", http.MethodPost, AccessRead},
+		{"/api/proxy/listenPort80", http.MethodGet, AccessRead},
+		{"/api/proxy/listenPort80", http.MethodPost, AccessWrite},
+		{"/api/proxy/toggle", http.MethodGet, AccessWrite},
+		{"/api/proxy/del", http.MethodPost, AccessWrite},
+		{"/api/fs/list", http.MethodGet, AccessAdmin},
+		{"/api/tools/webssh", http.MethodGet, AccessAdmin},
+		{"/api/auth/rbac/users", http.MethodGet, AccessAdmin},
+		{"/api/auth/rbac/me", http.MethodGet, AccessRead},
+		{"/web.ssh/", http.MethodGet, AccessAdmin},
+		{"/plugin.ui/", http.MethodGet, AccessAdmin},
+		{"/api/auth/changePassword", http.MethodPost, AccessRead},
+		{"/api/auth/2fa/totp/enroll", http.MethodPost, AccessRead},
+		{"/api/auth/2fa/webauthn/register/begin", http.MethodPost, AccessRead},
+	}
+	for _, test := range tests {
+		if got := RequiredAccessLevel(test.endpoint, test.method); got != test.want {
+			t.Errorf("%s %s: expected level %d, got %d", test.method, test.endpoint, test.want, got)
+		}
+	}
+}
+
+func TestCheckUserAccess(t *testing.T) {
+	a := newTwoFactorTestAgent(t)
+	if err := a.CreateUserAccount("viewer", "password", ""); err != nil {
+		t.Fatal(err)
+	}
+	a.SetUserPermission("viewer", &UserPermission{Role: RoleViewer})
+
+	for username, want := range map[string]int{"admin": http.StatusOK, "viewer": http.StatusForbidden} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/web.ssh/instance/", nil)
+		r.AddCookie(loginCookie(a, username))
+		if a.CheckUserAccess(w, r, "/web.ssh/") {
+			w.WriteHeader(http.StatusOK)
+		}
+		if w.Code != want {
+			t.Errorf("%s: expected %d, got %d", username, want, w.Code)
+		}
+	}
+	if entries := a.ListAuditLog(0); len(entries) != 1 || entries[0].Username != "viewer" {
+		t.Errorf("expected the denied viewer to be audited, got %+v", entries)
+	}
+}
+
+func TestRouterEnforceRoles(t *testing.T) {
+	a := newTwoFactorTestAgent(t)
+	for _, username := range []string{"viewer", "operator", "teama"} {
+		if err := a.CreateUserAccount(username, "password", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a.SetUserPermission("viewer", &UserPermission{Role: RoleViewer})
+	a.SetUserPermission("operator", &UserPermission{Role: RoleOperator})
+	a.SetUserPermission("teama", &UserPermission{Role: RoleOperator, Tags: []string{" team-a", "team-a"}})
+	if tags := a.GetUserPermission("teama").Tags; !slices.Equal(tags, []string{"team-a"}) {
+		t.Errorf("unexpected tags %v", tags)
+	}
+
+	mux := http.NewServeMux()
+	router := NewManagedHTTPRouter(RouterOption{
+		AuthAgent:   a,
+		RequireAuth: true,
+		TargetMux:   mux,
+		DeniedHandler: func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "401 - Unauthorized", http.StatusUnauthorized)
+		},
+		ResourceScopeCheck: func(r *http.Request, allowedTags []string) error {
+			if r.URL.Query().Get("ep") == "a.example.com" && slices.Contains(allowedTags, "team-a") {
+				return nil
+			}
+			return errors.New("proxy rule is not tagged with team-a")
+		},
+	})
+	a.LoginRedirectionHandler = func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "401 - Unauthorized", http.StatusUnauthorized)
+	}
+	for _, endpoint := range []string{"/api/proxy/list", "/api/proxy/toggle", "/api/fs/list", "/api/auth/2fa/status"} {
+		router.HandleFunc(endpoint, func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("OK"))
+		})
+	}
+
+	request := func(username string, target string) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, target, nil)
+		r.AddCookie(loginCookie(a, username))
+		mux.ServeHTTP(w, r)
+		return w.Code
+	}
+	tests := []struct {
+		username string
+		target   string
+		want     int
+	}{
+		{"admin", "/api/fs/list", http.StatusOK},
+		{"viewer", "/api/proxy/list", http.StatusOK},
+		{"viewer", "/api/proxy/toggle?ep=a.example.com", http.StatusForbidden},
+		{"operator", "/api/proxy/toggle?ep=b.example.com", http.StatusOK},
+		{"operator", "/api/fs/list", http.StatusForbidden},
+		{"teama", "/api/proxy/toggle?ep=a.example.com", http.StatusOK},
+		{"teama", "/api/proxy/toggle?ep=b.example.com", http.StatusForbidden},
+		{"teama", "/api/proxy/list", http.StatusOK},
+		{"viewer", "/api/auth/2fa/status", http.StatusOK},
+		{"teama", "/api/auth/2fa/status", http.StatusOK},
+	}
+	for _, test := range tests {
+		if code := request(test.username, test.target); code != test.want {
+			t.Errorf("%s %s: expected %d, got %d", test.username, test.target, test.want, code)
+		}
+	}
+
+	//Denied requests are audited, newest first
+	entries := a.ListAuditLog(0)
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 audit entries, got %d", len(entries))
+	}
+	if entries[0].Username != "teama" || entries[0].Endpoint != "/api/proxy/toggle" || entries[0].Reason != "proxy rule is not tagged with team-a" {
+		t.Errorf("unexpected audit entry %+v", entries[0])
+	}
+
+	//Session of a removed account is rejected even though it has no role record
+	cookie := loginCookie(a, "viewer")
+	a.UnregisterUser("viewer")
+	a.Database.Delete("auth", "role/viewer")
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/api/fs/list", nil)
+	r.AddCookie(cookie)
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("removed account got %d", w.Code)
+	}
+}
+
+func TestLastAdminProtected(t *testing.T) {
+	a := newTwoFactorTestAgent(t)
+	if err := a.SetUserPermission("admin", &UserPermission{Role: RoleViewer}); err == nil {
+		t.Fatal("last admin demoted")
+	}
+	if err := a.SetUserPermission("admin", &UserPermission{Role: "root"}); err == nil {
+		t.Fatal("invalid role accepted")
+	}
+	a.CreateUserAccount("second", "password", "")
+	if err := a.SetUserPermission("admin", &UserPermission{Role: RoleViewer}); err != nil {
+		t.Fatalf("admin not demoted with another admin left: %v", err)
+	}
+	if a.GetUserPermission("second").Role != RoleAdmin {
+		t.Error("account without role is not admin")
+	}
+}
+
+func TestDeleteUser(t *testing.T) {
+	a := newTwoFactorTestAgent(t)
+	if err := a.CreateUserAccount("viewer", "password", ""); err != nil {
+		t.Fatal(err)
+	}
+	a.SetUserPermission("viewer", &UserPermission{Role: RoleViewer})
+	a.Database.Write("auth", "totp/viewer", "secret")
+	a.Database.Write("auth", "external/viewer", "LDAP")
+	if _, _, err := a.CreateAPIToken("viewer", "ci", []*APITokenScope{{Endpoint: "/api/*"}}, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	//Changing the password keep the role and second factors
+	a.UnregisterUser("viewer")
+	a.CreateUserAccount("viewer", "newpassword", "")
+	if a.GetUserPermission("viewer").Role != RoleViewer || a.totpSecret("viewer") == "" {
+		t.Fatal("password change removed the account settings")
+	}
+
+	if err := a.DeleteUser("viewer"); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"passhash/viewer", "role/viewer", "totp/viewer", "external/viewer"} {
+		if a.Database.KeyExists("auth", key) {
+			t.Errorf("%s not removed", key)
+		}
+	}
+	if tokens := a.ListAPITokens("viewer"); len(tokens) != 0 {
+		t.Errorf("expected API tokens to be removed, got %d", len(tokens))
+	}
+}
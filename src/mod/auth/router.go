@@ -11,6 +11,9 @@ type RouterOption struct {
 	RequireAuth   bool                                     //This router require authentication
 	DeniedHandler func(http.ResponseWriter, *http.Request) //Things to do when request is rejected
 	TargetMux     *http.ServeMux
+
+	//Check if the request only changes resources tagged with one of the allowed tags, for operators limited to some tags
+	ResourceScopeCheck func(r *http.Request, allowedTags []string) error
 }
 
 type RouterDef struct {
@@ -33,32 +36,38 @@ func (router *RouterDef) HandleFunc(endpoint string, handler func(http.ResponseW
 	}
 
 	authAgent := router.option.AuthAgent
+	wrappedHandler := func(w http.ResponseWriter, r *http.Request) {
+		//Check authentication of the user
+		if !router.option.RequireAuth {
+			handler(w, r)
+			return
+		}
+		if IsAPITokenRequest(r) {
+			//Automation requests authenticated with API token
+			token, err := authAgent.ValidateAPIToken(r)
+			if err != nil {
+				http.Error(w, "401 - Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			r = withAPIToken(r, token)
+			if !token.Allow(endpoint, r.Method) {
+				authAgent.denyRequest(w, r, token.Owner, authAgent.GetUserPermission(token.Owner).Role, "API token "+token.Name+" is not scoped for "+r.Method+" "+endpoint)
+				return
+			}
+		}
+		authAgent.HandleCheckAuth(w, r, func(w http.ResponseWriter, r *http.Request) {
+			if !router.checkPermission(w, r, endpoint) {
+				return
+			}
+			handler(w, r)
+		})
+	}
 
 	//OK. Register handler
 	if router.option.TargetMux == nil {
-		http.HandleFunc(endpoint, func(w http.ResponseWriter, r *http.Request) {
-			//Check authentication of the user
-			if router.option.RequireAuth {
-				authAgent.HandleCheckAuth(w, r, func(w http.ResponseWriter, r *http.Request) {
-					handler(w, r)
-				})
-			} else {
-				handler(w, r)
-			}
-
-		})
+		http.HandleFunc(endpoint, wrappedHandler)
 	} else {
-		router.option.TargetMux.HandleFunc(endpoint, func(w http.ResponseWriter, r *http.Request) {
-			//Check authentication of the user
-			if router.option.RequireAuth {
-				authAgent.HandleCheckAuth(w, r, func(w http.ResponseWriter, r *http.Request) {
-					handler(w, r)
-				})
-			} else {
-				handler(w, r)
-			}
-
-		})
+		router.option.TargetMux.HandleFunc(endpoint, wrappedHandler)
 	}
 
 	router.endpoints[endpoint] = handler
@@ -0,0 +1,328 @@
+package jwtauth
+
+/*
+	JWT Auth
+
+	Validate bearer tokens of API clients locally without
+	redirecting to a login page. Tokens are verified with keys
+	from JWKS URLs or static keys configured on the endpoint,
+	then checked against the issuer, audience, expiry and
+	required claims of the endpoint
+*/
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"imuslab.com/zoraxy/mod/auth/sso/oauth2"
+	"imuslab.com/zoraxy/mod/info/logger"
+)
+
+const (
+	LogTitle = "JWT Auth"
+
+	tokenLeeway = time.Minute //Allowed clock skew on the time claims
+)
+
+var (
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrForbidden    = errors.New("forbidden")
+)
+
+var supportedAlgorithms = []jose.SignatureAlgorithm{
+	jose.RS256, jose.RS384, jose.RS512,
+	jose.PS256, jose.PS384, jose.PS512,
+	jose.ES256, jose.ES384, jose.ES512,
+	jose.EdDSA,
+	jose.HS256, jose.HS384, jose.HS512,
+}
+
+// Policy is the JWT settings of a proxy endpoint
+type Policy struct {
+	JWKSURLs       []string            //JWKS URLs of the token issuers
+	StaticKeys     []string            //PEM encoded public keys or certificates, JWK or JWK set JSON
+	Issuers        []string            //Allowed iss claim values, empty to allow all issuers
+	Audiences      []string            //Token must be issued for one of these audiences, empty to skip
+	RequiredClaims map[string][]string //Claim must exist and contain one of the values if any given
+	ClaimHeaders   map[string]string   //Claim name to upstream request header name
+}
+
+// Validator verify bearer tokens, the key sets are shared between endpoints
+type Validator struct {
+	KeySets *oauth2.KeySetCache
+
+	logger     *logger.Logger
+	staticKeys sync.Map //Parsed static keys by their config string
+}
+
+func NewValidator(logger *logger.Logger) *Validator {
+	return &Validator{
+		KeySets: oauth2.NewKeySetCache(),
+		logger:  logger,
+	}
+}
+
+// ParseStaticKey parse a PEM public key, PEM certificate, JWK or JWK set
+func ParseStaticKey(key string) ([]jose.JSONWebKey, error) {
+	key = strings.TrimSpace(key)
+	if strings.HasPrefix(key, "{") {
+		keySet := jose.JSONWebKeySet{}
+		if err := json.Unmarshal([]byte(key), &keySet); err != nil || len(keySet.Keys) == 0 {
+			jwk := jose.JSONWebKey{}
+			if err := json.Unmarshal([]byte(key), &jwk); err != nil {
+				return nil, errors.New("invalid JWK: " + err.Error())
+			}
+			keySet.Keys = []jose.JSONWebKey{jwk}
+		}
+		keys := []jose.JSONWebKey{}
+		for _, jwk := range keySet.Keys {
+			if public := jwk.Public(); public.Valid() {
+				//Private keys pasted by mistake are only used for verification
+				keys = append(keys, public)
+			} else if secret, ok := jwk.Key.([]byte); ok && len(secret) > 0 {
+				//Symmetric key for HMAC signed tokens
+				keys = append(keys, jwk)
+			} else {
+				return nil, errors.New("invalid JWK " + jwk.KeyID)
+			}
+		}
+		return keys, nil
+	}
+
+	keys := []jose.JSONWebKey{}
+	rest := []byte(key)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		switch block.Type {
+		case "PUBLIC KEY":
+			publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, jose.JSONWebKey{Key: publicKey})
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, jose.JSONWebKey{Key: cert.PublicKey})
+		default:
+			return nil, errors.New("unsupported PEM block " + block.Type)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("key is not a PEM public key, certificate or JWK")
+	}
+	return keys, nil
+}
+
+// Validate check the settings of the policy before saving
+func (p *Policy) Validate() error {
+	if len(p.JWKSURLs) == 0 && len(p.StaticKeys) == 0 {
+		return errors.New("at least one JWKS URL or static key is required")
+	}
+	for _, jwksURL := range p.JWKSURLs {
+		u, err := url.Parse(jwksURL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return errors.New("invalid JWKS URL: " + jwksURL)
+		}
+	}
+	for _, key := range p.StaticKeys {
+		if _, err := ParseStaticKey(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get the parsed static keys of the policy
+func (v *Validator) policyStaticKeys(p *Policy) []jose.JSONWebKey {
+	keys := []jose.JSONWebKey{}
+	for _, key := range p.StaticKeys {
+		if cached, ok := v.staticKeys.Load(key); ok {
+			keys = append(keys, cached.([]jose.JSONWebKey)...)
+			continue
+		}
+		parsed, err := ParseStaticKey(key)
+		if err != nil {
+			continue
+		}
+		v.staticKeys.Store(key, parsed)
+		keys = append(keys, parsed...)
+	}
+	return keys
+}
+
+// Get the keys that can verify the token. refetch fetch the key sets
+// again in case the issuer rotated its keys
+func (v *Validator) candidateKeys(p *Policy, header jose.Header, refetch bool) []jose.JSONWebKey {
+	keys := v.policyStaticKeys(p)
+	for _, jwksURL := range p.JWKSURLs {
+		keySet, err := v.KeySets.Get(jwksURL, refetch)
+		if err != nil {
+			if v.logger != nil {
+				v.logger.PrintAndLog(LogTitle, "Unable to fetch JWKS from "+jwksURL, err)
+			}
+			continue
+		}
+		keys = append(keys, keySet.Keys...)
+	}
+
+	results := []jose.JSONWebKey{}
+	for _, key := range keys {
+		if header.KeyID != "" && key.KeyID != "" && key.KeyID != header.KeyID {
+			continue
+		}
+		if key.Algorithm != "" && key.Algorithm != header.Algorithm {
+			continue
+		}
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		results = append(results, key)
+	}
+	return results
+}
+
+// Verify the signature with the first key that works
+func verifyWithKeys(token *jwt.JSONWebToken, keys []jose.JSONWebKey, dest ...interface{}) error {
+	for _, key := range keys {
+		if err := token.Claims(key.Key, dest...); err == nil {
+			return nil
+		}
+	}
+	return errors.New("token is not signed by a trusted key")
+}
+
+// Verify the token signature and its time, issuer and audience claims
+func (v *Validator) Verify(p *Policy, rawToken string) (oauth2.Claims, error) {
+	token, err := jwt.ParseSigned(rawToken, supportedAlgorithms)
+	if err != nil {
+		return nil, err
+	}
+	standardClaims := jwt.Claims{}
+	claims := oauth2.Claims{}
+	err = verifyWithKeys(token, v.candidateKeys(p, token.Headers[0], false), &standardClaims, &claims)
+	if err != nil && len(p.JWKSURLs) > 0 {
+		//The issuer might have rotated its keys
+		err = verifyWithKeys(token, v.candidateKeys(p, token.Headers[0], true), &standardClaims, &claims)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if standardClaims.Expiry == nil {
+		return nil, errors.New("token has no expiry")
+	}
+	if err := standardClaims.ValidateWithLeeway(jwt.Expected{Time: time.Now()}, tokenLeeway); err != nil {
+		return nil, err
+	}
+	if len(p.Issuers) > 0 && !slices.Contains(p.Issuers, standardClaims.Issuer) {
+		return nil, errors.New("token issuer " + standardClaims.Issuer + " is not allowed")
+	}
+	if len(p.Audiences) > 0 && !slices.ContainsFunc(p.Audiences, standardClaims.Audience.Contains) {
+		return nil, errors.New("token is not issued for this audience")
+	}
+	return claims, nil
+}
+
+// Get the values of a claim, space delimited scope claims are split into scopes
+func claimValues(claims oauth2.Claims, name string) []string {
+	values := claims.Strings(name)
+	if name == "scope" || name == "scp" {
+		scopes := []string{}
+		for _, value := range values {
+			scopes = append(scopes, strings.Fields(value)...)
+		}
+		return scopes
+	}
+	return values
+}
+
+// Authorize check the required claims of the policy
+func (p *Policy) Authorize(claims oauth2.Claims) error {
+	for name, allowed := range p.RequiredClaims {
+		values := claimValues(claims, name)
+		if len(values) == 0 {
+			return errors.New("token has no " + name + " claim")
+		}
+		if len(allowed) > 0 && !slices.ContainsFunc(values, func(value string) bool {
+			return slices.Contains(allowed, value)
+		}) {
+			return errors.New("token " + name + " claim does not contain any allowed value")
+		}
+	}
+	return nil
+}
+
+// ApplyClaimHeaders set the mapped claims and the token subject as upstream
+// request headers. Mapped headers sent by the client are always removed
+func (p *Policy) ApplyClaimHeaders(r *http.Request, claims oauth2.Claims) {
+	r.Header.Del("X-Remote-User")
+	if subject, ok := claims["sub"].(string); ok {
+		r.Header.Set("X-Remote-User", subject)
+	}
+	for claim, header := range p.ClaimHeaders {
+		r.Header.Del(header)
+		values := claimValues(claims, claim)
+		if len(values) > 0 {
+			r.Header.Set(header, strings.Join(values, ","))
+		}
+	}
+}
+
+// Reply the error of a bearer token request (RFC 6750)
+func denyRequest(w http.ResponseWriter, status int, bearerError string) {
+	challenge := `Bearer realm="Restricted"`
+	if bearerError != "" {
+		challenge += `, error="` + bearerError + `"`
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	w.WriteHeader(status)
+	if status == http.StatusForbidden {
+		w.Write([]byte("403 - Forbidden"))
+	} else {
+		w.Write([]byte("401 - Unauthorized"))
+	}
+}
+
+// HandleJWTAuth authenticate the bearer token of the request with the policy of the endpoint.
+// If error is returned, the request is already replied
+func (v *Validator) HandleJWTAuth(w http.ResponseWriter, r *http.Request, p *Policy) error {
+	rawToken, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || strings.TrimSpace(rawToken) == "" {
+		denyRequest(w, http.StatusUnauthorized, "")
+		return ErrUnauthorized
+	}
+	claims, err := v.Verify(p, strings.TrimSpace(rawToken))
+	if err != nil {
+		if v.logger != nil {
+			v.logger.PrintAndLog(LogTitle, "Invalid token for "+r.Host, err)
+		}
+		denyRequest(w, http.StatusUnauthorized, "invalid_token")
+		return ErrUnauthorized
+	}
+	if err := p.Authorize(claims); err != nil {
+		if v.logger != nil {
+			v.logger.PrintAndLog(LogTitle, "Token denied for "+r.Host+": "+err.Error(), nil)
+		}
+		denyRequest(w, http.StatusForbidden, "insufficient_scope")
+		return ErrForbidden
+	}
+	p.ApplyClaimHeaders(r, claims)
+	return nil
+}
@@ -0,0 +1,191 @@
+package jwtauth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+func signToken(t *testing.T, alg jose.SignatureAlgorithm, key interface{}, kid string, claims map[string]interface{}) string {
+	options := (&jose.SignerOptions{}).WithType("JWT")
+	if kid != "" {
+		options = options.WithHeader(jose.HeaderKey("kid"), kid)
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: alg, Key: key}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jwt.Signed(signer).Claims(claims).Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func validClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"iss":   "https://idp.example.com",
+		"aud":   []string{"orders-api"},
+		"sub":   "service-a",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"scope": "orders:read orders:write",
+	}
+}
+
+func TestStaticKeyVerify(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	der, _ := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	publicPEM := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	hmacJWK, _ := json.Marshal(jose.JSONWebKey{Key: []byte("0123456789abcdef0123456789abcdef"), KeyID: "shared", Algorithm: string(jose.HS256)})
+
+	policy := &Policy{
+		StaticKeys: []string{publicPEM, string(hmacJWK)},
+		Issuers:    []string{"https://idp.example.com"},
+		Audiences:  []string{"orders-api"},
+	}
+	if err := policy.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	v := NewValidator(nil)
+
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	expired := validClaims()
+	expired["exp"] = time.Now().Add(-time.Hour).Unix()
+	noExpiry := validClaims()
+	delete(noExpiry, "exp")
+	wrongIssuer := validClaims()
+	wrongIssuer["iss"] = "https://evil.example.com"
+	wrongAudience := validClaims()
+	wrongAudience["aud"] = "billing-api"
+
+	tests := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"rsa", signToken(t, jose.RS256, rsaKey, "", validClaims()), true},
+		{"hmac", signToken(t, jose.HS256, []byte("0123456789abcdef0123456789abcdef"), "shared", validClaims()), true},
+		{"untrusted key", signToken(t, jose.RS256, otherKey, "", validClaims()), false},
+		{"public key as hmac secret", signToken(t, jose.HS256, []byte(publicPEM), "", validClaims()), false},
+		{"expired", signToken(t, jose.RS256, rsaKey, "", expired), false},
+		{"no expiry", signToken(t, jose.RS256, rsaKey, "", noExpiry), false},
+		{"wrong issuer", signToken(t, jose.RS256, rsaKey, "", wrongIssuer), false},
+		{"wrong audience", signToken(t, jose.RS256, rsaKey, "", wrongAudience), false},
+	}
+	for _, test := range tests {
+		_, err := v.Verify(policy, test.token)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: expected valid %v, got error %v", test.name, test.valid, err)
+		}
+	}
+
+	if err := (&Policy{}).Validate(); err == nil {
+		t.Error("policy without keys accepted")
+	}
+	if err := (&Policy{StaticKeys: []string{"not a key"}}).Validate(); err == nil {
+		t.Error("invalid static key accepted")
+	}
+}
+
+func TestJWKSRotation(t *testing.T) {
+	oldKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	newKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	var lock sync.Mutex
+	var fetches atomic.Int32
+	keySet := jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: &oldKey.PublicKey, KeyID: "old", Algorithm: string(jose.ES256), Use: "sig"}}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		lock.Lock()
+		defer lock.Unlock()
+		json.NewEncoder(w).Encode(keySet)
+	}))
+	defer server.Close()
+
+	v := NewValidator(nil)
+	policy := &Policy{JWKSURLs: []string{server.URL}}
+	for i := 0; i < 3; i++ {
+		if _, err := v.Verify(policy, signToken(t, jose.ES256, oldKey, "old", validClaims())); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fetches.Load() != 1 {
+		t.Errorf("key set fetched %d times, expected cached", fetches.Load())
+	}
+
+	//Issuer rotated its key, unknown key is fetched again once the refetch interval passed
+	lock.Lock()
+	keySet.Keys = []jose.JSONWebKey{{Key: &newKey.PublicKey, KeyID: "new", Algorithm: string(jose.ES256), Use: "sig"}}
+	lock.Unlock()
+	rotated := signToken(t, jose.ES256, newKey, "new", validClaims())
+	if _, err := v.Verify(policy, rotated); err == nil {
+		t.Error("key set refetched within the minimum refetch interval")
+	}
+	v.KeySets.MinRefetchTime = 0
+	if _, err := v.Verify(policy, rotated); err != nil {
+		t.Errorf("rotated key rejected: %v", err)
+	}
+	if _, err := v.Verify(policy, signToken(t, jose.ES256, oldKey, "old", validClaims())); err == nil {
+		t.Error("removed key still accepted")
+	}
+}
+
+func TestHandleJWTAuth(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	jwk, _ := json.Marshal(jose.JSONWebKey{Key: &key.PublicKey, KeyID: "k1"})
+	policy := &Policy{
+		StaticKeys:     []string{string(jwk)},
+		RequiredClaims: map[string][]string{"scope": {"orders:write"}, "sub": {}},
+		ClaimHeaders:   map[string]string{"scope": "X-Token-Scope"},
+	}
+	v := NewValidator(nil)
+
+	request := func(token string) (*httptest.ResponseRecorder, *http.Request) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "https://api.example.com/orders", nil)
+		r.Header.Set("X-Remote-User", "spoofed")
+		r.Header.Set("X-Token-Scope", "admin")
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		v.HandleJWTAuth(w, r, policy)
+		return w, r
+	}
+
+	w, r := request(signToken(t, jose.ES256, key, "k1", validClaims()))
+	if w.Code != http.StatusOK {
+		t.Fatalf("valid token got %d", w.Code)
+	}
+	if r.Header.Get("X-Remote-User") != "service-a" || r.Header.Get("X-Token-Scope") != "orders:read,orders:write" {
+		t.Errorf("unexpected upstream headers %v", r.Header)
+	}
+
+	if w, _ := request(""); w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") != `Bearer realm="Restricted"` {
+		t.Errorf("missing token got %d %s", w.Code, w.Header().Get("WWW-Authenticate"))
+	}
+	if w, _ := request("not.a.token"); w.Code != http.StatusUnauthorized {
+		t.Errorf("malformed token got %d", w.Code)
+	}
+	readOnly := validClaims()
+	readOnly["scope"] = "orders:read"
+	if w, _ := request(signToken(t, jose.ES256, key, "k1", readOnly)); w.Code != http.StatusForbidden {
+		t.Errorf("token without required scope got %d", w.Code)
+	}
+	noSubject := validClaims()
+	delete(noSubject, "sub")
+	if w, _ := request(signToken(t, jose.ES256, key, "k1", noSubject)); w.Code != http.StatusForbidden {
+		t.Errorf("token without required claim got %d", w.Code)
+	}
+}
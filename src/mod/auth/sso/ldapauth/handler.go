@@ -0,0 +1,123 @@
+package ldapauth
+
+/*
+	handler.go
+
+	Admin API handlers of the LDAP authenticator
+*/
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"imuslab.com/zoraxy/mod/utils"
+)
+
+// SettingsResponse is the settings without the service account password
+type SettingsResponse struct {
+	Settings
+	BindPasswordSet bool
+}
+
+// HandleSettings get or update the LDAP settings
+func (a *Authenticator) HandleSettings(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		settings := a.GetSettings()
+		response := SettingsResponse{
+			Settings:        settings,
+			BindPasswordSet: settings.BindPassword != "",
+		}
+		response.BindPassword = ""
+		js, _ := json.Marshal(response)
+		utils.SendJSONResponse(w, string(js))
+	case http.MethodPost:
+		settings := a.GetSettings()
+		enabled, err := utils.PostBool(r, "enabled")
+		if err != nil {
+			utils.SendErrorResponse(w, "enabled not defined")
+			return
+		}
+		settings.Enabled = enabled
+		settings.URL = r.Form.Get("url")
+		settings.StartTLS = r.Form.Get("startTLS") == "true"
+		settings.SkipTLSVerify = r.Form.Get("skipTLSVerify") == "true"
+		settings.CACertificate = strings.TrimSpace(r.Form.Get("caCertificate"))
+		settings.BindDN = strings.TrimSpace(r.Form.Get("bindDN"))
+		if r.Form.Get("bindPassword") != "" {
+			//Keep the saved password if not changed
+			settings.BindPassword = r.Form.Get("bindPassword")
+		}
+		if settings.BindDN == "" {
+			settings.BindPassword = ""
+		}
+		settings.BaseDN = strings.TrimSpace(r.Form.Get("baseDN"))
+		settings.UserFilter = strings.TrimSpace(r.Form.Get("userFilter"))
+		settings.GroupAttribute = strings.TrimSpace(r.Form.Get("groupAttribute"))
+		settings.RequiredGroups = splitGroups(r.Form.Get("requiredGroups"))
+		if r.Form.Get("cacheTime") != "" {
+			cacheTime, err := utils.PostInt(r, "cacheTime")
+			if err != nil {
+				utils.SendErrorResponse(w, "invalid cache time given")
+				return
+			}
+			settings.CacheTime = cacheTime
+		}
+		settings.ManagementLogin = r.Form.Get("managementLogin") == "true"
+		settings.AdminGroups = splitGroups(r.Form.Get("adminGroups"))
+		settings.OperatorGroups = splitGroups(r.Form.Get("operatorGroups"))
+		settings.ViewerGroups = splitGroups(r.Form.Get("viewerGroups"))
+		if err := a.UpdateSettings(settings); err != nil {
+			utils.SendErrorResponse(w, err.Error())
+			return
+		}
+		a.options.Logger.PrintAndLog(LogTitle, "LDAP settings updated", nil)
+		utils.SendOK(w)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandleTestLogin try to login a user with the saved settings, require POST username and password
+func (a *Authenticator) HandleTestLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	username, err := utils.PostPara(r, "username")
+	if err != nil {
+		utils.SendErrorResponse(w, "username not defined")
+		return
+	}
+	password, err := utils.PostPara(r, "password")
+	if err != nil {
+		utils.SendErrorResponse(w, "password not defined")
+		return
+	}
+	settings := a.GetSettings()
+	if !settings.Enabled {
+		utils.SendErrorResponse(w, ErrDisabled.Error())
+		return
+	}
+	//Bypass the cache so the current directory state is tested
+	user, err := settings.authenticate(username, password)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	js, _ := json.Marshal(user)
+	utils.SendJSONResponse(w, string(js))
+}
+
+// Split a group list given one per line, DNs contain commas so they cannot be used as seperator
+func splitGroups(list string) []string {
+	groups := []string{}
+	for _, group := range strings.Split(list, "\n") {
+		group = strings.TrimSpace(group)
+		if group != "" {
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
@@ -0,0 +1,416 @@
+package ldapauth
+
+/*
+	LDAP Auth
+
+	Authenticate users against an LDAP directory or Active Directory.
+	The user is searched with a service account, then the password is
+	verified by binding as the user. Successful logins are cached for
+	a short time so basic auth requests do not bind on every request
+*/
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/jellydator/ttlcache/v3"
+	"imuslab.com/zoraxy/mod/auth"
+	"imuslab.com/zoraxy/mod/database"
+	"imuslab.com/zoraxy/mod/info/logger"
+)
+
+const (
+	LogTitle      = "LDAP"
+	DatabaseTable = "ldap"
+
+	DefaultUserFilter     = "(uid={username})"
+	DefaultGroupAttribute = "memberOf"
+	DefaultCacheTime      = 60 //Seconds a successful login is cached
+
+	settingsKey     = "settings"
+	usernameHolder  = "{username}"
+	connectTimeout  = 10 * time.Second
+	maxCachedLogins = 10000
+)
+
+var (
+	ErrDisabled           = errors.New("ldap authentication is disabled")
+	ErrInvalidCredentials = errors.New("invalid username or password")
+	ErrNotInGroup         = errors.New("user is not in any of the required groups")
+)
+
+type Settings struct {
+	Enabled        bool
+	URL            string   //ldap://host:389 or ldaps://host:636
+	StartTLS       bool     //Upgrade ldap:// connections with StartTLS
+	SkipTLSVerify  bool     //Do not verify the server certificate
+	CACertificate  string   //PEM encoded CA of the server certificate, empty to use the system CAs
+	BindDN         string   //Service account to search users, empty for anonymous search
+	BindPassword   string   //Password of the service account
+	BaseDN         string   //Search base of the users
+	UserFilter     string   //Search filter of the user, {username} is replaced by the escaped username
+	GroupAttribute string   //Attribute of the user listing its group DNs
+	RequiredGroups []string //User must be in one of these groups to login anywhere, empty to allow all users
+	CacheTime      int      //Seconds a successful login is cached, 0 to disable
+
+	/* Management Login */
+	ManagementLogin bool     //Allow directory users to login to the management panel
+	AdminGroups     []string //Groups logging in as admin
+	OperatorGroups  []string //Groups logging in as operator
+	ViewerGroups    []string //Groups logging in as viewer
+}
+
+// User is an authenticated directory user
+type User struct {
+	Username string
+	DN       string
+	Groups   []string //DNs of the groups of the user
+}
+
+type Options struct {
+	Database *database.Database
+	Logger   *logger.Logger
+}
+
+type Authenticator struct {
+	options      *Options
+	settings     Settings
+	settingsLock sync.RWMutex
+	cache        *ttlcache.Cache[string, *User] //Successful logins by keyed hash of the credentials
+	cacheKey     []byte
+}
+
+func NewAuthenticator(options *Options) (*Authenticator, error) {
+	if options.Database == nil {
+		return nil, errors.New("database is required")
+	}
+	options.Database.NewTable(DatabaseTable)
+	cacheKey := make([]byte, 32)
+	if _, err := rand.Read(cacheKey); err != nil {
+		return nil, err
+	}
+	a := &Authenticator{
+		options: options,
+		cache: ttlcache.New[string, *User](
+			ttlcache.WithCapacity[string, *User](maxCachedLogins),
+			ttlcache.WithDisableTouchOnHit[string, *User](),
+		),
+		cacheKey: cacheKey,
+	}
+	options.Database.Read(DatabaseTable, settingsKey, &a.settings)
+	go a.cache.Start()
+	return a, nil
+}
+
+// GetSettings return the current settings
+func (a *Authenticator) GetSettings() Settings {
+	a.settingsLock.RLock()
+	defer a.settingsLock.RUnlock()
+	settings := a.settings
+	if settings.UserFilter == "" {
+		settings.UserFilter = DefaultUserFilter
+	}
+	if settings.GroupAttribute == "" {
+		settings.GroupAttribute = DefaultGroupAttribute
+	}
+	return settings
+}
+
+// UpdateSettings validate and save the settings, cached logins are cleared
+func (a *Authenticator) UpdateSettings(settings Settings) error {
+	settings.URL = strings.TrimSpace(settings.URL)
+	if settings.UserFilter == "" {
+		settings.UserFilter = DefaultUserFilter
+	}
+	if settings.GroupAttribute == "" {
+		settings.GroupAttribute = DefaultGroupAttribute
+	}
+	if settings.CacheTime < 0 {
+		return errors.New("cache time cannot be negative")
+	}
+	if settings.Enabled {
+		u, err := url.Parse(settings.URL)
+		if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+			return errors.New("LDAP URL must be ldap://host:port or ldaps://host:port")
+		}
+		if settings.StartTLS && u.Scheme == "ldaps" {
+			return errors.New("StartTLS cannot be used with ldaps://")
+		}
+		if settings.BaseDN == "" {
+			return errors.New("base DN is required")
+		}
+		if _, err := ldap.ParseDN(settings.BaseDN); err != nil {
+			return errors.New("invalid base DN")
+		}
+		if !strings.Contains(settings.UserFilter, usernameHolder) {
+			return errors.New("user filter must contain " + usernameHolder)
+		}
+		if _, err := ldap.CompileFilter(strings.ReplaceAll(settings.UserFilter, usernameHolder, "user")); err != nil {
+			return errors.New("invalid user filter: " + err.Error())
+		}
+	}
+	if settings.CACertificate != "" {
+		if !x509.NewCertPool().AppendCertsFromPEM([]byte(settings.CACertificate)) {
+			return errors.New("invalid CA certificate")
+		}
+	}
+	if err := a.options.Database.Write(DatabaseTable, settingsKey, settings); err != nil {
+		return err
+	}
+	a.settingsLock.Lock()
+	a.settings = settings
+	a.settingsLock.Unlock()
+	a.cache.DeleteAll()
+	return nil
+}
+
+// Connect to the directory with the TLS settings
+func (s *Settings) connect() (*ldap.Conn, error) {
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		ServerName:         u.Hostname(),
+		InsecureSkipVerify: s.SkipTLSVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if s.CACertificate != "" {
+		tlsConfig.RootCAs = x509.NewCertPool()
+		tlsConfig.RootCAs.AppendCertsFromPEM([]byte(s.CACertificate))
+	}
+	conn, err := ldap.DialURL(s.URL, ldap.DialWithDialer(&net.Dialer{Timeout: connectTimeout}), ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(connectTimeout)
+	if s.StartTLS && u.Scheme == "ldap" {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// Search the user with the service account
+func (s *Settings) search(conn *ldap.Conn, username string) (*ldap.Entry, error) {
+	var err error
+	if s.BindDN != "" {
+		err = conn.Bind(s.BindDN, s.BindPassword)
+	} else {
+		err = conn.UnauthenticatedBind("")
+	}
+	if err != nil {
+		return nil, errors.Join(errors.New("service account bind failed"), err)
+	}
+
+	filter := strings.ReplaceAll(s.UserFilter, usernameHolder, ldap.EscapeFilter(username))
+	result, err := conn.Search(ldap.NewSearchRequest(
+		s.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(connectTimeout.Seconds()), false,
+		filter, []string{s.GroupAttribute}, nil,
+	))
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return nil, err
+	}
+	if result == nil || len(result.Entries) != 1 {
+		//Not found or the filter is ambiguous
+		return nil, ErrInvalidCredentials
+	}
+	return result.Entries[0], nil
+}
+
+// Create the user from the search result, the user must be in the required groups
+func (s *Settings) newUser(username string, entry *ldap.Entry) (*User, error) {
+	user := &User{
+		Username: username,
+		DN:       entry.DN,
+		Groups:   entry.GetAttributeValues(s.GroupAttribute),
+	}
+	if len(s.RequiredGroups) > 0 && !user.InAnyGroup(s.RequiredGroups) {
+		return nil, ErrNotInGroup
+	}
+	return user, nil
+}
+
+// Search the user with the service account and verify the password by binding as the user
+func (s *Settings) authenticate(username string, password string) (*User, error) {
+	if username == "" || password == "" {
+		//Empty password is an unauthenticated bind and always succeed
+		return nil, ErrInvalidCredentials
+	}
+	conn, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	entry, err := s.search(conn, username)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, err
+	}
+	return s.newUser(username, entry)
+}
+
+// Search the user without its password, for logins verified by other means
+func (s *Settings) lookup(username string) (*User, error) {
+	if username == "" {
+		return nil, ErrInvalidCredentials
+	}
+	conn, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	entry, err := s.search(conn, username)
+	if err != nil {
+		return nil, err
+	}
+	return s.newUser(username, entry)
+}
+
+// InAnyGroup check if the user is in one of the groups, given as DN or common name
+func (u *User) InAnyGroup(groups []string) bool {
+	for _, group := range groups {
+		group = strings.TrimSpace(group)
+		groupDN, err := ldap.ParseDN(group)
+		isDN := err == nil && strings.Contains(group, "=")
+		for _, userGroup := range u.Groups {
+			userGroupDN, err := ldap.ParseDN(userGroup)
+			if err != nil {
+				if strings.EqualFold(userGroup, group) {
+					return true
+				}
+				continue
+			}
+			if isDN && groupDN.EqualFold(userGroupDN) {
+				return true
+			}
+			if !isDN && len(userGroupDN.RDNs) > 0 && slices.ContainsFunc(userGroupDN.RDNs[0].Attributes, func(attr *ldap.AttributeTypeAndValue) bool {
+				return strings.EqualFold(attr.Type, "cn") && strings.EqualFold(attr.Value, group)
+			}) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Authenticate verify the credentials with the directory, successful logins are cached
+func (a *Authenticator) Authenticate(username string, password string) (*User, error) {
+	settings := a.GetSettings()
+	if !settings.Enabled {
+		return nil, ErrDisabled
+	}
+	mac := hmac.New(sha256.New, a.cacheKey)
+	mac.Write([]byte(username + "\x00" + password))
+	key := hex.EncodeToString(mac.Sum(nil))
+	if item := a.cache.Get(key); item != nil {
+		return item.Value(), nil
+	}
+
+	user, err := settings.authenticate(username, password)
+	if err != nil {
+		if !errors.Is(err, ErrInvalidCredentials) && !errors.Is(err, ErrNotInGroup) && a.options.Logger != nil {
+			a.options.Logger.PrintAndLog(LogTitle, "Unable to authenticate "+username+" with "+settings.URL, err)
+		}
+		return nil, err
+	}
+	if settings.CacheTime > 0 {
+		a.cache.Set(key, user, time.Duration(settings.CacheTime)*time.Second)
+	}
+	return user, nil
+}
+
+// AuthenticateGroups check the credentials of a proxy endpoint basic auth,
+// the user must be in one of the groups if any given
+func (a *Authenticator) AuthenticateGroups(username string, password string, groups []string) bool {
+	user, err := a.Authenticate(username, password)
+	if err != nil {
+		return false
+	}
+	return len(groups) == 0 || user.InAnyGroup(groups)
+}
+
+/*
+	Management login, implements auth.ExternalAuthenticator
+*/
+
+func (a *Authenticator) Name() string {
+	return LogTitle
+}
+
+func (a *Authenticator) ManagementLoginEnabled() bool {
+	settings := a.GetSettings()
+	return settings.Enabled && settings.ManagementLogin
+}
+
+// AuthenticateManagementUser verify the user and map its groups to a role, the highest role is used
+func (a *Authenticator) AuthenticateManagementUser(username string, password string) (auth.Role, error) {
+	settings := a.GetSettings()
+	if !settings.ManagementLogin {
+		return "", ErrDisabled
+	}
+	user, err := a.Authenticate(username, password)
+	if err != nil {
+		return "", err
+	}
+	return settings.managementRole(user)
+}
+
+// LookupManagementUser check the user is still in the directory and return its current role,
+// used by passkey logins, API tokens and sessions of directory accounts. Results are cached
+// for the same time as successful logins
+func (a *Authenticator) LookupManagementUser(username string) (auth.Role, error) {
+	settings := a.GetSettings()
+	if !settings.Enabled || !settings.ManagementLogin {
+		return "", ErrDisabled
+	}
+	key := "lookup/" + username
+	if item := a.cache.Get(key); item != nil {
+		return settings.managementRole(item.Value())
+	}
+	user, err := settings.lookup(username)
+	if err != nil {
+		if !errors.Is(err, ErrInvalidCredentials) && !errors.Is(err, ErrNotInGroup) && a.options.Logger != nil {
+			a.options.Logger.PrintAndLog(LogTitle, "Unable to lookup "+username+" with "+settings.URL, err)
+		}
+		return "", err
+	}
+	if settings.CacheTime > 0 {
+		a.cache.Set(key, user, time.Duration(settings.CacheTime)*time.Second)
+	}
+	return settings.managementRole(user)
+}
+
+// Map the groups of the user to a role, the highest role is used
+func (s *Settings) managementRole(user *User) (auth.Role, error) {
+	switch {
+	case user.InAnyGroup(s.AdminGroups):
+		return auth.RoleAdmin, nil
+	case user.InAnyGroup(s.OperatorGroups):
+		return auth.RoleOperator, nil
+	case user.InAnyGroup(s.ViewerGroups):
+		return auth.RoleViewer, nil
+	}
+	return "", errors.New("user is not in any of the management groups")
+}
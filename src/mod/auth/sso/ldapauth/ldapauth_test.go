@@ -0,0 +1,427 @@
+package ldapauth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"imuslab.com/zoraxy/mod/auth"
+	"imuslab.com/zoraxy/mod/database"
+	"imuslab.com/zoraxy/mod/database/dbinc"
+	"imuslab.com/zoraxy/mod/info/logger"
+)
+
+const (
+	testServiceDN       = "cn=zoraxy,ou=services,dc=example,dc=org"
+	testServicePassword = "service-password"
+)
+
+type testUser struct {
+	DN       string
+	Password string
+	Groups   []string
+}
+
+// In-process LDAP server supporting bind, search, StartTLS and unbind
+type testDirectory struct {
+	users     map[string]*testUser //By uid
+	tlsConfig *tls.Config
+	userBinds atomic.Int32
+}
+
+func newTestDirectory(t *testing.T) (*testDirectory, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &testDirectory{
+		users: map[string]*testUser{
+			"alice": {
+				DN:       "uid=alice,ou=people,dc=example,dc=org",
+				Password: "alice-password",
+				Groups:   []string{"cn=admins,ou=groups,dc=example,dc=org", "cn=staff,ou=groups,dc=example,dc=org"},
+			},
+			"bob": {
+				DN:       "uid=bob,ou=people,dc=example,dc=org",
+				Password: "bob-password",
+				Groups:   []string{"cn=staff,ou=groups,dc=example,dc=org"},
+			},
+			"carol": {
+				DN:       "uid=carol,ou=people,dc=example,dc=org",
+				Password: "carol-password",
+			},
+		},
+		tlsConfig: &tls.Config{
+			Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		},
+	}
+	return d, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+// Listen on a random port and return the LDAP URL
+func (d *testDirectory) listen(t *testing.T, ldaps bool) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	scheme := "ldap"
+	if ldaps {
+		listener = tls.NewListener(listener, d.tlsConfig)
+		scheme = "ldaps"
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go d.serve(conn)
+		}
+	}()
+	return scheme + "://" + listener.Addr().String()
+}
+
+func (d *testDirectory) serve(conn net.Conn) {
+	defer func() { conn.Close() }()
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		messageID := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			conn.Write(ldapResponse(messageID, ldap.ApplicationBindResponse, d.bind(op.Children[1].Data.String(), op.Children[2].Data.String())))
+		case ldap.ApplicationSearchRequest:
+			filter, _ := ldap.DecompileFilter(op.Children[6])
+			uid := strings.TrimSuffix(strings.TrimPrefix(filter, "(uid="), ")")
+			if user, ok := d.users[uid]; ok {
+				conn.Write(searchEntry(messageID, user))
+			}
+			conn.Write(ldapResponse(messageID, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess))
+		case ldap.ApplicationExtendedRequest:
+			//StartTLS is the only supported extended operation
+			conn.Write(ldapResponse(messageID, ldap.ApplicationExtendedResponse, ldap.LDAPResultSuccess))
+			conn = tls.Server(conn, d.tlsConfig)
+		default:
+			return
+		}
+	}
+}
+
+func (d *testDirectory) bind(dn string, password string) uint16 {
+	if dn == "" && password == "" {
+		return ldap.LDAPResultSuccess
+	}
+	if dn == testServiceDN && password == testServicePassword {
+		return ldap.LDAPResultSuccess
+	}
+	for _, user := range d.users {
+		if user.DN == dn && user.Password == password {
+			d.userBinds.Add(1)
+			return ldap.LDAPResultSuccess
+		}
+	}
+	return ldap.LDAPResultInvalidCredentials
+}
+
+func ldapMessage(messageID int64, op *ber.Packet) []byte {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "MessageID"))
+	packet.AppendChild(op)
+	return packet.Bytes()
+}
+
+func ldapResponse(messageID int64, tag ber.Tag, resultCode uint16) []byte {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Response")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(resultCode), "Result Code"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+	return ldapMessage(messageID, op)
+}
+
+func searchEntry(messageID int64, user *testUser) []byte {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, user.DN, "DN"))
+	attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+	attribute := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute")
+	attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, DefaultGroupAttribute, "Type"))
+	values := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+	for _, group := range user.Groups {
+		values.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, group, "Value"))
+	}
+	attribute.AppendChild(values)
+	attributes.AppendChild(attribute)
+	op.AppendChild(attributes)
+	return ldapMessage(messageID, op)
+}
+
+func newTestAuthenticator(t *testing.T, settings Settings) (*Authenticator, *database.Database) {
+	db, err := database.NewDatabase(filepath.Join(t.TempDir(), "sys.db"), dbinc.BackendBoltDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+	fmtLogger, _ := logger.NewFmtLogger()
+	a, err := NewAuthenticator(&Options{Database: db, Logger: fmtLogger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.UpdateSettings(settings); err != nil {
+		t.Fatal(err)
+	}
+	return a, db
+}
+
+func TestAuthenticate(t *testing.T) {
+	directory, caCertificate := newTestDirectory(t)
+	tests := []struct {
+		name     string
+		settings Settings
+	}{
+		{"StartTLS", Settings{URL: directory.listen(t, false), StartTLS: true, CACertificate: caCertificate}},
+		{"LDAPS", Settings{URL: directory.listen(t, true), CACertificate: caCertificate}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.settings.Enabled = true
+			tt.settings.BindDN = testServiceDN
+			tt.settings.BindPassword = testServicePassword
+			tt.settings.BaseDN = "ou=people,dc=example,dc=org"
+			tt.settings.RequiredGroups = []string{"staff"}
+			a, _ := newTestAuthenticator(t, tt.settings)
+
+			user, err := a.Authenticate("alice", "alice-password")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if user.DN != "uid=alice,ou=people,dc=example,dc=org" || len(user.Groups) != 2 {
+				t.Fatalf("unexpected user %+v", user)
+			}
+			if _, err := a.Authenticate("alice", "wrong-password"); !errors.Is(err, ErrInvalidCredentials) {
+				t.Fatalf("expected invalid credentials, got %v", err)
+			}
+			if _, err := a.Authenticate("nobody", "alice-password"); !errors.Is(err, ErrInvalidCredentials) {
+				t.Fatalf("expected invalid credentials for unknown user, got %v", err)
+			}
+			if _, err := a.Authenticate("carol", "carol-password"); !errors.Is(err, ErrNotInGroup) {
+				t.Fatalf("expected user outside required groups to be rejected, got %v", err)
+			}
+			if _, err := a.Authenticate("alice", ""); err == nil {
+				t.Fatal("empty password must not login")
+			}
+		})
+	}
+}
+
+func TestUntrustedCertificate(t *testing.T) {
+	directory, _ := newTestDirectory(t)
+	a, _ := newTestAuthenticator(t, Settings{
+		Enabled:      true,
+		URL:          directory.listen(t, true),
+		BaseDN:       "dc=example,dc=org",
+		BindDN:       testServiceDN,
+		BindPassword: testServicePassword,
+	})
+	if _, err := a.Authenticate("alice", "alice-password"); err == nil || errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("expected certificate error, got %v", err)
+	}
+}
+
+func TestLoginCache(t *testing.T) {
+	directory, caCertificate := newTestDirectory(t)
+	a, _ := newTestAuthenticator(t, Settings{
+		Enabled:       true,
+		URL:           directory.listen(t, true),
+		CACertificate: caCertificate,
+		BaseDN:        "dc=example,dc=org",
+		CacheTime:     DefaultCacheTime,
+	})
+
+	for i := 0; i < 3; i++ {
+		if !a.AuthenticateGroups("bob", "bob-password", []string{"cn=Staff,ou=Groups,dc=example,dc=org"}) {
+			t.Fatal("bob should be allowed by group DN")
+		}
+	}
+	if binds := directory.userBinds.Load(); binds != 1 {
+		t.Fatalf("expected 1 directory bind with cache, got %d", binds)
+	}
+	if a.AuthenticateGroups("bob", "bob-password", []string{"admins"}) {
+		t.Fatal("bob is not in admins")
+	}
+
+	//Failed logins are never cached
+	if a.AuthenticateGroups("bob", "wrong-password", nil) {
+		t.Fatal("wrong password accepted")
+	}
+	directory.users["bob"].Password = "new-password"
+	if a.AuthenticateGroups("bob", "wrong-password", nil) {
+		t.Fatal("wrong password accepted")
+	}
+
+	//Settings change clear the cache
+	settings := a.GetSettings()
+	settings.CacheTime = 0
+	if err := a.UpdateSettings(settings); err != nil {
+		t.Fatal(err)
+	}
+	if a.AuthenticateGroups("bob", "bob-password", nil) {
+		t.Fatal("old password accepted after cache is cleared")
+	}
+	a.AuthenticateGroups("bob", "new-password", nil)
+	a.AuthenticateGroups("bob", "new-password", nil)
+	if binds := directory.userBinds.Load(); binds != 3 {
+		t.Fatalf("expected every login to bind without cache, got %d binds", binds)
+	}
+}
+
+func TestManagementLogin(t *testing.T) {
+	directory, caCertificate := newTestDirectory(t)
+	directory.users["dave"] = &testUser{
+		DN:       "uid=dave,ou=people,dc=example,dc=org",
+		Password: "directory-password",
+		Groups:   []string{"cn=admins,ou=groups,dc=example,dc=org"},
+	}
+	a, db := newTestAuthenticator(t, Settings{
+		Enabled:         true,
+		URL:             directory.listen(t, false),
+		StartTLS:        true,
+		CACertificate:   caCertificate,
+		BaseDN:          "dc=example,dc=org",
+		ManagementLogin: true,
+		AdminGroups:     []string{"admins"},
+		ViewerGroups:    []string{"staff"},
+	})
+	fmtLogger, _ := logger.NewFmtLogger()
+	authAgent := auth.NewAuthenticationAgent("zoraxy", []byte("test-session-key"), db, false, fmtLogger, nil)
+	if err := authAgent.CreateUserAccount("dave", "local-password", ""); err != nil {
+		t.Fatal(err)
+	}
+	authAgent.ExternalAuthenticator = a
+
+	if !authAgent.ValidateUsernameAndPassword("alice", "alice-password") {
+		t.Fatal("alice should login from the directory")
+	}
+	if !authAgent.IsExternalUser("alice") || authAgent.GetUserPermission("alice").Role != auth.RoleAdmin {
+		t.Fatal("alice should be provisioned as directory admin")
+	}
+	if !authAgent.ValidateUsernameAndPassword("bob", "bob-password") || authAgent.GetUserPermission("bob").Role != auth.RoleViewer {
+		t.Fatal("bob should be provisioned as viewer")
+	}
+	if authAgent.ValidateUsernameAndPassword("carol", "carol-password") || authAgent.UserExists("carol") {
+		t.Fatal("carol is not in any management group")
+	}
+	if authAgent.ValidateUsernameAndPassword("alice", "wrong-password") {
+		t.Fatal("wrong password accepted")
+	}
+
+	//Local accounts take precedence over directory users
+	if authAgent.ValidateUsernameAndPassword("dave", "directory-password") {
+		t.Fatal("directory password accepted for local account")
+	}
+	if !authAgent.ValidateUsernameAndPassword("dave", "local-password") {
+		t.Fatal("local account login failed")
+	}
+
+	//Role follows the directory groups
+	settings := a.GetSettings()
+	settings.ViewerGroups = nil
+	settings.OperatorGroups = []string{"staff"}
+	if err := a.UpdateSettings(settings); err != nil {
+		t.Fatal(err)
+	}
+	if !authAgent.ValidateUsernameAndPassword("bob", "bob-password") || authAgent.GetUserPermission("bob").Role != auth.RoleOperator {
+		t.Fatal("bob role should follow the directory groups")
+	}
+
+	//Disabling management login lock out directory accounts
+	settings.ManagementLogin = false
+	if err := a.UpdateSettings(settings); err != nil {
+		t.Fatal(err)
+	}
+	if authAgent.ValidateUsernameAndPassword("alice", "alice-password") {
+		t.Fatal("directory account login after management login is disabled")
+	}
+}
+
+func TestManagementLookup(t *testing.T) {
+	directory, caCertificate := newTestDirectory(t)
+	a, db := newTestAuthenticator(t, Settings{
+		Enabled:         true,
+		URL:             directory.listen(t, true),
+		CACertificate:   caCertificate,
+		BaseDN:          "dc=example,dc=org",
+		ManagementLogin: true,
+		AdminGroups:     []string{"admins"},
+		OperatorGroups:  []string{"staff"},
+	})
+	fmtLogger, _ := logger.NewFmtLogger()
+	authAgent := auth.NewAuthenticationAgent("zoraxy", []byte("test-session-key"), db, false, fmtLogger, nil)
+	if err := authAgent.CreateUserAccount("admin", "local-password", ""); err != nil {
+		t.Fatal(err)
+	}
+	authAgent.ExternalAuthenticator = a
+	if !authAgent.ValidateUsernameAndPassword("bob", "bob-password") {
+		t.Fatal("bob should login from the directory")
+	}
+	token, _, err := authAgent.CreateAPIToken("bob", "ci", []*auth.APITokenScope{{Endpoint: "/api/*"}}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenRequest := func() error {
+		r := httptest.NewRequest(http.MethodGet, "/api/proxy/list", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		_, err := authAgent.ValidateAPIToken(r)
+		return err
+	}
+
+	if role, err := a.LookupManagementUser("bob"); err != nil || role != auth.RoleOperator {
+		t.Fatalf("expected bob to be operator, got %q (%v)", role, err)
+	}
+	if err := tokenRequest(); err != nil {
+		t.Fatalf("token of directory user rejected: %v", err)
+	}
+
+	//Tokens stop working once the user leaves the management groups
+	directory.users["bob"].Groups = nil
+	if _, err := a.LookupManagementUser("bob"); err == nil {
+		t.Fatal("bob is no longer in any management group")
+	}
+	if err := tokenRequest(); err == nil {
+		t.Fatal("token of removed directory user accepted")
+	}
+	if _, err := a.LookupManagementUser("nobody"); err == nil {
+		t.Fatal("unknown user found")
+	}
+}
@@ -0,0 +1,152 @@
+package oauth2
+
+/*
+	claims.go
+
+	Claim based authorization and claim to header mapping
+	for endpoints using OAuth2 / OIDC authentication
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// EndpointPolicy is the OIDC settings of a proxy endpoint
+type EndpointPolicy struct {
+	ProviderID          string            //ID of the provider, empty for the default provider
+	AllowedGroups       []string          //User must be in one of these groups, empty to allow all
+	AllowedRoles        []string          //User must have one of these roles, empty to allow all
+	AllowedEmailDomains []string          //User email must be in one of these domains, empty to allow all
+	ClaimHeaders        map[string]string //Claim name to upstream request header name
+}
+
+// Claims of the authenticated user, merged from the ID token and user info response
+type Claims map[string]interface{}
+
+// Get the value of a claim, nested claims can be accessed with dots, e.g. realm_access.roles
+func (c Claims) Get(name string) (interface{}, bool) {
+	if value, ok := c[name]; ok {
+		return value, true
+	}
+	var current interface{} = map[string]interface{}(c)
+	for _, part := range strings.Split(name, ".") {
+		object, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		current, ok = object[part]
+		if !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// Get the values of a claim as string list. Single strings are treated as one value
+func (c Claims) Strings(name string) []string {
+	value, ok := c.Get(name)
+	if !ok {
+		return []string{}
+	}
+	switch v := value.(type) {
+	case []interface{}:
+		results := []string{}
+		for _, item := range v {
+			results = append(results, claimToString(item))
+		}
+		return results
+	case nil:
+		return []string{}
+	default:
+		return []string{claimToString(v)}
+	}
+}
+
+func claimToString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case []interface{}:
+		values := []string{}
+		for _, item := range v {
+			values = append(values, claimToString(item))
+		}
+		return strings.Join(values, ",")
+	case map[string]interface{}:
+		js, _ := json.Marshal(v)
+		return string(js)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// Check if the list contains any of the allowed values
+func containsAny(values []string, allowed []string) bool {
+	for _, a := range allowed {
+		for _, v := range values {
+			if v == a {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Authorize check the claims against the access rules of the endpoint.
+// Each non-empty rule must be satisfied by at least one of its values
+func (p *EndpointPolicy) Authorize(provider *OIDCProvider, claims Claims) error {
+	if p == nil {
+		return nil
+	}
+	if len(p.AllowedGroups) > 0 && !containsAny(claims.Strings(provider.GroupsClaim), p.AllowedGroups) {
+		return errors.New("user is not in any of the allowed groups")
+	}
+	if len(p.AllowedRoles) > 0 && !containsAny(claims.Strings(provider.RolesClaim), p.AllowedRoles) {
+		return errors.New("user does not have any of the allowed roles")
+	}
+	if len(p.AllowedEmailDomains) > 0 {
+		if verified, ok := claims.Get("email_verified"); ok && verified == false {
+			return errors.New("user email is not verified")
+		}
+		email, _ := claims.Get("email")
+		emailString, _ := email.(string)
+		at := strings.LastIndex(emailString, "@")
+		if at < 0 {
+			return errors.New("user email not found in claims")
+		}
+		domain := strings.ToLower(emailString[at+1:])
+		allowed := false
+		for _, d := range p.AllowedEmailDomains {
+			if strings.ToLower(strings.TrimPrefix(d, "@")) == domain {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return errors.New("user email domain is not allowed")
+		}
+	}
+	return nil
+}
+
+// ApplyClaimHeaders set the mapped claims as upstream request headers.
+// Mapped headers sent by the client are always removed
+func (p *EndpointPolicy) ApplyClaimHeaders(r *http.Request, claims Claims) {
+	if p == nil {
+		return
+	}
+	for claim, header := range p.ClaimHeaders {
+		r.Header.Del(header)
+		values := claims.Strings(claim)
+		if len(values) > 0 {
+			r.Header.Set(header, strings.Join(values, ","))
+		}
+	}
+}
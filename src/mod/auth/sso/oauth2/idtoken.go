@@ -0,0 +1,161 @@
+package oauth2
+
+/*
+	idtoken.go
+
+	ID token verification against the JSON Web Key Set of
+	the provider. Key sets are cached and fetched again when
+	a token is signed by a key not in the cached set, so key
+	rotation on the provider side does not break logins
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+const (
+	jwksCacheTime      = time.Hour        //Time a fetched key set is used before fetching again
+	jwksMinRefetchTime = 30 * time.Second //Minimum interval to fetch a key set on unknown keys
+	idTokenLeeway      = time.Minute      //Allowed clock skew on ID token time claims
+)
+
+var supportedIDTokenAlgorithms = []jose.SignatureAlgorithm{
+	jose.RS256, jose.RS384, jose.RS512,
+	jose.PS256, jose.PS384, jose.PS512,
+	jose.ES256, jose.ES384, jose.ES512,
+	jose.EdDSA,
+	jose.HS256, jose.HS384, jose.HS512,
+}
+
+type cachedKeySet struct {
+	keys      *jose.JSONWebKeySet
+	fetchedAt time.Time
+}
+
+// KeySetCache cache the JSON Web Key Sets by URL, shared with the JWT auth method
+type KeySetCache struct {
+	CacheTime      time.Duration //Time a fetched key set is used before fetching again
+	MinRefetchTime time.Duration //Minimum interval to fetch a key set on unknown keys
+
+	client *http.Client
+	sets   map[string]*cachedKeySet
+	lock   sync.Mutex
+}
+
+func NewKeySetCache() *KeySetCache {
+	return &KeySetCache{
+		CacheTime:      jwksCacheTime,
+		MinRefetchTime: jwksMinRefetchTime,
+		client:         &http.Client{Timeout: 10 * time.Second},
+		sets:           map[string]*cachedKeySet{},
+	}
+}
+
+// Get the key set of the URL. refetch fetch the key set again if
+// the cached one is old enough, used when a key is not found
+func (c *KeySetCache) Get(jwksURL string, refetch bool) (*jose.JSONWebKeySet, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	cached, ok := c.sets[jwksURL]
+	if ok {
+		age := time.Since(cached.fetchedAt)
+		if (!refetch && age < c.CacheTime) || (refetch && age < c.MinRefetchTime) {
+			return cached.keys, nil
+		}
+	}
+
+	keys, err := c.fetch(jwksURL)
+	if err != nil {
+		if ok {
+			//Keep using the old key set if the provider is unreachable
+			return cached.keys, nil
+		}
+		return nil, err
+	}
+	c.sets[jwksURL] = &cachedKeySet{keys: keys, fetchedAt: time.Now()}
+	return keys, nil
+}
+
+func (c *KeySetCache) fetch(jwksURL string) (*jose.JSONWebKeySet, error) {
+	resp, err := c.client.Get(jwksURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("key set endpoint returned " + resp.Status)
+	}
+	keys := jose.JSONWebKeySet{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&keys); err != nil {
+		return nil, err
+	}
+	return &keys, nil
+}
+
+// Verify the signature and claims of an ID token and return its claims.
+// nonce must match the nonce of the login request, empty for refreshed tokens
+func (ar *OAuth2Router) verifyIDToken(provider *OIDCProvider, config *ClientConfig, rawIDToken string, nonce string) (Claims, error) {
+	if config.Issuer == "" {
+		return nil, errors.New("id token issuer is not configured or discovered")
+	}
+	token, err := jwt.ParseSigned(rawIDToken, supportedIDTokenAlgorithms)
+	if err != nil {
+		return nil, err
+	}
+	standardClaims := jwt.Claims{}
+	claims := Claims{}
+	if strings.HasPrefix(string(token.Headers[0].Algorithm), "HS") {
+		//Symmetric signatures use the client secret as key
+		err = token.Claims([]byte(provider.ClientSecret), &standardClaims, &claims)
+	} else {
+		if config.JwksURL == "" {
+			//Never trust an unverified token, even if received over the back channel
+			return nil, errors.New("id token key set is not configured or discovered")
+		}
+		var keys *jose.JSONWebKeySet
+		keys, err = ar.keySets.Get(config.JwksURL, false)
+		if err == nil {
+			err = token.Claims(keys, &standardClaims, &claims)
+			if err != nil {
+				//The provider might have rotated its keys
+				keys, _ = ar.keySets.Get(config.JwksURL, true)
+				err = token.Claims(keys, &standardClaims, &claims)
+			}
+		}
+	}
+	if err != nil {
+		return nil, errors.Join(errors.New("invalid id token signature"), err)
+	}
+
+	if standardClaims.Expiry == nil {
+		return nil, errors.New("id token has no expiry")
+	}
+	err = standardClaims.ValidateWithLeeway(jwt.Expected{
+		Issuer:      config.Issuer,
+		AnyAudience: jwt.Audience{provider.ClientId},
+		Time:        time.Now(),
+	}, idTokenLeeway)
+	if err != nil {
+		return nil, err
+	}
+	if len(standardClaims.Audience) > 1 {
+		if azp, _ := claims["azp"].(string); azp != provider.ClientId {
+			return nil, errors.New("id token authorized party mismatch")
+		}
+	}
+	if nonce != "" {
+		if tokenNonce, _ := claims["nonce"].(string); tokenNonce != nonce {
+			return nil, errors.New("id token nonce mismatch")
+		}
+	}
+	return claims, nil
+}
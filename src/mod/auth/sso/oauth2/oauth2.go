@@ -2,11 +2,15 @@ package oauth2
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
+	"io"
 	"net/http"
 	"net/url"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/jellydator/ttlcache/v3"
@@ -19,6 +23,9 @@ import (
 const (
 	// DefaultOAuth2ConfigCacheTime defines the default cache duration for OAuth2 configuration
 	DefaultOAuth2ConfigCacheTime = 60 * time.Second
+
+	callbackPath = "/internal/oauth2"        //Redirect URL of the provider after login
+	logoutPath   = "/internal/oauth2/logout" //End the session of the user
 )
 
 type OAuth2RouterOptions struct {
@@ -31,9 +38,19 @@ type OAuth2RouterOptions struct {
 	OAuth2Scopes                 string //The scopes for OAuth 2.0 Application
 	OAuth2CodeChallengeMethod    string //The authorization code challenge method
 	OAuth2ConfigurationCacheTime *time.Duration
+	OAuth2SessionLifetime        *time.Duration //Maximum lifetime of login sessions of the default provider
 	Logger                       *logger.Logger
 	Database                     *database.Database
-	OAuth2ConfigCache            *ttlcache.Cache[string, *oauth2.Config]
+	OAuth2ConfigCache            *ttlcache.Cache[string, *ClientConfig]
+}
+
+// ClientConfig is the resolved OAuth2 client configuration of a provider
+type ClientConfig struct {
+	OAuth2        *oauth2.Config
+	UserInfoUrl   string
+	Issuer        string //Expected ID token issuer, ID tokens are rejected if empty
+	JwksURL       string //Key set for ID token verification, required for asymmetric signatures
+	EndSessionURL string //RP-initiated logout endpoint, empty if not supported
 }
 
 type OIDCDiscoveryDocument struct {
@@ -50,10 +67,17 @@ type OIDCDiscoveryDocument struct {
 	TokenEndpoint                     string   `json:"token_endpoint"`
 	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
 	UserinfoEndpoint                  string   `json:"userinfo_endpoint"`
+	EndSessionEndpoint                string   `json:"end_session_endpoint"`
 }
 
 type OAuth2Router struct {
-	options *OAuth2RouterOptions
+	options       *OAuth2RouterOptions
+	providers     map[string]*OIDCProvider //Additional OIDC providers, ID to provider
+	providerLock  sync.RWMutex
+	sessions      map[string]*Session //Login sessions by hash of session ID
+	sessionLock   sync.RWMutex
+	pendingLogins *ttlcache.Cache[string, *pendingLogin] //Authorization requests by state
+	keySets       *KeySetCache
 }
 
 // NewOAuth2Router creates a new OAuth2Router object
@@ -70,10 +94,23 @@ func NewOAuth2Router(options *OAuth2RouterOptions) *OAuth2Router {
 	options.Database.Read("oauth2", "oauth2CodeChallengeMethod", &options.OAuth2CodeChallengeMethod)
 	options.Database.Read("oauth2", "oauth2Scopes", &options.OAuth2Scopes)
 	options.Database.Read("oauth2", "oauth2ConfigurationCacheTime", &options.OAuth2ConfigurationCacheTime)
+	options.Database.Read("oauth2", "oauth2SessionLifetime", &options.OAuth2SessionLifetime)
 
 	ar := &OAuth2Router{
-		options: options,
+		options:   options,
+		providers: map[string]*OIDCProvider{},
+		sessions:  map[string]*Session{},
+		pendingLogins: ttlcache.New[string, *pendingLogin](
+			ttlcache.WithTTL[string, *pendingLogin](pendingLoginTimeout),
+			ttlcache.WithCapacity[string, *pendingLogin](maxPendingLogins),
+			ttlcache.WithDisableTouchOnHit[string, *pendingLogin](),
+		),
+		keySets: NewKeySetCache(),
 	}
+	ar.loadProviders()
+	ar.loadSessions()
+	go ar.pendingLogins.Start()
+	go ar.sessionCleanupLoop()
 
 	if options.OAuth2ConfigurationCacheTime == nil ||
 		options.OAuth2ConfigurationCacheTime.Seconds() == 0 {
@@ -81,8 +118,8 @@ func NewOAuth2Router(options *OAuth2RouterOptions) *OAuth2Router {
 		options.OAuth2ConfigurationCacheTime = &cacheTime
 	}
 
-	options.OAuth2ConfigCache = ttlcache.New[string, *oauth2.Config](
-		ttlcache.WithTTL[string, *oauth2.Config](*options.OAuth2ConfigurationCacheTime),
+	options.OAuth2ConfigCache = ttlcache.New[string, *ClientConfig](
+		ttlcache.WithTTL[string, *ClientConfig](*options.OAuth2ConfigurationCacheTime),
 	)
 	go options.OAuth2ConfigCache.Start()
 
@@ -115,6 +152,7 @@ func (ar *OAuth2Router) handleSetOAuthSettingsGET(w http.ResponseWriter, r *http
 		"oauth2ClientId":               ar.options.OAuth2ClientId,
 		"oauth2CodeChallengeMethod":    ar.options.OAuth2CodeChallengeMethod,
 		"oauth2ConfigurationCacheTime": ar.options.OAuth2ConfigurationCacheTime.String(),
+		"oauth2SessionLifetime":        ar.defaultProvider().sessionLifetime().String(),
 	})
 
 	utils.SendJSONResponse(w, string(js))
@@ -149,6 +187,16 @@ func (ar *OAuth2Router) handleSetOAuthSettingsPOST(w http.ResponseWriter, r *htt
 		return
 	}
 
+	//Session lifetime is optional, keep the current value if not given
+	oauth2SessionLifetime := ar.options.OAuth2SessionLifetime
+	if r.Form.Get("oauth2SessionLifetime") != "" {
+		oauth2SessionLifetime, err = utils.PostDuration(r, "oauth2SessionLifetime")
+		if err != nil {
+			utils.SendErrorResponse(w, "invalid oauth2SessionLifetime given")
+			return
+		}
+	}
+
 	oauth2WellKnownUrl, err := utils.PostPara(r, "oauth2WellKnownUrl")
 	if err != nil {
 		oauth2ServerUrl, err = utils.PostPara(r, "oauth2ServerUrl")
@@ -188,6 +236,7 @@ func (ar *OAuth2Router) handleSetOAuthSettingsPOST(w http.ResponseWriter, r *htt
 	ar.options.OAuth2Scopes = oauth2Scopes
 	ar.options.OAuth2CodeChallengeMethod = oauth2CodeChallengeMethod
 	ar.options.OAuth2ConfigurationCacheTime = oauth2ConfigurationCacheTime
+	ar.options.OAuth2SessionLifetime = oauth2SessionLifetime
 
 	//Write changes to database
 	ar.options.Database.Write("oauth2", "oauth2WellKnownUrl", oauth2WellKnownUrl)
@@ -199,6 +248,7 @@ func (ar *OAuth2Router) handleSetOAuthSettingsPOST(w http.ResponseWriter, r *htt
 	ar.options.Database.Write("oauth2", "oauth2Scopes", oauth2Scopes)
 	ar.options.Database.Write("oauth2", "oauth2CodeChallengeMethod", oauth2CodeChallengeMethod)
 	ar.options.Database.Write("oauth2", "oauth2ConfigurationCacheTime", oauth2ConfigurationCacheTime)
+	ar.options.Database.Write("oauth2", "oauth2SessionLifetime", oauth2SessionLifetime)
 
 	// Flush caches
 	ar.options.OAuth2ConfigCache.DeleteAll()
@@ -215,6 +265,7 @@ func (ar *OAuth2Router) handleSetOAuthSettingsDELETE(w http.ResponseWriter, r *h
 	ar.options.OAuth2ClientSecret = ""
 	ar.options.OAuth2Scopes = ""
 	ar.options.OAuth2CodeChallengeMethod = ""
+	ar.options.OAuth2SessionLifetime = nil
 
 	ar.options.Database.Delete("oauth2", "oauth2WellKnownUrl")
 	ar.options.Database.Delete("oauth2", "oauth2ServerUrl")
@@ -225,12 +276,17 @@ func (ar *OAuth2Router) handleSetOAuthSettingsDELETE(w http.ResponseWriter, r *h
 	ar.options.Database.Delete("oauth2", "oauth2Scopes")
 	ar.options.Database.Delete("oauth2", "oauth2CodeChallengeMethod")
 	ar.options.Database.Delete("oauth2", "oauth2ConfigurationCacheTime")
+	ar.options.Database.Delete("oauth2", "oauth2SessionLifetime")
+
+	// Flush caches and log out users of the default provider
+	ar.options.OAuth2ConfigCache.DeleteAll()
+	ar.RemoveProviderSessions(DefaultProviderID)
 
 	utils.SendOK(w)
 }
 
-func (ar *OAuth2Router) fetchOAuth2Configuration(config *oauth2.Config) (*oauth2.Config, error) {
-	req, err := http.NewRequest("GET", ar.options.OAuth2WellKnownUrl, nil)
+func (ar *OAuth2Router) fetchOAuth2Configuration(provider *OIDCProvider, config *ClientConfig) (*ClientConfig, error) {
+	req, err := http.NewRequest("GET", provider.WellKnownUrl, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -243,186 +299,353 @@ func (ar *OAuth2Router) fetchOAuth2Configuration(config *oauth2.Config) (*oauth2
 		if err := json.NewDecoder(resp.Body).Decode(&oidcDiscoveryDocument); err != nil {
 			return nil, err
 		}
-		if len(config.Scopes) == 0 {
-			config.Scopes = oidcDiscoveryDocument.ScopesSupported
+		if len(config.OAuth2.Scopes) == 0 {
+			config.OAuth2.Scopes = oidcDiscoveryDocument.ScopesSupported
+		}
+
+		if config.OAuth2.Endpoint.AuthURL == "" {
+			config.OAuth2.Endpoint.AuthURL = oidcDiscoveryDocument.AuthorizationEndpoint
+		}
+
+		if config.OAuth2.Endpoint.TokenURL == "" {
+			config.OAuth2.Endpoint.TokenURL = oidcDiscoveryDocument.TokenEndpoint
+		}
+
+		if config.UserInfoUrl == "" {
+			config.UserInfoUrl = oidcDiscoveryDocument.UserinfoEndpoint
 		}
 
-		if config.Endpoint.AuthURL == "" {
-			config.Endpoint.AuthURL = oidcDiscoveryDocument.AuthorizationEndpoint
+		if config.Issuer == "" {
+			config.Issuer = oidcDiscoveryDocument.Issuer
 		}
 
-		if config.Endpoint.TokenURL == "" {
-			config.Endpoint.TokenURL = oidcDiscoveryDocument.TokenEndpoint
+		if config.JwksURL == "" {
+			config.JwksURL = oidcDiscoveryDocument.JwksURI
 		}
 
-		if ar.options.OAuth2UserInfoUrl == "" {
-			ar.options.OAuth2UserInfoUrl = oidcDiscoveryDocument.UserinfoEndpoint
+		if config.EndSessionURL == "" {
+			config.EndSessionURL = oidcDiscoveryDocument.EndSessionEndpoint
 		}
 
 	}
 	return config, nil
 }
 
-func (ar *OAuth2Router) newOAuth2Conf(redirectUrl string) (*oauth2.Config, error) {
-	config := &oauth2.Config{
-		ClientID:     ar.options.OAuth2ClientId,
-		ClientSecret: ar.options.OAuth2ClientSecret,
-		RedirectURL:  redirectUrl,
-		Endpoint: oauth2.Endpoint{
-			AuthURL:  ar.options.OAuth2ServerURL,
-			TokenURL: ar.options.OAuth2TokenURL,
+func (ar *OAuth2Router) newOAuth2Conf(provider *OIDCProvider, redirectUrl string) (*ClientConfig, error) {
+	config := &ClientConfig{
+		OAuth2: &oauth2.Config{
+			ClientID:     provider.ClientId,
+			ClientSecret: provider.ClientSecret,
+			RedirectURL:  redirectUrl,
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  provider.ServerURL,
+				TokenURL: provider.TokenURL,
+			},
 		},
+		UserInfoUrl:   provider.UserInfoUrl,
+		Issuer:        provider.Issuer,
+		JwksURL:       provider.JwksURL,
+		EndSessionURL: provider.LogoutURL,
 	}
-	if ar.options.OAuth2Scopes != "" {
-		config.Scopes = strings.Split(ar.options.OAuth2Scopes, ",")
+	if provider.Scopes != "" {
+		config.OAuth2.Scopes = strings.Split(provider.Scopes, ",")
 	}
-	if ar.options.OAuth2WellKnownUrl != "" && (config.Endpoint.AuthURL == "" || config.Endpoint.TokenURL == "" ||
-		ar.options.OAuth2UserInfoUrl == "") {
-		return ar.fetchOAuth2Configuration(config)
+	if provider.WellKnownUrl != "" {
+		return ar.fetchOAuth2Configuration(provider, config)
 	}
 	return config, nil
 }
 
-// HandleOAuth2Auth is the internal handler for OAuth authentication
-// Set useHTTPS to true if your OAuth server is using HTTPS
-// Set OAuthURL to the URL of the OAuth server, e.g. OAuth.example.com
-func (ar *OAuth2Router) HandleOAuth2Auth(w http.ResponseWriter, r *http.Request) error {
-	const callbackPrefix = "/internal/oauth2"
-	const tokenCookie = "z-token"
-	const verifierCookie = "z-verifier"
-	scheme := "http"
-	if r.TLS != nil {
-		scheme = "https"
+// Get the cached client configuration of the provider for the requested host
+func (ar *OAuth2Router) clientConfig(provider *OIDCProvider, scheme string, host string) (*ClientConfig, error) {
+	cacheTime := provider.ConfigurationCacheTime
+	if cacheTime <= 0 {
+		cacheTime = DefaultOAuth2ConfigCacheTime
 	}
-
-	reqUrl := scheme + "://" + r.Host + r.RequestURI
-	oauthConfigCache, _ := ar.options.OAuth2ConfigCache.GetOrSetFunc(r.Host, func() *oauth2.Config {
-		oauthConfig, err := ar.newOAuth2Conf(scheme + "://" + r.Host + callbackPrefix)
+	oauthConfigCache, _ := ar.options.OAuth2ConfigCache.GetOrSetFunc(provider.ID+"|"+host, func() *ClientConfig {
+		oauthConfig, err := ar.newOAuth2Conf(provider, scheme+"://"+host+callbackPath)
 		if err != nil {
 			ar.options.Logger.PrintAndLog("OAuth2Router", "Failed to fetch OIDC configuration:", err)
 			return nil
 		}
 		return oauthConfig
-	})
+	}, ttlcache.WithTTL[string, *ClientConfig](cacheTime))
 
-	oauthConfig := oauthConfigCache.Value()
-	if oauthConfig == nil {
+	clientConfig := oauthConfigCache.Value()
+	if clientConfig == nil {
+		return nil, errors.New("failed to fetch OIDC configuration")
+	}
+	if clientConfig.OAuth2.Endpoint.AuthURL == "" || clientConfig.OAuth2.Endpoint.TokenURL == "" || clientConfig.UserInfoUrl == "" {
+		ar.options.Logger.PrintAndLog("OAuth2Router", "Invalid OAuth2 configuration", nil)
+		return nil, errors.New("invalid OAuth2 configuration")
+	}
+	return clientConfig, nil
+}
+
+// Fetch the user info with the access token
+func (ar *OAuth2Router) fetchUserInfo(config *ClientConfig, accessToken string) (Claims, error) {
+	client := config.OAuth2.Client(context.Background(), &oauth2.Token{AccessToken: accessToken})
+	resp, err := client.Get(config.UserInfoUrl)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("user info endpoint returned " + resp.Status)
+	}
+	userInfo := Claims{}
+	//Some providers return signed user info instead of JSON, only the status is checked then
+	json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&userInfo)
+	return userInfo, nil
+}
+
+// Verify the ID token in the token response and merge its claims with the user info.
+// nonce is the nonce of the login request, empty when refreshing
+func (ar *OAuth2Router) tokenClaims(provider *OIDCProvider, config *ClientConfig, token *oauth2.Token, nonce string) (Claims, error) {
+	claims := Claims{}
+	if idToken, ok := token.Extra("id_token").(string); ok && idToken != "" {
+		idTokenClaims, err := ar.verifyIDToken(provider, config, idToken, nonce)
+		if err != nil {
+			return nil, err
+		}
+		claims = idTokenClaims
+	} else if nonce != "" && slices.Contains(config.OAuth2.Scopes, "openid") {
+		return nil, errors.New("id token missing from token response")
+	}
+
+	userInfo, err := ar.fetchUserInfo(config, token.AccessToken)
+	if err != nil {
+		return nil, err
+	}
+	idTokenSubject, _ := claims["sub"].(string)
+	userInfoSubject, _ := userInfo["sub"].(string)
+	if idTokenSubject != "" && userInfoSubject != "" && idTokenSubject != userInfoSubject {
+		return nil, errors.New("user info subject does not match id token")
+	}
+	for k, v := range userInfo {
+		claims[k] = v
+	}
+	return claims, nil
+}
+
+// HandleOAuth2Auth is the internal handler for OAuth authentication
+// policy select the provider of the endpoint and the claims required to
+// access it, nil to use the default provider and allow any logged in user
+func (ar *OAuth2Router) HandleOAuth2Auth(w http.ResponseWriter, r *http.Request, policy *EndpointPolicy) error {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	providerID := ""
+	if policy != nil {
+		providerID = policy.ProviderID
+	}
+	provider, err := ar.GetProvider(providerID)
+	if err != nil {
+		ar.options.Logger.PrintAndLog("OAuth2Router", "OIDC provider "+providerID+" of "+r.Host+" not found", err)
 		w.WriteHeader(500)
-		return errors.New("failed to fetch OIDC configuration")
+		return err
 	}
 
-	if oauthConfig.Endpoint.AuthURL == "" || oauthConfig.Endpoint.TokenURL == "" || ar.options.OAuth2UserInfoUrl == "" {
-		ar.options.Logger.PrintAndLog("OAuth2Router", "Invalid OAuth2 configuration", nil)
+	clientConfig, err := ar.clientConfig(provider, scheme, r.Host)
+	if err != nil {
 		w.WriteHeader(500)
-		return errors.New("invalid OAuth2 configuration")
+		return err
 	}
 
-	code := r.URL.Query().Get("code")
+	switch {
+	case r.URL.Path == logoutPath:
+		return ar.handleLogout(w, r, provider, clientConfig, scheme)
+	case r.Method == http.MethodGet && r.URL.Path == callbackPath && r.URL.Query().Get("state") != "":
+		return ar.handleCallback(w, r, provider, clientConfig)
+	}
+
+	sessionKey, session := ar.getSession(r)
+	if session == nil || session.ProviderID != provider.ID || session.Host != r.Host {
+		return ar.redirectToLogin(w, r, provider, clientConfig, scheme)
+	}
+	if err := ar.refreshSession(sessionKey, session, provider, clientConfig); err != nil {
+		ar.options.Logger.PrintAndLog("OAuth2", "Session refresh failed, login required", err)
+		ar.deleteSession(sessionKey)
+		return ar.redirectToLogin(w, r, provider, clientConfig, scheme)
+	}
+
+	//Logged in, check the claims against the access rules of the endpoint
+	session.lock.Lock()
+	claims := session.Claims
+	session.lock.Unlock()
+	if err := policy.Authorize(provider, claims); err != nil {
+		ar.options.Logger.PrintAndLog("OAuth2", "Access to "+r.Host+" denied", err)
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("403 - Forbidden"))
+		return errors.New("forbidden")
+	}
+	policy.ApplyClaimHeaders(r, claims)
+	return nil
+}
+
+// Start a new authorization request and redirect the user to the provider
+func (ar *OAuth2Router) redirectToLogin(w http.ResponseWriter, r *http.Request, provider *OIDCProvider, config *ClientConfig, scheme string) error {
+	login := &pendingLogin{
+		ProviderID: provider.ID,
+		Host:       r.Host,
+		Nonce:      newRandomToken(),
+		ReturnURL:  scheme + "://" + r.Host + r.RequestURI,
+	}
+	authCodeOptions := []oauth2.AuthCodeOption{oauth2.AccessTypeOffline, oauth2.SetAuthURLParam("nonce", login.Nonce)}
+	switch provider.CodeChallengeMethod {
+	case "PKCE":
+		login.Verifier = oauth2.GenerateVerifier()
+		authCodeOptions = append(authCodeOptions, oauth2.SetAuthURLParam("code_challenge", login.Verifier))
+	case "PKCE_S256":
+		login.Verifier = oauth2.GenerateVerifier()
+		authCodeOptions = append(authCodeOptions, oauth2.S256ChallengeOption(login.Verifier))
+	}
+
+	state := newRandomToken()
+	ar.pendingLogins.Set(state, login, ttlcache.DefaultTTL)
+	setCookie(w, r, stateCookie, state, time.Now().Add(pendingLoginTimeout))
+	http.Redirect(w, r, config.OAuth2.AuthCodeURL(state, authCodeOptions...), http.StatusFound)
+	return errors.New("unauthorized")
+}
+
+// Handle the redirect back from the provider, create the session and return to the original URL
+func (ar *OAuth2Router) handleCallback(w http.ResponseWriter, r *http.Request, provider *OIDCProvider, config *ClientConfig) error {
+	unauthorized := func(message string, err error) error {
+		ar.options.Logger.PrintAndLog("OAuth2", message, err)
+		w.WriteHeader(401)
+		w.Write([]byte("401 - Unauthorized"))
+		return errors.New("unauthorized")
+	}
+
+	//The state must match the login request started in this browser
 	state := r.URL.Query().Get("state")
-	if r.Method == http.MethodGet && strings.HasPrefix(r.RequestURI, callbackPrefix) && code != "" && state != "" {
-		ctx := context.Background()
-		var authCodeOptions []oauth2.AuthCodeOption
-		if ar.options.OAuth2CodeChallengeMethod == "PKCE" || ar.options.OAuth2CodeChallengeMethod == "PKCE_S256" {
-			verifierCookie, err := r.Cookie(verifierCookie)
-			if err != nil || verifierCookie.Value == "" {
-				ar.options.Logger.PrintAndLog("OAuth2Router", "Read OAuth2 verifier cookie failed", err)
-				w.WriteHeader(401)
-				return errors.New("unauthorized")
-			}
-			authCodeOptions = append(authCodeOptions, oauth2.VerifierOption(verifierCookie.Value))
-		}
-		token, err := oauthConfig.Exchange(ctx, code, authCodeOptions...)
-		if err != nil {
-			ar.options.Logger.PrintAndLog("OAuth2", "Token exchange failed", err)
-			w.WriteHeader(401)
-			return errors.New("unauthorized")
-		}
-		if !token.Valid() {
-			ar.options.Logger.PrintAndLog("OAuth2", "Invalid token", err)
-			w.WriteHeader(401)
-			return errors.New("unauthorized")
-		}
+	cookie, err := r.Cookie(stateCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		return unauthorized("OAuth2 state mismatch", err)
+	}
+	item := ar.pendingLogins.Get(state)
+	if item == nil {
+		return unauthorized("OAuth2 login request expired or already used", nil)
+	}
+	ar.pendingLogins.Delete(state)
+	setCookie(w, r, stateCookie, "", time.Time{})
+	login := item.Value()
+	if login.ProviderID != provider.ID || login.Host != r.Host {
+		return unauthorized("OAuth2 login request was started for another endpoint", nil)
+	}
+	if providerError := r.URL.Query().Get("error"); providerError != "" {
+		return unauthorized("OAuth2 provider returned error: "+providerError, nil)
+	}
 
-		cookieExpiry := token.Expiry
-		if cookieExpiry.IsZero() || cookieExpiry.Before(time.Now()) {
-			cookieExpiry = time.Now().Add(time.Hour)
-		}
-		cookie := http.Cookie{Name: tokenCookie, Value: token.AccessToken, Path: "/", Expires: cookieExpiry}
-		if scheme == "https" {
-			cookie.Secure = true
-			cookie.SameSite = http.SameSiteLaxMode
-		}
-		w.Header().Add("Set-Cookie", cookie.String())
+	var authCodeOptions []oauth2.AuthCodeOption
+	if login.Verifier != "" {
+		authCodeOptions = append(authCodeOptions, oauth2.VerifierOption(login.Verifier))
+	}
+	token, err := config.OAuth2.Exchange(context.Background(), r.URL.Query().Get("code"), authCodeOptions...)
+	if err != nil {
+		return unauthorized("Token exchange failed", err)
+	}
+	if !token.Valid() {
+		return unauthorized("Invalid token", nil)
+	}
+	claims, err := ar.tokenClaims(provider, config, token, login.Nonce)
+	if err != nil {
+		return unauthorized("Token verification failed", err)
+	}
 
-		if ar.options.OAuth2CodeChallengeMethod == "PKCE" || ar.options.OAuth2CodeChallengeMethod == "PKCE_S256" {
-			cookie := http.Cookie{Name: verifierCookie, Value: "", Path: "/", Expires: time.Now().Add(-time.Hour * 1)}
-			if scheme == "https" {
-				cookie.Secure = true
-				cookie.SameSite = http.SameSiteLaxMode
-			}
-			w.Header().Add("Set-Cookie", cookie.String())
-		}
+	now := time.Now()
+	idToken, _ := token.Extra("id_token").(string)
+	subject, _ := claims["sub"].(string)
+	session := &Session{
+		ProviderID:   provider.ID,
+		Host:         r.Host,
+		Subject:      subject,
+		Claims:       claims,
+		AccessToken:  token.AccessToken,
+		RefreshToken: token.RefreshToken,
+		IDToken:      idToken,
+		TokenExpiry:  token.Expiry,
+		CreatedAt:    now,
+		ExpiresAt:    now.Add(provider.sessionLifetime()),
+	}
+	sessionID, err := ar.createSession(session)
+	if err != nil {
+		ar.options.Logger.PrintAndLog("OAuth2", "Unable to create session", err)
+		w.WriteHeader(500)
+		return err
+	}
+	setCookie(w, r, sessionCookie, sessionID, session.ExpiresAt)
+	http.Redirect(w, r, login.ReturnURL, http.StatusTemporaryRedirect)
+	return errors.New("authorized")
+}
 
-		//Fix for #695
-		location := strings.TrimPrefix(state, "/internal/")
-		//Check if the location starts with http:// or https://. if yes, this is full URL
-		decodedLocation, err := url.PathUnescape(location)
-		if err == nil && (strings.HasPrefix(decodedLocation, "http://") || strings.HasPrefix(decodedLocation, "https://")) {
-			//Redirect to the full URL
-			http.Redirect(w, r, decodedLocation, http.StatusTemporaryRedirect)
-		} else {
-			//Redirect to a relative path
-			http.Redirect(w, r, state, http.StatusTemporaryRedirect)
-		}
+// Refresh the tokens and claims of a session if the access token is expiring
+func (ar *OAuth2Router) refreshSession(key string, session *Session, provider *OIDCProvider, config *ClientConfig) error {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	if session.RefreshToken == "" || session.TokenExpiry.IsZero() || time.Until(session.TokenExpiry) > tokenRefreshSkew {
+		return nil
+	}
 
-		return errors.New("authorized")
-	}
-	unauthorized := false
-	cookie, err := r.Cookie(tokenCookie)
-	if err == nil {
-		if cookie.Value == "" {
-			unauthorized = true
-		} else {
-			ctx := context.Background()
-			client := oauthConfig.Client(ctx, &oauth2.Token{AccessToken: cookie.Value})
-			req, err := client.Get(ar.options.OAuth2UserInfoUrl)
-			if err != nil {
-				ar.options.Logger.PrintAndLog("OAuth2", "Failed to get user info", err)
-				unauthorized = true
-			}
-			defer req.Body.Close()
-			if req.StatusCode != http.StatusOK {
-				ar.options.Logger.PrintAndLog("OAuth2", "Failed to get user info", err)
-				unauthorized = true
+	token, err := config.OAuth2.TokenSource(context.Background(), &oauth2.Token{RefreshToken: session.RefreshToken}).Token()
+	if err != nil {
+		return err
+	}
+	claims, err := ar.tokenClaims(provider, config, token, "")
+	if err != nil {
+		return err
+	}
+	if subject, _ := claims["sub"].(string); subject != "" && subject != session.Subject {
+		return errors.New("refreshed token subject does not match session")
+	}
+	if _, ok := token.Extra("id_token").(string); !ok {
+		//No new ID token, keep the verified claims from login
+		for k, v := range session.Claims {
+			if _, exists := claims[k]; !exists {
+				claims[k] = v
 			}
 		}
 	} else {
-		unauthorized = true
-	}
-	if unauthorized {
-		state := url.QueryEscape(reqUrl)
-		var url string
-		if ar.options.OAuth2CodeChallengeMethod == "PKCE" || ar.options.OAuth2CodeChallengeMethod == "PKCE_S256" {
-			cookie := http.Cookie{Name: verifierCookie, Value: oauth2.GenerateVerifier(), Path: "/", Expires: time.Now().Add(time.Hour * 1)}
-			if scheme == "https" {
-				cookie.Secure = true
-				cookie.SameSite = http.SameSiteLaxMode
-			}
-
-			w.Header().Add("Set-Cookie", cookie.String())
+		session.IDToken = token.Extra("id_token").(string)
+	}
 
-			if ar.options.OAuth2CodeChallengeMethod == "PKCE" {
-				url = oauthConfig.AuthCodeURL(state, oauth2.AccessTypeOffline, oauth2.SetAuthURLParam("code_challenge", cookie.Value))
-			} else {
-				url = oauthConfig.AuthCodeURL(state, oauth2.AccessTypeOffline, oauth2.S256ChallengeOption(cookie.Value))
-			}
-		} else {
-			url = oauthConfig.AuthCodeURL(state, oauth2.AccessTypeOffline)
-		}
+	session.Claims = claims
+	session.AccessToken = token.AccessToken
+	session.RefreshToken = token.RefreshToken
+	session.TokenExpiry = token.Expiry
+	return ar.saveSession(key, session)
+}
 
-		http.Redirect(w, r, url, http.StatusFound)
+// Log out the user and redirect to the logout endpoint of the provider if supported
+func (ar *OAuth2Router) handleLogout(w http.ResponseWriter, r *http.Request, provider *OIDCProvider, config *ClientConfig, scheme string) error {
+	idTokenHint := ""
+	if key, session := ar.getSession(r); session != nil {
+		session.lock.Lock()
+		idTokenHint = session.IDToken
+		session.lock.Unlock()
+		ar.deleteSession(key)
+	}
+	setCookie(w, r, sessionCookie, "", time.Time{})
 
-		return errors.New("unauthorized")
+	postLogoutURL := scheme + "://" + r.Host + "/"
+	if config.EndSessionURL == "" {
+		http.Redirect(w, r, postLogoutURL, http.StatusFound)
+		return errors.New("logged out")
 	}
-	return nil
+	logoutURL, err := url.Parse(config.EndSessionURL)
+	if err != nil {
+		w.WriteHeader(500)
+		return err
+	}
+	query := logoutURL.Query()
+	query.Set("client_id", provider.ClientId)
+	query.Set("post_logout_redirect_uri", postLogoutURL)
+	if idTokenHint != "" {
+		query.Set("id_token_hint", idTokenHint)
+	}
+	logoutURL.RawQuery = query.Encode()
+	http.Redirect(w, r, logoutURL.String(), http.StatusFound)
+	return errors.New("logged out")
 }
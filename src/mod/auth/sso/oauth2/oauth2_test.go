@@ -0,0 +1,454 @@
+package oauth2
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"imuslab.com/zoraxy/mod/database"
+	"imuslab.com/zoraxy/mod/database/dbinc"
+	"imuslab.com/zoraxy/mod/info/logger"
+)
+
+// mockIdP is an OpenID provider issuing tokens for alice in the staff group
+type mockIdP struct {
+	server *httptest.Server
+	keyID  string
+
+	lock          sync.Mutex
+	nonces        map[string]string //Nonce of the authorization request by code
+	publishedKeys []jose.JSONWebKey
+	tokenNonce    string //Override the nonce in the next ID token if set
+	signingKey    *rsa.PrivateKey
+	accessExpiry  int
+	refreshFails  bool
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	idp := &mockIdP{nonces: map[string]string{}, accessExpiry: 3600}
+	idp.rotateKey(t, "key-1")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                 idp.server.URL,
+			"authorization_endpoint": idp.server.URL + "/authorize",
+			"token_endpoint":         idp.server.URL + "/token",
+			"userinfo_endpoint":      idp.server.URL + "/userinfo",
+			"jwks_uri":               idp.server.URL + "/jwks",
+			"end_session_endpoint":   idp.server.URL + "/logout",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		idp.lock.Lock()
+		defer idp.lock.Unlock()
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: idp.publishedKeys})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		idp.lock.Lock()
+		defer idp.lock.Unlock()
+		nonce := ""
+		switch r.Form.Get("grant_type") {
+		case "authorization_code":
+			var ok bool
+			nonce, ok = idp.nonces[r.Form.Get("code")]
+			if !ok {
+				http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+				return
+			}
+			delete(idp.nonces, r.Form.Get("code"))
+		case "refresh_token":
+			if idp.refreshFails || r.Form.Get("refresh_token") != "alice-refresh" {
+				http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+				return
+			}
+		}
+		if idp.tokenNonce != "" {
+			nonce = idp.tokenNonce
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token":  "alice-token",
+			"refresh_token": "alice-refresh",
+			"token_type":    "Bearer",
+			"expires_in":    idp.accessExpiry,
+			"id_token":      idp.signIDToken(t, nonce),
+		})
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer alice-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"sub":            "alice",
+			"email":          "alice@example.com",
+			"email_verified": true,
+			"realm_access":   map[string]interface{}{"roles": []string{"editor"}},
+		})
+	})
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+// Replace the signing key and publish it in the key set
+func (idp *mockIdP) rotateKey(t *testing.T, keyID string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp.lock.Lock()
+	defer idp.lock.Unlock()
+	idp.keyID = keyID
+	idp.signingKey = key
+	idp.publishedKeys = []jose.JSONWebKey{{Key: &key.PublicKey, KeyID: keyID, Algorithm: string(jose.RS256), Use: "sig"}}
+}
+
+// Sign an ID token, caller must hold the lock
+func (idp *mockIdP) signIDToken(t *testing.T, nonce string) string {
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: idp.signingKey},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", idp.keyID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	idToken, err := jwt.Signed(signer).Claims(jwt.Claims{
+		Issuer:   idp.server.URL,
+		Subject:  "alice",
+		Audience: jwt.Audience{"zoraxy"},
+		Expiry:   jwt.NewNumericDate(now.Add(time.Hour)),
+		IssuedAt: jwt.NewNumericDate(now),
+	}).Claims(map[string]interface{}{
+		"nonce":  nonce,
+		"groups": []string{"staff"},
+	}).Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return idToken
+}
+
+// Act as the browser at the provider, approve the login and return the callback URL
+func (idp *mockIdP) authorize(t *testing.T, location string) string {
+	authURL, err := url.Parse(location)
+	if err != nil || !strings.HasPrefix(location, idp.server.URL+"/authorize") {
+		t.Fatalf("expected redirect to provider, got %q", location)
+	}
+	query := authURL.Query()
+	code := "code-" + newRandomToken()
+	idp.lock.Lock()
+	idp.nonces[code] = query.Get("nonce")
+	idp.lock.Unlock()
+
+	redirectURL, _ := url.Parse(query.Get("redirect_uri"))
+	return redirectURL.Path + "?" + url.Values{"code": {code}, "state": {query.Get("state")}}.Encode()
+}
+
+func newTestRouter(t *testing.T, idp *mockIdP) (*OAuth2Router, string) {
+	db, err := database.NewDatabase(filepath.Join(t.TempDir(), "sys.db"), dbinc.BackendBoltDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+	fmtLogger, _ := logger.NewFmtLogger()
+	ar := NewOAuth2Router(&OAuth2RouterOptions{Database: db, Logger: fmtLogger})
+	providerID, err := ar.AddProvider(&OIDCProvider{
+		Name:         "Mock IdP",
+		WellKnownUrl: idp.server.URL + "/.well-known/openid-configuration",
+		ClientId:     "zoraxy",
+		ClientSecret: "secret",
+		Scopes:       "openid,email",
+		GroupsClaim:  "groups",
+		RolesClaim:   "realm_access.roles",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ar, providerID
+}
+
+func findCookie(w *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, c := range w.Result().Cookies() {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// Start a login at /page and return the callback request with the state cookie set
+func startLogin(t *testing.T, ar *OAuth2Router, idp *mockIdP, policy *EndpointPolicy) *http.Request {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/page", nil)
+	if err := ar.HandleOAuth2Auth(w, r, policy); err == nil {
+		t.Fatal("request without session accepted")
+	}
+	if w.Code != http.StatusFound {
+		t.Fatalf("expected redirect to provider, got %d", w.Code)
+	}
+	stateCookie := findCookie(w, stateCookie)
+	if stateCookie == nil {
+		t.Fatal("state cookie not set")
+	}
+	callback := httptest.NewRequest(http.MethodGet, idp.authorize(t, w.Header().Get("Location")), nil)
+	callback.AddCookie(stateCookie)
+	return callback
+}
+
+// Complete a login and return the session cookie
+func login(t *testing.T, ar *OAuth2Router, idp *mockIdP, policy *EndpointPolicy) *http.Cookie {
+	w := httptest.NewRecorder()
+	ar.HandleOAuth2Auth(w, startLogin(t, ar, idp, policy), policy)
+	sessionCookie := findCookie(w, sessionCookie)
+	if w.Code != http.StatusTemporaryRedirect || sessionCookie == nil {
+		t.Fatalf("login failed with status %d", w.Code)
+	}
+	if location := w.Header().Get("Location"); location != "http://example.com/page" {
+		t.Errorf("unexpected return URL %q", location)
+	}
+	return sessionCookie
+}
+
+func request(ar *OAuth2Router, sessionCookie *http.Cookie, path string, policy *EndpointPolicy) (*httptest.ResponseRecorder, *http.Request, error) {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	r.Header.Set("X-Auth-Request-Email", "spoofed@evil.com")
+	r.AddCookie(sessionCookie)
+	err := ar.HandleOAuth2Auth(w, r, policy)
+	return w, r, err
+}
+
+func TestOIDCProviderFlow(t *testing.T) {
+	idp := newMockIdP(t)
+	ar, providerID := newTestRouter(t, idp)
+	policy := &EndpointPolicy{
+		ProviderID:    providerID,
+		AllowedGroups: []string{"staff"},
+		AllowedRoles:  []string{"editor"},
+		ClaimHeaders:  map[string]string{"email": "X-Auth-Request-Email", "sub": "X-Auth-Request-User"},
+	}
+	sessionCookie := login(t, ar, idp, policy)
+	if !sessionCookie.HttpOnly || strings.Contains(sessionCookie.Value, "alice") {
+		t.Errorf("unexpected session cookie %+v", sessionCookie)
+	}
+
+	//Groups from the ID token and roles from user info are both checked
+	_, r, err := request(ar, sessionCookie, "/page", policy)
+	if err != nil {
+		t.Fatalf("allowed user rejected: %v", err)
+	}
+	if r.Header.Get("X-Auth-Request-Email") != "alice@example.com" || r.Header.Get("X-Auth-Request-User") != "alice" {
+		t.Errorf("unexpected claim headers: %v", r.Header)
+	}
+
+	denied := []*EndpointPolicy{
+		{ProviderID: providerID, AllowedGroups: []string{"admins"}},
+		{ProviderID: providerID, AllowedRoles: []string{"owner"}},
+		{ProviderID: providerID, AllowedEmailDomains: []string{"example.org"}},
+	}
+	for _, p := range denied {
+		w, _, err := request(ar, sessionCookie, "/page", p)
+		if err == nil || w.Code != http.StatusForbidden {
+			t.Errorf("policy %+v: expected 403, got %d", p, w.Code)
+		}
+	}
+	if _, _, err := request(ar, sessionCookie, "/page", &EndpointPolicy{ProviderID: providerID, AllowedEmailDomains: []string{"@Example.com"}}); err != nil {
+		t.Errorf("allowed email domain rejected: %v", err)
+	}
+
+	//Sessions survive a restart of the router
+	restarted := NewOAuth2Router(&OAuth2RouterOptions{Database: ar.options.Database, Logger: ar.options.Logger})
+	if _, _, err := request(restarted, sessionCookie, "/page", policy); err != nil {
+		t.Errorf("session lost after restart: %v", err)
+	}
+
+	//Endpoints referencing a removed provider deny all requests
+	ar.RemoveProvider(providerID)
+	w, _, err := request(ar, sessionCookie, "/page", policy)
+	if err == nil || w.Code != http.StatusInternalServerError {
+		t.Errorf("removed provider: expected 500, got %d", w.Code)
+	}
+}
+
+func TestCallbackRejectsForgedLogins(t *testing.T) {
+	idp := newMockIdP(t)
+	ar, providerID := newTestRouter(t, idp)
+	policy := &EndpointPolicy{ProviderID: providerID}
+
+	expectRejected := func(name string, callback *http.Request) {
+		w := httptest.NewRecorder()
+		ar.HandleOAuth2Auth(w, callback, policy)
+		if w.Code != http.StatusUnauthorized || findCookie(w, sessionCookie) != nil {
+			t.Errorf("%s: expected 401 without session, got %d", name, w.Code)
+		}
+	}
+
+	//State cookie from another login attempt
+	callback := startLogin(t, ar, idp, policy)
+	other := startLogin(t, ar, idp, policy)
+	forged := httptest.NewRequest(http.MethodGet, callback.URL.RequestURI(), nil)
+	otherCookie, _ := other.Cookie(stateCookie)
+	forged.AddCookie(otherCookie)
+	expectRejected("state mismatch", forged)
+
+	//Replay of a completed callback
+	w := httptest.NewRecorder()
+	ar.HandleOAuth2Auth(w, other, policy)
+	if w.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("valid login rejected with %d", w.Code)
+	}
+	replay := httptest.NewRequest(http.MethodGet, other.URL.RequestURI(), nil)
+	replay.AddCookie(otherCookie)
+	expectRejected("replayed state", replay)
+
+	//ID token issued for another authorization request
+	idp.lock.Lock()
+	idp.tokenNonce = "another-nonce"
+	idp.lock.Unlock()
+	expectRejected("nonce mismatch", startLogin(t, ar, idp, policy))
+	idp.lock.Lock()
+	idp.tokenNonce = ""
+	idp.lock.Unlock()
+
+	//ID token signed by a key not published by the provider
+	forgedKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	idp.lock.Lock()
+	idp.signingKey = forgedKey
+	idp.lock.Unlock()
+	expectRejected("bad signature", startLogin(t, ar, idp, policy))
+}
+
+func TestIDTokenKeyRotation(t *testing.T) {
+	idp := newMockIdP(t)
+	ar, providerID := newTestRouter(t, idp)
+	policy := &EndpointPolicy{ProviderID: providerID}
+	login(t, ar, idp, policy)
+
+	//The cached key set does not contain the new key and is fetched again
+	//once the minimum refetch interval has passed
+	idp.rotateKey(t, "key-2")
+	ar.keySets.lock.Lock()
+	for _, cached := range ar.keySets.sets {
+		cached.fetchedAt = cached.fetchedAt.Add(-jwksMinRefetchTime)
+	}
+	ar.keySets.lock.Unlock()
+	login(t, ar, idp, policy)
+}
+
+func TestIDTokenRequireKeySetAndIssuer(t *testing.T) {
+	idp := newMockIdP(t)
+	ar, _ := newTestRouter(t, idp)
+	provider := &OIDCProvider{ClientId: "zoraxy", ClientSecret: "secret"}
+	idp.lock.Lock()
+	idToken := idp.signIDToken(t, "nonce")
+	idp.lock.Unlock()
+
+	tests := []struct {
+		name   string
+		config *ClientConfig
+		valid  bool
+	}{
+		{"verified", &ClientConfig{Issuer: idp.server.URL, JwksURL: idp.server.URL + "/jwks"}, true},
+		{"no key set", &ClientConfig{Issuer: idp.server.URL}, false},
+		{"no issuer", &ClientConfig{JwksURL: idp.server.URL + "/jwks"}, false},
+	}
+	for _, tt := range tests {
+		_, err := ar.verifyIDToken(provider, tt.config, idToken, "nonce")
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: expected valid %v, got %v", tt.name, tt.valid, err)
+		}
+	}
+}
+
+func TestSessionRefresh(t *testing.T) {
+	idp := newMockIdP(t)
+	idp.accessExpiry = 20 //Within the refresh skew, refreshed on every request
+	ar, providerID := newTestRouter(t, idp)
+	policy := &EndpointPolicy{ProviderID: providerID, ClaimHeaders: map[string]string{"sub": "X-Auth-Request-User"}}
+	sessionCookie := login(t, ar, idp, policy)
+
+	_, r, err := request(ar, sessionCookie, "/page", policy)
+	if err != nil || r.Header.Get("X-Auth-Request-User") != "alice" {
+		t.Fatalf("refresh failed: %v", err)
+	}
+
+	//Refresh token revoked at the provider, the user must login again
+	idp.lock.Lock()
+	idp.refreshFails = true
+	idp.lock.Unlock()
+	w, _, err := request(ar, sessionCookie, "/page", policy)
+	if err == nil || w.Code != http.StatusFound || !strings.HasPrefix(w.Header().Get("Location"), idp.server.URL+"/authorize") {
+		t.Fatalf("expected login redirect after failed refresh, got %d", w.Code)
+	}
+	if _, session := ar.getSession(r); session != nil {
+		t.Error("session kept after failed refresh")
+	}
+}
+
+func TestSessionLifetimeAndLogout(t *testing.T) {
+	idp := newMockIdP(t)
+	ar, providerID := newTestRouter(t, idp)
+	provider, _ := ar.GetProvider(providerID)
+	provider.SessionLifetime = time.Hour
+	if err := ar.UpdateProvider(provider); err != nil {
+		t.Fatal(err)
+	}
+	policy := &EndpointPolicy{ProviderID: providerID}
+
+	//Session is ended after its lifetime even if the tokens are still valid
+	sessionCookie := login(t, ar, idp, policy)
+	_, r, _ := request(ar, sessionCookie, "/page", policy)
+	_, session := ar.getSession(r)
+	if session == nil || session.ExpiresAt.Sub(session.CreatedAt) != time.Hour {
+		t.Fatalf("session lifetime not applied: %+v", session)
+	}
+	session.ExpiresAt = time.Now().Add(-time.Second)
+	if w, _, err := request(ar, sessionCookie, "/page", policy); err == nil || w.Code != http.StatusFound {
+		t.Errorf("expired session accepted with %d", w.Code)
+	}
+
+	//Logout ends the session and redirect to the provider with the ID token as hint
+	sessionCookie = login(t, ar, idp, policy)
+	w, _, _ := request(ar, sessionCookie, "/internal/oauth2/logout", policy)
+	logoutURL, err := url.Parse(w.Header().Get("Location"))
+	if err != nil || w.Code != http.StatusFound || !strings.HasPrefix(logoutURL.String(), idp.server.URL+"/logout") {
+		t.Fatalf("expected redirect to provider logout, got %d %s", w.Code, logoutURL)
+	}
+	if logoutURL.Query().Get("id_token_hint") == "" || logoutURL.Query().Get("post_logout_redirect_uri") != "http://example.com/" {
+		t.Errorf("unexpected logout parameters: %s", logoutURL.RawQuery)
+	}
+	if cookie := findCookie(w, sessionCookie.Name); cookie == nil || cookie.MaxAge >= 0 {
+		t.Error("session cookie not cleared")
+	}
+	if w, _, err := request(ar, sessionCookie, "/page", policy); err == nil || w.Code != http.StatusFound {
+		t.Errorf("session still valid after logout, got %d", w.Code)
+	}
+}
+
+func TestProviderListMasksSecret(t *testing.T) {
+	idp := newMockIdP(t)
+	ar, providerID := newTestRouter(t, idp)
+	providers := ar.ListProviders()
+	if len(providers) != 2 || providers[0].ID != DefaultProviderID || providers[1].ID != providerID {
+		t.Fatalf("unexpected providers: %+v", providers)
+	}
+	if providers[1].ClientSecret != maskedClientSecret {
+		t.Error("client secret not masked")
+	}
+	if provider, _ := ar.GetProvider(providerID); provider.ClientSecret != "secret" {
+		t.Error("masking changed the stored provider")
+	}
+}
@@ -0,0 +1,335 @@
+package oauth2
+
+/*
+	providers.go
+
+	Named OIDC provider profiles. The legacy settings stored
+	under the fixed keys of the oauth2 table are exposed as the
+	default provider, additional providers are stored in their
+	own table and selected per proxy endpoint by ID
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"imuslab.com/zoraxy/mod/utils"
+)
+
+const (
+	DefaultProviderID  = "default"
+	providerTable      = "oauth2_providers"
+	defaultGroupsClaim = "groups"
+	defaultRolesClaim  = "roles"
+	maskedClientSecret = "********"
+)
+
+type OIDCProvider struct {
+	ID                     string
+	Name                   string
+	WellKnownUrl           string        //The well-known url for OAuth 2.0 server
+	ServerURL              string        //The URL of the OAuth 2.0 server server
+	TokenURL               string        //The URL of the OAuth 2.0 token server
+	UserInfoUrl            string        //The URL of the OAuth 2.0 user info endpoint
+	ClientId               string        //The client id for OAuth 2.0 Application
+	ClientSecret           string        //The client secret for OAuth 2.0 Application
+	Scopes                 string        //Comma seperated scopes for OAuth 2.0 Application
+	CodeChallengeMethod    string        //The authorization code challenge method
+	ConfigurationCacheTime time.Duration //Time to cache the discovered configuration, 0 for default
+	GroupsClaim            string        //Claim holding the groups of the user, default to "groups"
+	RolesClaim             string        //Claim holding the roles of the user, default to "roles"
+	Issuer                 string        //Expected issuer of ID tokens, required for ID tokens unless discovered
+	JwksURL                string        //URL of the key set signing ID tokens, required for ID tokens unless discovered
+	LogoutURL              string        //End session endpoint for RP-initiated logout, optional if discovery url is set
+	SessionLifetime        time.Duration //Maximum lifetime of a login session, 0 for default
+}
+
+// The provider built from the legacy global OAuth2 settings
+func (ar *OAuth2Router) defaultProvider() *OIDCProvider {
+	cacheTime := DefaultOAuth2ConfigCacheTime
+	if ar.options.OAuth2ConfigurationCacheTime != nil {
+		cacheTime = *ar.options.OAuth2ConfigurationCacheTime
+	}
+	sessionLifetime := DefaultSessionLifetime
+	if ar.options.OAuth2SessionLifetime != nil {
+		sessionLifetime = *ar.options.OAuth2SessionLifetime
+	}
+	return &OIDCProvider{
+		ID:                     DefaultProviderID,
+		Name:                   "Default",
+		WellKnownUrl:           ar.options.OAuth2WellKnownUrl,
+		ServerURL:              ar.options.OAuth2ServerURL,
+		TokenURL:               ar.options.OAuth2TokenURL,
+		UserInfoUrl:            ar.options.OAuth2UserInfoUrl,
+		ClientId:               ar.options.OAuth2ClientId,
+		ClientSecret:           ar.options.OAuth2ClientSecret,
+		Scopes:                 ar.options.OAuth2Scopes,
+		CodeChallengeMethod:    ar.options.OAuth2CodeChallengeMethod,
+		ConfigurationCacheTime: cacheTime,
+		GroupsClaim:            defaultGroupsClaim,
+		RolesClaim:             defaultRolesClaim,
+		SessionLifetime:        sessionLifetime,
+	}
+}
+
+// Lifetime of the login sessions of this provider
+func (p *OIDCProvider) sessionLifetime() time.Duration {
+	if p.SessionLifetime <= 0 {
+		return DefaultSessionLifetime
+	}
+	return p.SessionLifetime
+}
+
+// Load the additional providers from database
+func (ar *OAuth2Router) loadProviders() {
+	ar.options.Database.NewTable(providerTable)
+	entries, _ := ar.options.Database.ListTable(providerTable)
+	for _, keypairs := range entries {
+		provider := OIDCProvider{}
+		if err := json.Unmarshal(keypairs[1], &provider); err != nil {
+			continue
+		}
+		ar.providers[provider.ID] = &provider
+	}
+}
+
+// GetProvider return the provider with the given ID, empty ID for the default provider
+func (ar *OAuth2Router) GetProvider(providerID string) (*OIDCProvider, error) {
+	if providerID == "" || providerID == DefaultProviderID {
+		return ar.defaultProvider(), nil
+	}
+	ar.providerLock.RLock()
+	defer ar.providerLock.RUnlock()
+	provider, ok := ar.providers[providerID]
+	if !ok {
+		return nil, errors.New("OIDC provider not found")
+	}
+	return provider, nil
+}
+
+// ProviderExists check if a provider with the given ID exists
+func (ar *OAuth2Router) ProviderExists(providerID string) bool {
+	_, err := ar.GetProvider(providerID)
+	return err == nil
+}
+
+// ListProviders return all providers with client secrets masked, default provider first
+func (ar *OAuth2Router) ListProviders() []*OIDCProvider {
+	results := []*OIDCProvider{}
+	ar.providerLock.RLock()
+	for _, provider := range ar.providers {
+		masked := *provider
+		results = append(results, &masked)
+	}
+	ar.providerLock.RUnlock()
+	sort.Slice(results, func(i, j int) bool {
+		return strings.ToLower(results[i].Name) < strings.ToLower(results[j].Name)
+	})
+	results = append([]*OIDCProvider{ar.defaultProvider()}, results...)
+	for _, provider := range results {
+		if provider.ClientSecret != "" {
+			provider.ClientSecret = maskedClientSecret
+		}
+	}
+	return results
+}
+
+// Check the provider settings are usable
+func (p *OIDCProvider) validate() error {
+	if strings.TrimSpace(p.Name) == "" {
+		return errors.New("provider name cannot be empty")
+	}
+	if p.ClientId == "" || p.ClientSecret == "" {
+		return errors.New("client id and client secret are required")
+	}
+	if p.WellKnownUrl == "" && (p.ServerURL == "" || p.TokenURL == "" || p.UserInfoUrl == "") {
+		return errors.New("either the discovery url or the authorization, token and user info url are required")
+	}
+	switch p.CodeChallengeMethod {
+	case "", "plain", "PKCE", "PKCE_S256":
+	default:
+		return errors.New("invalid code challenge method")
+	}
+	return nil
+}
+
+// AddProvider add a new provider and return its ID
+func (ar *OAuth2Router) AddProvider(provider *OIDCProvider) (string, error) {
+	if err := provider.validate(); err != nil {
+		return "", err
+	}
+	provider.ID = uuid.New().String()
+	ar.providerLock.Lock()
+	defer ar.providerLock.Unlock()
+	if err := ar.options.Database.Write(providerTable, provider.ID, provider); err != nil {
+		return "", err
+	}
+	ar.providers[provider.ID] = provider
+	return provider.ID, nil
+}
+
+// UpdateProvider replace the settings of an existing provider
+func (ar *OAuth2Router) UpdateProvider(provider *OIDCProvider) error {
+	if err := provider.validate(); err != nil {
+		return err
+	}
+	ar.providerLock.Lock()
+	defer ar.providerLock.Unlock()
+	if _, ok := ar.providers[provider.ID]; !ok {
+		return errors.New("OIDC provider not found")
+	}
+	if err := ar.options.Database.Write(providerTable, provider.ID, provider); err != nil {
+		return err
+	}
+	ar.providers[provider.ID] = provider
+	ar.flushProviderCache(provider.ID)
+	return nil
+}
+
+// RemoveProvider remove a provider. Endpoints still using it will deny all requests
+func (ar *OAuth2Router) RemoveProvider(providerID string) error {
+	if providerID == DefaultProviderID {
+		return errors.New("the default provider cannot be removed")
+	}
+	ar.providerLock.Lock()
+	defer ar.providerLock.Unlock()
+	if _, ok := ar.providers[providerID]; !ok {
+		return errors.New("OIDC provider not found")
+	}
+	if err := ar.options.Database.Delete(providerTable, providerID); err != nil {
+		return err
+	}
+	delete(ar.providers, providerID)
+	ar.flushProviderCache(providerID)
+	ar.RemoveProviderSessions(providerID)
+	return nil
+}
+
+// Remove the cached client configurations of a provider
+func (ar *OAuth2Router) flushProviderCache(providerID string) {
+	for _, key := range ar.options.OAuth2ConfigCache.Keys() {
+		if strings.HasPrefix(key, providerID+"|") {
+			ar.options.OAuth2ConfigCache.Delete(key)
+		}
+	}
+}
+
+/* Handlers */
+
+// Read the provider settings from request, empty client secret keep the existing one
+func providerFromRequest(r *http.Request, existing *OIDCProvider) (*OIDCProvider, error) {
+	provider := &OIDCProvider{}
+	if existing != nil {
+		*provider = *existing
+	}
+	name, _ := utils.PostPara(r, "name")
+	provider.Name = strings.TrimSpace(name)
+	provider.WellKnownUrl, _ = utils.PostPara(r, "wellKnownUrl")
+	provider.ServerURL, _ = utils.PostPara(r, "serverUrl")
+	provider.TokenURL, _ = utils.PostPara(r, "tokenUrl")
+	provider.UserInfoUrl, _ = utils.PostPara(r, "userInfoUrl")
+	provider.ClientId, _ = utils.PostPara(r, "clientId")
+	provider.Scopes, _ = utils.PostPara(r, "scopes")
+	provider.CodeChallengeMethod, _ = utils.PostPara(r, "codeChallengeMethod")
+	provider.GroupsClaim, _ = utils.PostPara(r, "groupsClaim")
+	provider.RolesClaim, _ = utils.PostPara(r, "rolesClaim")
+	provider.Issuer, _ = utils.PostPara(r, "issuer")
+	provider.JwksURL, _ = utils.PostPara(r, "jwksUrl")
+	provider.LogoutURL, _ = utils.PostPara(r, "logoutUrl")
+	if clientSecret, err := utils.PostPara(r, "clientSecret"); err == nil && clientSecret != maskedClientSecret {
+		provider.ClientSecret = clientSecret
+	}
+
+	provider.ConfigurationCacheTime = 0
+	if cacheTime, err := utils.PostDuration(r, "configurationCacheTime"); err == nil {
+		provider.ConfigurationCacheTime = *cacheTime
+	} else if r.Form.Get("configurationCacheTime") != "" {
+		return nil, err
+	}
+	provider.SessionLifetime = 0
+	if sessionLifetime, err := utils.PostDuration(r, "sessionLifetime"); err == nil {
+		provider.SessionLifetime = *sessionLifetime
+	} else if r.Form.Get("sessionLifetime") != "" {
+		return nil, err
+	}
+	if provider.GroupsClaim == "" {
+		provider.GroupsClaim = defaultGroupsClaim
+	}
+	if provider.RolesClaim == "" {
+		provider.RolesClaim = defaultRolesClaim
+	}
+	return provider, nil
+}
+
+// HandleListProviders list all OIDC providers, client secrets are masked
+func (ar *OAuth2Router) HandleListProviders(w http.ResponseWriter, r *http.Request) {
+	js, _ := json.Marshal(ar.ListProviders())
+	utils.SendJSONResponse(w, string(js))
+}
+
+// HandleAddProvider add a new OIDC provider and return its ID
+func (ar *OAuth2Router) HandleAddProvider(w http.ResponseWriter, r *http.Request) {
+	provider, err := providerFromRequest(r, nil)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	providerID, err := ar.AddProvider(provider)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	ar.options.Logger.PrintAndLog("OAuth2Router", "OIDC provider "+provider.Name+" added", nil)
+	js, _ := json.Marshal(providerID)
+	utils.SendJSONResponse(w, string(js))
+}
+
+// HandleEditProvider update an OIDC provider, require POST id
+func (ar *OAuth2Router) HandleEditProvider(w http.ResponseWriter, r *http.Request) {
+	providerID, err := utils.PostPara(r, "id")
+	if err != nil {
+		utils.SendErrorResponse(w, "invalid provider id given")
+		return
+	}
+	if providerID == DefaultProviderID {
+		utils.SendErrorResponse(w, "the default provider is edited in the OAuth 2.0 settings")
+		return
+	}
+	ar.providerLock.RLock()
+	existing, ok := ar.providers[providerID]
+	ar.providerLock.RUnlock()
+	if !ok {
+		utils.SendErrorResponse(w, "OIDC provider not found")
+		return
+	}
+	provider, err := providerFromRequest(r, existing)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	if err := ar.UpdateProvider(provider); err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	utils.SendOK(w)
+}
+
+// HandleRemoveProvider remove an OIDC provider, require POST id
+func (ar *OAuth2Router) HandleRemoveProvider(w http.ResponseWriter, r *http.Request) {
+	providerID, err := utils.PostPara(r, "id")
+	if err != nil {
+		utils.SendErrorResponse(w, "invalid provider id given")
+		return
+	}
+	if err := ar.RemoveProvider(providerID); err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	ar.options.Logger.PrintAndLog("OAuth2Router", "OIDC provider "+providerID+" removed", nil)
+	utils.SendOK(w)
+}
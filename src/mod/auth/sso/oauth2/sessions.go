@@ -0,0 +1,177 @@
+package oauth2
+
+/*
+	sessions.go
+
+	Server-side login sessions of OAuth2 / OIDC endpoints.
+	The browser only holds a random session ID, tokens and
+	claims are kept in memory and persisted to database by
+	the hash of the session ID
+*/
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultSessionLifetime = 12 * time.Hour
+
+	sessionCookie          = "z-session"
+	stateCookie            = "z-state"
+	sessionTable           = "oauth2_sessions"
+	pendingLoginTimeout    = 10 * time.Minute //Time for the user to complete login at the provider
+	maxPendingLogins       = 10000            //Oldest pending logins are dropped over this count
+	tokenRefreshSkew       = 30 * time.Second //Refresh access tokens this long before they expire
+	sessionCleanupInterval = 10 * time.Minute
+)
+
+// Session is a logged in user of an OAuth2 endpoint
+type Session struct {
+	ProviderID   string
+	Host         string //Hostname the session is created for
+	Subject      string
+	Claims       Claims //Verified ID token claims merged with user info
+	AccessToken  string
+	RefreshToken string
+	IDToken      string    //Raw ID token, sent as hint on logout
+	TokenExpiry  time.Time //Expire time of the access token, zero if unknown
+	CreatedAt    time.Time
+	ExpiresAt    time.Time //Session is ended at this time regardless of refresh
+
+	lock sync.Mutex //Serialize token refresh of this session
+}
+
+// pendingLogin is an authorization request waiting for the provider to redirect back
+type pendingLogin struct {
+	ProviderID string
+	Host       string
+	Nonce      string
+	Verifier   string //PKCE code verifier, empty if PKCE is not used
+	ReturnURL  string
+}
+
+// Generate a random URL safe token
+func newRandomToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Sessions are stored by the hash of their ID, so the database does not hold usable cookies
+func sessionKey(sessionID string) string {
+	hash := sha256.Sum256([]byte(sessionID))
+	return hex.EncodeToString(hash[:])
+}
+
+func setCookie(w http.ResponseWriter, r *http.Request, name string, value string, expires time.Time) {
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Secure:   r.TLS != nil,
+	}
+	if value == "" {
+		cookie.MaxAge = -1
+	}
+	http.SetCookie(w, cookie)
+}
+
+// Load the sessions from database, expired sessions are removed
+func (ar *OAuth2Router) loadSessions() {
+	ar.options.Database.NewTable(sessionTable)
+	entries, _ := ar.options.Database.ListTable(sessionTable)
+	now := time.Now()
+	for _, keypairs := range entries {
+		key := string(keypairs[0])
+		session := &Session{}
+		if err := json.Unmarshal(keypairs[1], session); err != nil || now.After(session.ExpiresAt) {
+			ar.options.Database.Delete(sessionTable, key)
+			continue
+		}
+		ar.sessions[key] = session
+	}
+}
+
+// Store a new session and return its ID
+func (ar *OAuth2Router) createSession(session *Session) (string, error) {
+	sessionID := newRandomToken()
+	key := sessionKey(sessionID)
+	if err := ar.options.Database.Write(sessionTable, key, session); err != nil {
+		return "", err
+	}
+	ar.sessionLock.Lock()
+	ar.sessions[key] = session
+	ar.sessionLock.Unlock()
+	return sessionID, nil
+}
+
+// Get the session of the request, nil if not logged in or the session expired
+func (ar *OAuth2Router) getSession(r *http.Request) (string, *Session) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil || cookie.Value == "" {
+		return "", nil
+	}
+	key := sessionKey(cookie.Value)
+	ar.sessionLock.RLock()
+	session, ok := ar.sessions[key]
+	ar.sessionLock.RUnlock()
+	if !ok {
+		return "", nil
+	}
+	if time.Now().After(session.ExpiresAt) {
+		ar.deleteSession(key)
+		return "", nil
+	}
+	return key, session
+}
+
+// Persist the changes of a session, caller must hold the session lock
+func (ar *OAuth2Router) saveSession(key string, session *Session) error {
+	return ar.options.Database.Write(sessionTable, key, session)
+}
+
+func (ar *OAuth2Router) deleteSession(key string) {
+	ar.sessionLock.Lock()
+	delete(ar.sessions, key)
+	ar.sessionLock.Unlock()
+	ar.options.Database.Delete(sessionTable, key)
+}
+
+// RemoveProviderSessions log out all users of a provider
+func (ar *OAuth2Router) RemoveProviderSessions(providerID string) {
+	ar.sessionLock.Lock()
+	defer ar.sessionLock.Unlock()
+	for key, session := range ar.sessions {
+		if session.ProviderID == providerID {
+			delete(ar.sessions, key)
+			ar.options.Database.Delete(sessionTable, key)
+		}
+	}
+}
+
+// Remove expired sessions periodically
+func (ar *OAuth2Router) sessionCleanupLoop() {
+	ticker := time.NewTicker(sessionCleanupInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		now := time.Now()
+		ar.sessionLock.Lock()
+		for key, session := range ar.sessions {
+			if now.After(session.ExpiresAt) {
+				delete(ar.sessions, key)
+				ar.options.Database.Delete(sessionTable, key)
+			}
+		}
+		ar.sessionLock.Unlock()
+	}
+}
@@ -0,0 +1,85 @@
+package portal
+
+/*
+	handler.go
+
+	Admin API handlers of the SSO portal
+*/
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"imuslab.com/zoraxy/mod/utils"
+)
+
+// HandleSettings get or update the portal settings
+func (p *Portal) HandleSettings(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		js, _ := json.Marshal(p.GetSettings())
+		utils.SendJSONResponse(w, string(js))
+	case http.MethodPost:
+		settings := p.GetSettings()
+		enabled, err := utils.PostBool(r, "enabled")
+		if err != nil {
+			utils.SendErrorResponse(w, "enabled not defined")
+			return
+		}
+		settings.Enabled = enabled
+		settings.PortalDomain = r.Form.Get("portalDomain")
+		settings.CookieDomain = r.Form.Get("cookieDomain")
+		if r.Form.Get("sessionLifetime") != "" {
+			sessionLifetime, err := utils.PostDuration(r, "sessionLifetime")
+			if err != nil {
+				utils.SendErrorResponse(w, "invalid session lifetime given")
+				return
+			}
+			settings.SessionLifetime = *sessionLifetime
+		}
+		if err := p.UpdateSettings(settings); err != nil {
+			utils.SendErrorResponse(w, err.Error())
+			return
+		}
+		p.options.Logger.PrintAndLog(LogTitle, "SSO portal settings updated", nil)
+		utils.SendOK(w)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// PortalUser is a portal user with its second factor and session state
+type PortalUser struct {
+	Username    string
+	TOTPEnabled bool
+	Sessions    int //Number of active sessions
+}
+
+// HandleListUsers list the users that can login to the portal
+func (p *Portal) HandleListUsers(w http.ResponseWriter, r *http.Request) {
+	usernames := p.options.AuthAgent.ListUsers()
+	sort.Strings(usernames)
+	results := []*PortalUser{}
+	for _, username := range usernames {
+		results = append(results, &PortalUser{
+			Username:    username,
+			TOTPEnabled: p.options.AuthAgent.GetTwoFactorStatus(username).TOTPEnabled,
+			Sessions:    p.userSessionCount(username),
+		})
+	}
+	js, _ := json.Marshal(results)
+	utils.SendJSONResponse(w, string(js))
+}
+
+// HandleLogoutUser end all sessions of a user, require POST username
+func (p *Portal) HandleLogoutUser(w http.ResponseWriter, r *http.Request) {
+	username, err := utils.PostPara(r, "username")
+	if err != nil {
+		utils.SendErrorResponse(w, "username not defined")
+		return
+	}
+	p.RemoveUserSessions(username)
+	p.options.Logger.PrintAndLog(LogTitle, "All sessions of "+username+" ended", nil)
+	utils.SendOK(w)
+}
@@ -0,0 +1,361 @@
+package portal
+
+/*
+	SSO Portal
+
+	Built-in forward auth provider of Zoraxy. Users login with
+	their Zoraxy account on the portal domain and the session
+	cookie is shared with every endpoint under the cookie domain,
+	so small sites do not need to host an external SSO server
+*/
+
+import (
+	_ "embed"
+	"errors"
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jellydator/ttlcache/v3"
+	"imuslab.com/zoraxy/mod/auth"
+	"imuslab.com/zoraxy/mod/database"
+	"imuslab.com/zoraxy/mod/info/logger"
+	"imuslab.com/zoraxy/mod/netutils"
+)
+
+const (
+	LogTitle      = "SSO Portal"
+	DatabaseTable = "sso_portal"
+
+	DefaultSessionLifetime = 12 * time.Hour
+
+	settingsKey       = "settings"
+	maxFailedLogins   = 10               //Failed logins from an IP before it is blocked
+	failedLoginWindow = 10 * time.Minute //Time a failed login is counted for
+)
+
+var (
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrForbidden    = errors.New("forbidden")
+)
+
+//go:embed templates/login.html
+var loginPageTemplate string
+
+type Settings struct {
+	Enabled         bool
+	PortalDomain    string        //Hostname serving the login portal, e.g. auth.example.com
+	CookieDomain    string        //Parent domain sharing the session cookie, e.g. example.com
+	SessionLifetime time.Duration //Time before the user must login again
+}
+
+type PortalOptions struct {
+	AuthAgent *auth.AuthAgent //Source of the portal users
+	Database  *database.Database
+	Logger    *logger.Logger
+}
+
+type Portal struct {
+	options       *PortalOptions
+	settings      Settings
+	settingsLock  sync.RWMutex
+	sessions      map[string]*Session //Login sessions by hash of session ID
+	sessionLock   sync.RWMutex
+	failedLogins  *ttlcache.Cache[string, int] //Failed login count by IP
+	loginTemplate *template.Template
+}
+
+// NewPortal create the SSO portal and load its settings and sessions from database
+func NewPortal(options *PortalOptions) (*Portal, error) {
+	if options.AuthAgent == nil || options.Database == nil {
+		return nil, errors.New("auth agent and database are required")
+	}
+	loginTemplate, err := template.New("login").Parse(loginPageTemplate)
+	if err != nil {
+		return nil, err
+	}
+	options.Database.NewTable(DatabaseTable)
+
+	p := &Portal{
+		options:  options,
+		sessions: map[string]*Session{},
+		failedLogins: ttlcache.New[string, int](
+			ttlcache.WithTTL[string, int](failedLoginWindow),
+			ttlcache.WithDisableTouchOnHit[string, int](),
+		),
+		loginTemplate: loginTemplate,
+	}
+	options.Database.Read(DatabaseTable, settingsKey, &p.settings)
+	p.loadSessions()
+	go p.failedLogins.Start()
+	go p.sessionCleanupLoop()
+	return p, nil
+}
+
+// GetSettings return a copy of the current settings
+func (p *Portal) GetSettings() Settings {
+	p.settingsLock.RLock()
+	defer p.settingsLock.RUnlock()
+	settings := p.settings
+	if settings.SessionLifetime <= 0 {
+		settings.SessionLifetime = DefaultSessionLifetime
+	}
+	return settings
+}
+
+// UpdateSettings validate and save the settings
+func (p *Portal) UpdateSettings(settings Settings) error {
+	settings.PortalDomain = normalizeDomain(settings.PortalDomain)
+	settings.CookieDomain = normalizeDomain(settings.CookieDomain)
+	if settings.SessionLifetime < 0 {
+		return errors.New("session lifetime cannot be negative")
+	}
+	if settings.Enabled {
+		if settings.PortalDomain == "" || settings.CookieDomain == "" {
+			return errors.New("portal domain and cookie domain are required")
+		}
+		if !withinDomain(settings.PortalDomain, settings.CookieDomain) {
+			return errors.New("portal domain must be the cookie domain or one of its subdomains")
+		}
+	}
+	if err := p.options.Database.Write(DatabaseTable, settingsKey, settings); err != nil {
+		return err
+	}
+	p.settingsLock.Lock()
+	p.settings = settings
+	p.settingsLock.Unlock()
+	return nil
+}
+
+// IsPortalRequest check if the request is sent to the portal domain
+func (p *Portal) IsPortalRequest(r *http.Request) bool {
+	settings := p.GetSettings()
+	return settings.Enabled && settings.PortalDomain != "" && strings.EqualFold(hostname(r.Host), settings.PortalDomain)
+}
+
+// ServeHTTP serve the login portal on the portal domain
+func (p *Portal) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/", "/login":
+		if r.Method == http.MethodPost {
+			p.handleLogin(w, r)
+			return
+		}
+		p.handleLoginPage(w, r)
+	case "/logout":
+		p.handleLogout(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// HandleAuth authenticate a request to an endpoint protected by the portal.
+// allowedUsers limit the users that can access the endpoint, empty to allow all users
+// do not write to http.ResponseWriter if err return is not nil (already handled by this function)
+func (p *Portal) HandleAuth(w http.ResponseWriter, r *http.Request, allowedUsers []string) error {
+	settings := p.GetSettings()
+	if !settings.Enabled || settings.PortalDomain == "" {
+		p.options.Logger.PrintAndLog(LogTitle, "SSO portal is not enabled, request to "+r.Host+" denied", nil)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("500 - SSO portal is not enabled"))
+		return ErrUnauthorized
+	}
+	if !withinDomain(hostname(r.Host), settings.CookieDomain) {
+		//The session cookie is never sent to this host, login would loop forever
+		p.options.Logger.PrintAndLog(LogTitle, r.Host+" is not under the cookie domain "+settings.CookieDomain, nil)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("500 - Host is not under the SSO cookie domain"))
+		return ErrUnauthorized
+	}
+
+	key, session := p.getSession(r)
+	if session != nil && !p.options.AuthAgent.UserExists(session.Username) {
+		//User removed after login
+		p.deleteSession(key)
+		session = nil
+	}
+	if session == nil {
+		returnURL := scheme(r) + "://" + r.Host + r.RequestURI
+		http.Redirect(w, r, p.portalURL(r, settings)+"/?rd="+url.QueryEscape(returnURL), http.StatusFound)
+		return ErrUnauthorized
+	}
+
+	if len(allowedUsers) > 0 && !slices.Contains(allowedUsers, session.Username) {
+		p.options.Logger.PrintAndLog(LogTitle, session.Username+" is not allowed to access "+r.Host, nil)
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("403 - Forbidden"))
+		return ErrForbidden
+	}
+
+	//Do not leak the session to the upstream
+	removeCookie(r, sessionCookie)
+	r.Header.Set("X-Remote-User", session.Username)
+	return nil
+}
+
+type loginPage struct {
+	Username string //Logged in user, empty if not logged in
+	Error    string
+	Redirect string
+}
+
+func (p *Portal) renderLoginPage(w http.ResponseWriter, statusCode int, page loginPage) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.WriteHeader(statusCode)
+	p.loginTemplate.Execute(w, page)
+}
+
+func (p *Portal) handleLoginPage(w http.ResponseWriter, r *http.Request) {
+	settings := p.GetSettings()
+	returnURL := r.URL.Query().Get("rd")
+	if _, session := p.getSession(r); session != nil {
+		if returnURL != "" {
+			http.Redirect(w, r, p.safeRedirect(returnURL, settings), http.StatusFound)
+			return
+		}
+		p.renderLoginPage(w, http.StatusOK, loginPage{Username: session.Username})
+		return
+	}
+	p.renderLoginPage(w, http.StatusOK, loginPage{Redirect: returnURL})
+}
+
+func (p *Portal) handleLogin(w http.ResponseWriter, r *http.Request) {
+	settings := p.GetSettings()
+	r.ParseForm()
+	returnURL := r.PostForm.Get("rd")
+	page := loginPage{Redirect: returnURL}
+
+	//Reject logins posted from other sites
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if originURL, err := url.Parse(origin); err != nil || !strings.EqualFold(originURL.Host, r.Host) {
+			page.Error = "Invalid login request"
+			p.renderLoginPage(w, http.StatusForbidden, page)
+			return
+		}
+	}
+
+	clientIP := netutils.GetRequesterIPUntrusted(r)
+	if item := p.failedLogins.Get(clientIP); item != nil && item.Value() >= maxFailedLogins {
+		page.Error = "Too many failed login attempts, please try again later"
+		p.renderLoginPage(w, http.StatusTooManyRequests, page)
+		return
+	}
+
+	username := strings.TrimSpace(r.PostForm.Get("username"))
+	password := r.PostForm.Get("password")
+	code := strings.TrimSpace(r.PostForm.Get("code"))
+	loginSucceed := username != "" && p.options.AuthAgent.ValidateUsernameAndPassword(username, password)
+	if loginSucceed && p.options.AuthAgent.TwoFactorRequired(username) {
+		//Same second factor as the management UI, passkeys are not supported by the portal
+		loginSucceed = p.options.AuthAgent.VerifyTwoFactorCode(username, code)
+	}
+	if !loginSucceed {
+		failedCount := 1
+		if item := p.failedLogins.Get(clientIP); item != nil {
+			failedCount = item.Value() + 1
+		}
+		p.failedLogins.Set(clientIP, failedCount, ttlcache.DefaultTTL)
+		p.options.Logger.PrintAndLog(LogTitle, "Login of "+username+" from "+clientIP+" rejected", nil)
+		page.Error = "Invalid username, password or verification code"
+		p.renderLoginPage(w, http.StatusUnauthorized, page)
+		return
+	}
+
+	now := time.Now()
+	session := &Session{
+		Username:  username,
+		CreatedAt: now,
+		ExpiresAt: now.Add(settings.SessionLifetime),
+	}
+	sessionID, err := p.createSession(session)
+	if err != nil {
+		p.options.Logger.PrintAndLog(LogTitle, "Unable to create session", err)
+		page.Error = "Internal server error"
+		p.renderLoginPage(w, http.StatusInternalServerError, page)
+		return
+	}
+	p.failedLogins.Delete(clientIP)
+	p.setSessionCookie(w, r, settings, sessionID, session.ExpiresAt)
+	p.options.Logger.PrintAndLog(LogTitle, username+" logged in from "+clientIP, nil)
+	http.Redirect(w, r, p.safeRedirect(returnURL, settings), http.StatusSeeOther)
+}
+
+func (p *Portal) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if key, session := p.getSession(r); session != nil {
+		p.deleteSession(key)
+		p.options.Logger.PrintAndLog(LogTitle, session.Username+" logged out", nil)
+	}
+	p.setSessionCookie(w, r, p.GetSettings(), "", time.Time{})
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// URL of the portal, on the same port as the request
+func (p *Portal) portalURL(r *http.Request, settings Settings) string {
+	portalHost := settings.PortalDomain
+	if _, port, err := net.SplitHostPort(r.Host); err == nil {
+		portalHost = net.JoinHostPort(portalHost, port)
+	}
+	return scheme(r) + "://" + portalHost
+}
+
+// Only redirect back to hosts sharing the session cookie, so the portal cannot be used as an open redirect
+func (p *Portal) safeRedirect(returnURL string, settings Settings) string {
+	target, err := url.Parse(returnURL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || !withinDomain(target.Hostname(), settings.CookieDomain) {
+		return "/"
+	}
+	return target.String()
+}
+
+func scheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// Get the hostname of a host with optional port
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+func normalizeDomain(domain string) string {
+	return strings.TrimPrefix(strings.ToLower(strings.TrimSpace(domain)), ".")
+}
+
+// Check if host is the domain or one of its subdomains
+func withinDomain(host string, domain string) bool {
+	if domain == "" {
+		return false
+	}
+	host = strings.ToLower(host)
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// Remove a cookie from the request header
+func removeCookie(r *http.Request, name string) {
+	cookies := r.Cookies()
+	kept := []string{}
+	for _, cookie := range cookies {
+		if cookie.Name != name {
+			kept = append(kept, cookie.String())
+		}
+	}
+	if len(kept) == len(cookies) {
+		return
+	}
+	if len(kept) == 0 {
+		r.Header.Del("Cookie")
+		return
+	}
+	r.Header.Set("Cookie", strings.Join(kept, "; "))
+}
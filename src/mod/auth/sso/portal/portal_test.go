@@ -0,0 +1,210 @@
+package portal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp/totp"
+	"imuslab.com/zoraxy/mod/auth"
+	"imuslab.com/zoraxy/mod/database"
+	"imuslab.com/zoraxy/mod/database/dbinc"
+	"imuslab.com/zoraxy/mod/info/logger"
+)
+
+func newTestPortal(t *testing.T) *Portal {
+	db, err := database.NewDatabase(filepath.Join(t.TempDir(), "sys.db"), dbinc.BackendBoltDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+	fmtLogger, _ := logger.NewFmtLogger()
+	authAgent := auth.NewAuthenticationAgent("zoraxy", []byte("test-session-key"), db, false, fmtLogger, nil)
+	for _, username := range []string{"alice", "bob"} {
+		if err := authAgent.CreateUserAccount(username, username+"-password", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p, err := NewPortal(&PortalOptions{AuthAgent: authAgent, Database: db, Logger: fmtLogger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.UpdateSettings(Settings{
+		Enabled:      true,
+		PortalDomain: "auth.example.com",
+		CookieDomain: ".Example.com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func postLogin(p *Portal, form url.Values) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+	r.Host = "auth.example.com"
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.RemoteAddr = "192.0.2.1:1234"
+	p.ServeHTTP(w, r)
+	return w
+}
+
+func findSessionCookie(w *httptest.ResponseRecorder) *http.Cookie {
+	for _, c := range w.Result().Cookies() {
+		if c.Name == sessionCookie && c.Value != "" {
+			return c
+		}
+	}
+	return nil
+}
+
+func TestPortalLoginFlow(t *testing.T) {
+	p := newTestPortal(t)
+
+	//Not logged in, redirect to the portal with the original URL
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/dashboard?tab=1", nil)
+	r.Host = "app.example.com:8443"
+	if err := p.HandleAuth(w, r, nil); err == nil {
+		t.Fatal("request without session accepted")
+	}
+	location, _ := url.Parse(w.Header().Get("Location"))
+	if w.Code != http.StatusFound || location.Host != "auth.example.com:8443" || location.Query().Get("rd") != "http://app.example.com:8443/dashboard?tab=1" {
+		t.Fatalf("unexpected redirect %d %s", w.Code, location)
+	}
+
+	//Wrong password
+	w = postLogin(p, url.Values{"username": {"alice"}, "password": {"wrong"}, "rd": {location.Query().Get("rd")}})
+	if w.Code != http.StatusUnauthorized || findSessionCookie(w) != nil {
+		t.Fatalf("wrong password accepted with %d", w.Code)
+	}
+
+	//Login set the cookie on the parent domain and return to the endpoint
+	w = postLogin(p, url.Values{"username": {"alice"}, "password": {"alice-password"}, "rd": {location.Query().Get("rd")}})
+	cookie := findSessionCookie(w)
+	if w.Code != http.StatusSeeOther || cookie == nil {
+		t.Fatalf("login failed with %d", w.Code)
+	}
+	if cookie.Domain != "example.com" || !cookie.HttpOnly {
+		t.Errorf("unexpected session cookie %+v", cookie)
+	}
+	if w.Header().Get("Location") != "http://app.example.com:8443/dashboard?tab=1" {
+		t.Errorf("unexpected return URL %s", w.Header().Get("Location"))
+	}
+
+	request := func(host string, allowedUsers []string) (*httptest.ResponseRecorder, *http.Request, error) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Host = host
+		r.Header.Set("X-Remote-User", "admin")
+		r.AddCookie(&http.Cookie{Name: "app", Value: "1"})
+		r.AddCookie(cookie)
+		err := p.HandleAuth(w, r, allowedUsers)
+		return w, r, err
+	}
+
+	//The session is shared by every host under the cookie domain
+	_, r, err := request("other.example.com", nil)
+	if err != nil {
+		t.Fatalf("logged in user rejected: %v", err)
+	}
+	if r.Header.Get("X-Remote-User") != "alice" {
+		t.Errorf("unexpected remote user %q", r.Header.Get("X-Remote-User"))
+	}
+	if _, err := r.Cookie(sessionCookie); err == nil {
+		t.Error("session cookie forwarded to upstream")
+	}
+	if _, err := r.Cookie("app"); err != nil {
+		t.Error("other cookies removed")
+	}
+
+	//Per-endpoint allowed users
+	if _, _, err := request("app.example.com", []string{"alice"}); err != nil {
+		t.Errorf("allowed user rejected: %v", err)
+	}
+	if w, _, err := request("app.example.com", []string{"bob"}); err == nil || w.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for user not in allowed list, got %d", w.Code)
+	}
+
+	//Hosts outside the cookie domain never receive the cookie
+	if w, _, err := request("example.org", nil); err == nil || w.Code != http.StatusInternalServerError {
+		t.Errorf("expected 500 for host outside cookie domain, got %d", w.Code)
+	}
+
+	//Logout end the session on all hosts
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/logout", nil)
+	r.Host = "auth.example.com"
+	r.AddCookie(cookie)
+	p.ServeHTTP(w, r)
+	if w, _, err := request("app.example.com", nil); err == nil || w.Code != http.StatusFound {
+		t.Errorf("session valid after logout, got %d", w.Code)
+	}
+}
+
+func TestPortalRejectsOpenRedirect(t *testing.T) {
+	p := newTestPortal(t)
+	for _, rd := range []string{"https://evil.com/", "https://example.com.evil.com/", "javascript:alert(1)", "//evil.com"} {
+		w := postLogin(p, url.Values{"username": {"bob"}, "password": {"bob-password"}, "rd": {rd}})
+		if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/" {
+			t.Errorf("rd %q: redirected to %q", rd, w.Header().Get("Location"))
+		}
+	}
+}
+
+func TestPortalTOTP(t *testing.T) {
+	p := newTestPortal(t)
+
+	//Portal use the TOTP secret enrolled on the management account
+	enrollment, err := auth.NewTOTPEnrollment("Zoraxy", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.options.Database.Write("auth", "totp/alice", enrollment.Secret); err != nil {
+		t.Fatal(err)
+	}
+	if !p.options.AuthAgent.TwoFactorRequired("alice") {
+		t.Fatal("TOTP not enabled on the auth agent")
+	}
+
+	if w := postLogin(p, url.Values{"username": {"alice"}, "password": {"alice-password"}}); w.Code != http.StatusUnauthorized {
+		t.Errorf("login without code accepted with %d", w.Code)
+	}
+	code, _ := totp.GenerateCode(enrollment.Secret, time.Now())
+	if w := postLogin(p, url.Values{"username": {"alice"}, "password": {"alice-password"}, "code": {code}}); findSessionCookie(w) == nil {
+		t.Errorf("login with valid code rejected with %d", w.Code)
+	}
+	if w := postLogin(p, url.Values{"username": {"alice"}, "password": {"alice-password"}, "code": {code}}); w.Code != http.StatusUnauthorized {
+		t.Errorf("reused code accepted with %d", w.Code)
+	}
+
+	//Too many failed logins block the client
+	for i := 0; i < maxFailedLogins; i++ {
+		postLogin(p, url.Values{"username": {"bob"}, "password": {"wrong"}})
+	}
+	if w := postLogin(p, url.Values{"username": {"bob"}, "password": {"bob-password"}}); w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected login to be blocked, got %d", w.Code)
+	}
+}
+
+func TestPortalSettingsValidation(t *testing.T) {
+	p := newTestPortal(t)
+	invalid := []Settings{
+		{Enabled: true, PortalDomain: "auth.example.com"},
+		{Enabled: true, PortalDomain: "auth.example.org", CookieDomain: "example.com"},
+		{Enabled: true, PortalDomain: "auth.example.com", CookieDomain: "example.com", SessionLifetime: -time.Hour},
+	}
+	for _, settings := range invalid {
+		if err := p.UpdateSettings(settings); err == nil {
+			t.Errorf("invalid settings accepted: %+v", settings)
+		}
+	}
+	if settings := p.GetSettings(); settings.CookieDomain != "example.com" || settings.SessionLifetime != DefaultSessionLifetime {
+		t.Errorf("unexpected settings %+v", settings)
+	}
+}
@@ -0,0 +1,159 @@
+package portal
+
+/*
+	sessions.go
+
+	Server-side sessions of the SSO portal. The browser only
+	holds a random session ID, sessions are persisted to database
+	by the hash of the ID so they survive restarts
+*/
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+const (
+	sessionCookie          = "zoraxy_sso"
+	sessionTable           = "sso_portal_sessions"
+	sessionCleanupInterval = 10 * time.Minute
+)
+
+// Session is a user logged in to the portal
+type Session struct {
+	Username  string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// Sessions are stored by the hash of their ID, so the database does not hold usable cookies
+func sessionKey(sessionID string) string {
+	hash := sha256.Sum256([]byte(sessionID))
+	return hex.EncodeToString(hash[:])
+}
+
+// Set the session cookie on the cookie domain, empty value remove the cookie
+func (p *Portal) setSessionCookie(w http.ResponseWriter, r *http.Request, settings Settings, value string, expires time.Time) {
+	cookie := &http.Cookie{
+		Name:     sessionCookie,
+		Value:    value,
+		Path:     "/",
+		Domain:   settings.CookieDomain,
+		Expires:  expires,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Secure:   r.TLS != nil,
+	}
+	if value == "" {
+		cookie.MaxAge = -1
+	}
+	http.SetCookie(w, cookie)
+}
+
+// Load the sessions from database, expired sessions are removed
+func (p *Portal) loadSessions() {
+	p.options.Database.NewTable(sessionTable)
+	entries, _ := p.options.Database.ListTable(sessionTable)
+	now := time.Now()
+	for _, keypairs := range entries {
+		key := string(keypairs[0])
+		session := &Session{}
+		if err := json.Unmarshal(keypairs[1], session); err != nil || now.After(session.ExpiresAt) {
+			p.options.Database.Delete(sessionTable, key)
+			continue
+		}
+		p.sessions[key] = session
+	}
+}
+
+// Store a new session and return its ID
+func (p *Portal) createSession(session *Session) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	sessionID := base64.RawURLEncoding.EncodeToString(b)
+	key := sessionKey(sessionID)
+	if err := p.options.Database.Write(sessionTable, key, session); err != nil {
+		return "", err
+	}
+	p.sessionLock.Lock()
+	p.sessions[key] = session
+	p.sessionLock.Unlock()
+	return sessionID, nil
+}
+
+// Get the session of the request, nil if not logged in or the session expired
+func (p *Portal) getSession(r *http.Request) (string, *Session) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil || cookie.Value == "" {
+		return "", nil
+	}
+	key := sessionKey(cookie.Value)
+	p.sessionLock.RLock()
+	session, ok := p.sessions[key]
+	p.sessionLock.RUnlock()
+	if !ok {
+		return "", nil
+	}
+	if time.Now().After(session.ExpiresAt) {
+		p.deleteSession(key)
+		return "", nil
+	}
+	return key, session
+}
+
+func (p *Portal) deleteSession(key string) {
+	p.sessionLock.Lock()
+	delete(p.sessions, key)
+	p.sessionLock.Unlock()
+	p.options.Database.Delete(sessionTable, key)
+}
+
+// RemoveUserSessions log out a user from all devices
+func (p *Portal) RemoveUserSessions(username string) {
+	p.sessionLock.Lock()
+	defer p.sessionLock.Unlock()
+	for key, session := range p.sessions {
+		if session.Username == username {
+			delete(p.sessions, key)
+			p.options.Database.Delete(sessionTable, key)
+		}
+	}
+}
+
+// Count the active sessions of a user
+func (p *Portal) userSessionCount(username string) int {
+	p.sessionLock.RLock()
+	defer p.sessionLock.RUnlock()
+	now := time.Now()
+	count := 0
+	for _, session := range p.sessions {
+		if session.Username == username && now.Before(session.ExpiresAt) {
+			count++
+		}
+	}
+	return count
+}
+
+// Remove expired sessions periodically
+func (p *Portal) sessionCleanupLoop() {
+	ticker := time.NewTicker(sessionCleanupInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		now := time.Now()
+		p.sessionLock.Lock()
+		for key, session := range p.sessions {
+			if now.After(session.ExpiresAt) {
+				delete(p.sessions, key)
+				p.options.Database.Delete(sessionTable, key)
+			}
+		}
+		p.sessionLock.Unlock()
+	}
+}
@@ -0,0 +1,80 @@
+package auth
+
+/*
+	totp.go
+
+	Time-based one-time password helpers shared by
+	the management UI and the SSO portal
+*/
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image/png"
+	"sync"
+	"time"
+
+	"github.com/jellydator/ttlcache/v3"
+	"github.com/pquerna/otp/totp"
+)
+
+// Codes are accepted for one period before and after the current one
+const totpCodeLifetime = 90 * time.Second
+
+// TOTPEnrollment is a new TOTP secret waiting for the user to confirm with a code
+type TOTPEnrollment struct {
+	Secret string
+	URL    string //otpauth URL for authenticator apps
+	QRCode string //otpauth URL as PNG data URL
+}
+
+// NewTOTPEnrollment generate a new TOTP secret for the account
+func NewTOTPEnrollment(issuer string, accountName string) (*TOTPEnrollment, error) {
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      issuer,
+		AccountName: accountName,
+	})
+	if err != nil {
+		return nil, err
+	}
+	enrollment := &TOTPEnrollment{
+		Secret: key.Secret(),
+		URL:    key.URL(),
+	}
+	if img, err := key.Image(200, 200); err == nil {
+		buf := bytes.Buffer{}
+		if png.Encode(&buf, img) == nil {
+			enrollment.QRCode = "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())
+		}
+	}
+	return enrollment, nil
+}
+
+// TOTPGuard verify TOTP codes and reject codes that were already used
+type TOTPGuard struct {
+	usedCodes *ttlcache.Cache[string, struct{}]
+	lock      sync.Mutex
+}
+
+func NewTOTPGuard() *TOTPGuard {
+	usedCodes := ttlcache.New[string, struct{}](
+		ttlcache.WithTTL[string, struct{}](totpCodeLifetime),
+	)
+	go usedCodes.Start()
+	return &TOTPGuard{usedCodes: usedCodes}
+}
+
+// Verify check the code against the secret, each code can only be used once per account
+func (g *TOTPGuard) Verify(accountName string, secret string, code string) bool {
+	if code == "" || secret == "" || !totp.Validate(code, secret) {
+		return false
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	usedKey := accountName + "|" + code
+	if g.usedCodes.Has(usedKey) {
+		return false
+	}
+	g.usedCodes.Set(usedKey, struct{}{}, ttlcache.DefaultTTL)
+	return true
+}
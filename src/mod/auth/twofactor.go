@@ -0,0 +1,458 @@
+package auth
+
+/*
+	twofactor.go
+
+	Optional second factor of the management accounts. Users with
+	TOTP or WebAuthn credentials must finish a second login step after
+	their password is accepted. Recovery codes can replace the second
+	factor, each code can only be used once
+*/
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jellydator/ttlcache/v3"
+	"imuslab.com/zoraxy/mod/utils"
+)
+
+const (
+	twoFactorIssuer       = "Zoraxy"
+	twoFactorLoginTimeout = 5 * time.Minute  //Time to finish the second step after the password is accepted
+	maxTwoFactorAttempts  = 5                //Wrong codes before the pending login is dropped
+	maxTwoFactorFailures  = 10               //Wrong codes of a user before the second factor is locked
+	twoFactorLockoutTime  = 15 * time.Minute //Time a wrong code is counted for the lockout
+	recoveryCodeCount     = 10
+
+	errTwoFactorLocked = "Too many wrong verification codes, please try again later"
+)
+
+var totpCodeRegex = regexp.MustCompile(`^[0-9]{6}$`)
+
+// A login with correct password waiting for the second factor
+type pendingLogin struct {
+	Username   string
+	RememberMe bool
+	Attempts   int
+}
+
+// TwoFactorStatus is the two-factor authentication state of a user
+type TwoFactorStatus struct {
+	Required          bool //Second factor is required on login
+	Disabled          bool //Two-factor authentication is disabled by start parameter
+	TOTPEnabled       bool
+	RecoveryCodesLeft int
+	WebAuthn          []*WebAuthnCredentialInfo
+}
+
+func (a *AuthAgent) initTwoFactor() {
+	a.pendingLogins = ttlcache.New[string, *pendingLogin](
+		ttlcache.WithTTL[string, *pendingLogin](twoFactorLoginTimeout),
+		ttlcache.WithDisableTouchOnHit[string, *pendingLogin](),
+	)
+	a.pendingTOTP = ttlcache.New[string, string](
+		ttlcache.WithTTL[string, string](twoFactorLoginTimeout),
+	)
+	a.webauthnChallenges = ttlcache.New[string, *webauthnChallenge](
+		ttlcache.WithTTL[string, *webauthnChallenge](twoFactorLoginTimeout),
+	)
+	a.twoFactorFailures = ttlcache.New[string, int](
+		ttlcache.WithTTL[string, int](twoFactorLockoutTime),
+		ttlcache.WithDisableTouchOnHit[string, int](),
+	)
+	a.totpGuard = NewTOTPGuard()
+	go a.twoFactorFailures.Start()
+	go a.pendingLogins.Start()
+	go a.pendingTOTP.Start()
+	go a.webauthnChallenges.Start()
+}
+
+// Get the confirmed TOTP secret of the user, empty if TOTP is not enabled
+func (a *AuthAgent) totpSecret(username string) string {
+	secret := ""
+	a.Database.Read("auth", "totp/"+username, &secret)
+	return secret
+}
+
+// Get the hashes of the unused recovery codes of the user
+func (a *AuthAgent) recoveryCodeHashes(username string) []string {
+	hashes := []string{}
+	a.Database.Read("auth", "recovery/"+username, &hashes)
+	return hashes
+}
+
+// TwoFactorRequired check if the user must pass a second factor on login
+func (a *AuthAgent) TwoFactorRequired(username string) bool {
+	if a.TwoFactorDisabled {
+		return false
+	}
+	return a.totpSecret(username) != "" || len(a.webauthnCredentials(username)) > 0
+}
+
+// Second factors that can be used by the user on login
+func (a *AuthAgent) twoFactorMethods(username string) []string {
+	methods := []string{}
+	if a.totpSecret(username) != "" {
+		methods = append(methods, "totp")
+	}
+	if len(a.webauthnCredentials(username)) > 0 {
+		methods = append(methods, "webauthn")
+	}
+	if len(a.recoveryCodeHashes(username)) > 0 {
+		methods = append(methods, "recovery")
+	}
+	return methods
+}
+
+// GetTwoFactorStatus return the two-factor authentication state of the user
+func (a *AuthAgent) GetTwoFactorStatus(username string) *TwoFactorStatus {
+	credentials := []*WebAuthnCredentialInfo{}
+	for _, credential := range a.webauthnCredentials(username) {
+		credentials = append(credentials, credential.Info())
+	}
+	return &TwoFactorStatus{
+		Required:          a.TwoFactorRequired(username),
+		Disabled:          a.TwoFactorDisabled,
+		TOTPEnabled:       a.totpSecret(username) != "",
+		RecoveryCodesLeft: len(a.recoveryCodeHashes(username)),
+		WebAuthn:          credentials,
+	}
+}
+
+// RemoveTwoFactor remove all second factors and recovery codes of the user
+func (a *AuthAgent) RemoveTwoFactor(username string) {
+	a.Database.Delete("auth", "totp/"+username)
+	a.Database.Delete("auth", "recovery/"+username)
+	a.Database.Delete("auth", "webauthn/"+username)
+}
+
+// Remove the recovery codes if the user has no second factor left
+func (a *AuthAgent) cleanupRecoveryCodes(username string) {
+	if a.totpSecret(username) == "" && len(a.webauthnCredentials(username)) == 0 {
+		a.Database.Delete("auth", "recovery/"+username)
+	}
+}
+
+/*
+	Login
+*/
+
+// Create a pending login for a user with correct password, return the login token
+func (a *AuthAgent) startTwoFactorLogin(username string, rememberme bool) string {
+	token := make([]byte, 32)
+	rand.Read(token)
+	loginToken := hex.EncodeToString(token)
+	a.pendingLogins.Set(loginToken, &pendingLogin{
+		Username:   username,
+		RememberMe: rememberme,
+	}, ttlcache.DefaultTTL)
+	return loginToken
+}
+
+// Check if the user has too many wrong second factor codes recently
+func (a *AuthAgent) twoFactorLocked(username string) bool {
+	item := a.twoFactorFailures.Get(username)
+	return item != nil && item.Value() >= maxTwoFactorFailures
+}
+
+// Count a wrong second factor code of the user, caller must hold twoFactorLock
+func (a *AuthAgent) recordTwoFactorFailure(username string) {
+	failures := 1
+	if item := a.twoFactorFailures.Get(username); item != nil {
+		failures = item.Value() + 1
+	}
+	a.twoFactorFailures.Set(username, failures, ttlcache.DefaultTTL)
+	if failures == maxTwoFactorFailures {
+		a.Logger.PrintAndLog("auth", "Second factor of "+username+" locked after too many wrong verification codes", nil)
+	}
+}
+
+// Reply to a password login that still need the second factor
+func (a *AuthAgent) sendTwoFactorChallenge(w http.ResponseWriter, username string, rememberme bool) {
+	js, _ := json.Marshal(map[string]interface{}{
+		"twofactor": true,
+		"token":     a.startTwoFactorLogin(username, rememberme),
+		"methods":   a.twoFactorMethods(username),
+	})
+	utils.SendJSONResponse(w, string(js))
+}
+
+// Check a TOTP or recovery code of the user
+func (a *AuthAgent) verifySecondFactorCode(username string, code string) (bool, string) {
+	code = strings.TrimSpace(code)
+	if totpCodeRegex.MatchString(code) {
+		secret := a.totpSecret(username)
+		if secret != "" && a.totpGuard.Verify(username, secret, code) {
+			return true, "totp"
+		}
+		return false, ""
+	}
+	if a.useRecoveryCode(username, code) {
+		return true, "recovery code"
+	}
+	return false, ""
+}
+
+// VerifyTwoFactorCode check a TOTP or recovery code of the user for logins outside
+// of the management UI, e.g. the SSO portal. Wrong codes count toward the lockout
+func (a *AuthAgent) VerifyTwoFactorCode(username string, code string) bool {
+	a.twoFactorLock.Lock()
+	defer a.twoFactorLock.Unlock()
+	if a.twoFactorLocked(username) {
+		return false
+	}
+	if codeCorrect, _ := a.verifySecondFactorCode(username, code); !codeCorrect {
+		a.recordTwoFactorFailure(username)
+		return false
+	}
+	a.twoFactorFailures.Delete(username)
+	return true
+}
+
+// Handle the second login step, require POST token and code (TOTP or recovery code)
+func (a *AuthAgent) HandleTwoFactorLogin(w http.ResponseWriter, r *http.Request) {
+	token, err := utils.PostPara(r, "token")
+	if err != nil {
+		utils.SendErrorResponse(w, "login token not defined")
+		return
+	}
+	code, err := utils.PostPara(r, "code")
+	if err != nil {
+		utils.SendErrorResponse(w, "verification code not defined")
+		return
+	}
+
+	a.twoFactorLock.Lock()
+	item := a.pendingLogins.Get(token)
+	if item == nil {
+		a.twoFactorLock.Unlock()
+		utils.SendErrorResponse(w, "Login expired, please login again")
+		return
+	}
+	pending := item.Value()
+	if a.twoFactorLocked(pending.Username) {
+		//New password logins do not reset the attempts of the user
+		a.pendingLogins.Delete(token)
+		a.twoFactorLock.Unlock()
+		utils.SendErrorResponse(w, errTwoFactorLocked)
+		return
+	}
+	codeCorrect, method := a.verifySecondFactorCode(pending.Username, code)
+	if !codeCorrect {
+		pending.Attempts++
+		if pending.Attempts >= maxTwoFactorAttempts {
+			a.pendingLogins.Delete(token)
+		}
+		a.recordTwoFactorFailure(pending.Username)
+		a.twoFactorLock.Unlock()
+		a.Logger.PrintAndLog("auth", pending.Username+" login request rejected: invalid verification code", nil)
+		utils.SendErrorResponse(w, "Invalid verification code")
+		return
+	}
+	a.pendingLogins.Delete(token)
+	a.twoFactorFailures.Delete(pending.Username)
+	a.twoFactorLock.Unlock()
+
+	a.LoginUserByRequest(w, r, pending.Username, pending.RememberMe)
+	a.Logger.PrintAndLog("auth", pending.Username+" logged in with "+method+".", nil)
+	utils.SendOK(w)
+}
+
+/*
+	Recovery Codes
+*/
+
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	hash := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(hash[:])
+}
+
+// Generate a new set of recovery codes for the user, old codes are invalidated
+func (a *AuthAgent) generateRecoveryCodes(username string) ([]string, error) {
+	codes := []string{}
+	hashes := []string{}
+	for i := 0; i < recoveryCodeCount; i++ {
+		buf := make([]byte, 5)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+		code := hex.EncodeToString(buf)
+		code = code[:5] + "-" + code[5:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	if err := a.Database.Write("auth", "recovery/"+username, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// Check and consume a recovery code of the user
+func (a *AuthAgent) useRecoveryCode(username string, code string) bool {
+	if code == "" {
+		return false
+	}
+	hashes := a.recoveryCodeHashes(username)
+	codeHash := hashRecoveryCode(code)
+	for i, hash := range hashes {
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(codeHash)) == 1 {
+			hashes = append(hashes[:i], hashes[i+1:]...)
+			if err := a.Database.Write("auth", "recovery/"+username, hashes); err != nil {
+				return false
+			}
+			return true
+		}
+	}
+	return false
+}
+
+/*
+	Management APIs, all of them require a logged in user
+*/
+
+// Get the logged in user, reply 401 if not logged in. Second factors can only be
+// managed with a session login, so a leaked token cannot add a passkey to login with
+func (a *AuthAgent) twoFactorUser(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if requestAPIToken(r) != nil {
+		utils.SendErrorResponse(w, "two-factor authentication cannot be managed with an API token")
+		return "", false
+	}
+	username, err := a.GetUserName(w, r)
+	if err != nil || username == "" {
+		http.Error(w, "401 - Unauthorized", http.StatusUnauthorized)
+		return "", false
+	}
+	return username, true
+}
+
+// Check the password given in POST password for changes that weaken the account
+func (a *AuthAgent) twoFactorPasswordCheck(w http.ResponseWriter, r *http.Request, username string) bool {
+	password, err := utils.PostPara(r, "password")
+	if err != nil {
+		utils.SendErrorResponse(w, "current password required")
+		return false
+	}
+	if !a.ValidateUsernameAndPassword(username, password) {
+		utils.SendErrorResponse(w, "Invalid current password given")
+		return false
+	}
+	return true
+}
+
+// Reply the newly generated recovery codes, or OK if the user already has some
+func (a *AuthAgent) sendRecoveryCodesIfNew(w http.ResponseWriter, username string) {
+	if len(a.recoveryCodeHashes(username)) > 0 {
+		utils.SendOK(w)
+		return
+	}
+	codes, err := a.generateRecoveryCodes(username)
+	if err != nil {
+		utils.SendErrorResponse(w, "unable to generate recovery codes")
+		return
+	}
+	js, _ := json.Marshal(codes)
+	utils.SendJSONResponse(w, string(js))
+}
+
+// HandleTwoFactorStatus return the two-factor authentication state of the current user
+func (a *AuthAgent) HandleTwoFactorStatus(w http.ResponseWriter, r *http.Request) {
+	username, ok := a.twoFactorUser(w, r)
+	if !ok {
+		return
+	}
+	js, _ := json.Marshal(a.GetTwoFactorStatus(username))
+	utils.SendJSONResponse(w, string(js))
+}
+
+// HandleTOTPEnroll generate a new TOTP secret for the current user, it must be confirmed before use
+func (a *AuthAgent) HandleTOTPEnroll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "405 - Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	username, ok := a.twoFactorUser(w, r)
+	if !ok {
+		return
+	}
+	enrollment, err := NewTOTPEnrollment(twoFactorIssuer, username)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	a.pendingTOTP.Set(username, enrollment.Secret, ttlcache.DefaultTTL)
+	js, _ := json.Marshal(enrollment)
+	utils.SendJSONResponse(w, string(js))
+}
+
+// HandleTOTPConfirm enable the pending TOTP secret with POST code, reply the recovery codes if they are newly generated
+func (a *AuthAgent) HandleTOTPConfirm(w http.ResponseWriter, r *http.Request) {
+	username, ok := a.twoFactorUser(w, r)
+	if !ok {
+		return
+	}
+	code, err := utils.PostPara(r, "code")
+	if err != nil {
+		utils.SendErrorResponse(w, "verification code not defined")
+		return
+	}
+	item := a.pendingTOTP.Get(username)
+	if item == nil {
+		utils.SendErrorResponse(w, "no pending TOTP enrollment, please start again")
+		return
+	}
+	if !a.totpGuard.Verify(username, item.Value(), strings.TrimSpace(code)) {
+		utils.SendErrorResponse(w, "Invalid verification code")
+		return
+	}
+	if err := a.Database.Write("auth", "totp/"+username, item.Value()); err != nil {
+		utils.SendErrorResponse(w, "unable to save TOTP secret")
+		return
+	}
+	a.pendingTOTP.Delete(username)
+	a.Logger.PrintAndLog("auth", "TOTP enabled for "+username, nil)
+	a.sendRecoveryCodesIfNew(w, username)
+}
+
+// HandleTOTPDisable disable TOTP of the current user, require POST password
+func (a *AuthAgent) HandleTOTPDisable(w http.ResponseWriter, r *http.Request) {
+	username, ok := a.twoFactorUser(w, r)
+	if !ok || !a.twoFactorPasswordCheck(w, r, username) {
+		return
+	}
+	if err := a.Database.Delete("auth", "totp/"+username); err != nil {
+		utils.SendErrorResponse(w, "unable to disable TOTP")
+		return
+	}
+	a.cleanupRecoveryCodes(username)
+	a.Logger.PrintAndLog("auth", "TOTP disabled for "+username, nil)
+	utils.SendOK(w)
+}
+
+// HandleRecoveryCodesRegenerate replace the recovery codes of the current user, require POST password
+func (a *AuthAgent) HandleRecoveryCodesRegenerate(w http.ResponseWriter, r *http.Request) {
+	username, ok := a.twoFactorUser(w, r)
+	if !ok || !a.twoFactorPasswordCheck(w, r, username) {
+		return
+	}
+	if a.totpSecret(username) == "" && len(a.webauthnCredentials(username)) == 0 {
+		utils.SendErrorResponse(w, "two-factor authentication is not enabled")
+		return
+	}
+	codes, err := a.generateRecoveryCodes(username)
+	if err != nil {
+		utils.SendErrorResponse(w, "unable to generate recovery codes")
+		return
+	}
+	a.Logger.PrintAndLog("auth", "Recovery codes regenerated for "+username, nil)
+	js, _ := json.Marshal(codes)
+	utils.SendJSONResponse(w, string(js))
+}
@@ -0,0 +1,317 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp/totp"
+	"imuslab.com/zoraxy/mod/database"
+	"imuslab.com/zoraxy/mod/database/dbinc"
+	"imuslab.com/zoraxy/mod/info/logger"
+)
+
+const twoFactorTestHost = "zoraxy.example.com:8000"
+
+func newTwoFactorTestAgent(t *testing.T) *AuthAgent {
+	db, err := database.NewDatabase(filepath.Join(t.TempDir(), "sys.db"), dbinc.BackendBoltDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+	fmtLogger, _ := logger.NewFmtLogger()
+	a := NewAuthenticationAgent("zoraxy", []byte("test-session-key"), db, false, fmtLogger, nil)
+	if err := a.CreateUserAccount("admin", "password", ""); err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func postForm(handler http.HandlerFunc, form url.Values, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/api/auth/login", strings.NewReader(form.Encode()))
+	r.Host = twoFactorTestHost
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	handler(w, r)
+	return w
+}
+
+// Get the session cookie of a logged in user
+func loginCookie(a *AuthAgent, username string) *http.Cookie {
+	w := httptest.NewRecorder()
+	a.LoginUserByRequest(w, httptest.NewRequest(http.MethodGet, "/", nil), username, false)
+	return w.Result().Cookies()[0]
+}
+
+func isLoggedIn(a *AuthAgent, w *httptest.ResponseRecorder) bool {
+	if strings.Contains(w.Body.String(), "error") {
+		return false
+	}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	return a.CheckAuth(r)
+}
+
+// Login with password and return the second factor login token
+func passwordLogin(t *testing.T, a *AuthAgent) (string, []string) {
+	t.Helper()
+	w := postForm(a.HandleLogin, url.Values{"username": {"admin"}, "password": {"password"}})
+	response := struct {
+		TwoFactor bool     `json:"twofactor"`
+		Token     string   `json:"token"`
+		Methods   []string `json:"methods"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil || !response.TwoFactor || response.Token == "" {
+		t.Fatalf("expected second factor challenge, got %s", w.Body.String())
+	}
+	if isLoggedIn(a, w) {
+		t.Fatal("logged in before second factor")
+	}
+	return response.Token, response.Methods
+}
+
+func TestTOTPLogin(t *testing.T) {
+	a := newTwoFactorTestAgent(t)
+	session := loginCookie(a, "admin")
+
+	//Enrollment is not active until confirmed
+	w := postForm(a.HandleTOTPEnroll, nil, session)
+	enrollment := TOTPEnrollment{}
+	if err := json.Unmarshal(w.Body.Bytes(), &enrollment); err != nil || enrollment.Secret == "" {
+		t.Fatalf("enroll failed: %s", w.Body.String())
+	}
+	if a.TwoFactorRequired("admin") {
+		t.Fatal("unconfirmed TOTP required on login")
+	}
+	if w := postForm(a.HandleTOTPConfirm, url.Values{"code": {"000000"}}, session); !strings.Contains(w.Body.String(), "error") {
+		t.Fatal("invalid code confirmed enrollment")
+	}
+	code, _ := totp.GenerateCode(enrollment.Secret, time.Now().Add(-30*time.Second))
+	w = postForm(a.HandleTOTPConfirm, url.Values{"code": {code}}, session)
+	recoveryCodes := []string{}
+	if err := json.Unmarshal(w.Body.Bytes(), &recoveryCodes); err != nil || len(recoveryCodes) != recoveryCodeCount {
+		t.Fatalf("expected recovery codes, got %s", w.Body.String())
+	}
+
+	//Password alone is not enough
+	token, methods := passwordLogin(t, a)
+	if strings.Join(methods, ",") != "totp,recovery" {
+		t.Errorf("unexpected methods %v", methods)
+	}
+	if w := postForm(a.HandleTwoFactorLogin, url.Values{"token": {token}, "code": {"000000"}}); isLoggedIn(a, w) {
+		t.Fatal("invalid code accepted")
+	}
+	code, _ = totp.GenerateCode(enrollment.Secret, time.Now())
+	if w := postForm(a.HandleTwoFactorLogin, url.Values{"token": {token}, "code": {code}}); !isLoggedIn(a, w) {
+		t.Fatalf("valid code rejected: %s", w.Body.String())
+	}
+	if w := postForm(a.HandleTwoFactorLogin, url.Values{"token": {token}, "code": {code}}); isLoggedIn(a, w) {
+		t.Fatal("login token reused")
+	}
+
+	//Recovery codes can only be used once
+	token, _ = passwordLogin(t, a)
+	if w := postForm(a.HandleTwoFactorLogin, url.Values{"token": {token}, "code": {strings.ToUpper(recoveryCodes[0])}}); !isLoggedIn(a, w) {
+		t.Fatalf("recovery code rejected: %s", w.Body.String())
+	}
+	token, _ = passwordLogin(t, a)
+	if w := postForm(a.HandleTwoFactorLogin, url.Values{"token": {token}, "code": {recoveryCodes[0]}}); isLoggedIn(a, w) {
+		t.Fatal("recovery code reused")
+	}
+	if left := a.GetTwoFactorStatus("admin").RecoveryCodesLeft; left != recoveryCodeCount-1 {
+		t.Errorf("expected %d recovery codes left, got %d", recoveryCodeCount-1, left)
+	}
+
+	//Emergency recovery flag skip the second factor
+	a.TwoFactorDisabled = true
+	if w := postForm(a.HandleLogin, url.Values{"username": {"admin"}, "password": {"password"}}); !isLoggedIn(a, w) {
+		t.Fatalf("login with 2FA disabled failed: %s", w.Body.String())
+	}
+	a.TwoFactorDisabled = false
+
+	//Disable require the password, recovery codes are removed with the last factor
+	if w := postForm(a.HandleTOTPDisable, url.Values{"password": {"wrong"}}, session); !strings.Contains(w.Body.String(), "error") {
+		t.Fatal("TOTP disabled with wrong password")
+	}
+	postForm(a.HandleTOTPDisable, url.Values{"password": {"password"}}, session)
+	if status := a.GetTwoFactorStatus("admin"); status.Required || status.RecoveryCodesLeft != 0 {
+		t.Errorf("unexpected status after disable %+v", status)
+	}
+}
+
+func TestTwoFactorAttemptLimit(t *testing.T) {
+	a := newTwoFactorTestAgent(t)
+	secret := "JBSWY3DPEHPK3PXP"
+	a.Database.Write("auth", "totp/admin", secret)
+
+	token, _ := passwordLogin(t, a)
+	for i := 0; i < maxTwoFactorAttempts; i++ {
+		postForm(a.HandleTwoFactorLogin, url.Values{"token": {token}, "code": {"abcde-fghij"}})
+	}
+	code, _ := totp.GenerateCode(secret, time.Now())
+	if w := postForm(a.HandleTwoFactorLogin, url.Values{"token": {token}, "code": {code}}); isLoggedIn(a, w) {
+		t.Fatal("login allowed after too many wrong codes")
+	}
+}
+
+func TestTwoFactorLockout(t *testing.T) {
+	a := newTwoFactorTestAgent(t)
+	secret := "JBSWY3DPEHPK3PXP"
+	a.Database.Write("auth", "totp/admin", secret)
+
+	//Guesses are counted for the user, new password logins do not reset them
+	for failures := 0; failures < maxTwoFactorFailures; {
+		token, _ := passwordLogin(t, a)
+		for i := 0; i < maxTwoFactorAttempts && failures < maxTwoFactorFailures; i++ {
+			postForm(a.HandleTwoFactorLogin, url.Values{"token": {token}, "code": {"abcde-fghij"}})
+			failures++
+		}
+	}
+	if w := postForm(a.HandleLogin, url.Values{"username": {"admin"}, "password": {"password"}}); !strings.Contains(w.Body.String(), "error") {
+		t.Fatalf("second factor challenge issued for locked user: %s", w.Body.String())
+	}
+
+	//Lockout expire after the window
+	a.twoFactorFailures.Delete("admin")
+	token, _ := passwordLogin(t, a)
+	code, _ := totp.GenerateCode(secret, time.Now())
+	if w := postForm(a.HandleTwoFactorLogin, url.Values{"token": {token}, "code": {code}}); !isLoggedIn(a, w) {
+		t.Fatalf("login failed after lockout expired: %s", w.Body.String())
+	}
+}
+
+// Software authenticator with an ES256 key
+type testAuthenticator struct {
+	t            *testing.T
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	signCount    uint32
+}
+
+func (ta *testAuthenticator) clientData(typ string, options []byte, origin string) string {
+	challenge := struct {
+		Challenge string `json:"challenge"`
+	}{}
+	if err := json.Unmarshal(options, &challenge); err != nil || challenge.Challenge == "" {
+		ta.t.Fatalf("invalid options %s", options)
+	}
+	js, _ := json.Marshal(collectedClientData{Type: typ, Challenge: challenge.Challenge, Origin: origin})
+	return string(js)
+}
+
+func (ta *testAuthenticator) authData(flags byte) []byte {
+	rpIDHash := sha256.Sum256([]byte("zoraxy.example.com"))
+	data := append(rpIDHash[:], flags)
+	data = binary.BigEndian.AppendUint32(data, ta.signCount)
+	if flags&authDataFlagAttestedCredential != 0 {
+		data = append(data, make([]byte, 16)...)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(ta.credentialID)))
+		data = append(data, ta.credentialID...)
+	}
+	return data
+}
+
+func (ta *testAuthenticator) register(a *AuthAgent, session *http.Cookie) *httptest.ResponseRecorder {
+	options := postForm(a.HandleWebAuthnRegisterBegin, url.Values{"password": {"password"}}, session).Body.Bytes()
+	publicKey, _ := x509.MarshalPKIXPublicKey(&ta.key.PublicKey)
+	return postForm(a.HandleWebAuthnRegisterFinish, url.Values{
+		"name":               {"Test Key"},
+		"clientDataJSON":     {base64.RawURLEncoding.EncodeToString([]byte(ta.clientData("webauthn.create", options, "https://"+twoFactorTestHost)))},
+		"authenticatorData":  {base64.RawURLEncoding.EncodeToString(ta.authData(authDataFlagUserPresent | authDataFlagAttestedCredential))},
+		"publicKey":          {base64.RawURLEncoding.EncodeToString(publicKey)},
+		"publicKeyAlgorithm": {strconv.Itoa(coseAlgES256)},
+	}, session)
+}
+
+func (ta *testAuthenticator) login(a *AuthAgent, token string, flags byte, origin string) *httptest.ResponseRecorder {
+	options := postForm(a.HandleWebAuthnLoginBegin, url.Values{"token": {token}}).Body.Bytes()
+	clientDataJSON := ta.clientData("webauthn.get", options, origin)
+	ta.signCount++
+	authData := ta.authData(flags)
+	clientDataHash := sha256.Sum256([]byte(clientDataJSON))
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, ta.key, digest[:])
+	if err != nil {
+		ta.t.Fatal(err)
+	}
+	return postForm(a.HandleWebAuthnLoginFinish, url.Values{
+		"id":                {base64.RawURLEncoding.EncodeToString(ta.credentialID)},
+		"clientDataJSON":    {base64.RawURLEncoding.EncodeToString([]byte(clientDataJSON))},
+		"authenticatorData": {base64.RawURLEncoding.EncodeToString(authData)},
+		"signature":         {base64.RawURLEncoding.EncodeToString(signature)},
+	})
+}
+
+func TestWebAuthnLogin(t *testing.T) {
+	a := newTwoFactorTestAgent(t)
+	session := loginCookie(a, "admin")
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	authenticator := &testAuthenticator{t: t, key: key, credentialID: []byte("test-credential-id")}
+
+	//A stolen session cannot add a passkey without the password
+	if w := postForm(a.HandleWebAuthnRegisterBegin, url.Values{"password": {"wrong"}}, session); !strings.Contains(w.Body.String(), "error") {
+		t.Error("registration started without the current password")
+	}
+
+	w := authenticator.register(a, session)
+	recoveryCodes := []string{}
+	if err := json.Unmarshal(w.Body.Bytes(), &recoveryCodes); err != nil || len(recoveryCodes) != recoveryCodeCount {
+		t.Fatalf("registration failed: %s", w.Body.String())
+	}
+	if w := authenticator.register(a, session); !strings.Contains(w.Body.String(), "error") {
+		t.Error("same credential registered twice")
+	}
+
+	const verified = authDataFlagUserPresent | authDataFlagUserVerified
+	origin := "https://" + twoFactorTestHost
+
+	//Passkey login without password
+	if w := authenticator.login(a, "", verified, origin); !isLoggedIn(a, w) {
+		t.Fatalf("passkey login failed: %s", w.Body.String())
+	}
+	if w := authenticator.login(a, "", authDataFlagUserPresent, origin); isLoggedIn(a, w) {
+		t.Error("passkey login without user verification accepted")
+	}
+	if w := authenticator.login(a, "", verified, "https://evil.example.com"); isLoggedIn(a, w) {
+		t.Error("assertion from other origin accepted")
+	}
+	authenticator.signCount = 0
+	if w := authenticator.login(a, "", verified, origin); isLoggedIn(a, w) {
+		t.Error("assertion with old signature counter accepted")
+	}
+	authenticator.signCount = 10
+
+	//Second factor after password, user presence is enough
+	token, methods := passwordLogin(t, a)
+	if strings.Join(methods, ",") != "webauthn,recovery" {
+		t.Errorf("unexpected methods %v", methods)
+	}
+	if w := authenticator.login(a, token, authDataFlagUserPresent, origin); !isLoggedIn(a, w) {
+		t.Fatalf("security key second factor failed: %s", w.Body.String())
+	}
+
+	//Removing the last credential remove the second factor
+	credentialID := base64.RawURLEncoding.EncodeToString(authenticator.credentialID)
+	postForm(a.HandleWebAuthnRemove, url.Values{"id": {credentialID}, "password": {"password"}}, session)
+	if status := a.GetTwoFactorStatus("admin"); status.Required || len(status.WebAuthn) != 0 || status.RecoveryCodesLeft != 0 {
+		t.Errorf("unexpected status after removal %+v", status)
+	}
+}
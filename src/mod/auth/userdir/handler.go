@@ -0,0 +1,196 @@
+package userdir
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"imuslab.com/zoraxy/mod/utils"
+)
+
+/*
+	Handler.go
+
+	HTTP handlers for managing the users and groups
+	of the user directory
+*/
+
+// Split a comma seperated list of group IDs
+func parseGroupIDs(groups string) []string {
+	results := []string{}
+	for _, id := range strings.Split(groups, ",") {
+		id = strings.TrimSpace(id)
+		if id != "" {
+			results = append(results, id)
+		}
+	}
+	return results
+}
+
+// List all users in the directory
+func (d *Directory) HandleListUsers(w http.ResponseWriter, r *http.Request) {
+	js, _ := json.Marshal(d.ListUsers())
+	utils.SendJSONResponse(w, string(js))
+}
+
+// Add a new user, require POST username and password, groups is optional
+func (d *Directory) HandleAddUser(w http.ResponseWriter, r *http.Request) {
+	username, err := utils.PostPara(r, "username")
+	if err != nil {
+		utils.SendErrorResponse(w, "username cannot be empty")
+		return
+	}
+	password, err := utils.PostPara(r, "password")
+	if err != nil {
+		utils.SendErrorResponse(w, "password cannot be empty")
+		return
+	}
+	groups, _ := utils.PostPara(r, "groups")
+
+	err = d.CreateUser(strings.TrimSpace(username), password, parseGroupIDs(groups))
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	utils.SendOK(w)
+}
+
+// Edit a user. Only the given fields among password, groups and disabled are updated
+func (d *Directory) HandleEditUser(w http.ResponseWriter, r *http.Request) {
+	username, err := utils.PostPara(r, "username")
+	if err != nil {
+		utils.SendErrorResponse(w, "invalid username given")
+		return
+	}
+	if _, err := d.GetUser(username); err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	if password, err := utils.PostPara(r, "password"); err == nil {
+		if err := d.SetPassword(username, password); err != nil {
+			utils.SendErrorResponse(w, err.Error())
+			return
+		}
+	}
+
+	if r.Form.Has("groups") {
+		if err := d.SetUserGroups(username, parseGroupIDs(r.Form.Get("groups"))); err != nil {
+			utils.SendErrorResponse(w, err.Error())
+			return
+		}
+	}
+
+	if disabled, err := utils.PostBool(r, "disabled"); err == nil {
+		if err := d.SetUserDisabled(username, disabled); err != nil {
+			utils.SendErrorResponse(w, err.Error())
+			return
+		}
+	}
+	utils.SendOK(w)
+}
+
+// Remove a user, require POST username
+func (d *Directory) HandleRemoveUser(w http.ResponseWriter, r *http.Request) {
+	username, err := utils.PostPara(r, "username")
+	if err != nil {
+		utils.SendErrorResponse(w, "invalid username given")
+		return
+	}
+	if err := d.RemoveUser(username); err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	utils.SendOK(w)
+}
+
+// List all groups in the directory
+func (d *Directory) HandleListGroups(w http.ResponseWriter, r *http.Request) {
+	js, _ := json.Marshal(d.ListGroups())
+	utils.SendJSONResponse(w, string(js))
+}
+
+// Add a new group, require POST name, return the new group ID
+func (d *Directory) HandleAddGroup(w http.ResponseWriter, r *http.Request) {
+	name, err := utils.PostPara(r, "name")
+	if err != nil {
+		utils.SendErrorResponse(w, "group name cannot be empty")
+		return
+	}
+	description, _ := utils.PostPara(r, "description")
+
+	groupID, err := d.CreateGroup(name, description)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	js, _ := json.Marshal(groupID)
+	utils.SendJSONResponse(w, string(js))
+}
+
+// Edit a group, require POST id and name
+func (d *Directory) HandleEditGroup(w http.ResponseWriter, r *http.Request) {
+	groupID, err := utils.PostPara(r, "id")
+	if err != nil {
+		utils.SendErrorResponse(w, "invalid group id given")
+		return
+	}
+	name, err := utils.PostPara(r, "name")
+	if err != nil {
+		utils.SendErrorResponse(w, "group name cannot be empty")
+		return
+	}
+	description, _ := utils.PostPara(r, "description")
+
+	if err := d.UpdateGroup(groupID, name, description); err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	utils.SendOK(w)
+}
+
+// Remove a group, require POST id
+func (d *Directory) HandleRemoveGroup(w http.ResponseWriter, r *http.Request) {
+	groupID, err := utils.PostPara(r, "id")
+	if err != nil {
+		utils.SendErrorResponse(w, "invalid group id given")
+		return
+	}
+	if err := d.RemoveGroup(groupID); err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	utils.SendOK(w)
+}
+
+// Import users from htpasswd content, require POST content. groups and overwrite are optional
+func (d *Directory) HandleImportHtpasswd(w http.ResponseWriter, r *http.Request) {
+	content, err := utils.PostPara(r, "content")
+	if err != nil {
+		utils.SendErrorResponse(w, "htpasswd content cannot be empty")
+		return
+	}
+	groups, _ := utils.PostPara(r, "groups")
+	overwrite, _ := utils.PostBool(r, "overwrite")
+
+	result, err := d.ImportHtpasswd([]byte(content), parseGroupIDs(groups), overwrite)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	js, _ := json.Marshal(result)
+	utils.SendJSONResponse(w, string(js))
+}
+
+// Download the users of a group in htpasswd format, all users if group is not given
+func (d *Directory) HandleExportHtpasswd(w http.ResponseWriter, r *http.Request) {
+	groupID, _ := utils.GetPara(r, "group")
+	content, err := d.ExportHtpasswd(groupID)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"htpasswd\"")
+	w.Write(content)
+}
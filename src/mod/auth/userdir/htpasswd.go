@@ -0,0 +1,118 @@
+package userdir
+
+/*
+	htpasswd.go
+
+	Import and export of users in htpasswd format for
+	migrating from nginx or Apache. Only bcrypt hashes
+	(htpasswd -B) can be used by both sides, MD5 (apr1),
+	SHA1 and crypt hashes are skipped on import
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+
+	"imuslab.com/zoraxy/mod/auth"
+)
+
+// ImportResult is the result of an htpasswd import
+type ImportResult struct {
+	Imported []string          //Usernames imported
+	Skipped  map[string]string //Username or line number to reason
+}
+
+// ImportHtpasswd add the users in the htpasswd content to the given groups.
+// overwrite replace the password of existing users, otherwise they are skipped
+func (d *Directory) ImportHtpasswd(content []byte, groupIDs []string, overwrite bool) (*ImportResult, error) {
+	d.lock.RLock()
+	_, err := d.cleanGroupIDs(groupIDs)
+	d.lock.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ImportResult{
+		Imported: []string{},
+		Skipped:  map[string]string{},
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		username, passwordHash, found := strings.Cut(line, ":")
+		if !found {
+			result.Skipped["line "+strconv.Itoa(lineNumber)] = "invalid htpasswd entry"
+			continue
+		}
+		if err := ValidateUsername(username); err != nil {
+			result.Skipped["line "+strconv.Itoa(lineNumber)] = err.Error()
+			continue
+		}
+		format := auth.GetPasswordHashFormat(passwordHash)
+		if format != auth.PasswordHashBcrypt && format != auth.PasswordHashArgon2id {
+			result.Skipped[username] = "unsupported hash format, re-create the password with htpasswd -B"
+			continue
+		}
+		if err := d.addUser(username, passwordHash, groupIDs, overwrite); err != nil {
+			result.Skipped[username] = err.Error()
+			continue
+		}
+		result.Imported = append(result.Imported, username)
+	}
+	if err := scanner.Err(); err != nil {
+		return result, err
+	}
+	if len(result.Imported) > 0 {
+		d.logf("Imported "+strconv.Itoa(len(result.Imported))+" users from htpasswd", nil)
+	}
+	return result, nil
+}
+
+// ExportHtpasswd return the users of the group in htpasswd format, all users if groupID
+// is empty. Users with hash formats not supported by htpasswd are listed as comments
+func (d *Directory) ExportHtpasswd(groupID string) ([]byte, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	if groupID != "" {
+		if _, ok := d.groups[groupID]; !ok {
+			return nil, errors.New("group not found")
+		}
+	}
+
+	var buf bytes.Buffer
+	skipped := []string{}
+	for _, username := range d.sortedUsers() {
+		user := d.users[username]
+		if groupID != "" && !contains(user.Groups, groupID) {
+			continue
+		}
+		if auth.GetPasswordHashFormat(user.PasswordHash) != auth.PasswordHashBcrypt {
+			skipped = append(skipped, user.Username)
+			continue
+		}
+		buf.WriteString(user.Username + ":" + user.PasswordHash + "\n")
+	}
+	for _, username := range skipped {
+		buf.WriteString("# " + username + ": skipped, password hash format not supported by htpasswd\n")
+	}
+	return buf.Bytes(), nil
+}
+
+// Usernames in sorted order, caller must hold the lock
+func (d *Directory) sortedUsers() []string {
+	results := []string{}
+	for username := range d.users {
+		results = append(results, username)
+	}
+	sort.Strings(results)
+	return results
+}
@@ -0,0 +1,487 @@
+package userdir
+
+/*
+	User Directory
+
+	Shared users and groups for proxy basic auth. Endpoints
+	reference groups by ID, so changing the password of a
+	user apply to every endpoint the user has access to
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"imuslab.com/zoraxy/mod/auth"
+	"imuslab.com/zoraxy/mod/database"
+	"imuslab.com/zoraxy/mod/info/logger"
+)
+
+const (
+	userTable  = "userdir_users"
+	groupTable = "userdir_groups"
+)
+
+type Options struct {
+	Database *database.Database
+	Logger   *logger.Logger //Logger for directory changes, can be nil
+}
+
+type User struct {
+	Username     string
+	PasswordHash string
+	Groups       []string //IDs of the groups this user belongs to
+	Disabled     bool     //Disabled users cannot login
+	CreatedAt    int64
+	UpdatedAt    int64
+}
+
+type Group struct {
+	ID          string
+	Name        string
+	Description string
+}
+
+// UserInfo is the public information of a user, without the password hash
+type UserInfo struct {
+	Username   string
+	Groups     []string
+	Disabled   bool
+	HashFormat string //Format of the password hash, e.g. argon2id or bcrypt
+	CreatedAt  int64
+	UpdatedAt  int64
+}
+
+// GroupInfo is a group with its member count
+type GroupInfo struct {
+	ID          string
+	Name        string
+	Description string
+	Members     int
+}
+
+type Directory struct {
+	Options *Options
+	users   map[string]*User  //Username to user
+	groups  map[string]*Group //Group ID to group
+	cache   *auth.CredentialCache
+	lock    sync.RWMutex
+}
+
+// NewDirectory create the user directory and load the users and groups from database
+func NewDirectory(options *Options) (*Directory, error) {
+	if options.Database == nil {
+		return nil, errors.New("database is required")
+	}
+	options.Database.NewTable(userTable)
+	options.Database.NewTable(groupTable)
+
+	d := &Directory{
+		Options: options,
+		users:   map[string]*User{},
+		groups:  map[string]*Group{},
+		cache:   auth.NewCredentialCache(0),
+	}
+
+	entries, _ := options.Database.ListTable(groupTable)
+	for _, keypairs := range entries {
+		group := Group{}
+		if err := json.Unmarshal(keypairs[1], &group); err != nil {
+			continue
+		}
+		d.groups[group.ID] = &group
+	}
+	entries, _ = options.Database.ListTable(userTable)
+	for _, keypairs := range entries {
+		user := User{}
+		if err := json.Unmarshal(keypairs[1], &user); err != nil {
+			continue
+		}
+		if user.Groups == nil {
+			user.Groups = []string{}
+		}
+		d.users[user.Username] = &user
+	}
+	return d, nil
+}
+
+func (d *Directory) logf(message string, originalError error) {
+	if d.Options.Logger == nil {
+		return
+	}
+	d.Options.Logger.PrintAndLog("userdir", message, originalError)
+}
+
+// Validate the username is usable in the directory and htpasswd files
+func ValidateUsername(username string) error {
+	if username == "" {
+		return errors.New("username cannot be empty")
+	}
+	if len(username) > 255 {
+		return errors.New("username too long")
+	}
+	if strings.ContainsAny(username, ": \t\r\n/") {
+		return errors.New("username cannot contain colon, slash or whitespace")
+	}
+	return nil
+}
+
+/* Users */
+
+func (u *User) info() *UserInfo {
+	return &UserInfo{
+		Username:   u.Username,
+		Groups:     append([]string{}, u.Groups...),
+		Disabled:   u.Disabled,
+		HashFormat: string(auth.GetPasswordHashFormat(u.PasswordHash)),
+		CreatedAt:  u.CreatedAt,
+		UpdatedAt:  u.UpdatedAt,
+	}
+}
+
+// Save the user to database, caller must hold the lock
+func (d *Directory) saveUser(user *User) error {
+	user.UpdatedAt = time.Now().Unix()
+	return d.Options.Database.Write(userTable, user.Username, user)
+}
+
+// Check the group IDs exist and remove duplicates, caller must hold the lock
+func (d *Directory) cleanGroupIDs(groupIDs []string) ([]string, error) {
+	results := []string{}
+	seen := map[string]bool{}
+	for _, id := range groupIDs {
+		id = strings.TrimSpace(id)
+		if id == "" || seen[id] {
+			continue
+		}
+		if _, ok := d.groups[id]; !ok {
+			return nil, errors.New("group not found: " + id)
+		}
+		seen[id] = true
+		results = append(results, id)
+	}
+	return results, nil
+}
+
+// List all users, sorted by username
+func (d *Directory) ListUsers() []*UserInfo {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	results := []*UserInfo{}
+	for _, user := range d.users {
+		results = append(results, user.info())
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Username < results[j].Username
+	})
+	return results
+}
+
+// Get a user by username
+func (d *Directory) GetUser(username string) (*UserInfo, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	user, ok := d.users[username]
+	if !ok {
+		return nil, errors.New("user not found")
+	}
+	return user.info(), nil
+}
+
+// Create a new user with the given password and groups
+func (d *Directory) CreateUser(username string, password string, groupIDs []string) error {
+	if err := ValidateUsername(username); err != nil {
+		return err
+	}
+	if password == "" {
+		return errors.New("password cannot be empty")
+	}
+	passwordHash, err := auth.HashPassword(password)
+	if err != nil {
+		return err
+	}
+	return d.addUser(username, passwordHash, groupIDs, false)
+}
+
+// Add a user with an existing password hash, overwrite replace the hash of an existing user
+func (d *Directory) addUser(username string, passwordHash string, groupIDs []string, overwrite bool) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	groupIDs, err := d.cleanGroupIDs(groupIDs)
+	if err != nil {
+		return err
+	}
+
+	if existing, ok := d.users[username]; ok {
+		if !overwrite {
+			return errors.New("user with same name already exists")
+		}
+		existing.PasswordHash = passwordHash
+		for _, id := range groupIDs {
+			if !contains(existing.Groups, id) {
+				existing.Groups = append(existing.Groups, id)
+			}
+		}
+		return d.saveUser(existing)
+	}
+
+	user := &User{
+		Username:     username,
+		PasswordHash: passwordHash,
+		Groups:       groupIDs,
+		CreatedAt:    time.Now().Unix(),
+	}
+	if err := d.saveUser(user); err != nil {
+		return err
+	}
+	d.users[username] = user
+	d.logf("User "+username+" created", nil)
+	return nil
+}
+
+// Set the password of a user, applied to every endpoint using this user
+func (d *Directory) SetPassword(username string, password string) error {
+	if password == "" {
+		return errors.New("password cannot be empty")
+	}
+	passwordHash, err := auth.HashPassword(password)
+	if err != nil {
+		return err
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	user, ok := d.users[username]
+	if !ok {
+		return errors.New("user not found")
+	}
+	user.PasswordHash = passwordHash
+	d.logf("Password of user "+username+" updated", nil)
+	return d.saveUser(user)
+}
+
+// Replace the groups of a user
+func (d *Directory) SetUserGroups(username string, groupIDs []string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	user, ok := d.users[username]
+	if !ok {
+		return errors.New("user not found")
+	}
+	groupIDs, err := d.cleanGroupIDs(groupIDs)
+	if err != nil {
+		return err
+	}
+	user.Groups = groupIDs
+	return d.saveUser(user)
+}
+
+// Enable or disable a user
+func (d *Directory) SetUserDisabled(username string, disabled bool) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	user, ok := d.users[username]
+	if !ok {
+		return errors.New("user not found")
+	}
+	user.Disabled = disabled
+	return d.saveUser(user)
+}
+
+// Remove a user from the directory
+func (d *Directory) RemoveUser(username string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if _, ok := d.users[username]; !ok {
+		return errors.New("user not found")
+	}
+	if err := d.Options.Database.Delete(userTable, username); err != nil {
+		return err
+	}
+	delete(d.users, username)
+	d.logf("User "+username+" removed", nil)
+	return nil
+}
+
+/* Groups */
+
+// List all groups with their member counts, sorted by name
+func (d *Directory) ListGroups() []*GroupInfo {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	results := []*GroupInfo{}
+	for _, group := range d.groups {
+		members := 0
+		for _, user := range d.users {
+			if contains(user.Groups, group.ID) {
+				members++
+			}
+		}
+		results = append(results, &GroupInfo{
+			ID:          group.ID,
+			Name:        group.Name,
+			Description: group.Description,
+			Members:     members,
+		})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return strings.ToLower(results[i].Name) < strings.ToLower(results[j].Name)
+	})
+	return results
+}
+
+// Check if a group with the given ID exists
+func (d *Directory) GroupExists(groupID string) bool {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	_, ok := d.groups[groupID]
+	return ok
+}
+
+// Check the group name is not used by another group, caller must hold the lock
+func (d *Directory) checkGroupName(name string, excludeID string) error {
+	if name == "" {
+		return errors.New("group name cannot be empty")
+	}
+	for _, group := range d.groups {
+		if group.ID != excludeID && strings.EqualFold(group.Name, name) {
+			return errors.New("group with same name already exists")
+		}
+	}
+	return nil
+}
+
+// Create a new group and return its ID
+func (d *Directory) CreateGroup(name string, description string) (string, error) {
+	name = strings.TrimSpace(name)
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if err := d.checkGroupName(name, ""); err != nil {
+		return "", err
+	}
+	group := &Group{
+		ID:          uuid.New().String(),
+		Name:        name,
+		Description: description,
+	}
+	if err := d.Options.Database.Write(groupTable, group.ID, group); err != nil {
+		return "", err
+	}
+	d.groups[group.ID] = group
+	d.logf("Group "+name+" created", nil)
+	return group.ID, nil
+}
+
+// Update the name and description of a group
+func (d *Directory) UpdateGroup(groupID string, name string, description string) error {
+	name = strings.TrimSpace(name)
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	group, ok := d.groups[groupID]
+	if !ok {
+		return errors.New("group not found")
+	}
+	if err := d.checkGroupName(name, groupID); err != nil {
+		return err
+	}
+	group.Name = name
+	group.Description = description
+	return d.Options.Database.Write(groupTable, group.ID, group)
+}
+
+// Remove a group and its memberships. Endpoints referencing
+// the removed group no longer grant access through it
+func (d *Directory) RemoveGroup(groupID string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	group, ok := d.groups[groupID]
+	if !ok {
+		return errors.New("group not found")
+	}
+	for _, user := range d.users {
+		if contains(user.Groups, groupID) {
+			user.Groups = remove(user.Groups, groupID)
+			d.saveUser(user)
+		}
+	}
+	if err := d.Options.Database.Delete(groupTable, groupID); err != nil {
+		return err
+	}
+	delete(d.groups, groupID)
+	d.logf("Group "+group.Name+" removed", nil)
+	return nil
+}
+
+/* Authentication */
+
+// Authenticate check the credential of a user in any of the given groups.
+// Legacy password hashes are upgraded on successful login
+func (d *Directory) Authenticate(username string, password string, groupIDs []string) bool {
+	d.lock.RLock()
+	user, ok := d.users[username]
+	var passwordHash string
+	allowed := false
+	if ok && !user.Disabled {
+		passwordHash = user.PasswordHash
+		for _, id := range groupIDs {
+			if contains(user.Groups, id) {
+				allowed = true
+				break
+			}
+		}
+	}
+	d.lock.RUnlock()
+	if !allowed {
+		return false
+	}
+
+	passwordCorrect, needsRehash := d.cache.Verify(username, password, passwordHash)
+	if !passwordCorrect {
+		return false
+	}
+	if needsRehash {
+		d.upgradeHash(username, password, passwordHash)
+	}
+	return true
+}
+
+// Replace the password hash of the user if it is not changed in the meantime
+func (d *Directory) upgradeHash(username string, password string, oldHash string) {
+	newHash, err := auth.HashPassword(password)
+	if err != nil {
+		return
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	user, ok := d.users[username]
+	if !ok || user.PasswordHash != oldHash {
+		return
+	}
+	user.PasswordHash = newHash
+	if err := d.saveUser(user); err != nil {
+		d.logf("Unable to upgrade password hash of "+username, err)
+	}
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func remove(list []string, value string) []string {
+	results := []string{}
+	for _, v := range list {
+		if v != value {
+			results = append(results, v)
+		}
+	}
+	return results
+}
@@ -0,0 +1,144 @@
+package userdir
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+	"imuslab.com/zoraxy/mod/database"
+	"imuslab.com/zoraxy/mod/database/dbinc"
+)
+
+func newTestDirectory(t *testing.T, dbfile string) *Directory {
+	db, err := database.NewDatabase(dbfile, dbinc.BackendBoltDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+	d, err := NewDirectory(&Options{Database: db})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestDirectoryAuthenticate(t *testing.T) {
+	d := newTestDirectory(t, filepath.Join(t.TempDir(), "sys.db"))
+
+	staff, err := d.CreateGroup("Staff", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	admins, _ := d.CreateGroup("Admins", "")
+	if _, err := d.CreateGroup("staff", ""); err == nil {
+		t.Error("duplicated group name accepted")
+	}
+	if err := d.CreateUser("alice", "secret", []string{"no-such-group"}); err == nil {
+		t.Error("user created with unknown group")
+	}
+	if err := d.CreateUser("alice", "secret", []string{staff}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CreateUser("alice", "other", nil); err == nil {
+		t.Error("duplicated user accepted")
+	}
+
+	if !d.Authenticate("alice", "secret", []string{staff}) {
+		t.Error("valid credential rejected")
+	}
+	if d.Authenticate("alice", "secret", []string{admins}) {
+		t.Error("user accepted for group it is not in")
+	}
+	if d.Authenticate("alice", "wrong", []string{staff}) {
+		t.Error("wrong password accepted")
+	}
+	if d.Authenticate("bob", "secret", []string{staff}) {
+		t.Error("unknown user accepted")
+	}
+
+	//Password change apply immediately
+	if err := d.SetPassword("alice", "changed"); err != nil {
+		t.Fatal(err)
+	}
+	if d.Authenticate("alice", "secret", []string{staff}) {
+		t.Error("old password accepted after change")
+	}
+	if !d.Authenticate("alice", "changed", []string{admins, staff}) {
+		t.Error("new password rejected")
+	}
+
+	d.SetUserDisabled("alice", true)
+	if d.Authenticate("alice", "changed", []string{staff}) {
+		t.Error("disabled user accepted")
+	}
+	d.SetUserDisabled("alice", false)
+
+	//Removing a group revoke access through it
+	if err := d.RemoveGroup(staff); err != nil {
+		t.Fatal(err)
+	}
+	if d.Authenticate("alice", "changed", []string{staff}) {
+		t.Error("user accepted through removed group")
+	}
+	if user, _ := d.GetUser("alice"); len(user.Groups) != 0 {
+		t.Errorf("removed group still in memberships: %v", user.Groups)
+	}
+}
+
+func TestDirectoryPersistence(t *testing.T) {
+	dbfile := filepath.Join(t.TempDir(), "sys.db")
+	db, err := database.NewDatabase(dbfile, dbinc.BackendBoltDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, _ := NewDirectory(&Options{Database: db})
+	groupID, _ := d.CreateGroup("Staff", "Office staff")
+	d.CreateUser("alice", "secret", []string{groupID})
+	db.Close()
+
+	d = newTestDirectory(t, dbfile)
+	if !d.GroupExists(groupID) {
+		t.Fatal("group not loaded from database")
+	}
+	if !d.Authenticate("alice", "secret", []string{groupID}) {
+		t.Error("user not loaded from database")
+	}
+}
+
+func TestHtpasswdImportExport(t *testing.T) {
+	d := newTestDirectory(t, filepath.Join(t.TempDir(), "sys.db"))
+	groupID, _ := d.CreateGroup("Imported", "")
+
+	bobHash, _ := bcrypt.GenerateFromPassword([]byte("bobpass"), bcrypt.MinCost)
+	content := "# comment\n" +
+		"bob:" + string(bobHash) + "\n" +
+		"carol:$apr1$abcdefgh$0123456789abcdefghijkl\n" +
+		"invalid line\n"
+	result, err := d.ImportHtpasswd([]byte(content), []string{groupID}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Imported) != 1 || result.Imported[0] != "bob" {
+		t.Errorf("unexpected imported users: %v", result.Imported)
+	}
+	if _, ok := result.Skipped["carol"]; !ok {
+		t.Error("md5 hash not skipped")
+	}
+	if _, ok := result.Skipped["line 4"]; !ok {
+		t.Error("invalid line not skipped")
+	}
+	if !d.Authenticate("bob", "bobpass", []string{groupID}) {
+		t.Error("imported user rejected")
+	}
+
+	d.CreateUser("dave", "davepass", []string{groupID})
+	exported, err := d.ExportHtpasswd(groupID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(exported)), "\n")
+	if len(lines) != 2 || lines[0] != "bob:"+string(bobHash) || !strings.HasPrefix(lines[1], "# dave:") {
+		t.Errorf("unexpected export:\n%s", exported)
+	}
+}
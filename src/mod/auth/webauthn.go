@@ -0,0 +1,569 @@
+package auth
+
+/*
+	webauthn.go
+
+	WebAuthn / passkey support for the management accounts.
+	Credentials can be used as the second factor after the password,
+	or to login without password if the authenticator verified the user.
+
+	Attestation is not verified ("none" conveyance), the browser send the
+	public key in SPKI format with getPublicKey() so no CBOR decoding is needed
+*/
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jellydator/ttlcache/v3"
+	"imuslab.com/zoraxy/mod/utils"
+)
+
+// COSE algorithm identifiers
+const (
+	coseAlgES256 = -7
+	coseAlgEdDSA = -8
+	coseAlgRS256 = -257
+)
+
+// Authenticator data flags
+const (
+	authDataFlagUserPresent        = 0x01
+	authDataFlagUserVerified       = 0x04
+	authDataFlagAttestedCredential = 0x40
+)
+
+// WebAuthnCredential is a public key credential registered by a user
+type WebAuthnCredential struct {
+	ID        string //Base64url encoded credential ID
+	Name      string
+	PublicKey []byte //PKIX encoded public key
+	Algorithm int    //COSE algorithm identifier
+	SignCount uint32
+	CreatedAt int64
+	LastUsed  int64
+}
+
+// WebAuthnCredentialInfo is the credential info shown to the user
+type WebAuthnCredentialInfo struct {
+	ID        string
+	Name      string
+	CreatedAt int64
+	LastUsed  int64
+}
+
+func (c *WebAuthnCredential) Info() *WebAuthnCredentialInfo {
+	return &WebAuthnCredentialInfo{
+		ID:        c.ID,
+		Name:      c.Name,
+		CreatedAt: c.CreatedAt,
+		LastUsed:  c.LastUsed,
+	}
+}
+
+// A challenge sent to the browser waiting for the authenticator response
+type webauthnChallenge struct {
+	Username     string //Registering user or user of the pending login, empty for passkey login
+	Registration bool
+	LoginToken   string //Pending password login finished by this assertion
+}
+
+type collectedClientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+type authenticatorData struct {
+	RPIDHash     []byte
+	Flags        byte
+	SignCount    uint32
+	CredentialID []byte //Only set if attested credential data is included
+}
+
+/*
+	Credential Storage
+*/
+
+func (a *AuthAgent) webauthnCredentials(username string) []*WebAuthnCredential {
+	credentials := []*WebAuthnCredential{}
+	a.Database.Read("auth", "webauthn/"+username, &credentials)
+	return credentials
+}
+
+func (a *AuthAgent) saveWebAuthnCredentials(username string, credentials []*WebAuthnCredential) error {
+	if len(credentials) == 0 {
+		return a.Database.Delete("auth", "webauthn/"+username)
+	}
+	return a.Database.Write("auth", "webauthn/"+username, credentials)
+}
+
+// Find the owner of a credential ID, return empty username if not found
+func (a *AuthAgent) findWebAuthnCredential(credentialID string) (string, *WebAuthnCredential) {
+	entries, _ := a.Database.ListTable("auth")
+	for _, keypairs := range entries {
+		key := string(keypairs[0])
+		if !strings.HasPrefix(key, "webauthn/") {
+			continue
+		}
+		username := strings.TrimPrefix(key, "webauthn/")
+		for _, credential := range a.webauthnCredentials(username) {
+			if credential.ID == credentialID {
+				return username, credential
+			}
+		}
+	}
+	return "", nil
+}
+
+/*
+	Verification
+*/
+
+func decodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// Get the relying party ID, which is the hostname of the management interface
+func relyingPartyID(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	return strings.Trim(host, "[]")
+}
+
+func (a *AuthAgent) newWebAuthnChallenge(challenge *webauthnChallenge) string {
+	buf := make([]byte, 32)
+	rand.Read(buf)
+	encoded := base64.RawURLEncoding.EncodeToString(buf)
+	a.webauthnChallenges.Set(encoded, challenge, ttlcache.DefaultTTL)
+	return encoded
+}
+
+// Check the client data and consume its challenge
+func (a *AuthAgent) verifyClientData(r *http.Request, clientDataJSON []byte, expectedType string) (*webauthnChallenge, error) {
+	clientData := collectedClientData{}
+	if err := json.Unmarshal(clientDataJSON, &clientData); err != nil {
+		return nil, errors.New("invalid client data")
+	}
+	if clientData.Type != expectedType {
+		return nil, errors.New("invalid client data type")
+	}
+	origin, err := url.Parse(clientData.Origin)
+	if err != nil || !strings.EqualFold(origin.Host, r.Host) {
+		//Scheme is not checked as the management interface might be behind a TLS terminating proxy
+		return nil, errors.New("origin mismatch")
+	}
+	item, ok := a.webauthnChallenges.GetAndDelete(strings.TrimRight(clientData.Challenge, "="))
+	if !ok {
+		return nil, errors.New("challenge expired or not found")
+	}
+	return item.Value(), nil
+}
+
+func parseAuthenticatorData(data []byte) (*authenticatorData, error) {
+	if len(data) < 37 {
+		return nil, errors.New("authenticator data too short")
+	}
+	authData := &authenticatorData{
+		RPIDHash:  data[:32],
+		Flags:     data[32],
+		SignCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	if authData.Flags&authDataFlagAttestedCredential != 0 {
+		//16 bytes AAGUID followed by 2 bytes credential ID length
+		if len(data) < 55 {
+			return nil, errors.New("attested credential data too short")
+		}
+		idLength := int(binary.BigEndian.Uint16(data[53:55]))
+		if len(data) < 55+idLength {
+			return nil, errors.New("credential ID too short")
+		}
+		authData.CredentialID = data[55 : 55+idLength]
+	}
+	return authData, nil
+}
+
+// Check the authenticator data is issued for this relying party with user presence
+func verifyAuthenticatorData(r *http.Request, authData *authenticatorData, requireUserVerification bool) error {
+	rpIDHash := sha256.Sum256([]byte(relyingPartyID(r)))
+	if !bytes.Equal(authData.RPIDHash, rpIDHash[:]) {
+		return errors.New("relying party ID mismatch")
+	}
+	if authData.Flags&authDataFlagUserPresent == 0 {
+		return errors.New("user presence not confirmed")
+	}
+	if requireUserVerification && authData.Flags&authDataFlagUserVerified == 0 {
+		return errors.New("user verification required")
+	}
+	return nil
+}
+
+// Check the public key is supported and match the algorithm
+func parseWebAuthnPublicKey(publicKey []byte, algorithm int) (crypto.PublicKey, error) {
+	key, err := x509.ParsePKIXPublicKey(publicKey)
+	if err != nil {
+		return nil, errors.New("invalid public key")
+	}
+	switch key.(type) {
+	case *ecdsa.PublicKey:
+		if algorithm == coseAlgES256 {
+			return key, nil
+		}
+	case ed25519.PublicKey:
+		if algorithm == coseAlgEdDSA {
+			return key, nil
+		}
+	case *rsa.PublicKey:
+		if algorithm == coseAlgRS256 {
+			return key, nil
+		}
+	}
+	return nil, errors.New("unsupported public key algorithm")
+}
+
+// Verify the assertion signature over authenticator data and client data hash
+func (c *WebAuthnCredential) verifySignature(authData []byte, clientDataJSON []byte, signature []byte) error {
+	key, err := parseWebAuthnPublicKey(c.PublicKey, c.Algorithm)
+	if err != nil {
+		return err
+	}
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signedData := append(append([]byte{}, authData...), clientDataHash[:]...)
+	digest := sha256.Sum256(signedData)
+	valid := false
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		valid = ecdsa.VerifyASN1(k, digest[:], signature)
+	case ed25519.PublicKey:
+		valid = ed25519.Verify(k, signedData, signature)
+	case *rsa.PublicKey:
+		valid = rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], signature) == nil
+	}
+	if !valid {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+/*
+	Registration, require a logged in user
+*/
+
+// HandleWebAuthnRegisterBegin reply the credential creation options for the current user, require POST password.
+// A passkey can login without password, so the challenge is only issued after the password is confirmed
+func (a *AuthAgent) HandleWebAuthnRegisterBegin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "405 - Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	username, ok := a.twoFactorUser(w, r)
+	if !ok {
+		return
+	}
+	if !a.twoFactorPasswordCheck(w, r, username) {
+		return
+	}
+	excludeCredentials := []map[string]string{}
+	for _, credential := range a.webauthnCredentials(username) {
+		excludeCredentials = append(excludeCredentials, map[string]string{"type": "public-key", "id": credential.ID})
+	}
+	challenge := a.newWebAuthnChallenge(&webauthnChallenge{
+		Username:     username,
+		Registration: true,
+	})
+	js, _ := json.Marshal(map[string]interface{}{
+		"challenge": challenge,
+		"rp": map[string]string{
+			"id":   relyingPartyID(r),
+			"name": twoFactorIssuer,
+		},
+		"user": map[string]string{
+			"id":          base64.RawURLEncoding.EncodeToString([]byte(username)),
+			"name":        username,
+			"displayName": username,
+		},
+		"pubKeyCredParams": []map[string]interface{}{
+			{"type": "public-key", "alg": coseAlgES256},
+			{"type": "public-key", "alg": coseAlgEdDSA},
+			{"type": "public-key", "alg": coseAlgRS256},
+		},
+		"excludeCredentials": excludeCredentials,
+		"authenticatorSelection": map[string]string{
+			"residentKey":      "preferred",
+			"userVerification": "preferred",
+		},
+		"attestation": "none",
+		"timeout":     twoFactorLoginTimeout.Milliseconds(),
+	})
+	utils.SendJSONResponse(w, string(js))
+}
+
+// HandleWebAuthnRegisterFinish save a new credential of the current user.
+// Require POST clientDataJSON, authenticatorData, publicKey (SPKI), publicKeyAlgorithm
+// and optional name, binary values are base64url encoded
+func (a *AuthAgent) HandleWebAuthnRegisterFinish(w http.ResponseWriter, r *http.Request) {
+	username, ok := a.twoFactorUser(w, r)
+	if !ok {
+		return
+	}
+	values := map[string][]byte{}
+	for _, field := range []string{"clientDataJSON", "authenticatorData", "publicKey"} {
+		encoded, err := utils.PostPara(r, field)
+		if err != nil {
+			utils.SendErrorResponse(w, field+" not defined")
+			return
+		}
+		values[field], err = decodeBase64URL(encoded)
+		if err != nil {
+			utils.SendErrorResponse(w, "invalid "+field)
+			return
+		}
+	}
+	algorithm, err := utils.PostInt(r, "publicKeyAlgorithm")
+	if err != nil {
+		utils.SendErrorResponse(w, "publicKeyAlgorithm not defined")
+		return
+	}
+	name, _ := utils.PostPara(r, "name")
+	if name == "" {
+		name = "Passkey"
+	}
+
+	challenge, err := a.verifyClientData(r, values["clientDataJSON"], "webauthn.create")
+	if err == nil && (!challenge.Registration || challenge.Username != username) {
+		err = errors.New("challenge not issued for this registration")
+	}
+	var authData *authenticatorData
+	if err == nil {
+		authData, err = parseAuthenticatorData(values["authenticatorData"])
+	}
+	if err == nil {
+		err = verifyAuthenticatorData(r, authData, false)
+	}
+	if err == nil && len(authData.CredentialID) == 0 {
+		err = errors.New("credential ID not found in authenticator data")
+	}
+	if err == nil {
+		_, err = parseWebAuthnPublicKey(values["publicKey"], algorithm)
+	}
+	if err != nil {
+		a.Logger.PrintAndLog("auth", "WebAuthn registration of "+username+" rejected", err)
+		utils.SendErrorResponse(w, "Registration failed: "+err.Error())
+		return
+	}
+
+	credentialID := base64.RawURLEncoding.EncodeToString(authData.CredentialID)
+	if owner, _ := a.findWebAuthnCredential(credentialID); owner != "" {
+		utils.SendErrorResponse(w, "this credential is already registered")
+		return
+	}
+	credentials := append(a.webauthnCredentials(username), &WebAuthnCredential{
+		ID:        credentialID,
+		Name:      name,
+		PublicKey: values["publicKey"],
+		Algorithm: algorithm,
+		SignCount: authData.SignCount,
+		CreatedAt: time.Now().Unix(),
+	})
+	if err := a.saveWebAuthnCredentials(username, credentials); err != nil {
+		utils.SendErrorResponse(w, "unable to save credential")
+		return
+	}
+	a.Logger.PrintAndLog("auth", "WebAuthn credential "+strconv.Quote(name)+" registered for "+username, nil)
+	a.sendRecoveryCodesIfNew(w, username)
+}
+
+// HandleWebAuthnRemove remove a credential of the current user, require POST id and password
+func (a *AuthAgent) HandleWebAuthnRemove(w http.ResponseWriter, r *http.Request) {
+	username, ok := a.twoFactorUser(w, r)
+	if !ok {
+		return
+	}
+	credentialID, err := utils.PostPara(r, "id")
+	if err != nil {
+		utils.SendErrorResponse(w, "credential id not defined")
+		return
+	}
+	if !a.twoFactorPasswordCheck(w, r, username) {
+		return
+	}
+	credentials := a.webauthnCredentials(username)
+	for i, credential := range credentials {
+		if credential.ID == credentialID {
+			credentials = append(credentials[:i], credentials[i+1:]...)
+			if err := a.saveWebAuthnCredentials(username, credentials); err != nil {
+				utils.SendErrorResponse(w, "unable to remove credential")
+				return
+			}
+			a.cleanupRecoveryCodes(username)
+			a.Logger.PrintAndLog("auth", "WebAuthn credential "+strconv.Quote(credential.Name)+" removed for "+username, nil)
+			utils.SendOK(w)
+			return
+		}
+	}
+	utils.SendErrorResponse(w, "credential not found")
+}
+
+/*
+	Login
+*/
+
+// HandleWebAuthnLoginBegin reply the credential request options.
+// With POST token, the credential is used as the second factor of a password login.
+// Without token, any passkey with user verification can login
+func (a *AuthAgent) HandleWebAuthnLoginBegin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "405 - Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	token, _ := utils.PostPara(r, "token")
+	challenge := &webauthnChallenge{LoginToken: token}
+	allowCredentials := []map[string]string{}
+	userVerification := "required"
+	if token != "" {
+		item := a.pendingLogins.Get(token)
+		if item == nil {
+			utils.SendErrorResponse(w, "Login expired, please login again")
+			return
+		}
+		challenge.Username = item.Value().Username
+		for _, credential := range a.webauthnCredentials(challenge.Username) {
+			allowCredentials = append(allowCredentials, map[string]string{"type": "public-key", "id": credential.ID})
+		}
+		if len(allowCredentials) == 0 {
+			utils.SendErrorResponse(w, "no security key registered for this user")
+			return
+		}
+		userVerification = "preferred"
+	}
+
+	js, _ := json.Marshal(map[string]interface{}{
+		"challenge":        a.newWebAuthnChallenge(challenge),
+		"rpId":             relyingPartyID(r),
+		"allowCredentials": allowCredentials,
+		"userVerification": userVerification,
+		"timeout":          twoFactorLoginTimeout.Milliseconds(),
+	})
+	utils.SendJSONResponse(w, string(js))
+}
+
+// HandleWebAuthnLoginFinish verify the assertion and login the user.
+// Require POST id, clientDataJSON, authenticatorData and signature in base64url,
+// rmbme is used for passkey login without password
+func (a *AuthAgent) HandleWebAuthnLoginFinish(w http.ResponseWriter, r *http.Request) {
+	credentialID, err := utils.PostPara(r, "id")
+	if err != nil {
+		utils.SendErrorResponse(w, "credential id not defined")
+		return
+	}
+	credentialID = strings.TrimRight(credentialID, "=")
+	values := map[string][]byte{}
+	for _, field := range []string{"clientDataJSON", "authenticatorData", "signature"} {
+		encoded, err := utils.PostPara(r, field)
+		if err != nil {
+			utils.SendErrorResponse(w, field+" not defined")
+			return
+		}
+		values[field], err = decodeBase64URL(encoded)
+		if err != nil {
+			utils.SendErrorResponse(w, "invalid "+field)
+			return
+		}
+	}
+
+	challenge, err := a.verifyClientData(r, values["clientDataJSON"], "webauthn.get")
+	if err != nil || challenge.Registration {
+		utils.SendErrorResponse(w, "Login failed: invalid or expired challenge")
+		return
+	}
+
+	//Find the credential, limited to the pending login user if this is the second factor
+	var username string
+	var credential *WebAuthnCredential
+	if challenge.Username != "" {
+		for _, c := range a.webauthnCredentials(challenge.Username) {
+			if c.ID == credentialID {
+				username, credential = challenge.Username, c
+			}
+		}
+	} else {
+		username, credential = a.findWebAuthnCredential(credentialID)
+	}
+	if credential == nil {
+		a.Logger.PrintAndLog("auth", "WebAuthn login rejected: unknown credential", nil)
+		utils.SendErrorResponse(w, "Login failed: unknown credential")
+		return
+	}
+
+	authData, err := parseAuthenticatorData(values["authenticatorData"])
+	if err == nil {
+		//Passkey login replace the password, so the authenticator must verify the user
+		err = verifyAuthenticatorData(r, authData, challenge.LoginToken == "")
+	}
+	if err == nil {
+		err = credential.verifySignature(values["authenticatorData"], values["clientDataJSON"], values["signature"])
+	}
+	if err == nil && (authData.SignCount != 0 || credential.SignCount != 0) && authData.SignCount <= credential.SignCount {
+		//Counter did not increase, the authenticator might be cloned
+		err = errors.New("signature counter did not increase")
+	}
+	if err != nil {
+		a.Logger.PrintAndLog("auth", username+" WebAuthn login rejected", err)
+		utils.SendErrorResponse(w, "Login failed: "+err.Error())
+		return
+	}
+	if !a.checkExternalUser(username) {
+		//Passkey logins skip the directory password check
+		utils.SendErrorResponse(w, "Login failed: directory account is not allowed to login")
+		return
+	}
+
+	rememberme := false
+	if challenge.LoginToken != "" {
+		a.twoFactorLock.Lock()
+		item, ok := a.pendingLogins.GetAndDelete(challenge.LoginToken)
+		a.twoFactorLock.Unlock()
+		if !ok || item.Value().Username != username {
+			utils.SendErrorResponse(w, "Login expired, please login again")
+			return
+		}
+		rememberme = item.Value().RememberMe
+	} else {
+		rmbme, _ := utils.PostPara(r, "rmbme")
+		rememberme = rmbme == "true"
+	}
+
+	//Update the credential usage
+	credentials := a.webauthnCredentials(username)
+	for _, c := range credentials {
+		if c.ID == credential.ID {
+			c.SignCount = authData.SignCount
+			c.LastUsed = time.Now().Unix()
+		}
+	}
+	if err := a.saveWebAuthnCredentials(username, credentials); err != nil {
+		a.Logger.PrintAndLog("auth", "Unable to update WebAuthn credential of "+username, err)
+	}
+
+	a.LoginUserByRequest(w, r, username, rememberme)
+	a.Logger.PrintAndLog("auth", username+" logged in with security key "+strconv.Quote(credential.Name)+".", nil)
+	utils.SendOK(w)
+}
@@ -0,0 +1,247 @@
+package bandwidth
+
+/*
+	Bandwidth Shaping
+
+	Token bucket limiters for capping the throughput of
+	proxied responses and stream relays. A stream can be
+	shaped by multiple limiters at once (e.g. per endpoint,
+	per upstream and per client IP), the slowest one wins.
+*/
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	minBurstSize = 16 * 1024 //Minimum burst size in bytes, also the max chunk size for low limits
+)
+
+// Limiter is a token bucket limiting the byte rate shared by all streams using it
+type Limiter struct {
+	mu     sync.Mutex
+	rate   int64     //Bytes per second, 0 or less for unlimited
+	burst  int64     //Max tokens that can be accumulated
+	tokens float64   //Available tokens, negative when the bucket is in debt
+	last   time.Time //Last time tokens are refilled
+}
+
+// NewLimiter create a limiter with the given bytes per second, 0 for unlimited
+func NewLimiter(bytesPerSecond int64) *Limiter {
+	l := &Limiter{}
+	l.SetLimit(bytesPerSecond)
+	return l
+}
+
+// SetLimit update the bytes per second of this limiter, 0 for unlimited
+func (l *Limiter) SetLimit(bytesPerSecond int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = bytesPerSecond
+	l.burst = bytesPerSecond
+	if l.burst < minBurstSize {
+		l.burst = minBurstSize
+	}
+	l.tokens = float64(l.burst)
+	l.last = time.Now()
+}
+
+// Limit return the bytes per second of this limiter, 0 for unlimited
+func (l *Limiter) Limit() int64 {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return 0
+	}
+	return l.rate
+}
+
+// IsUnlimited return true if this limiter do not shape traffic
+func (l *Limiter) IsUnlimited() bool {
+	return l.Limit() == 0
+}
+
+// chunkSize return the largest write size that can be taken at once
+func (l *Limiter) chunkSize() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.burst)
+}
+
+// refill add the tokens accumulated since the last call, caller must hold the lock
+func (l *Limiter) refill() {
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	if l.tokens > float64(l.burst) {
+		l.tokens = float64(l.burst)
+	}
+	l.last = now
+}
+
+// reserve take n tokens and return how long the caller should wait before sending
+func (l *Limiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return 0
+	}
+
+	l.refill()
+
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+}
+
+// AllowN take n tokens if available without waiting, return false if the
+// bytes should be dropped instead (e.g. UDP packets over the limit)
+func (l *Limiter) AllowN(n int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return true
+	}
+
+	l.refill()
+
+	if l.tokens < float64(n) {
+		return false
+	}
+	l.tokens -= float64(n)
+	return true
+}
+
+// WaitN block until n bytes can be sent or the context is done
+func (l *Limiter) WaitN(ctx context.Context, n int) error {
+	wait := l.reserve(n)
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Active return the limiters that shape traffic, skipping nil and unlimited ones
+func Active(limiters ...*Limiter) []*Limiter {
+	results := []*Limiter{}
+	for _, l := range limiters {
+		if l != nil && !l.IsUnlimited() {
+			results = append(results, l)
+		}
+	}
+	return results
+}
+
+// Wait block until n bytes can be sent through all the limiters
+func Wait(ctx context.Context, n int, limiters []*Limiter) error {
+	for _, l := range limiters {
+		if err := l.WaitN(ctx, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Allow return true if n bytes can be sent through all the limiters without waiting
+func Allow(n int, limiters []*Limiter) bool {
+	for _, l := range limiters {
+		if !l.AllowN(n) {
+			return false
+		}
+	}
+	return true
+}
+
+// ChunkSize return the largest write size accepted by all the limiters
+func ChunkSize(limiters []*Limiter) int {
+	size := 0
+	for _, l := range limiters {
+		if s := l.chunkSize(); size == 0 || s < size {
+			size = s
+		}
+	}
+	return size
+}
+
+/* Per Key Limiters */
+
+// LimiterGroup hold one limiter per key (e.g. client IP) with the same rate
+type LimiterGroup struct {
+	mu        sync.Mutex
+	rate      int64
+	limiters  map[string]*groupEntry
+	lastSweep time.Time
+}
+
+type groupEntry struct {
+	limiter  *Limiter
+	lastUsed time.Time
+}
+
+const groupEntryIdleTimeout = 5 * time.Minute //Remove limiters of keys that are not seen for this long
+
+// NewLimiterGroup create a group of limiters with the given bytes per second each, 0 for unlimited
+func NewLimiterGroup(bytesPerSecond int64) *LimiterGroup {
+	return &LimiterGroup{
+		rate:      bytesPerSecond,
+		limiters:  map[string]*groupEntry{},
+		lastSweep: time.Now(),
+	}
+}
+
+// Get return the limiter of the given key, nil if the group is unlimited
+func (g *LimiterGroup) Get(key string) *Limiter {
+	if g == nil {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.rate <= 0 {
+		return nil
+	}
+
+	now := time.Now()
+	if now.Sub(g.lastSweep) > groupEntryIdleTimeout {
+		//Remove idle entries
+		for k, entry := range g.limiters {
+			if now.Sub(entry.lastUsed) > groupEntryIdleTimeout {
+				delete(g.limiters, k)
+			}
+		}
+		g.lastSweep = now
+	}
+
+	entry, ok := g.limiters[key]
+	if !ok {
+		entry = &groupEntry{limiter: NewLimiter(g.rate)}
+		g.limiters[key] = entry
+	}
+	entry.lastUsed = now
+	return entry.limiter
+}
+
+// Limit return the bytes per second of each limiter in this group, 0 for unlimited
+func (g *LimiterGroup) Limit() int64 {
+	if g == nil {
+		return 0
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.rate <= 0 {
+		return 0
+	}
+	return g.rate
+}
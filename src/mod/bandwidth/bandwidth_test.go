@@ -0,0 +1,74 @@
+package bandwidth
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestWriterShapesThroughput(t *testing.T) {
+	limiter := NewLimiter(64 * 1024)
+	buf := &bytes.Buffer{}
+	var counted int64
+	w := NewWriter(context.Background(), buf, func(n int64) { counted += n }, limiter)
+
+	//First burst is free, the next 64KB take about one second
+	start := time.Now()
+	payload := make([]byte, 128*1024)
+	n, err := w.Write(payload)
+	if err != nil || n != len(payload) {
+		t.Fatalf("write failed: %d, %v", n, err)
+	}
+	elapsed := time.Since(start)
+	if elapsed < 800*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("unexpected shaping duration %v", elapsed)
+	}
+	if counted != int64(len(payload)) || buf.Len() != len(payload) {
+		t.Errorf("unexpected byte count %d", counted)
+	}
+}
+
+func TestWriterUnlimited(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if w := NewWriter(context.Background(), buf, nil, nil, NewLimiter(0)); w != buf {
+		t.Error("unlimited writer should not be wrapped")
+	}
+}
+
+func TestWriterContextCancel(t *testing.T) {
+	limiter := NewLimiter(1024)
+	ctx, cancel := context.WithCancel(context.Background())
+	w := NewWriter(ctx, &bytes.Buffer{}, nil, limiter)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+	if _, err := w.Write(make([]byte, 64*1024)); err == nil {
+		t.Error("write should be aborted by context")
+	}
+}
+
+func TestLimiterGroup(t *testing.T) {
+	group := NewLimiterGroup(1024)
+	a := group.Get("10.0.0.1")
+	if a == nil || a != group.Get("10.0.0.1") {
+		t.Error("same key should share the same limiter")
+	}
+	if a == group.Get("10.0.0.2") {
+		t.Error("different keys should have their own limiter")
+	}
+	if NewLimiterGroup(0).Get("10.0.0.1") != nil {
+		t.Error("unlimited group should return no limiter")
+	}
+}
+
+func TestLimiterAllow(t *testing.T) {
+	limiter := NewLimiter(1024)
+	if !limiter.AllowN(minBurstSize) {
+		t.Error("first burst should be allowed")
+	}
+	if limiter.AllowN(1024) {
+		t.Error("packets over the limit should be dropped")
+	}
+}
@@ -0,0 +1,65 @@
+package bandwidth
+
+import (
+	"context"
+	"io"
+)
+
+// Writer shape the writes to the underlying writer with one or more limiters
+type Writer struct {
+	ctx      context.Context
+	dst      io.Writer
+	limiters []*Limiter
+	onWrite  func(n int64) //Called after each write with the number of bytes written, can be nil
+}
+
+// NewWriter wrap dst with the given limiters. onWrite is called after
+// each write with the number of bytes written and can be nil.
+// If none of the limiters shape traffic and onWrite is nil, dst is returned as is.
+func NewWriter(ctx context.Context, dst io.Writer, onWrite func(n int64), limiters ...*Limiter) io.Writer {
+	active := Active(limiters...)
+	if len(active) == 0 && onWrite == nil {
+		return dst
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return &Writer{
+		ctx:      ctx,
+		dst:      dst,
+		limiters: active,
+		onWrite:  onWrite,
+	}
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	if len(w.limiters) == 0 {
+		n, err := w.dst.Write(p)
+		if n > 0 && w.onWrite != nil {
+			w.onWrite(int64(n))
+		}
+		return n, err
+	}
+
+	//Split into chunks so low limits do not wait for one large burst
+	written := 0
+	chunkSize := ChunkSize(w.limiters)
+	for written < len(p) {
+		end := written + chunkSize
+		if end > len(p) {
+			end = len(p)
+		}
+		if err := Wait(w.ctx, end-written, w.limiters); err != nil {
+			return written, err
+		}
+		n, err := w.dst.Write(p[written:end])
+		written += n
+		if n > 0 && w.onWrite != nil {
+			w.onWrite(int64(n))
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
@@ -62,7 +62,7 @@ func (h *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		domainOnly = hostPath[0]
 	}
 	sep := h.Parent.GetProxyEndpointFromHostname(domainOnly)
-	if sep != nil && !sep.Disabled {
+	if sep != nil && !sep.Disabled && sep.ProxyType != ProxyTypeTlsPassthrough {
 		//Matching proxy rule found
 		//Access Check (blacklist / whitelist)
 		ruleID := sep.AccessFilterUUID
@@ -3,9 +3,12 @@ package dynamicproxy
 import (
 	"errors"
 	"net/http"
+	"slices"
 	"strings"
 
 	"imuslab.com/zoraxy/mod/auth"
+	"imuslab.com/zoraxy/mod/auth/sso/jwtauth"
+	"imuslab.com/zoraxy/mod/auth/sso/oauth2"
 	"imuslab.com/zoraxy/mod/netutils"
 )
 
@@ -48,7 +51,19 @@ func handleAuthProviderRouting(sep *ProxyEndpoint, w http.ResponseWriter, r *htt
 			return true
 		}
 	case AuthMethodOauth2:
-		err := h.handleOAuth2Auth(w, r)
+		err := h.handleOAuth2Auth(w, r, sep)
+		if err != nil {
+			h.Parent.Option.Logger.LogHTTPRequest(r, "host-http", 401, requestHostname, "")
+			return true
+		}
+	case AuthMethodSSOPortal:
+		err := h.handleSSOPortalAuth(w, r, sep)
+		if err != nil {
+			h.Parent.Option.Logger.LogHTTPRequest(r, "host-http", 401, requestHostname, "")
+			return true
+		}
+	case AuthMethodJWT:
+		err := h.handleJWTAuth(w, r, sep)
 		if err != nil {
 			h.Parent.Option.Logger.LogHTTPRequest(r, "host-http", 401, requestHostname, "")
 			return true
@@ -62,12 +77,12 @@ func handleAuthProviderRouting(sep *ProxyEndpoint, w http.ResponseWriter, r *htt
 /* Basic Auth */
 func (h *ProxyHandler) handleBasicAuthRouting(w http.ResponseWriter, r *http.Request, pe *ProxyEndpoint) error {
 	//Wrapper for oop style
-	return handleBasicAuth(w, r, pe)
+	return h.Parent.handleBasicAuth(w, r, pe)
 }
 
 // Handle basic auth logic
 // do not write to http.ResponseWriter if err return is not nil (already handled by this function)
-func handleBasicAuth(w http.ResponseWriter, r *http.Request, pe *ProxyEndpoint) error {
+func (router *Router) handleBasicAuth(w http.ResponseWriter, r *http.Request, pe *ProxyEndpoint) error {
 	if len(pe.AuthenticationProvider.BasicAuthExceptionRules) > 0 {
 		//Check if the current path matches the exception rules
 		for _, exceptionRule := range pe.AuthenticationProvider.BasicAuthExceptionRules {
@@ -113,12 +128,26 @@ func handleBasicAuth(w http.ResponseWriter, r *http.Request, pe *ProxyEndpoint)
 		return errors.New("unauthorized")
 	}
 
+	//Block clients guessing passwords before any password is hashed
+	clientIP := netutils.GetRequesterIPUntrusted(r)
+	if router.basicAuthCache.Blocked(clientIP) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte("429 - Too Many Requests"))
+		return errors.New("too many failed logins")
+	}
+
 	//Check for the credentials to see if there is one matching
-	hashedPassword := auth.Hash(p)
 	matchingFound := false
 	for _, cred := range pe.AuthenticationProvider.BasicAuthCredentials {
-		if u == cred.Username && hashedPassword == cred.PasswordHash {
+		if u != cred.Username {
+			continue
+		}
+		passwordCorrect, needsRehash := router.basicAuthCache.Verify(u, p, cred.PasswordHash)
+		if passwordCorrect {
 			matchingFound = true
+			if needsRehash {
+				router.upgradeBasicAuthHash(pe, cred, p)
+			}
 
 			//Set the X-Remote-User header
 			r.Header.Set("X-Remote-User", u)
@@ -126,16 +155,64 @@ func handleBasicAuth(w http.ResponseWriter, r *http.Request, pe *ProxyEndpoint)
 		}
 	}
 
+	//Check the users of the allowed groups in the user directory
+	if !matchingFound && len(pe.AuthenticationProvider.BasicAuthGroupIDs) > 0 && router.Option.UserDirectory != nil {
+		if router.Option.UserDirectory.Authenticate(u, p, pe.AuthenticationProvider.BasicAuthGroupIDs) {
+			matchingFound = true
+			r.Header.Set("X-Remote-User", u)
+		}
+	}
+
+	//Check the users in the LDAP directory
+	if !matchingFound && pe.AuthenticationProvider.BasicAuthLDAP && router.Option.LDAPAuthenticator != nil {
+		if router.Option.LDAPAuthenticator.AuthenticateGroups(u, p, pe.AuthenticationProvider.BasicAuthLDAPGroups) {
+			matchingFound = true
+			r.Header.Set("X-Remote-User", u)
+		}
+	}
+
 	if !matchingFound {
+		router.basicAuthCache.RecordFailure(clientIP)
 		w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
 		w.WriteHeader(401)
 		w.Write([]byte("401 - Unauthorized"))
 		return errors.New("unauthorized")
 	}
-
+	router.basicAuthCache.ResetFailures(clientIP)
 	return nil
 }
 
+// Replace the legacy password hash of the credential with the current format and save the endpoint.
+// Credentials are read by concurrent requests, so the list is replaced instead of edited in place
+func (router *Router) upgradeBasicAuthHash(pe *ProxyEndpoint, cred *BasicAuthCredentials, password string) {
+	router.basicAuthHashMutex.Lock()
+	defer router.basicAuthHashMutex.Unlock()
+	oldCredentials := pe.AuthenticationProvider.BasicAuthCredentials
+	credIndex := slices.Index(oldCredentials, cred)
+	if credIndex < 0 {
+		//Upgraded by another request or the credentials were edited
+		return
+	}
+	newHash, err := auth.HashPassword(password)
+	if err != nil {
+		return
+	}
+	newCredentials := slices.Clone(oldCredentials)
+	newCredentials[credIndex] = &BasicAuthCredentials{
+		Username:     cred.Username,
+		PasswordHash: newHash,
+	}
+	pe.AuthenticationProvider.BasicAuthCredentials = newCredentials
+	if router.Option.SaveEndpoint == nil {
+		return
+	}
+	if err := router.Option.SaveEndpoint(pe); err != nil {
+		router.Option.Logger.PrintAndLog("dprouter", "Unable to save upgraded basic auth hash of "+pe.RootOrMatchingDomain, err)
+		return
+	}
+	router.Option.Logger.PrintAndLog("dprouter", "Basic auth password hash of "+cred.Username+" on "+pe.RootOrMatchingDomain+" upgraded", nil)
+}
+
 /* Forward Auth */
 
 // Handle forward auth routing
@@ -143,6 +220,49 @@ func (h *ProxyHandler) handleForwardAuth(w http.ResponseWriter, r *http.Request)
 	return h.Parent.Option.ForwardAuthRouter.HandleAuthProviderRouting(w, r)
 }
 
-func (h *ProxyHandler) handleOAuth2Auth(w http.ResponseWriter, r *http.Request) error {
-	return h.Parent.Option.OAuth2Router.HandleOAuth2Auth(w, r)
+// Handle OAuth2 / OIDC routing with the provider and access rules of the endpoint
+func (h *ProxyHandler) handleOAuth2Auth(w http.ResponseWriter, r *http.Request, pe *ProxyEndpoint) error {
+	return h.Parent.Option.OAuth2Router.HandleOAuth2Auth(w, r, &oauth2.EndpointPolicy{
+		ProviderID:          pe.AuthenticationProvider.OAuth2ProviderID,
+		AllowedGroups:       pe.AuthenticationProvider.OAuth2AllowedGroups,
+		AllowedRoles:        pe.AuthenticationProvider.OAuth2AllowedRoles,
+		AllowedEmailDomains: pe.AuthenticationProvider.OAuth2AllowedEmailDomains,
+		ClaimHeaders:        pe.AuthenticationProvider.OAuth2ClaimHeaders,
+	})
+}
+
+/* SSO Portal */
+
+// Handle the built-in SSO portal with the allowed users of the endpoint
+func (h *ProxyHandler) handleSSOPortalAuth(w http.ResponseWriter, r *http.Request, pe *ProxyEndpoint) error {
+	if h.Parent.Option.SSOPortal == nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("500 - SSO portal not available"))
+		return errors.New("sso portal not available")
+	}
+	return h.Parent.Option.SSOPortal.HandleAuth(w, r, pe.AuthenticationProvider.SSOPortalAllowedUsers)
+}
+
+/* JWT */
+
+// Handle bearer token validation with the JWT settings of the endpoint
+func (h *ProxyHandler) handleJWTAuth(w http.ResponseWriter, r *http.Request, pe *ProxyEndpoint) error {
+	if h.Parent.Option.JWTValidator == nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("500 - JWT validator not available"))
+		return errors.New("jwt validator not available")
+	}
+	return h.Parent.Option.JWTValidator.HandleJWTAuth(w, r, pe.AuthenticationProvider.JWTPolicy())
+}
+
+// JWTPolicy return the JWT settings of the endpoint as validator policy
+func (ap *AuthenticationProvider) JWTPolicy() *jwtauth.Policy {
+	return &jwtauth.Policy{
+		JWKSURLs:       ap.JWTJwksURLs,
+		StaticKeys:     ap.JWTStaticKeys,
+		Issuers:        ap.JWTIssuers,
+		Audiences:      ap.JWTAudiences,
+		RequiredClaims: ap.JWTRequiredClaims,
+		ClaimHeaders:   ap.JWTClaimHeaders,
+	}
 }
@@ -0,0 +1,47 @@
+package dynamicproxy
+
+import (
+	"crypto/sha512"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"imuslab.com/zoraxy/mod/info/logger"
+)
+
+func TestUpgradeBasicAuthHash(t *testing.T) {
+	fmtLogger, _ := logger.NewFmtLogger()
+	saved := 0
+	router := &Router{Option: &RouterOption{
+		Logger: fmtLogger,
+		SaveEndpoint: func(endpoint *ProxyEndpoint) error {
+			saved++
+			return nil
+		},
+	}}
+	legacyHash := sha512.Sum512([]byte("secret"))
+	cred := &BasicAuthCredentials{Username: "alice", PasswordHash: hex.EncodeToString(legacyHash[:])}
+	oldCredentials := []*BasicAuthCredentials{{Username: "bob"}, cred}
+	pe := &ProxyEndpoint{
+		RootOrMatchingDomain:   "example.com",
+		AuthenticationProvider: &AuthenticationProvider{BasicAuthCredentials: oldCredentials},
+	}
+
+	router.upgradeBasicAuthHash(pe, cred, "secret")
+	newCredentials := pe.AuthenticationProvider.BasicAuthCredentials
+	if !strings.HasPrefix(newCredentials[1].PasswordHash, "$argon2id$") || newCredentials[1].Username != "alice" {
+		t.Errorf("hash not upgraded: %+v", newCredentials[1])
+	}
+	if oldCredentials[1] != cred || cred.PasswordHash != hex.EncodeToString(legacyHash[:]) {
+		t.Error("credential list read by other requests was modified")
+	}
+	if newCredentials[0] != oldCredentials[0] || saved != 1 {
+		t.Errorf("unexpected upgrade result, saved %d times", saved)
+	}
+
+	//Stale credential from a request that read the old list
+	router.upgradeBasicAuthHash(pe, cred, "secret")
+	if saved != 1 {
+		t.Error("credential upgraded twice")
+	}
+}
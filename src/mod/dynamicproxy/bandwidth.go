@@ -0,0 +1,81 @@
+package dynamicproxy
+
+/*
+	bandwidth.go
+
+	Bandwidth shaping of proxied responses per endpoint
+	and per client IP, with live reporting to the host
+	statistics collector
+*/
+
+import (
+	"net/http"
+
+	"imuslab.com/zoraxy/mod/bandwidth"
+	"imuslab.com/zoraxy/mod/netutils"
+)
+
+// Create the runtime limiters from the bandwidth settings of this endpoint
+func (ep *ProxyEndpoint) prepareBandwidthLimiters() {
+	ep.bandwidthLimiter = nil
+	ep.bandwidthLimiterPerIP = nil
+	if ep.BandwidthLimit > 0 {
+		ep.bandwidthLimiter = bandwidth.NewLimiter(ep.BandwidthLimit)
+	}
+	if ep.BandwidthLimitPerIP > 0 {
+		ep.bandwidthLimiterPerIP = bandwidth.NewLimiterGroup(ep.BandwidthLimitPerIP)
+	}
+}
+
+// Get the limiters shaping the response of this request
+func (ep *ProxyEndpoint) getBandwidthLimiters(r *http.Request) []*bandwidth.Limiter {
+	limiters := []*bandwidth.Limiter{}
+	if ep.bandwidthLimiter != nil {
+		limiters = append(limiters, ep.bandwidthLimiter)
+	}
+	if ep.bandwidthLimiterPerIP != nil {
+		limiters = append(limiters, ep.bandwidthLimiterPerIP.Get(netutils.GetRequesterIP(r)))
+	}
+	return limiters
+}
+
+// Report the bandwidth limit of the endpoint to the host statistics, called when the
+// endpoint is prepared so requests do not need to update it
+func (router *Router) reportBandwidthLimit(ep *ProxyEndpoint) {
+	collector := router.Option.HostStatsCollector
+	if collector == nil {
+		return
+	}
+
+	//Each request go through one upstream, so upstream limits only cap the host if all upstreams are limited
+	upstreamLimit := int64(0)
+	for _, origin := range ep.ActiveOrigins {
+		if origin.BandwidthLimit <= 0 {
+			upstreamLimit = 0
+			break
+		}
+		upstreamLimit = max(upstreamLimit, origin.BandwidthLimit)
+	}
+
+	//Report the tightest limit shared by all clients of this host
+	limit := ep.BandwidthLimit
+	if upstreamLimit > 0 && (limit <= 0 || upstreamLimit < limit) {
+		limit = upstreamLimit
+	}
+	collector.SetBandwidthLimit(ep.RootOrMatchingDomain, limit)
+	for _, alias := range ep.MatchingDomainAlias {
+		collector.SetBandwidthLimit(alias, limit)
+	}
+}
+
+// Get the callback that report the response traffic of the hostname
+// to the host statistics, nil if the collector is not set
+func (router *Router) getTrafficRecorder(hostname string) func(n int64) {
+	collector := router.Option.HostStatsCollector
+	if collector == nil {
+		return nil
+	}
+	return func(n int64) {
+		collector.RecordTraffic(hostname, 0, n)
+	}
+}
@@ -0,0 +1,53 @@
+package dynamicproxy
+
+import (
+	"path/filepath"
+	"testing"
+
+	"imuslab.com/zoraxy/mod/database"
+	"imuslab.com/zoraxy/mod/database/dbinc"
+	"imuslab.com/zoraxy/mod/dynamicproxy/loadbalance"
+	"imuslab.com/zoraxy/mod/hoststats"
+)
+
+func TestReportBandwidthLimit(t *testing.T) {
+	db, err := database.NewDatabase(filepath.Join(t.TempDir(), "sys.db"), dbinc.BackendBoltDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	collector, err := hoststats.NewCollector(hoststats.CollectorOption{Database: db})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer collector.Close()
+	router := &Router{Option: &RouterOption{HostStatsCollector: collector}}
+
+	tests := []struct {
+		name      string
+		limit     int64
+		upstreams []int64
+		want      int64
+	}{
+		{"unlimited", 0, []int64{0}, 0},
+		{"endpoint limit", 1000, []int64{0, 500}, 1000},
+		{"all upstreams limited", 0, []int64{300, 500}, 500},
+		{"tightest limit", 400, []int64{300, 500}, 400},
+	}
+	for _, tt := range tests {
+		ep := &ProxyEndpoint{
+			RootOrMatchingDomain: "example.com",
+			MatchingDomainAlias:  []string{"www.example.com"},
+			BandwidthLimit:       tt.limit,
+		}
+		for _, limit := range tt.upstreams {
+			ep.ActiveOrigins = append(ep.ActiveOrigins, &loadbalance.Upstream{BandwidthLimit: limit})
+		}
+		router.reportBandwidthLimit(ep)
+		for _, hostname := range []string{"example.com", "www.example.com"} {
+			if got := collector.GetHostStats(hostname).BandwidthLimit; got != tt.want {
+				t.Errorf("%s: expected limit %d of %s, got %d", tt.name, tt.want, hostname, got)
+			}
+		}
+	}
+}
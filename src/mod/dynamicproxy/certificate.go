@@ -1,6 +1,7 @@
 package dynamicproxy
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -57,3 +58,40 @@ func (router *Router) SetPreferredCertificateForDomain(ept *ProxyEndpoint, domai
 
 	return nil
 }
+
+// Get the TLS config for the incoming client hello. If the matching endpoint
+// has a TLS profile defined, a new config with the profile applied is returned.
+// Otherwise nil is returned and the global TLS config will be used
+func (router *Router) getTlsConfigForClient(helloInfo *tls.ClientHelloInfo) (*tls.Config, error) {
+	if helloInfo.ServerName == "" {
+		return nil, nil
+	}
+
+	tlsBehavior, err := router.ResolveHostSpecificTlsBehaviorForHostname(helloInfo.ServerName)
+	if err != nil || tlsBehavior.TlsProfile.IsDefault() {
+		//Use global TLS config
+		return nil, nil
+	}
+
+	config := router.newBaseTlsConfig()
+	err = tlsBehavior.TlsProfile.ApplyToConfig(config)
+	if err != nil {
+		router.Option.Logger.PrintAndLog("tls-router", "Invalid TLS profile for "+helloInfo.ServerName+", using global TLS options", err)
+		return nil, nil
+	}
+	return config, nil
+}
+
+// Create a TLS config using the global TLS options
+func (router *Router) newBaseTlsConfig() *tls.Config {
+	minVersion := uint16(tls.VersionTLS12) //Default to TLS 1.2
+	if router.Option.MinTLSVersion != 0 {
+		minVersion = router.Option.MinTLSVersion
+	}
+
+	return &tls.Config{
+		GetCertificate: router.Option.TlsManager.GetCert,
+		MinVersion:     minVersion,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"strings"
 	"time"
 
+	"imuslab.com/zoraxy/mod/bandwidth"
 	"imuslab.com/zoraxy/mod/dynamicproxy/domainsniff"
 	"imuslab.com/zoraxy/mod/dynamicproxy/permissionpolicy"
 )
@@ -58,6 +59,13 @@ type ReverseProxy struct {
 
 	//Appended by Zoraxy project
 
+	// FixedServerName disable the rewrite of TLS server name to the
+	// request host, set when the upstream has a SNI override
+	FixedServerName bool
+
+	// BandwidthLimiter shape the response bodies of all requests
+	// proxied to this upstream, nil for unlimited
+	BandwidthLimiter *bandwidth.Limiter
 }
 
 type ResponseRewriteRuleSet struct {
@@ -75,6 +83,10 @@ type ResponseRewriteRuleSet struct {
 	NoRemoveHopByHop               bool   //Do not remove hop-by-hop headers (advanced usecase)
 	DisableChunkedTransferEncoding bool   //Disable chunked transfer encoding
 
+	/* Bandwidth Shaping */
+	BandwidthLimiters   []*bandwidth.Limiter //Extra limiters applied to the response body, e.g. per endpoint and per client IP
+	OnResponseBodyWrite func(n int64)        //Called with the number of response body bytes written to the client, can be nil
+
 	/* System Information Payload */
 	DevelopmentMode bool   //Inject dev mode information to requests
 	Version         string //Version number of Zoraxy, use for X-Proxy-By
@@ -89,6 +101,8 @@ type DpcoreOptions struct {
 	FlushInterval           time.Duration //Duration to flush in normal requests. Stream request or keep-alive request will always flush with interval of -1 (immediately)
 	MaxConcurrentConnection int           //Maxmium concurrent requests to this server
 	ResponseHeaderTimeout   int64         //Timeout for response header, set to 0 for default
+	TLSClientConfig         *tls.Config   //Custom TLS config for upstream connections (custom CA, mTLS, SNI), nil for default
+	BandwidthLimit          int64         //Max response bytes per second shared by all requests to this upstream, 0 for unlimited
 }
 
 func NewDynamicProxyCore(target *url.URL, prepender string, dpcOptions *DpcoreOptions) *ReverseProxy {
@@ -130,12 +144,29 @@ func NewDynamicProxyCore(target *url.URL, prepender string, dpcOptions *DpcoreOp
 		}
 	}
 
+	fixedServerName := false
+	if dpcOptions.TLSClientConfig != nil {
+		//Upstream specific TLS settings, use a dedicated transport so
+		//the custom CA and client certificates are not shared
+		customTransporter := thisTransporter.(*http.Transport).Clone()
+		customTransporter.TLSClientConfig = dpcOptions.TLSClientConfig.Clone()
+		fixedServerName = customTransporter.TLSClientConfig.ServerName != ""
+		thisTransporter = customTransporter
+	}
+
+	var bandwidthLimiter *bandwidth.Limiter
+	if dpcOptions.BandwidthLimit > 0 {
+		bandwidthLimiter = bandwidth.NewLimiter(dpcOptions.BandwidthLimit)
+	}
+
 	return &ReverseProxy{
-		Director:      director,
-		Prepender:     prepender,
-		FlushInterval: dpcOptions.FlushInterval,
-		Verbal:        false,
-		Transport:     thisTransporter,
+		Director:         director,
+		Prepender:        prepender,
+		FlushInterval:    dpcOptions.FlushInterval,
+		Verbal:           false,
+		Transport:        thisTransporter,
+		FixedServerName:  fixedServerName,
+		BandwidthLimiter: bandwidthLimiter,
 	}
 }
 
@@ -176,7 +207,7 @@ var hopHeaders = []string{
 }
 
 // Copy response from src to dst with given flush interval, reference from httputil.ReverseProxy
-func (p *ReverseProxy) copyResponse(dst http.ResponseWriter, src io.Reader, flushInterval time.Duration) error {
+func (p *ReverseProxy) copyResponse(ctx context.Context, dst http.ResponseWriter, src io.Reader, flushInterval time.Duration, rrr *ResponseRewriteRuleSet) error {
 	var w io.Writer = dst
 	if flushInterval != 0 {
 		mlw := &maxLatencyWriter{
@@ -192,8 +223,18 @@ func (p *ReverseProxy) copyResponse(dst http.ResponseWriter, src io.Reader, flus
 		w = mlw
 	}
 
+	//Shape the body with the upstream, endpoint and client limiters
+	limiters := bandwidth.Active(append([]*bandwidth.Limiter{p.BandwidthLimiter}, rrr.BandwidthLimiters...)...)
+	if len(limiters) > 0 {
+		w = bandwidth.NewWriter(ctx, w, rrr.OnResponseBodyWrite, limiters...)
+	}
+
 	var buf []byte
-	_, err := p.copyBuffer(w, src, buf)
+	n, err := p.copyBuffer(w, src, buf)
+	if len(limiters) == 0 && rrr.OnResponseBodyWrite != nil && n > 0 {
+		//Unlimited responses are copied directly and reported once
+		rrr.OnResponseBodyWrite(n)
+	}
 	return err
 
 }
@@ -295,7 +336,7 @@ func (p *ReverseProxy) ProxyHTTP(rw http.ResponseWriter, req *http.Request, rrr
 	}
 
 	//Fix for issue #821
-	if outreq.URL != nil && strings.EqualFold(outreq.URL.Scheme, "https") {
+	if outreq.URL != nil && strings.EqualFold(outreq.URL.Scheme, "https") && !p.FixedServerName {
 		if tr, ok := transport.(*http.Transport); ok {
 			serverName := outreq.Host
 			if h, _, err := net.SplitHostPort(serverName); err == nil {
@@ -410,7 +451,7 @@ func (p *ReverseProxy) ProxyHTTP(rw http.ResponseWriter, req *http.Request, rrr
 
 	//Get flush interval in real time and start copying the request
 	flushInterval := p.getFlushInterval(req, res)
-	p.copyResponse(rw, res.Body, flushInterval)
+	p.copyResponse(req.Context(), rw, res.Body, flushInterval, rrr)
 
 	// close now, instead of defer, to populate res.Trailer
 	res.Body.Close()
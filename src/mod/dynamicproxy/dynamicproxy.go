@@ -2,10 +2,10 @@ package dynamicproxy
 
 import (
 	"context"
-	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -13,7 +13,9 @@ import (
 	"sync"
 	"time"
 
+	"imuslab.com/zoraxy/mod/auth"
 	"imuslab.com/zoraxy/mod/dynamicproxy/dpcore"
+	"imuslab.com/zoraxy/mod/netutils"
 )
 
 /*
@@ -30,6 +32,7 @@ func NewDynamicProxy(option RouterOption) (*Router, error) {
 		routingRules:     []*RoutingRule{},
 		loadBalancer:     option.LoadBalancer,
 		rateLimitCounter: RequestCountPerIpTable{},
+		basicAuthCache:   auth.NewCredentialCache(0),
 	}
 
 	thisRouter.mux = &ProxyHandler{
@@ -65,6 +68,31 @@ func (router *Router) UpdateHttpToHttpsRedirectSetting(useRedirect bool) {
 	router.Restart()
 }
 
+// Update inbound PROXY protocol setting, will restart the proxy server if running
+func (router *Router) UpdateProxyProtocolSetting(enabled bool, trustedCIDRs []string) {
+	router.Option.AcceptProxyProtocol = enabled
+	router.Option.TrustedProxyCIDRs = trustedCIDRs
+	router.Restart()
+}
+
+// Listen on the given address, parsing PROXY protocol header from trusted proxies if enabled
+func (router *Router) listen(addr string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if !router.Option.AcceptProxyProtocol {
+		return listener, nil
+	}
+
+	ppListener, err := netutils.NewProxyProtocolListener(listener, router.Option.TrustedProxyCIDRs)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return ppListener, nil
+}
+
 // Start the dynamic routing
 func (router *Router) StartProxyService() error {
 	//Create a new server object
@@ -77,15 +105,9 @@ func (router *Router) StartProxyService() error {
 		return errors.New("reverse proxy router root not set")
 	}
 
-	minVersion := tls.VersionTLS12 //Default to TLS 1.2
-	if router.Option.MinTLSVersion != 0 {
-		minVersion = int(router.Option.MinTLSVersion)
-	}
-
-	config := &tls.Config{
-		GetCertificate: router.Option.TlsManager.GetCert,
-		MinVersion:     uint16(minVersion),
-	}
+	config := router.newBaseTlsConfig()
+	//Per host TLS profiles are resolved on ClientHello
+	config.GetConfigForClient = router.getTlsConfigForClient
 
 	//Start rate limitor
 	err := router.startRateLimterCounterResetTicker()
@@ -94,6 +116,11 @@ func (router *Router) StartProxyService() error {
 	}
 
 	if router.Option.UseTls {
+		listener, err := router.listen(":" + strconv.Itoa(router.Option.Port))
+		if err != nil {
+			router.Option.Logger.PrintAndLog("dprouter", "Could not start proxy server", err)
+			return err
+		}
 		router.server = &http.Server{
 			Addr:      ":" + strconv.Itoa(router.Option.Port),
 			Handler:   router.mux,
@@ -146,7 +173,7 @@ func (router *Router) StartProxyService() error {
 
 						//Validate basic auth
 						if sep.AuthenticationProvider.AuthMethod == AuthMethodBasic {
-							err := handleBasicAuth(w, r, sep)
+							err := router.handleBasicAuth(w, r, sep)
 							if err != nil {
 								return
 							}
@@ -237,7 +264,11 @@ func (router *Router) StartProxyService() error {
 
 			//Start the http server that listens to port 80 and redirect to 443
 			go func() {
-				if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				l, err := router.listen(httpServer.Addr)
+				if err == nil {
+					err = httpServer.Serve(l)
+				}
+				if err != nil && err != http.ErrServerClosed {
 					//Unable to startup port 80 listener. Handle shutdown process gracefully
 					stopChan <- true
 					log.Fatalf("Could not start redirection server: %v\n", err)
@@ -246,22 +277,28 @@ func (router *Router) StartProxyService() error {
 			router.tlsRedirectStop = stopChan
 		}
 
-		//Start the TLS server
+		//Start the TLS server. The listener peek at the SNI to route TLS passthrough connections
+		router.tlsListener = newSNIListener(listener, router)
 		router.Option.Logger.PrintAndLog("dprouter", "Reverse proxy service started in the background (TLS mode)", nil)
-		go func() {
-			if err := router.server.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
+		go func(srv *http.Server, l net.Listener) {
+			if err := srv.ServeTLS(l, "", ""); err != nil && err != http.ErrServerClosed {
 				router.Option.Logger.PrintAndLog("dprouter", "Could not start proxy server", err)
 			}
-		}()
+		}(router.server, router.tlsListener)
 	} else {
 		//Serve with non TLS mode
+		listener, err := router.listen(":" + strconv.Itoa(router.Option.Port))
+		if err != nil {
+			router.Option.Logger.PrintAndLog("dprouter", "Could not start proxy server", err)
+			return err
+		}
 		router.tlsListener = nil
 		router.server = &http.Server{Addr: ":" + strconv.Itoa(router.Option.Port), Handler: router.mux}
 		router.Running = true
 		router.Option.Logger.PrintAndLog("dprouter", "Reverse proxy service started in the background (Plain HTTP mode)", nil)
-		go func() {
-			router.server.ListenAndServe()
-		}()
+		go func(srv *http.Server, l net.Listener) {
+			srv.Serve(l)
+		}(router.server, listener)
 	}
 
 	return nil
@@ -9,6 +9,7 @@ import (
 	"golang.org/x/text/language"
 	"imuslab.com/zoraxy/mod/dynamicproxy/loadbalance"
 	"imuslab.com/zoraxy/mod/dynamicproxy/rewrite"
+	"imuslab.com/zoraxy/mod/tlscert"
 )
 
 /*
@@ -187,7 +188,11 @@ func (ep *ProxyEndpoint) AddUpstreamOrigin(newOrigin *loadbalance.Upstream, acti
 
 	if activate {
 		//Add it to the active origin list
-		err := newOrigin.StartProxy()
+		var tlsManager *tlscert.Manager
+		if ep.parent != nil {
+			tlsManager = ep.parent.Option.TlsManager
+		}
+		err := newOrigin.StartProxy(tlsManager)
 		if err != nil {
 			return err
 		}
@@ -1,6 +1,7 @@
 package loadbalance
 
 import (
+	"crypto/tls"
 	"strings"
 	"sync"
 	"time"
@@ -42,6 +43,12 @@ type Upstream struct {
 	SkipCertValidations      bool   //Set to true to accept self signed certs
 	SkipWebSocketOriginCheck bool   //Skip origin check on websocket upgrade connections
 
+	//Upstream TLS Configs
+	CustomCABundle   string   //PEM encoded CA certificates to trust for this upstream, if empty, use system CA pool
+	ClientCertName   string   //Name of the certificate in cert store to present to upstream (mTLS), if empty, no client cert
+	SNIOverride      string   //Server name to send to upstream in TLS handshake, if empty, use the request host
+	PinnedSPKIHashes []string //Base64 SHA-256 hashes of the upstream certificate public key, if set, one of them must match
+
 	//Load balancing configs
 	Weight int //Random weight for round robin, 0 for fallback only
 
@@ -49,8 +56,12 @@ type Upstream struct {
 	MaxConn     int   //Maxmium concurrent requests to this upstream dpcore instance
 	RespTimeout int64 //Response header timeout in milliseconds
 
+	//Bandwidth Shaping
+	BandwidthLimit int64 //Max response bytes per second from this upstream, 0 for unlimited
+
 	//currentConnectionCounts atomic.Uint64 //Counter for number of client currently connected
-	proxy *dpcore.ReverseProxy
+	proxy     *dpcore.ReverseProxy
+	tlsConfig *tls.Config
 }
 
 // Create a new load balancer
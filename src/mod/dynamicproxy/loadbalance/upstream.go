@@ -9,11 +9,13 @@ import (
 	"time"
 
 	"imuslab.com/zoraxy/mod/dynamicproxy/dpcore"
+	"imuslab.com/zoraxy/mod/tlscert"
 )
 
 // StartProxy create and start a HTTP proxy using dpcore
 // Example of webProxyEndpoint: https://example.com:443 or http://192.168.1.100:8080
-func (u *Upstream) StartProxy() error {
+// tlsManager is used for loading client certificates, can be nil if the upstream do not use mTLS
+func (u *Upstream) StartProxy(tlsManager *tlscert.Manager) error {
 	//Filter the tailing slash if any
 	domain := u.OriginIpOrDomain
 	if len(domain) == 0 {
@@ -38,14 +40,22 @@ func (u *Upstream) StartProxy() error {
 		return err
 	}
 
+	tlsConfig, err := u.BuildTLSClientConfig(tlsManager)
+	if err != nil {
+		return err
+	}
+
 	proxy := dpcore.NewDynamicProxyCore(path, "", &dpcore.DpcoreOptions{
 		IgnoreTLSVerification:   u.SkipCertValidations,
 		FlushInterval:           100 * time.Millisecond,
 		ResponseHeaderTimeout:   u.RespTimeout,
 		MaxConcurrentConnection: u.MaxConn,
+		TLSClientConfig:         tlsConfig,
+		BandwidthLimit:          u.BandwidthLimit,
 	})
 
 	u.proxy = proxy
+	u.tlsConfig = tlsConfig
 	return nil
 }
 
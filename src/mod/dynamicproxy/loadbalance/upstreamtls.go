@@ -0,0 +1,97 @@
+package loadbalance
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"strings"
+
+	"imuslab.com/zoraxy/mod/tlscert"
+)
+
+/*
+	Upstream TLS
+
+	This script handle the TLS client settings used when
+	connecting to an upstream, including custom CA trust,
+	client certificate (mTLS), SNI override and SPKI pinning
+*/
+
+// HasCustomTLSOptions return true if the upstream require a custom TLS client config
+func (u *Upstream) HasCustomTLSOptions() bool {
+	return strings.TrimSpace(u.CustomCABundle) != "" ||
+		strings.TrimSpace(u.ClientCertName) != "" ||
+		strings.TrimSpace(u.SNIOverride) != "" ||
+		len(u.PinnedSPKIHashes) > 0
+}
+
+// BuildTLSClientConfig generate the TLS config for connecting to this upstream.
+// Return nil if the upstream do not have any custom TLS options
+func (u *Upstream) BuildTLSClientConfig(tlsManager *tlscert.Manager) (*tls.Config, error) {
+	if !u.HasCustomTLSOptions() {
+		return nil, nil
+	}
+
+	config := &tls.Config{
+		InsecureSkipVerify: u.SkipCertValidations,
+		ServerName:         strings.TrimSpace(u.SNIOverride),
+	}
+
+	//Custom CA trust
+	if strings.TrimSpace(u.CustomCABundle) != "" {
+		caPool := x509.NewCertPool()
+		if !caPool.AppendCertsFromPEM([]byte(u.CustomCABundle)) {
+			return nil, errors.New("no valid certificate found in custom CA bundle")
+		}
+		config.RootCAs = caPool
+	}
+
+	//Client certificate for mTLS
+	if strings.TrimSpace(u.ClientCertName) != "" {
+		if tlsManager == nil {
+			return nil, errors.New("certificate store not available for loading client certificate")
+		}
+		clientCert, err := tlsManager.LoadCertificateByName(u.ClientCertName)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{*clientCert}
+	}
+
+	//SPKI pinning, at least one certificate in the chain must match
+	if len(u.PinnedSPKIHashes) > 0 {
+		pins := map[string]bool{}
+		for _, pin := range u.PinnedSPKIHashes {
+			pin = strings.TrimPrefix(strings.TrimSpace(pin), "sha256/")
+			decoded, err := base64.StdEncoding.DecodeString(pin)
+			if err != nil || len(decoded) != sha256.Size {
+				return nil, errors.New("invalid SPKI pin: " + pin)
+			}
+			pins[pin] = true
+		}
+
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			for _, cert := range cs.PeerCertificates {
+				if pins[GetSPKIHash(cert)] {
+					return nil
+				}
+			}
+			return errors.New("upstream certificate does not match any pinned SPKI hash")
+		}
+	}
+
+	return config, nil
+}
+
+// GetTLSClientConfig return the TLS config used by this upstream, nil if using default
+func (u *Upstream) GetTLSClientConfig() *tls.Config {
+	return u.tlsConfig
+}
+
+// GetSPKIHash return the base64 encoded SHA-256 hash of the certificate public key (SPKI)
+func GetSPKIHash(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
@@ -0,0 +1,120 @@
+package loadbalance
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"imuslab.com/zoraxy/mod/info/logger"
+	"imuslab.com/zoraxy/mod/tlscert"
+)
+
+// Write a self-signed client certificate into the cert store folder
+func writeTestClientCert(t *testing.T, certStore string, name string) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "zoraxy-client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	os.WriteFile(filepath.Join(certStore, name+".pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	os.WriteFile(filepath.Join(certStore, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0644)
+	cert, _ := x509.ParseCertificate(der)
+	return cert
+}
+
+func TestUpstreamMutualTLS(t *testing.T) {
+	certStore := t.TempDir()
+	clientCert := writeTestClientCert(t, certStore, "internal-client")
+	fmtLogger, _ := logger.NewFmtLogger()
+	tlsManager, err := tlscert.NewManager(certStore, fmtLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//Upstream that require a client cert signed by our test client cert
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	server.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clientCAs,
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	caBundle := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+
+	tests := []struct {
+		name     string
+		upstream *Upstream
+		wantErr  bool
+	}{
+		{"system CA pool rejects private CA", &Upstream{ClientCertName: "internal-client"}, true},
+		{"missing client cert", &Upstream{CustomCABundle: caBundle}, true},
+		{"custom CA with client cert", &Upstream{CustomCABundle: caBundle, ClientCertName: "internal-client"}, false},
+		{"SNI override verified against CA", &Upstream{CustomCABundle: caBundle, ClientCertName: "internal-client", SNIOverride: "example.com"}, false},
+		{"SNI override not in certificate", &Upstream{CustomCABundle: caBundle, ClientCertName: "internal-client", SNIOverride: "internal.lan"}, true},
+		{"matching SPKI pin", &Upstream{SkipCertValidations: true, ClientCertName: "internal-client", PinnedSPKIHashes: []string{GetSPKIHash(server.Certificate())}}, false},
+		{"mismatch SPKI pin", &Upstream{SkipCertValidations: true, ClientCertName: "internal-client", PinnedSPKIHashes: []string{GetSPKIHash(clientCert)}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tlsConfig, err := tt.upstream.BuildTLSClientConfig(tlsManager)
+			if err != nil {
+				t.Fatalf("BuildTLSClientConfig failed: %v", err)
+			}
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+			resp, err := client.Get(server.URL)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("request error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestUpstreamTLSConfigValidation(t *testing.T) {
+	if config, err := (&Upstream{}).BuildTLSClientConfig(nil); config != nil || err != nil {
+		t.Errorf("Expected nil config for upstream without TLS options")
+	}
+
+	if _, err := (&Upstream{CustomCABundle: "not a pem"}).BuildTLSClientConfig(nil); err == nil {
+		t.Errorf("Expected error for invalid CA bundle")
+	}
+
+	if _, err := (&Upstream{PinnedSPKIHashes: []string{"abc"}}).BuildTLSClientConfig(nil); err == nil {
+		t.Errorf("Expected error for invalid SPKI pin")
+	}
+
+	if _, err := (&Upstream{ClientCertName: "missing"}).BuildTLSClientConfig(nil); err == nil {
+		t.Errorf("Expected error for client cert without cert store")
+	}
+}
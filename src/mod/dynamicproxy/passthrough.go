@@ -0,0 +1,261 @@
+package dynamicproxy
+
+/*
+	passthrough.go
+
+	TLS passthrough routing on the shared HTTPS port
+
+	The TLS listener peek at the ClientHello of each incoming
+	connection. If the SNI matches a passthrough endpoint, the raw
+	TCP connection is spliced to the upstream without terminating
+	TLS. Otherwise the connection is handed to the HTTP server
+	together with the peeked bytes.
+*/
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"imuslab.com/zoraxy/mod/netutils"
+	"imuslab.com/zoraxy/mod/streamproxy"
+)
+
+const (
+	clientHelloReadTimeout = 5 * time.Second      //Max time to wait for the ClientHello
+	passthroughDialTimeout = 10 * time.Second     //Max time to connect to passthrough upstream
+	acceptRetryMinDelay    = 5 * time.Millisecond //First delay before retrying a failed accept
+	acceptRetryMaxDelay    = 1 * time.Second      //Max delay between accept retries
+)
+
+// sniListener wrap the TLS port listener and route passthrough connections
+type sniListener struct {
+	net.Listener
+	router    *Router
+	conns     chan net.Conn
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newSNIListener(inner net.Listener, router *Router) *sniListener {
+	l := &sniListener{
+		Listener: inner,
+		router:   router,
+		conns:    make(chan net.Conn),
+		closed:   make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+func (l *sniListener) acceptLoop() {
+	var retryDelay time.Duration
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				l.Close()
+				return
+			}
+			//Errors like EMFILE are temporary, retry with backoff as http.Server does
+			if retryDelay == 0 {
+				retryDelay = acceptRetryMinDelay
+			} else {
+				retryDelay = min(retryDelay*2, acceptRetryMaxDelay)
+			}
+			l.router.Option.Logger.PrintAndLog("tls-passthrough", "Accept error, retrying in "+retryDelay.String(), err)
+			select {
+			case <-time.After(retryDelay):
+				continue
+			case <-l.closed:
+				return
+			}
+		}
+		retryDelay = 0
+		//Peek in its own goroutine so slow clients do not block the listener
+		go l.routeConn(conn)
+	}
+}
+
+// Peek the ClientHello and decide where the connection goes
+func (l *sniListener) routeConn(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(clientHelloReadTimeout))
+	serverName, peeked, _ := peekClientHelloServerName(conn)
+	conn.SetReadDeadline(time.Time{})
+
+	wrappedConn := &peekedConn{
+		Conn:   conn,
+		reader: io.MultiReader(bytes.NewReader(peeked), conn),
+	}
+
+	if serverName != "" {
+		ep := l.router.GetProxyEndpointFromHostname(serverName)
+		if ep != nil && !ep.Disabled && ep.ProxyType == ProxyTypeTlsPassthrough {
+			l.router.handleTlsPassthrough(wrappedConn, ep, serverName)
+			return
+		}
+	}
+
+	//Not a passthrough connection, let the HTTP server handle it
+	select {
+	case l.conns <- wrappedConn:
+	case <-l.closed:
+		conn.Close()
+	}
+}
+
+func (l *sniListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *sniListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		err = l.Listener.Close()
+	})
+	return err
+}
+
+// peekedConn replay the bytes read during ClientHello peeking
+type peekedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// readOnlyConn feed the recorded bytes to tls.Server and reject any write
+type readOnlyConn struct {
+	reader io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)         { return c.reader.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
+
+var errClientHelloPeeked = errors.New("client hello peeked")
+
+// Read the ClientHello from the connection and return the SNI server name
+// together with all bytes consumed from the connection
+func peekClientHelloServerName(conn io.Reader) (string, []byte, error) {
+	peeked := new(bytes.Buffer)
+	var serverName string
+	var helloReceived bool
+	err := tls.Server(readOnlyConn{reader: io.TeeReader(conn, peeked)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			helloReceived = true
+			//Abort the handshake, we only need the ClientHello
+			return nil, errClientHelloPeeked
+		},
+	}).Handshake()
+	if !helloReceived {
+		return "", peeked.Bytes(), err
+	}
+	return serverName, peeked.Bytes(), nil
+}
+
+// Splice the client connection to one of the upstreams of a passthrough endpoint
+func (router *Router) handleTlsPassthrough(clientConn net.Conn, ep *ProxyEndpoint, serverName string) {
+	defer clientConn.Close()
+
+	//Access Check (blacklist / whitelist)
+	ruleID := ep.AccessFilterUUID
+	if ruleID == "" {
+		ruleID = "default"
+	}
+	if router.Option.AccessController != nil {
+		accessRule, err := router.Option.AccessController.GetAccessRuleByID(ruleID)
+		if err == nil && !accessRule.AllowConnectionAccess(clientConn) {
+			router.logPassthrough("Blocked connection from "+clientConn.RemoteAddr().String()+" to "+serverName, nil, ep)
+			return
+		}
+	}
+
+	upstreamConn, err := dialPassthroughUpstream(ep)
+	if err != nil {
+		router.logPassthrough("Unable to connect to upstream of "+serverName, err, ep)
+		return
+	}
+	defer upstreamConn.Close()
+
+	if ep.PassthroughProxyProtocol != streamproxy.ProxyProtocolDisabled {
+		err = streamproxy.WriteProxyProtocolHeader(upstreamConn, clientConn, ep.PassthroughProxyProtocol)
+		if err != nil {
+			router.logPassthrough("Unable to write PROXY protocol header to upstream of "+serverName, err, ep)
+			return
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(upstreamConn, clientConn)
+		closeWrite(upstreamConn)
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(clientConn, upstreamConn)
+		closeWrite(clientConn)
+	}()
+	wg.Wait()
+}
+
+// Dial the active upstreams starting from a random one, failover to the next on error
+func dialPassthroughUpstream(ep *ProxyEndpoint) (net.Conn, error) {
+	origins := ep.ActiveOrigins
+	if len(origins) == 0 {
+		return nil, errors.New("no active upstream")
+	}
+
+	var lastErr error
+	offset := rand.Intn(len(origins))
+	for i := range origins {
+		origin := origins[(offset+i)%len(origins)]
+		conn, err := net.DialTimeout("tcp", origin.OriginIpOrDomain, passthroughDialTimeout)
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// Half close the write side if supported, so the peer receive EOF
+func closeWrite(conn net.Conn) {
+	if pc, ok := conn.(*peekedConn); ok {
+		conn = pc.Conn
+	}
+	conn = netutils.UnwrapProxyProtocolConn(conn)
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.CloseWrite()
+		return
+	}
+	conn.Close()
+}
+
+func (router *Router) logPassthrough(message string, err error, ep *ProxyEndpoint) {
+	if ep.DisableLogging && err == nil {
+		return
+	}
+	router.Option.Logger.PrintAndLog("tls-passthrough", message, err)
+}
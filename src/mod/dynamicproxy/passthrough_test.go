@@ -0,0 +1,220 @@
+package dynamicproxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"imuslab.com/zoraxy/mod/dynamicproxy/loadbalance"
+	"imuslab.com/zoraxy/mod/info/logger"
+)
+
+func TestPeekClientHelloServerName(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	go func() {
+		tls.Client(clientConn, &tls.Config{ServerName: "k8s.example.com", InsecureSkipVerify: true}).Handshake()
+	}()
+
+	serverName, peeked, err := peekClientHelloServerName(serverConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serverName != "k8s.example.com" {
+		t.Errorf("expected server name k8s.example.com, got %q", serverName)
+	}
+	//TLS record header: handshake (0x16)
+	if len(peeked) < 5 || peeked[0] != 0x16 {
+		t.Error("peeked bytes do not start with a TLS handshake record")
+	}
+}
+
+func TestSNIListenerRouting(t *testing.T) {
+	fmtLogger, _ := logger.NewFmtLogger()
+
+	//Upstream terminate its own TLS
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("from-upstream"))
+	}))
+	defer upstream.Close()
+
+	router := &Router{
+		Option:         &RouterOption{Logger: fmtLogger},
+		ProxyEndpoints: &sync.Map{},
+	}
+	router.ProxyEndpoints.Store("passthrough.example.com", &ProxyEndpoint{
+		ProxyType:            ProxyTypeTlsPassthrough,
+		RootOrMatchingDomain: "passthrough.example.com",
+		ActiveOrigins: []*loadbalance.Upstream{
+			{OriginIpOrDomain: strings.TrimPrefix(upstream.URL, "https://")},
+		},
+	})
+
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := newSNIListener(inner, router)
+	defer listener.Close()
+
+	//Non passthrough connections should be handed over with the ClientHello intact
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		hello := make([]byte, 1)
+		io.ReadFull(conn, hello)
+		if hello[0] == 0x16 {
+			conn.Write([]byte("from-http-server\n"))
+		}
+	}()
+
+	//Passthrough hostname reach the upstream TLS server directly
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{ServerName: "passthrough.example.com", InsecureSkipVerify: true},
+		},
+	}
+	resp, err := client.Get("https://" + inner.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "from-upstream" {
+		t.Errorf("expected passthrough response, got %q", body)
+	}
+
+	//Other hostname go to the HTTP server
+	conn, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go tls.Client(conn, &tls.Config{ServerName: "other.example.com", InsecureSkipVerify: true}).Handshake()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "from-http-server\n" {
+		t.Errorf("expected connection to be handed to the HTTP server, got %q (%v)", line, err)
+	}
+}
+
+func TestSNIListenerSkipDisabled(t *testing.T) {
+	fmtLogger, _ := logger.NewFmtLogger()
+	upstreamReached := make(chan struct{}, 1)
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	go func() {
+		conn, err := upstream.Accept()
+		if err == nil {
+			upstreamReached <- struct{}{}
+			conn.Close()
+		}
+	}()
+
+	router := &Router{
+		Option:         &RouterOption{Logger: fmtLogger},
+		ProxyEndpoints: &sync.Map{},
+	}
+	router.ProxyEndpoints.Store("disabled.example.com", &ProxyEndpoint{
+		ProxyType:            ProxyTypeTlsPassthrough,
+		RootOrMatchingDomain: "disabled.example.com",
+		Disabled:             true,
+		ActiveOrigins: []*loadbalance.Upstream{
+			{OriginIpOrDomain: upstream.Addr().String()},
+		},
+	})
+
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := newSNIListener(inner, router)
+	defer listener.Close()
+
+	conn, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go tls.Client(conn, &tls.Config{ServerName: "disabled.example.com", InsecureSkipVerify: true}).Handshake()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if c, err := listener.Accept(); err == nil {
+			accepted <- c
+		}
+	}()
+	select {
+	case c := <-accepted:
+		c.Close()
+	case <-upstreamReached:
+		t.Fatal("disabled passthrough rule should not reach its upstream")
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection of disabled passthrough rule should be handed to the HTTP server")
+	}
+}
+
+// Listener returning a temporary accept error before the real connections
+type flakyListener struct {
+	net.Listener
+	failures int
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if l.failures > 0 {
+		l.failures--
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Err: syscall.EMFILE}
+	}
+	return l.Listener.Accept()
+}
+
+func TestSNIListenerRetryAcceptError(t *testing.T) {
+	fmtLogger, _ := logger.NewFmtLogger()
+	router := &Router{
+		Option:         &RouterOption{Logger: fmtLogger},
+		ProxyEndpoints: &sync.Map{},
+	}
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := newSNIListener(&flakyListener{Listener: inner, failures: 3}, router)
+
+	conn, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	//Not a TLS connection, handed to the HTTP server once the peek fail
+	conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	conn.(*net.TCPConn).CloseWrite()
+
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("listener should keep accepting after temporary errors, got %v", err)
+	}
+	accepted.Close()
+
+	listener.Close()
+	if _, err := listener.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("expected net.ErrClosed after close, got %v", err)
+	}
+}
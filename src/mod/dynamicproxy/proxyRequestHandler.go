@@ -195,6 +195,7 @@ func (h *ProxyHandler) hostRequest(w http.ResponseWriter, r *http.Request, targe
 
 		wspHandler := websocketproxy.NewProxy(u, websocketproxy.Options{
 			SkipTLSValidation:  selectedUpstream.SkipCertValidations,
+			TLSClientConfig:    selectedUpstream.GetTLSClientConfig(),
 			SkipOriginCheck:    selectedUpstream.SkipWebSocketOriginCheck,
 			CopyAllHeaders:     target.EnableWebsocketCustomHeaders,
 			UserDefinedHeaders: target.HeaderRewriteRules.UserDefinedHeaders,
@@ -241,6 +242,8 @@ func (h *ProxyHandler) hostRequest(w http.ResponseWriter, r *http.Request, targe
 		NoRemoveHopByHop:               headerRewriteOptions.DisableHopByHopHeaderRemoval,
 		Version:                        target.parent.Option.HostVersion,
 		DevelopmentMode:                target.parent.Option.DevelopmentMode,
+		BandwidthLimiters:              target.getBandwidthLimiters(r),
+		OnResponseBodyWrite:            h.Parent.getTrafficRecorder(reqHostname),
 	})
 
 	//validate the error
@@ -335,6 +338,8 @@ func (h *ProxyHandler) vdirRequest(w http.ResponseWriter, r *http.Request, targe
 		HostHeaderOverwrite:            headerRewriteOptions.RequestHostOverwrite,
 		Version:                        target.parent.parent.Option.HostVersion,
 		DevelopmentMode:                target.parent.parent.Option.DevelopmentMode,
+		BandwidthLimiters:              target.parent.getBandwidthLimiters(r),
+		OnResponseBodyWrite:            h.Parent.getTrafficRecorder(reqHostname),
 	})
 
 	var dnsError *net.DNSError
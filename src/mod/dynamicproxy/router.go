@@ -22,7 +22,7 @@ import (
 func (router *Router) PrepareProxyRoute(endpoint *ProxyEndpoint) (*ProxyEndpoint, error) {
 	for _, thisOrigin := range endpoint.ActiveOrigins {
 		//Create the proxy routing handler
-		err := thisOrigin.StartProxy()
+		err := thisOrigin.StartProxy(router.Option.TlsManager)
 		if err != nil {
 			log.Println("Unable to setup upstream " + thisOrigin.OriginIpOrDomain + ": " + err.Error())
 			continue
@@ -30,6 +30,8 @@ func (router *Router) PrepareProxyRoute(endpoint *ProxyEndpoint) (*ProxyEndpoint
 	}
 
 	endpoint.parent = router
+	endpoint.prepareBandwidthLimiters()
+	router.reportBandwidthLimit(endpoint)
 
 	//Prepare proxy routing handler for each of the virtual directories
 	for _, vdir := range endpoint.VirtualDirectories {
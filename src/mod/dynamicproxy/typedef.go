@@ -16,16 +16,24 @@ import (
 	"imuslab.com/zoraxy/mod/auth/sso/oauth2"
 
 	"imuslab.com/zoraxy/mod/access"
+	"imuslab.com/zoraxy/mod/auth"
 	"imuslab.com/zoraxy/mod/auth/sso/forward"
+	"imuslab.com/zoraxy/mod/auth/sso/jwtauth"
+	"imuslab.com/zoraxy/mod/auth/sso/ldapauth"
+	"imuslab.com/zoraxy/mod/auth/sso/portal"
+	"imuslab.com/zoraxy/mod/auth/userdir"
+	"imuslab.com/zoraxy/mod/bandwidth"
 	"imuslab.com/zoraxy/mod/dynamicproxy/dpcore"
 	"imuslab.com/zoraxy/mod/dynamicproxy/loadbalance"
 	"imuslab.com/zoraxy/mod/dynamicproxy/permissionpolicy"
 	"imuslab.com/zoraxy/mod/dynamicproxy/redirection"
 	"imuslab.com/zoraxy/mod/dynamicproxy/rewrite"
 	"imuslab.com/zoraxy/mod/geodb"
+	"imuslab.com/zoraxy/mod/hoststats"
 	"imuslab.com/zoraxy/mod/info/logger"
 	"imuslab.com/zoraxy/mod/plugins"
 	"imuslab.com/zoraxy/mod/statistic"
+	"imuslab.com/zoraxy/mod/streamproxy"
 	"imuslab.com/zoraxy/mod/tlscert"
 )
 
@@ -36,6 +44,7 @@ const (
 	ProxyTypeRoot ProxyType = iota //Root Proxy, everything not matching will be routed here
 	ProxyTypeHost                  //Host Proxy, match by host (domain) name
 	ProxyTypeVdir                  //Virtual Directory Proxy, match by path prefix
+	ProxyTypeTlsPassthrough        //TLS Passthrough Proxy, match by SNI and forward the raw TCP connection
 )
 
 type ProxyHandler struct {
@@ -54,6 +63,10 @@ type RouterOption struct {
 	ListenOnPort80     bool   //Enable port 80 http listener
 	ForceHttpsRedirect bool   //Force redirection of http to https endpoint
 
+	/* Inbound PROXY Protocol */
+	AcceptProxyProtocol bool     //Parse PROXY protocol v1/v2 header on the inbound listeners
+	TrustedProxyCIDRs   []string //IP or CIDR of load balancers allowed to send PROXY protocol header
+
 	/* Routing Service Managers */
 	TlsManager         *tlscert.Manager          //TLS manager for serving SAN certificates
 	RedirectRuleTable  *redirection.RuleTable    //Redirection rules handler and table
@@ -63,14 +76,20 @@ type RouterOption struct {
 	WebDirectory       string                    //The static web server directory containing the templates folder
 	LoadBalancer       *loadbalance.RouteManager //Load balancer that handle load balancing of proxy target
 	PluginManager      *plugins.Manager          //Plugin manager for handling plugin routing
+	HostStatsCollector *hoststats.Collector      //Per-host statistics collector for reporting live bandwidth, can be nil
 
 	/* Authentication Providers */
 	ForwardAuthRouter *forward.AuthRouter
-	OAuth2Router      *oauth2.OAuth2Router //OAuth2Router router for OAuth2Router authentication
+	OAuth2Router      *oauth2.OAuth2Router    //OAuth2Router router for OAuth2Router authentication
+	UserDirectory     *userdir.Directory      //Shared users and groups for basic auth, referenced by BasicAuthGroupIDs
+	SSOPortal         *portal.Portal          //Built-in SSO portal for endpoints using AuthMethodSSOPortal
+	JWTValidator      *jwtauth.Validator      //Bearer token validator for endpoints using AuthMethodJWT
+	LDAPAuthenticator *ldapauth.Authenticator //LDAP directory for basic auth endpoints with BasicAuthLDAP enabled
 
 	/* Utilities */
-	DevelopmentMode bool           //Enable development mode, provide more debug information in headers
-	Logger          *logger.Logger //Logger for reverse proxy requests
+	DevelopmentMode bool                                //Enable development mode, provide more debug information in headers
+	Logger          *logger.Logger                      //Logger for reverse proxy requests
+	SaveEndpoint    func(endpoint *ProxyEndpoint) error //Save the endpoint config to disk, used for upgrading legacy password hashes
 }
 
 /* Router Object */
@@ -86,12 +105,15 @@ type Router struct {
 	loadBalancer *loadbalance.RouteManager //Load balancer routing manager
 	routingRules []*RoutingRule            //Special routing rules, handle high priority routing like ACME request handling
 
-	tlsListener      net.Listener //TLS listener, handle SNI routing
+	tlsListener      net.Listener //TLS listener, handle SNI routing and TLS passthrough
 	tlsBehaviorMutex sync.RWMutex //Mutex for tlsBehavior map
 	tlsRedirectStop  chan bool    //Stop channel for tls redirection server
 
 	rateLimterStop   chan bool              //Stop channel for rate limiter
 	rateLimitCounter RequestCountPerIpTable //Request counter for rate limter
+
+	basicAuthCache     *auth.CredentialCache //Cache of verified basic auth credentials
+	basicAuthHashMutex sync.Mutex            //Lock for upgrading legacy basic auth password hashes
 }
 
 /* Basic Auth Related Data structure*/
@@ -160,6 +182,8 @@ const (
 	AuthMethodBasic                     //Basic Auth
 	AuthMethodForward                   //Forward
 	AuthMethodOauth2                    //Oauth2
+	AuthMethodSSOPortal                 //Zoraxy built-in SSO portal
+	AuthMethodJWT                       //Bearer JWT validated locally, for APIs
 )
 
 type AuthenticationProvider struct {
@@ -167,7 +191,9 @@ type AuthenticationProvider struct {
 	/* Basic Auth Settings */
 	BasicAuthCredentials    []*BasicAuthCredentials   //Basic auth credentials
 	BasicAuthExceptionRules []*BasicAuthExceptionRule //Path to exclude in a basic auth enabled proxy target
-	BasicAuthGroupIDs       []string                  //Group IDs that are allowed to access this endpoint
+	BasicAuthGroupIDs       []string                  //User directory groups that are allowed to access this endpoint
+	BasicAuthLDAP           bool                      //Allow users from the LDAP directory to access this endpoint
+	BasicAuthLDAPGroups     []string                  //LDAP groups allowed to access this endpoint, empty to allow all directory users
 
 	/* Forward Auth Settings */
 	ForwardAuthURL                    string   // Full URL of the Forward Auth endpoint. Example: https://auth.example.com/api/authz/forward-auth
@@ -175,6 +201,24 @@ type AuthenticationProvider struct {
 	ForwardAuthResponseClientHeaders  []string // List of headers to copy from the forward auth server response to the client response.
 	ForwardAuthRequestHeaders         []string // List of headers to copy from the original request to the auth server. If empty all are copied.
 	ForwardAuthRequestExcludedCookies []string // List of cookies to exclude from the request after sending it to the forward auth server.
+
+	/* OAuth2 / OIDC Settings */
+	OAuth2ProviderID          string            //ID of the OIDC provider, empty for the default provider
+	OAuth2AllowedGroups       []string          //Groups claim values allowed to access, empty to allow all users
+	OAuth2AllowedRoles        []string          //Roles claim values allowed to access, empty to allow all users
+	OAuth2AllowedEmailDomains []string          //Email domains allowed to access, empty to allow all users
+	OAuth2ClaimHeaders        map[string]string //Claim name to upstream request header, e.g. email to X-Auth-Request-Email
+
+	/* SSO Portal Settings */
+	SSOPortalAllowedUsers []string //Portal users allowed to access, empty to allow all users
+
+	/* JWT Settings */
+	JWTJwksURLs       []string            //JWKS URLs of the token issuers
+	JWTStaticKeys     []string            //PEM public keys or certificates, JWK or JWK set JSON
+	JWTIssuers        []string            //Allowed iss claim values, empty to allow all issuers
+	JWTAudiences      []string            //Token must be issued for one of these audiences, empty to skip
+	JWTRequiredClaims map[string][]string //Claim must exist and contain one of the values if any given, e.g. scope to orders:write
+	JWTClaimHeaders   map[string]string   //Claim name to upstream request header, e.g. sub to X-Auth-Subject
 }
 
 /*
@@ -210,6 +254,9 @@ type ProxyEndpoint struct {
 	BypassGlobalTLS bool                             //Bypass global TLS setting options if TLS Listener enabled (parent.tlsListener != nil)
 	TlsOptions      *tlscert.HostSpecificTlsBehavior //TLS options for this endpoint, if nil, use global TLS options
 
+	//TLS Passthrough (ProxyTypeTlsPassthrough only)
+	PassthroughProxyProtocol streamproxy.ProxyProtocolVersion //Send PROXY protocol v1/v2 header to upstream, 0 to disable
+
 	//Virtual Directories
 	VirtualDirectories []*VirtualDirectoryEndpoint
 
@@ -224,6 +271,10 @@ type ProxyEndpoint struct {
 	RequireRateLimit bool
 	RateLimit        int64 // Rate limit in requests per second
 
+	//Bandwidth Shaping
+	BandwidthLimit      int64 //Max response bytes per second shared by all clients, 0 for unlimited
+	BandwidthLimitPerIP int64 //Max response bytes per second for each client IP, 0 for unlimited
+
 	//Uptime Monitor
 	DisableUptimeMonitor bool //Disable uptime monitor for this endpoint
 	DisableLogging       bool //Disable logging of reverse proxy requests
@@ -244,6 +295,9 @@ type ProxyEndpoint struct {
 	//Internal Logic Elements
 	parent *Router  `json:"-"`
 	Tags   []string // Tags for the proxy endpoint
+
+	bandwidthLimiter      *bandwidth.Limiter      //Limiter shared by all clients of this endpoint
+	bandwidthLimiterPerIP *bandwidth.LimiterGroup //Limiters for each client IP of this endpoint
 }
 
 /*
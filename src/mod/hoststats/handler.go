@@ -71,6 +71,7 @@ func (c *Collector) HandleGetHostBandwidth(w http.ResponseWriter, r *http.Reques
 		"current_bandwidth": stats.CurrentBandwidth,
 		"max_bandwidth":     stats.MaxBandwidth,
 		"min_bandwidth":     stats.MinBandwidth,
+		"bandwidth_limit":   stats.BandwidthLimit,
 		"samples":           stats.BandwidthSamples,
 	}
 
@@ -46,6 +46,7 @@ type HostStatistics struct {
 	MaxBandwidth        int64 `json:"max_bandwidth"`         // Maximum bandwidth observed
 	MinBandwidth        int64 `json:"min_bandwidth"`         // Minimum bandwidth observed (non-zero)
 	MinBandwidthRecorded bool  `json:"min_bandwidth_recorded"` // Whether MinBandwidth has been set
+	BandwidthLimit       int64 `json:"bandwidth_limit"`        // Configured bandwidth limit, 0 for unlimited
 
 	// Time-series bandwidth data for graphical display
 	BandwidthSamples []BandwidthSample `json:"bandwidth_samples"`
@@ -60,6 +61,7 @@ type HostStatistics struct {
 type BandwidthSample struct {
 	Timestamp time.Time `json:"timestamp"`
 	BytesPerSecond int64 `json:"bytes_per_second"`
+	LimitBytesPerSecond int64 `json:"limit_bytes_per_second"` // Bandwidth limit at the time of sampling, 0 for unlimited
 }
 
 // Collector manages statistics for all hosts
@@ -191,6 +193,26 @@ func (c *Collector) RecordTraffic(hostname string, bytesSent, bytesReceived int6
 	stats.LastUpdated = time.Now()
 }
 
+// SetBandwidthLimit records the bandwidth limit configured for a host, 0 for unlimited
+func (c *Collector) SetBandwidthLimit(hostname string, bytesPerSecond int64) {
+	c.mu.Lock()
+	stats, exists := c.stats[hostname]
+	if !exists {
+		stats = &HostStatistics{
+			Hostname:             hostname,
+			LastUpdated:          time.Now(),
+			MinBandwidthRecorded: false,
+		}
+		c.stats[hostname] = stats
+	}
+	c.mu.Unlock()
+
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	stats.BandwidthLimit = bytesPerSecond
+}
+
 // RecordCacheData records cache data statistics
 func (c *Collector) RecordCacheData(hostname string, dataSizeDelta int64, objectsDelta int64) {
 	c.mu.Lock()
@@ -258,8 +280,9 @@ func (c *Collector) startBandwidthSampling() {
 
 					// Add bandwidth sample
 					sample := BandwidthSample{
-						Timestamp:      now,
-						BytesPerSecond: bandwidth,
+						Timestamp:           now,
+						BytesPerSecond:      bandwidth,
+						LimitBytesPerSecond: stats.BandwidthLimit,
 					}
 					stats.BandwidthSamples = append(stats.BandwidthSamples, sample)
 
@@ -0,0 +1,90 @@
+package netutils
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	proxyproto "github.com/pires/go-proxyproto"
+)
+
+/*
+	proxyproto.go
+
+	Inbound PROXY protocol (v1 / v2) support for listeners
+	placed behind L4 load balancers. Only connections coming
+	from trusted proxies are allowed to override the client
+	address, others are served as raw connections.
+*/
+
+// Max time to wait for the PROXY protocol header after a connection is accepted
+const ProxyProtocolHeaderTimeout = 10 * time.Second
+
+// ParseTrustedProxyCIDRs parse a list of IP or CIDR into networks
+func ParseTrustedProxyCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		if !strings.Contains(cidr, "/") {
+			//Single IP address
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, errors.New("invalid trusted proxy address: " + cidr)
+			}
+			if ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.New("invalid trusted proxy CIDR: " + cidr)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// NewProxyProtocolListener wrap the listener so PROXY protocol headers sent by
+// trusted proxies replace the remote address of the accepted connections
+func NewProxyProtocolListener(inner net.Listener, trustedCIDRs []string) (net.Listener, error) {
+	trustedNetworks, err := ParseTrustedProxyCIDRs(trustedCIDRs)
+	if err != nil {
+		return nil, err
+	}
+	if len(trustedNetworks) == 0 {
+		return nil, errors.New("no trusted proxy CIDR given")
+	}
+
+	return &proxyproto.Listener{
+		Listener:          inner,
+		ReadHeaderTimeout: ProxyProtocolHeaderTimeout,
+		ConnPolicy: func(opts proxyproto.ConnPolicyOptions) (proxyproto.Policy, error) {
+			addr, ok := opts.Upstream.(*net.TCPAddr)
+			if !ok {
+				return proxyproto.SKIP, nil
+			}
+			for _, network := range trustedNetworks {
+				if network.Contains(addr.IP) {
+					//Trusted proxy, use the header if there is one
+					return proxyproto.USE, nil
+				}
+			}
+			//Untrusted source, serve the raw connection so it cannot spoof the client address
+			return proxyproto.SKIP, nil
+		},
+	}, nil
+}
+
+// UnwrapProxyProtocolConn return the underlying TCP connection of a PROXY protocol connection
+func UnwrapProxyProtocolConn(conn net.Conn) net.Conn {
+	if pc, ok := conn.(*proxyproto.Conn); ok {
+		return pc.Raw()
+	}
+	return conn
+}
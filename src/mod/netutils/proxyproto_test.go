@@ -0,0 +1,84 @@
+package netutils_test
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"imuslab.com/zoraxy/mod/netutils"
+)
+
+// Dial the listener, optionally send a PROXY v1 header and return the address seen by the server
+func remoteAddrSeenByServer(t *testing.T, trustedCIDRs []string, header string) string {
+	t.Helper()
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := netutils.NewProxyProtocolListener(inner, trustedCIDRs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte(header + "hello"))
+		io.ReadAll(conn)
+	}()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	payload := make([]byte, 5)
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		t.Fatal(err)
+	}
+	if string(payload) != "hello" {
+		t.Errorf("unexpected payload %q", payload)
+	}
+	return conn.RemoteAddr().(*net.TCPAddr).IP.String()
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	header := "PROXY TCP4 203.0.113.7 10.0.0.1 51000 443\r\n"
+
+	//Trusted proxy replace the client address
+	if ip := remoteAddrSeenByServer(t, []string{"127.0.0.0/8"}, header); ip != "203.0.113.7" {
+		t.Errorf("expected client address from PROXY header, got %s", ip)
+	}
+
+	//Trusted proxy without header keep the socket address
+	if ip := remoteAddrSeenByServer(t, []string{"127.0.0.1"}, ""); ip != "127.0.0.1" {
+		t.Errorf("expected socket address, got %s", ip)
+	}
+
+	//Untrusted source cannot spoof the client address
+	if ip := remoteAddrSeenByServer(t, []string{"10.0.0.0/8"}, ""); ip != "127.0.0.1" {
+		t.Errorf("expected socket address for untrusted source, got %s", ip)
+	}
+}
+
+func TestParseTrustedProxyCIDRs(t *testing.T) {
+	networks, err := netutils.ParseTrustedProxyCIDRs([]string{"10.0.0.0/8", " 192.168.1.10 ", "2001:db8::/32", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(networks) != 3 {
+		t.Fatalf("expected 3 networks, got %d", len(networks))
+	}
+	if !networks[1].Contains(net.ParseIP("192.168.1.10")) || networks[1].Contains(net.ParseIP("192.168.1.11")) {
+		t.Error("single IP should be parsed as a host network")
+	}
+
+	if _, err := netutils.ParseTrustedProxyCIDRs([]string{"not-an-ip"}); err == nil {
+		t.Error("expected error for invalid address")
+	}
+}
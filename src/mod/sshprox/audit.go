@@ -0,0 +1,122 @@
+package sshprox
+
+/*
+	audit.go
+
+	Audit log of web SSH sessions, recording who
+	connected to which server from where and when
+	the session ended
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	auditTable          = "webssh_audit"
+	auditRetentionDays  = 90  //Remove audit entries older than this on startup
+	defaultAuditListMax = 200 //Number of entries returned when no limit is given
+)
+
+// Audit events
+const (
+	AuditConnect       = "connect"
+	AuditConnectFailed = "connect_failed"
+	AuditDisconnect    = "disconnect"
+)
+
+type AuditEntry struct {
+	Timestamp  int64  //Unix timestamp of the event
+	Event      string //connect, connect_failed or disconnect
+	SessionID  string
+	Owner      string //Zoraxy user who opened the session
+	ClientIP   string //IP address of the browser
+	Username   string //Username on the remote server
+	RemoteAddr string
+	RemotePort int
+	AuthMethod string //password or key
+	Message    string //Reason of failure or disconnect
+	Duration   int64  //Session duration in seconds, only for disconnect
+}
+
+// Record an event of the session to the audit log
+func (m *Manager) recordAudit(instance *Instance, event string, message string) {
+	now := time.Now()
+	entry := AuditEntry{
+		Timestamp:  now.Unix(),
+		Event:      event,
+		SessionID:  instance.UUID,
+		Owner:      instance.Owner,
+		ClientIP:   instance.ClientIP,
+		Username:   instance.Username,
+		RemoteAddr: instance.RemoteAddr,
+		RemotePort: instance.RemotePort,
+		AuthMethod: instance.AuthMethod,
+		Message:    message,
+	}
+	if event == AuditDisconnect {
+		entry.Duration = int64(now.Sub(instance.CreatedTime).Seconds())
+	}
+
+	logMessage := fmt.Sprintf("[%s] %s (%s) %s@%s:%d", event, instance.Owner, instance.ClientIP, instance.Username, instance.RemoteAddr, instance.RemotePort)
+	if message != "" {
+		logMessage += ": " + message
+	}
+	m.logf(logMessage, nil)
+
+	if m.Options.Database == nil {
+		return
+	}
+	//Key start with nano timestamp so entries are in time order
+	key := fmt.Sprintf("%020d/%s", now.UnixNano(), instance.UUID)
+	m.Options.Database.Write(auditTable, key, entry)
+}
+
+// List the latest audit entries, newest first
+func (m *Manager) ListAuditLog(limit int) []*AuditEntry {
+	results := []*AuditEntry{}
+	if m.Options.Database == nil {
+		return results
+	}
+	if limit <= 0 {
+		limit = defaultAuditListMax
+	}
+	entries, _ := m.Options.Database.ListTable(auditTable)
+	for _, keypairs := range entries {
+		entry := AuditEntry{}
+		if err := json.Unmarshal(keypairs[1], &entry); err != nil {
+			continue
+		}
+		results = append(results, &entry)
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Timestamp > results[j].Timestamp
+	})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+// Remove the audit entries older than the retention period
+func (m *Manager) pruneAuditLog() {
+	if m.Options.Database == nil {
+		return
+	}
+	cutoff := time.Now().AddDate(0, 0, -auditRetentionDays).UnixNano()
+	entries, _ := m.Options.Database.ListTable(auditTable)
+	for _, keypairs := range entries {
+		key := string(keypairs[0])
+		if len(key) < 20 {
+			continue
+		}
+		timestamp, err := strconv.ParseInt(key[:20], 10, 64)
+		if err == nil && timestamp < cutoff {
+			m.Options.Database.Delete(auditTable, key)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package sshprox
+
+/*
+	hostkey.go
+
+	Trust on first use (TOFU) host key verification.
+	The host key of a server is stored on the first
+	connection and later connections are rejected if
+	the server present a different key
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"sort"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const hostKeyTable = "webssh_hostkeys"
+
+type KnownHost struct {
+	Address     string //host:port of the SSH server
+	KeyType     string //e.g. ssh-ed25519
+	Fingerprint string //SHA256 fingerprint of the host key
+	PublicKey   string //Host key in authorized_keys format
+	FirstSeen   int64  //Unix timestamp when the key is trusted
+}
+
+// HostKeyMismatchError is returned when a server present a different key from the stored one
+type HostKeyMismatchError struct {
+	Address     string
+	Expected    string //Fingerprint of the stored key
+	Fingerprint string //Fingerprint of the key presented by the server
+}
+
+func (e *HostKeyMismatchError) Error() string {
+	return "host key of " + e.Address + " has changed (expected " + e.Expected + ", got " + e.Fingerprint + "). " +
+		"Remove the known host key if the server key was changed intentionally"
+}
+
+// Create the host key callback verifying the server at the given address
+func (m *Manager) hostKeyCallback(address string) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if m.Options.Database == nil {
+			return errors.New("host key store not available")
+		}
+		fingerprint := ssh.FingerprintSHA256(key)
+		knownHost := KnownHost{}
+		err := m.Options.Database.Read(hostKeyTable, address, &knownHost)
+		if err != nil || knownHost.PublicKey == "" {
+			//First connection to this server, trust and store the key
+			knownHost = KnownHost{
+				Address:     address,
+				KeyType:     key.Type(),
+				Fingerprint: fingerprint,
+				PublicKey:   string(ssh.MarshalAuthorizedKey(key)),
+				FirstSeen:   time.Now().Unix(),
+			}
+			m.logf("Trusting new host key "+fingerprint+" for "+address, nil)
+			return m.Options.Database.Write(hostKeyTable, address, knownHost)
+		}
+
+		if knownHost.Fingerprint != fingerprint {
+			return &HostKeyMismatchError{
+				Address:     address,
+				Expected:    knownHost.Fingerprint,
+				Fingerprint: fingerprint,
+			}
+		}
+		return nil
+	}
+}
+
+// List the trusted host keys
+func (m *Manager) ListKnownHosts() []*KnownHost {
+	results := []*KnownHost{}
+	if m.Options.Database == nil {
+		return results
+	}
+	entries, _ := m.Options.Database.ListTable(hostKeyTable)
+	for _, keypairs := range entries {
+		knownHost := KnownHost{}
+		if err := json.Unmarshal(keypairs[1], &knownHost); err != nil {
+			continue
+		}
+		results = append(results, &knownHost)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Address < results[j].Address
+	})
+	return results
+}
+
+// Remove the trusted host key of a server, the next connection will trust the new key
+func (m *Manager) RemoveKnownHost(address string) error {
+	if m.Options.Database == nil {
+		return errors.New("host key store not available")
+	}
+	if !m.Options.Database.KeyExists(hostKeyTable, address) {
+		return errors.New("known host not found")
+	}
+	return m.Options.Database.Delete(hostKeyTable, address)
+}
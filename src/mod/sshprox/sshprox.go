@@ -4,85 +4,130 @@ import (
 	"errors"
 	"fmt"
 	"log"
-	"net/http"
-	"net/url"
-	"os"
-	"os/exec"
-	"path/filepath"
-	"runtime"
+	"net"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/google/uuid"
-	"imuslab.com/zoraxy/mod/reverseproxy"
-	"imuslab.com/zoraxy/mod/utils"
-	"imuslab.com/zoraxy/mod/websocketproxy"
+	"golang.org/x/crypto/ssh"
+	"imuslab.com/zoraxy/mod/database"
+	"imuslab.com/zoraxy/mod/info/logger"
 )
 
 /*
 	SSH Proxy
 
-	This is a tool to bind gotty into Zoraxy
-	so that you can do something similar to
-	online ssh terminal
+	This is a native web SSH client that connect to
+	the remote server with golang.org/x/crypto/ssh and
+	bridge the terminal to xterm.js over websocket
 */
 
+const (
+	defaultConnectTimeout = 10 * time.Second //Timeout for dialing and authenticating with the SSH server
+	defaultAttachTimeout  = time.Minute      //Close the session if the browser do not attach within this time
+	defaultIdleTimeout    = 30 * time.Minute //Close the session if there is no input or output for this long
+	defaultMaxSessionTime = 8 * time.Hour    //Close the session after this long regardless of activity
+	watchdogInterval      = time.Second      //Interval for checking session timeouts
+)
+
+type Options struct {
+	Database       *database.Database //Database for storing known host keys and the audit log
+	Logger         *logger.Logger     //Logger for session events, can be nil
+	AllowLoopback  bool               //Allow connecting to SSH servers on the loopback interface
+	ConnectTimeout time.Duration      //Timeout for dialing and authenticating, default 10 seconds
+	AttachTimeout  time.Duration      //Time for the browser to attach to a new session, default 1 minute
+	IdleTimeout    time.Duration      //Close the session after no activity for this long, default 30 minutes
+	MaxSessionTime time.Duration      //Max duration of a session, default 8 hours
+}
+
 type Manager struct {
-	StartingPort int
-	Instances    []*Instance
+	Options       *Options
+	Instances     []*Instance
+	instancesLock sync.RWMutex
 }
 
 type Instance struct {
-	UUID         string
-	ExecPath     string
-	RemoteAddr   string
-	RemotePort   int
-	AssignedPort int
-	conn         *reverseproxy.ReverseProxy //HTTP proxy
-	tty          *exec.Cmd                  //SSH connection ported to web interface
-	Parent       *Manager
+	UUID        string
+	Username    string //Username on the remote server
+	RemoteAddr  string
+	RemotePort  int
+	AuthMethod  string //password or key
+	Owner       string //Zoraxy user who opened this session
+	ClientIP    string //IP address of the browser that opened this session
+	CreatedTime time.Time
+	Parent      *Manager
+
+	client       *ssh.Client  //SSH connection to the remote server
+	attached     atomic.Bool  //If a browser terminal is attached to this session
+	lastActivity atomic.Int64 //Unix nano of the last input or output
+	closeOnce    sync.Once
+	closed       chan struct{}
 }
 
-func NewSSHProxyManager() *Manager {
-	return &Manager{
-		StartingPort: 14810,
-		Instances:    []*Instance{},
-	}
+// Credentials for authenticating with the remote server, never stored
+type Credentials struct {
+	Username   string
+	Password   string
+	PrivateKey []byte //PEM encoded private key, used instead of the password if set
+	Passphrase string //Passphrase of the private key if encrypted
 }
 
-func (m *Manager) HandleHttpByInstanceId(instanceId string, w http.ResponseWriter, r *http.Request) {
-	targetInstance, err := m.GetInstanceById(instanceId)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
-		return
+// SessionInfo is the public information of an active session
+type SessionInfo struct {
+	UUID        string
+	Username    string
+	RemoteAddr  string
+	RemotePort  int
+	AuthMethod  string
+	Owner       string
+	ClientIP    string
+	CreatedTime int64
+	Attached    bool
+}
+
+func NewSSHProxyManager(options *Options) *Manager {
+	if options.ConnectTimeout <= 0 {
+		options.ConnectTimeout = defaultConnectTimeout
+	}
+	if options.AttachTimeout <= 0 {
+		options.AttachTimeout = defaultAttachTimeout
+	}
+	if options.IdleTimeout <= 0 {
+		options.IdleTimeout = defaultIdleTimeout
+	}
+	if options.MaxSessionTime <= 0 {
+		options.MaxSessionTime = defaultMaxSessionTime
+	}
+	if options.Database != nil {
+		options.Database.NewTable(hostKeyTable)
+		options.Database.NewTable(auditTable)
 	}
 
-	if targetInstance.tty == nil {
-		//Server side already closed
-		http.Error(w, "Connection already closed", http.StatusInternalServerError)
-		return
+	m := &Manager{
+		Options:   options,
+		Instances: []*Instance{},
 	}
+	m.pruneAuditLog()
+	return m
+}
 
-	r.Header.Set("X-Forwarded-Host", r.Host)
-	requestURL := r.URL.String()
-	if r.Header["Upgrade"] != nil && strings.ToLower(r.Header["Upgrade"][0]) == "websocket" {
-		//Handle WebSocket request. Forward the custom Upgrade header and rewrite origin
-		r.Header.Set("Zr-Origin-Upgrade", "websocket")
-		requestURL = strings.TrimPrefix(requestURL, "/")
-		u, _ := url.Parse("ws://127.0.0.1:" + strconv.Itoa(targetInstance.AssignedPort) + "/" + requestURL)
-		wspHandler := websocketproxy.NewProxy(u, websocketproxy.Options{
-			SkipTLSValidation: false,
-			SkipOriginCheck:   false,
-			Logger:            nil,
-		})
-		wspHandler.ServeHTTP(w, r)
+func (m *Manager) logf(message string, originalError error) {
+	if m.Options.Logger == nil {
+		if originalError != nil {
+			message += ": " + originalError.Error()
+		}
+		log.Println("[webssh] " + message)
 		return
 	}
-
-	targetInstance.conn.ProxyHTTP(w, r)
+	m.Options.Logger.PrintAndLog("webssh", message, originalError)
 }
 
 func (m *Manager) GetInstanceById(instanceId string) (*Instance, error) {
+	m.instancesLock.RLock()
+	defer m.instancesLock.RUnlock()
 	for _, instance := range m.Instances {
 		if instance.UUID == instanceId {
 			return instance, nil
@@ -90,116 +135,191 @@ func (m *Manager) GetInstanceById(instanceId string) (*Instance, error) {
 	}
 	return nil, fmt.Errorf("instance not found: %s", instanceId)
 }
-func (m *Manager) NewSSHProxy(binaryRoot string) (*Instance, error) {
-	//Check if the binary exists in system/gotty/
-	binary := "gotty_" + runtime.GOOS + "_" + runtime.GOARCH
 
-	if runtime.GOOS == "windows" {
-		binary = binary + ".exe"
+// List the active sessions
+func (m *Manager) ListSessions() []*SessionInfo {
+	m.instancesLock.RLock()
+	defer m.instancesLock.RUnlock()
+	results := []*SessionInfo{}
+	for _, instance := range m.Instances {
+		results = append(results, &SessionInfo{
+			UUID:        instance.UUID,
+			Username:    instance.Username,
+			RemoteAddr:  instance.RemoteAddr,
+			RemotePort:  instance.RemotePort,
+			AuthMethod:  instance.AuthMethod,
+			Owner:       instance.Owner,
+			ClientIP:    instance.ClientIP,
+			CreatedTime: instance.CreatedTime.Unix(),
+			Attached:    instance.attached.Load(),
+		})
 	}
+	return results
+}
 
-	//Extract it from embedfs if not exists locally
-	execPath := filepath.Join(binaryRoot, binary)
-
-	//Create the storage folder structure
-	os.MkdirAll(filepath.Dir(execPath), 0775)
+// Create a new SSH session to the remote server. The connection is authenticated
+// and the host key verified before returning, the terminal is attached later
+func (m *Manager) NewSession(remoteAddr string, remotePort int, credentials *Credentials, owner string, clientIP string) (*Instance, error) {
+	username := strings.TrimSpace(credentials.Username)
+	remoteAddr = strings.TrimSpace(remoteAddr)
+	err := ValidateUsernameAndRemoteAddr(username, remoteAddr)
+	if err != nil {
+		return nil, err
+	}
+	if remotePort < 1 || remotePort > 65535 {
+		return nil, errors.New("invalid port number given")
+	}
 
-	//Create config file if not exists
-	if !utils.FileExists(filepath.Join(filepath.Dir(execPath), ".gotty")) {
-		configFile, _ := gotty.ReadFile("gotty/.gotty")
-		os.WriteFile(filepath.Join(filepath.Dir(execPath), ".gotty"), configFile, 0775)
+	thisInstance := &Instance{
+		UUID:        uuid.New().String(),
+		Username:    username,
+		RemoteAddr:  remoteAddr,
+		RemotePort:  remotePort,
+		AuthMethod:  "password",
+		Owner:       owner,
+		ClientIP:    clientIP,
+		CreatedTime: time.Now(),
+		Parent:      m,
+		closed:      make(chan struct{}),
 	}
 
-	//Create web.ssh binary if not exists
-	if !utils.FileExists(execPath) {
-		//Try to extract it from embedded fs
-		executable, err := gotty.ReadFile("gotty/" + binary)
-		if err != nil {
-			//Binary not found in embedded
-			return nil, errors.New("platform not supported")
+	//Build the auth methods from the given credentials
+	authMethods := []ssh.AuthMethod{}
+	if len(credentials.PrivateKey) > 0 {
+		thisInstance.AuthMethod = "key"
+		var signer ssh.Signer
+		if credentials.Passphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(credentials.PrivateKey, []byte(credentials.Passphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey(credentials.PrivateKey)
 		}
-
-		//Extract to target location
-		err = os.WriteFile(execPath, executable, 0777)
 		if err != nil {
-			//Binary not found in embedded
-			log.Println("Extract web.ssh failed: " + err.Error())
-			return nil, errors.New("web.ssh sub-program extract failed")
+			var missingPassphrase *ssh.PassphraseMissingError
+			if errors.As(err, &missingPassphrase) {
+				return nil, errors.New("private key is encrypted, passphrase required")
+			}
+			return nil, errors.New("unable to parse private key: " + err.Error())
 		}
+		authMethods = append(authMethods, ssh.PublicKeys(signer))
+	} else {
+		password := credentials.Password
+		authMethods = append(authMethods, ssh.Password(password), ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+			//Answer the password prompt of servers that only allow keyboard-interactive
+			answers := make([]string, len(questions))
+			for i := range questions {
+				answers[i] = password
+			}
+			return answers, nil
+		}))
 	}
 
-	//Convert the binary path to realpath
-	realpath, err := filepath.Abs(execPath)
+	client, err := m.dial(thisInstance, authMethods)
 	if err != nil {
+		m.recordAudit(thisInstance, AuditConnectFailed, err.Error())
 		return nil, err
 	}
+	thisInstance.client = client
+	thisInstance.touch()
 
-	thisInstance := Instance{
-		UUID:         uuid.New().String(),
-		ExecPath:     realpath,
-		AssignedPort: -1,
-		Parent:       m,
-	}
-
-	m.Instances = append(m.Instances, &thisInstance)
+	m.instancesLock.Lock()
+	m.Instances = append(m.Instances, thisInstance)
+	m.instancesLock.Unlock()
 
-	return &thisInstance, nil
+	m.recordAudit(thisInstance, AuditConnect, "")
+	go thisInstance.watchdog()
+	return thisInstance, nil
 }
 
-// Create a new Connection to target address
-func (i *Instance) CreateNewConnection(listenPort int, username string, remoteIpAddr string, remotePort int) error {
-	//Create a gotty instance
-	connAddr := remoteIpAddr
-	if username != "" {
-		connAddr = username + "@" + remoteIpAddr
+// Dial and authenticate with the remote server of the instance
+func (m *Manager) dial(instance *Instance, authMethods []ssh.AuthMethod) (*ssh.Client, error) {
+	address := net.JoinHostPort(instance.RemoteAddr, strconv.Itoa(instance.RemotePort))
+	dialer := &net.Dialer{Timeout: m.Options.ConnectTimeout}
+	conn, err := dialer.Dial("tcp", address)
+	if err != nil {
+		return nil, errors.New("unable to connect to " + address)
 	}
 
-	//Trim the space in the username and remote address
-	username = strings.TrimSpace(username)
-	remoteIpAddr = strings.TrimSpace(remoteIpAddr)
-
-	//Validate the username and remote address
-	err := ValidateUsernameAndRemoteAddr(username, remoteIpAddr)
-	if err != nil {
-		return err
+	//Check the resolved address, so domains pointing to loopback are also rejected
+	if !m.Options.AllowLoopback {
+		if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && (tcpAddr.IP.IsLoopback() || tcpAddr.IP.IsUnspecified()) {
+			conn.Close()
+			return nil, errors.New("loopback web ssh connection is not enabled on this host")
+		}
 	}
 
-	configPath := filepath.Join(filepath.Dir(i.ExecPath), ".gotty")
-	title := username + "@" + remoteIpAddr
-	if remotePort != 22 {
-		title = title + ":" + strconv.Itoa(remotePort)
+	config := &ssh.ClientConfig{
+		User:            instance.Username,
+		Auth:            authMethods,
+		HostKeyCallback: m.hostKeyCallback(address),
+		Timeout:         m.Options.ConnectTimeout,
 	}
 
-	sshCommand := []string{"ssh", "-t", connAddr, "-p", strconv.Itoa(remotePort)}
-	cmd := exec.Command(i.ExecPath, "-w", "-p", strconv.Itoa(listenPort), "--once", "--config", configPath, "--title-format", title, "bash", "-c", strings.Join(sshCommand, " "))
-	cmd.Dir = filepath.Dir(i.ExecPath)
-	cmd.Env = append(os.Environ(), "TERM=xterm")
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	go func() {
-		cmd.Run()
-		i.Destroy()
-	}()
-	i.tty = cmd
-	i.AssignedPort = listenPort
-	i.RemoteAddr = remoteIpAddr
-	i.RemotePort = remotePort
-
-	//Create a new proxy agent for this root
-	path, err := url.Parse("http://127.0.0.1:" + strconv.Itoa(listenPort))
+	//Handshake with deadline as ssh.ClientConfig.Timeout only covers the dialing
+	conn.SetDeadline(time.Now().Add(m.Options.ConnectTimeout))
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, address, config)
 	if err != nil {
-		return err
+		conn.Close()
+		var mismatch *HostKeyMismatchError
+		if errors.As(err, &mismatch) {
+			return nil, mismatch
+		}
+		if strings.Contains(err.Error(), "unable to authenticate") {
+			return nil, errors.New("authentication failed for " + instance.Username + "@" + address)
+		}
+		return nil, errors.New("ssh handshake failed: " + err.Error())
 	}
+	conn.SetDeadline(time.Time{})
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
 
-	//Create new proxy objects to the proxy
-	proxy := reverseproxy.NewReverseProxy(path)
+// Record activity on this session for the idle timeout
+func (i *Instance) touch() {
+	i.lastActivity.Store(time.Now().UnixNano())
+}
 
-	i.conn = proxy
-	return nil
+// Close the session when it is not attached in time, idle or over the max session time
+func (i *Instance) watchdog() {
+	options := i.Parent.Options
+	ticker := time.NewTicker(watchdogInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-i.closed:
+			return
+		case <-ticker.C:
+			now := time.Now()
+			if !i.attached.Load() && now.Sub(i.CreatedTime) > options.AttachTimeout {
+				i.Close("terminal not attached in time")
+				return
+			}
+			if now.Sub(time.Unix(0, i.lastActivity.Load())) > options.IdleTimeout {
+				i.Close("idle timeout")
+				return
+			}
+			if now.Sub(i.CreatedTime) > options.MaxSessionTime {
+				i.Close("max session time reached")
+				return
+			}
+		}
+	}
+}
+
+// Close the SSH connection and remove the instance with the given reason for the audit log
+func (i *Instance) Close(reason string) {
+	i.closeOnce.Do(func() {
+		close(i.closed)
+		if i.client != nil {
+			i.client.Close()
+		}
+		i.Destroy()
+		i.Parent.recordAudit(i, AuditDisconnect, reason)
+	})
 }
 
 func (i *Instance) Destroy() {
 	// Remove the instance from the Manager's Instances list
+	i.Parent.instancesLock.Lock()
+	defer i.Parent.instancesLock.Unlock()
 	for idx, inst := range i.Parent.Instances {
 		if inst == i {
 			// Remove the instance from the slice by swapping it with the last instance and slicing the slice
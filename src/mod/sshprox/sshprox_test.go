@@ -1,20 +1,224 @@
 package sshprox
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/ssh"
+	"imuslab.com/zoraxy/mod/database"
+	"imuslab.com/zoraxy/mod/database/dbinc"
 )
 
-func TestInstance_Destroy(t *testing.T) {
-	manager := NewSSHProxyManager()
-	instance, err := manager.NewSSHProxy("/tmp")
+// Start a test SSH server accepting the given password, the shell echo back the input
+func startTestSSHServer(t *testing.T, password string) (string, int) {
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, given []byte) (*ssh.Permissions, error) {
+			if string(given) == password {
+				return nil, nil
+			}
+			return nil, errors.New("wrong password")
+		},
+	}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, chans, reqs, err := ssh.NewServerConn(conn, config)
+				if err != nil {
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				for newChannel := range chans {
+					channel, requests, err := newChannel.Accept()
+					if err != nil {
+						continue
+					}
+					go func() {
+						for req := range requests {
+							req.Reply(req.Type == "pty-req" || req.Type == "shell", nil)
+						}
+					}()
+					go func() {
+						defer channel.Close()
+						buf := make([]byte, 1024)
+						for {
+							n, err := channel.Read(buf)
+							if err != nil {
+								return
+							}
+							channel.Write([]byte("echo:" + string(buf[:n])))
+						}
+					}()
+				}
+			}()
+		}
+	}()
+	addr := listener.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port
+}
+
+func newTestManager(t *testing.T) *Manager {
+	db, err := database.NewDatabase(filepath.Join(t.TempDir(), "sys.db"), dbinc.BackendBoltDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+	return NewSSHProxyManager(&Options{Database: db, AllowLoopback: true})
+}
+
+func TestSessionAuthAndHostKey(t *testing.T) {
+	m := newTestManager(t)
+	host, port := startTestSSHServer(t, "secret")
+
+	_, err := m.NewSession(host, port, &Credentials{Username: "pi", Password: "wrong"}, "admin", "10.0.0.1")
+	if err == nil || !strings.Contains(err.Error(), "authentication failed") {
+		t.Fatalf("expected authentication failure, got %v", err)
+	}
+
+	instance, err := m.NewSession(host, port, &Credentials{Username: "pi", Password: "secret"}, "admin", "10.0.0.1")
 	if err != nil {
-		t.Fatalf("Failed to create new SSH proxy: %v", err)
+		t.Fatal(err)
+	}
+	if len(m.ListKnownHosts()) != 1 {
+		t.Fatalf("expected host key to be trusted on first use")
+	}
+	instance.Close("test done")
+	if len(m.ListSessions()) != 0 {
+		t.Errorf("closed session should be removed")
 	}
 
-	instance.Destroy()
+	//Another server on the same address with a different key
+	knownHost := m.ListKnownHosts()[0]
+	knownHost.Fingerprint = "SHA256:changed"
+	m.Options.Database.Write(hostKeyTable, knownHost.Address, knownHost)
+	_, err = m.NewSession(host, port, &Credentials{Username: "pi", Password: "secret"}, "admin", "10.0.0.1")
+	var mismatch *HostKeyMismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("expected host key mismatch, got %v", err)
+	}
 
-	if len(manager.Instances) != 0 {
-		t.Errorf("Expected Instances to be empty, got %d", len(manager.Instances))
+	//Trust the new key after removing the old one
+	if err := m.RemoveKnownHost(knownHost.Address); err != nil {
+		t.Fatal(err)
+	}
+	instance, err = m.NewSession(host, port, &Credentials{Username: "pi", Password: "secret"}, "admin", "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	instance.Close("test done")
+
+	//Audit log: failed, connect, disconnect, failed, connect, disconnect
+	entries := m.ListAuditLog(0)
+	if len(entries) != 6 {
+		t.Fatalf("expected 6 audit entries, got %d", len(entries))
+	}
+	for _, entry := range entries {
+		if entry.Owner != "admin" || entry.ClientIP != "10.0.0.1" || entry.Username != "pi" {
+			t.Errorf("unexpected audit entry %+v", entry)
+		}
+	}
+}
+
+func TestSessionLoopbackRejected(t *testing.T) {
+	m := newTestManager(t)
+	m.Options.AllowLoopback = false
+	host, port := startTestSSHServer(t, "secret")
+	_, err := m.NewSession(host, port, &Credentials{Username: "pi", Password: "secret"}, "admin", "10.0.0.1")
+	if err == nil || !strings.Contains(err.Error(), "loopback") {
+		t.Fatalf("expected loopback rejection, got %v", err)
+	}
+}
+
+func TestTerminalBridge(t *testing.T) {
+	m := newTestManager(t)
+	host, port := startTestSSHServer(t, "secret")
+	instance, err := m.NewSession(host, port, &Credentials{Username: "pi", Password: "secret"}, "admin", "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.HandleHttpByInstanceId(instance.UUID, r.URL.Query().Get("user"), w, r)
+	}))
+	defer server.Close()
+
+	//Other users cannot attach to the session
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?cols=100&rows=30"
+	if _, resp, err := websocket.DefaultDialer.Dial(wsURL+"&user=operator", nil); err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatal("session of another user should be rejected")
+	}
+
+	wsURL += "&user=admin"
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	//Second attach to the same session is rejected
+	if _, _, err := websocket.DefaultDialer.Dial(wsURL, nil); err == nil {
+		t.Error("session should only be attached once")
+	}
+
+	conn.WriteJSON(map[string]string{"type": "input", "data": "ls"})
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, reply, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != "echo:ls" {
+		t.Errorf("unexpected terminal output %q", reply)
+	}
+
+	//Closing the terminal end the session
+	conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(m.ListSessions()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if len(m.ListSessions()) != 0 {
+		t.Error("session should be closed with the terminal")
+	}
+}
+
+func TestSessionAttachTimeout(t *testing.T) {
+	m := newTestManager(t)
+	m.Options.AttachTimeout = 500 * time.Millisecond
+	host, port := startTestSSHServer(t, "secret")
+	_, err := m.NewSession(host, port, &Credentials{Username: "pi", Password: "secret"}, "admin", "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * watchdogInterval)
+	if len(m.ListSessions()) != 0 {
+		t.Error("unattached session should be closed after the attach timeout")
 	}
 }
 
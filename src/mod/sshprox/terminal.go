@@ -0,0 +1,213 @@
+package sshprox
+
+/*
+	terminal.go
+
+	Bridge the SSH session to the xterm.js terminal in the browser.
+
+	Browser to server messages are JSON text frames:
+	{"type":"input","data":"ls\r"} or {"type":"resize","cols":80,"rows":24}
+	Server to browser messages are binary frames of the terminal output
+*/
+
+import (
+	_ "embed"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	//go:embed templates/terminal.html
+	page_terminal []byte
+)
+
+const (
+	defaultTermCols = 80
+	defaultTermRows = 24
+	termType        = "xterm-256color"
+)
+
+var terminalUpgrader = &websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+}
+
+type terminalMessage struct {
+	Type string `json:"type"` //input or resize
+	Data string `json:"data"`
+	Cols int    `json:"cols"`
+	Rows int    `json:"rows"`
+}
+
+// Serve the terminal page or the terminal websocket of the given session,
+// user is the Zoraxy user of the request and must be the owner of the session
+func (m *Manager) HandleHttpByInstanceId(instanceId string, user string, w http.ResponseWriter, r *http.Request) {
+	targetInstance, err := m.GetInstanceById(instanceId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if targetInstance.Owner != user {
+		m.logf("Session "+instanceId+" of "+targetInstance.Owner+" rejected for "+user, nil)
+		http.Error(w, "Session belongs to another user", http.StatusForbidden)
+		return
+	}
+
+	requestPath := "/" + strings.TrimPrefix(r.URL.Path, "/")
+	switch requestPath {
+	case "/":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write(page_terminal)
+	case "/ws":
+		if !websocket.IsWebSocketUpgrade(r) {
+			http.Error(w, "Invalid Usage", http.StatusBadRequest)
+			return
+		}
+		targetInstance.attachTerminal(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Upgrade the request to websocket and bridge it to a new shell on the SSH connection.
+// Each session can only be attached once, closing the terminal end the session
+func (i *Instance) attachTerminal(w http.ResponseWriter, r *http.Request) {
+	if !i.attached.CompareAndSwap(false, true) {
+		http.Error(w, "Session already attached", http.StatusConflict)
+		return
+	}
+
+	wsConn, err := terminalUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		i.Close("websocket upgrade failed")
+		return
+	}
+	defer wsConn.Close()
+
+	cols, _ := strconv.Atoi(r.URL.Query().Get("cols"))
+	rows, _ := strconv.Atoi(r.URL.Query().Get("rows"))
+	session, stdin, stdout, err := i.startShell(cols, rows)
+	if err != nil {
+		wsConn.WriteMessage(websocket.BinaryMessage, []byte("\r\nUnable to start shell: "+err.Error()+"\r\n"))
+		i.Close("unable to start shell")
+		return
+	}
+	defer session.Close()
+
+	//Terminal output to browser
+	var writeLock sync.Mutex
+	outputDone := make(chan struct{})
+	go func() {
+		defer close(outputDone)
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := stdout.Read(buf)
+			if n > 0 {
+				i.touch()
+				writeLock.Lock()
+				writeErr := wsConn.WriteMessage(websocket.BinaryMessage, buf[:n])
+				writeLock.Unlock()
+				if writeErr != nil {
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	//Browser input to terminal
+	inputDone := make(chan struct{})
+	go func() {
+		defer close(inputDone)
+		for {
+			_, payload, err := wsConn.ReadMessage()
+			if err != nil {
+				return
+			}
+			msg := terminalMessage{}
+			if err := json.Unmarshal(payload, &msg); err != nil {
+				continue
+			}
+			switch msg.Type {
+			case "input":
+				i.touch()
+				if _, err := stdin.Write([]byte(msg.Data)); err != nil {
+					return
+				}
+			case "resize":
+				if msg.Cols > 0 && msg.Rows > 0 {
+					session.WindowChange(msg.Rows, msg.Cols)
+				}
+			}
+		}
+	}()
+
+	reason := "terminal closed"
+	select {
+	case <-outputDone:
+		reason = "remote shell exited"
+		writeLock.Lock()
+		wsConn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "Connection closed"))
+		writeLock.Unlock()
+	case <-inputDone:
+	case <-i.closed:
+		//Closed by timeout or admin
+		writeLock.Lock()
+		wsConn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "Session closed"))
+		writeLock.Unlock()
+	}
+	i.Close(reason)
+}
+
+// Start an interactive shell with a pty on the SSH connection
+func (i *Instance) startShell(cols int, rows int) (*ssh.Session, io.WriteCloser, io.Reader, error) {
+	if cols <= 0 || rows <= 0 {
+		cols, rows = defaultTermCols, defaultTermRows
+	}
+
+	session, err := i.client.NewSession()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	modes := ssh.TerminalModes{
+		ssh.ECHO:          1,
+		ssh.TTY_OP_ISPEED: 14400,
+		ssh.TTY_OP_OSPEED: 14400,
+	}
+	err = session.RequestPty(termType, rows, cols, modes)
+	if err != nil {
+		session.Close()
+		return nil, nil, nil, err
+	}
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return nil, nil, nil, err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, nil, nil, err
+	}
+	//With a pty, stderr is merged into stdout by the remote server
+	session.Stderr = io.Discard
+
+	err = session.Shell()
+	if err != nil {
+		session.Close()
+		return nil, nil, nil, err
+	}
+	return session, stdin, stdout, nil
+}
@@ -6,7 +6,6 @@ import (
 	"net"
 	"net/url"
 	"regexp"
-	"runtime"
 	"strings"
 	"time"
 )
@@ -17,40 +16,12 @@ func RewriteURL(rooturl string, requestURL string) (*url.URL, error) {
 	return url.Parse(rewrittenURL)
 }
 
-// Check if the current platform support web.ssh function
+// Check if the current platform support web.ssh function. The
+// native client work on all platforms, kept for API compatibility
 func IsWebSSHSupported() bool {
-	//Check if the binary exists in system/gotty/
-	binary := "gotty_" + runtime.GOOS + "_" + runtime.GOARCH
-
-	if runtime.GOOS == "windows" {
-		binary = binary + ".exe"
-	}
-
-	//Check if the target gotty terminal exists
-	f, err := gotty.Open("gotty/" + binary)
-	if err != nil {
-		return false
-	}
-
-	f.Close()
 	return true
 }
 
-// Get the next free port in the list
-func (m *Manager) GetNextPort() int {
-	nextPort := m.StartingPort
-	occupiedPort := make(map[int]bool)
-	for _, instance := range m.Instances {
-		occupiedPort[instance.AssignedPort] = true
-	}
-	for {
-		if !occupiedPort[nextPort] {
-			return nextPort
-		}
-		nextPort++
-	}
-}
-
 // Check if a given domain and port is a valid ssh server
 func IsSSHConnectable(ipOrDomain string, port int) bool {
 	timeout := time.Second * 3
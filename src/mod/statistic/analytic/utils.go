@@ -38,6 +38,7 @@ func mergeDailySummaryExports(exports []*statistic.DailySummaryExport) *statisti
 		RequestURL:      make(map[string]int),
 		Downstreams:     make(map[string]int),
 		Upstreams:       make(map[string]int),
+		StreamRelays:    make(map[string]*statistic.StreamRelayStats),
 	}
 
 	for _, export := range exports {
@@ -76,6 +77,18 @@ func mergeDailySummaryExports(exports []*statistic.DailySummaryExport) *statisti
 		for key, value := range export.Upstreams {
 			mergedExport.Upstreams[key] += value
 		}
+
+		for key, value := range export.StreamRelays {
+			merged, ok := mergedExport.StreamRelays[key]
+			if !ok {
+				merged = &statistic.StreamRelayStats{}
+				mergedExport.StreamRelays[key] = merged
+			}
+			merged.Name = value.Name
+			merged.Connections += value.Connections
+			merged.BytesIn += value.BytesIn
+			merged.BytesOut += value.BytesOut
+		}
 	}
 
 	return mergedExport
@@ -32,6 +32,7 @@ type DailySummary struct {
 	RequestURL          *sync.Map //Request URL of the request object
 	DownstreamHostnames *sync.Map //Request count of downstream hostname
 	UpstreamHostnames   *sync.Map //Forwarded request count of upstream hostname
+	StreamRelays        *sync.Map //Map that hold [stream proxy UUID]: *StreamRelayStats
 }
 
 type RequestInfo struct {
@@ -303,6 +304,7 @@ func NewDailySummary() *DailySummary {
 		RequestURL:          &sync.Map{},
 		DownstreamHostnames: &sync.Map{},
 		UpstreamHostnames:   &sync.Map{},
+		StreamRelays:        &sync.Map{},
 	}
 }
 
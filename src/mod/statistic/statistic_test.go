@@ -213,3 +213,24 @@ func BenchmarkRecordRequest(b *testing.B) {
 	//testSummary := collector.GetCurrentDailySummary()
 	//statistic.PrintDailySummary(testSummary)
 }
+
+func TestRecordStreamRelay(t *testing.T) {
+	db := getNewDatabase()
+	defer clearDatabase(db)
+	option := statistic.CollectorOption{Database: db}
+	collector, _ := statistic.NewStatisticCollector(option)
+
+	collector.RecordStreamRelay(statistic.StreamRelayInfo{RelayUUID: "relay-1", RelayName: "ssh", BytesIn: 100, BytesOut: 2000})
+	collector.RecordStreamRelay(statistic.StreamRelayInfo{RelayUUID: "relay-1", RelayName: "ssh", BytesIn: 50, BytesOut: 10})
+
+	//Convert to the persisted format and back
+	restored := statistic.DailySummaryExportToSummary(*collector.GetExportSummary())
+	export := statistic.DailySummaryToExport(restored)
+	stats, ok := export.StreamRelays["relay-1"]
+	if !ok {
+		t.Fatal("stream relay stats not exported")
+	}
+	if stats.Connections != 2 || stats.BytesIn != 150 || stats.BytesOut != 2010 {
+		t.Errorf("unexpected stream relay stats: %+v", stats)
+	}
+}
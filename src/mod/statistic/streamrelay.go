@@ -0,0 +1,74 @@
+package statistic
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+/*
+	Stream Relay Statistic
+
+	Daily traffic totals of stream proxy (TCP / UDP) rules,
+	recorded when each connection or UDP session ends
+*/
+
+// StreamRelayStats is the daily traffic summary of a stream proxy rule
+type StreamRelayStats struct {
+	Name        string //Name of the stream proxy rule
+	Connections int64  //Number of TCP connections and UDP sessions
+	BytesIn     int64  //Bytes sent from clients to targets
+	BytesOut    int64  //Bytes sent from targets to clients
+}
+
+// StreamRelayInfo is the summary of a closed stream proxy connection
+type StreamRelayInfo struct {
+	RelayUUID string //UUID of the stream proxy rule
+	RelayName string //Name of the stream proxy rule
+	BytesIn   int64  //Bytes sent from the client to the target
+	BytesOut  int64  //Bytes sent from the target to the client
+}
+
+// RecordStreamRelay add a closed stream proxy connection to today summary
+func (c *Collector) RecordStreamRelay(si StreamRelayInfo) {
+	summary := c.DailySummary
+	if summary.StreamRelays == nil {
+		return
+	}
+	//Name is only set on creation as the stats are read concurrently
+	entry, _ := summary.StreamRelays.LoadOrStore(si.RelayUUID, &StreamRelayStats{Name: si.RelayName})
+	stats := entry.(*StreamRelayStats)
+	atomic.AddInt64(&stats.Connections, 1)
+	atomic.AddInt64(&stats.BytesIn, si.BytesIn)
+	atomic.AddInt64(&stats.BytesOut, si.BytesOut)
+}
+
+func syncMapToStreamRelayStats(syncMap *sync.Map) map[string]*StreamRelayStats {
+	result := make(map[string]*StreamRelayStats)
+	if syncMap == nil {
+		return result
+	}
+	syncMap.Range(func(key, value interface{}) bool {
+		strKey, okKey := key.(string)
+		stats, okValue := value.(*StreamRelayStats)
+		if okKey && okValue {
+			result[strKey] = &StreamRelayStats{
+				Name:        stats.Name,
+				Connections: atomic.LoadInt64(&stats.Connections),
+				BytesIn:     atomic.LoadInt64(&stats.BytesIn),
+				BytesOut:    atomic.LoadInt64(&stats.BytesOut),
+			}
+		}
+		return true
+	})
+	return result
+}
+
+func streamRelayStatsToSyncMap(m map[string]*StreamRelayStats) *sync.Map {
+	syncMap := &sync.Map{}
+	for k, v := range m {
+		if v != nil {
+			syncMap.Store(k, v)
+		}
+	}
+	return syncMap
+}
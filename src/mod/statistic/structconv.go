@@ -15,6 +15,8 @@ type DailySummaryExport struct {
 	RequestURL      map[string]int
 	Downstreams     map[string]int
 	Upstreams       map[string]int
+
+	StreamRelays map[string]*StreamRelayStats
 }
 
 func SyncMapToMapStringInt(syncMap *sync.Map) map[string]int {
@@ -53,6 +55,7 @@ func DailySummaryToExport(summary DailySummary) DailySummaryExport {
 	export.RequestURL = SyncMapToMapStringInt(summary.RequestURL)
 	export.Downstreams = SyncMapToMapStringInt(summary.DownstreamHostnames)
 	export.Upstreams = SyncMapToMapStringInt(summary.UpstreamHostnames)
+	export.StreamRelays = syncMapToStreamRelayStats(summary.StreamRelays)
 
 	return export
 }
@@ -88,6 +91,7 @@ func DailySummaryExportToSummary(export DailySummaryExport) DailySummary {
 	summary.RequestURL = MapStringIntToSyncMap(export.RequestURL)
 	summary.DownstreamHostnames = MapStringIntToSyncMap(export.Downstreams)
 	summary.UpstreamHostnames = MapStringIntToSyncMap(export.Upstreams)
+	summary.StreamRelays = streamRelayStatsToSyncMap(export.StreamRelays)
 
 	return summary
 }
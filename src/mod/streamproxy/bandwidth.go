@@ -0,0 +1,78 @@
+package streamproxy
+
+/*
+	bandwidth.go
+
+	Bandwidth shaping of stream proxy relays. TCP streams
+	are delayed when over the limit while UDP packets over
+	the limit are dropped. Traffic is reported to the host
+	statistics collector for live bandwidth samples.
+*/
+
+import (
+	"net"
+
+	"imuslab.com/zoraxy/mod/bandwidth"
+	"imuslab.com/zoraxy/mod/hoststats"
+)
+
+// limiterSet hold the runtime limiters of a proxy rule
+type limiterSet struct {
+	rule      *bandwidth.Limiter      //Shared by all connections of this rule
+	perIP     *bandwidth.LimiterGroup //One limiter for each client IP
+	perTarget *bandwidth.LimiterGroup //One limiter for each target address
+}
+
+// Create the runtime limiters from the bandwidth settings of this rule
+func (c *ProxyRelayInstance) prepareBandwidthLimiters() {
+	limiters := &limiterSet{}
+	if c.BandwidthLimit > 0 {
+		limiters.rule = bandwidth.NewLimiter(c.BandwidthLimit)
+	}
+	if c.BandwidthPerIP > 0 {
+		limiters.perIP = bandwidth.NewLimiterGroup(c.BandwidthPerIP)
+	}
+	if c.BandwidthPerTarget > 0 {
+		limiters.perTarget = bandwidth.NewLimiterGroup(c.BandwidthPerTarget)
+	}
+	c.bandwidthLimiters.Store(limiters)
+
+	if collector := c.hostStatsCollector(); collector != nil {
+		collector.SetBandwidthLimit(c.hostStatsKey(), c.BandwidthLimit)
+	}
+}
+
+// Get the limiters shaping a session between the client and target
+func (c *ProxyRelayInstance) getBandwidthLimiters(clientAddr string, targetAddr string) []*bandwidth.Limiter {
+	limiters := c.bandwidthLimiters.Load()
+	if limiters == nil {
+		return nil
+	}
+	clientIP, _, err := net.SplitHostPort(clientAddr)
+	if err != nil {
+		clientIP = clientAddr
+	}
+	return bandwidth.Active(limiters.rule, limiters.perIP.Get(clientIP), limiters.perTarget.Get(targetAddr))
+}
+
+// Key of this rule in the host statistics
+func (c *ProxyRelayInstance) hostStatsKey() string {
+	if name := c.settings().name; name != "" {
+		return "stream:" + name
+	}
+	return "stream:" + c.UUID
+}
+
+// Report the bytes sent to and received from the client to the host statistics
+func (c *ProxyRelayInstance) recordTraffic(bytesSent int64, bytesReceived int64) {
+	if collector := c.hostStatsCollector(); collector != nil {
+		collector.RecordTraffic(c.hostStatsKey(), bytesSent, bytesReceived)
+	}
+}
+
+func (c *ProxyRelayInstance) hostStatsCollector() *hoststats.Collector {
+	if c.parent == nil || c.parent.Options == nil {
+		return nil
+	}
+	return c.parent.Options.HostStatsCollector
+}
@@ -0,0 +1,67 @@
+package streamproxy
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBandwidthLimit(t *testing.T) {
+	//Sink target reporting the time all bytes arrived
+	const payloadSize = 128 * 1024
+	sink, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	received := make(chan time.Time, 1)
+	go func() {
+		conn, err := sink.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.CopyN(io.Discard, conn, payloadSize)
+		received <- time.Now()
+	}()
+
+	reserved, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listenAddr := reserved.Addr().String()
+	reserved.Close()
+
+	//First 64KB burst is free, the rest take about one second
+	c := &ProxyRelayInstance{ProxyTargets: []string{sink.Addr().String()}, BandwidthLimit: 64 * 1024}
+	c.prepareBandwidthLimiters()
+	stopChan := make(chan bool)
+	go c.Port2host(listenAddr, "", stopChan)
+	defer func() { stopChan <- true }()
+
+	var client net.Conn
+	for i := 0; i < 20; i++ {
+		client, err = net.Dial("tcp", listenAddr)
+		if err == nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	start := time.Now()
+	go client.Write(make([]byte, payloadSize))
+	select {
+	case done := <-received:
+		elapsed := done.Sub(start)
+		if elapsed < 700*time.Millisecond || elapsed > 3*time.Second {
+			t.Errorf("unexpected transfer time %v", elapsed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("payload not received")
+	}
+}
@@ -1,11 +1,14 @@
 package streamproxy
 
 import (
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"strconv"
 	"strings"
 
+	"imuslab.com/zoraxy/mod/netutils"
 	"imuslab.com/zoraxy/mod/utils"
 )
 
@@ -29,11 +32,33 @@ func (m *Manager) HandleAddProxyConfig(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	//Comma seperated list of targets for load balancing
 	proxyAddr, err := utils.PostPara(r, "proxyAddr")
 	if err != nil {
 		utils.SendErrorResponse(w, "second address cannot be empty")
 		return
 	}
+	proxyTargets := ParseTargetAddrs(proxyAddr)
+	if len(proxyTargets) == 0 {
+		utils.SendErrorResponse(w, "second address cannot be empty")
+		return
+	}
+
+	loadBalancePolicy, _ := utils.PostPara(r, "loadBalancePolicy")
+	if loadBalancePolicy == "" {
+		loadBalancePolicy = string(LoadBalanceRoundRobin)
+	} else if !IsValidLoadBalancePolicy(loadBalancePolicy) {
+		utils.SendErrorResponse(w, "invalid load balance policy given")
+		return
+	}
+
+	healthCheckInterval, err := utils.PostInt(r, "healthCheckInterval")
+	if err != nil {
+		healthCheckInterval = 0
+	} else if healthCheckInterval < 0 {
+		utils.SendErrorResponse(w, "invalid health check interval given")
+		return
+	}
 
 	timeoutStr, _ := utils.PostPara(r, "timeout")
 	timeout := m.Options.DefaultTimeout
@@ -49,17 +74,87 @@ func (m *Manager) HandleAddProxyConfig(w http.ResponseWriter, r *http.Request) {
 	useUDP, _ := utils.PostBool(r, "useUDP")
 	ProxyProtocolVersion, _ := utils.PostInt(r, "proxyProtocolVersion")
 	enableLogging, _ := utils.PostBool(r, "enableLogging")
+	acceptProxyProtocol, _ := utils.PostBool(r, "acceptProxyProtocol")
+	trustedProxyCIDRs, err := parseTrustedProxyCIDRsPara(r, acceptProxyProtocol)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	//Access rule and connection limits, 0 for unlimited
+	accessRuleID, _ := utils.PostPara(r, "accessRuleID")
+	maxConnections, _ := utils.PostInt(r, "maxConnections")
+	maxConnectionsPerIP, _ := utils.PostInt(r, "maxConnectionsPerIP")
+	idleTimeout, _ := utils.PostInt(r, "idleTimeout")
+	if maxConnections < 0 || maxConnectionsPerIP < 0 || idleTimeout < 0 {
+		utils.SendErrorResponse(w, "connection limits and idle timeout cannot be negative")
+		return
+	}
+
+	//Bandwidth limits in bytes per second, 0 for unlimited
+	bandwidthLimit, _ := utils.PostInt(r, "bandwidthLimit")
+	bandwidthPerIP, _ := utils.PostInt(r, "bandwidthPerIP")
+	bandwidthPerTarget, _ := utils.PostInt(r, "bandwidthPerTarget")
+	if bandwidthLimit < 0 || bandwidthPerIP < 0 || bandwidthPerTarget < 0 {
+		utils.SendErrorResponse(w, "bandwidth limits cannot be negative")
+		return
+	}
+
+	//Grace period for existing connections after a config change, 0 to wait until they close
+	drainTimeout, _ := utils.PostInt(r, "drainTimeout")
+	if drainTimeout < 0 {
+		utils.SendErrorResponse(w, "drain timeout cannot be negative")
+		return
+	}
+
+	tlsParas, err := parseTLSParas(r)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	//Check the listening ports are free and can be mapped to the targets
+	listenAddr = strings.TrimSpace(listenAddr)
+	if err := m.ValidateListeningAddress("", listenAddr, useTCP, useUDP); err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	if err := ValidatePortMapping(listenAddr, proxyTargets); err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
 
 	//Create the target config
 	newConfigUUID := m.NewConfig(&ProxyRelayOptions{
 		Name:                 name,
-		ListeningAddr:        strings.TrimSpace(listenAddr),
-		ProxyAddr:            strings.TrimSpace(proxyAddr),
+		ListeningAddr:        listenAddr,
+		ProxyAddr:            proxyTargets[0],
+		ProxyTargets:         proxyTargets,
+		LoadBalancePolicy:    LoadBalancePolicy(loadBalancePolicy),
+		HealthCheckInterval:  healthCheckInterval,
 		Timeout:              timeout,
 		UseTCP:               useTCP,
 		UseUDP:               useUDP,
 		ProxyProtocolVersion: convertIntToProxyProtocolVersion(ProxyProtocolVersion),
 		EnableLogging:        enableLogging,
+		AcceptProxyProtocol:  acceptProxyProtocol,
+		TrustedProxyCIDRs:    trustedProxyCIDRs,
+		AccessRuleID:         accessRuleID,
+		MaxConnections:       maxConnections,
+		MaxConnectionsPerIP:  maxConnectionsPerIP,
+		IdleTimeout:          idleTimeout,
+		TLSTerminate:         tlsParas.terminate,
+		ClientCABundle:       tlsParas.clientCABundle,
+		RequireClientCert:    tlsParas.requireClientCert,
+		TLSOriginate:         tlsParas.originate,
+		TargetSNI:            tlsParas.targetSNI,
+		TargetCABundle:       tlsParas.targetCABundle,
+		TargetSkipVerify:     tlsParas.targetSkipVerify,
+		TargetClientCertName: tlsParas.targetClientCertName,
+		BandwidthLimit:       int64(bandwidthLimit),
+		BandwidthPerIP:       int64(bandwidthPerIP),
+		BandwidthPerTarget:   int64(bandwidthPerTarget),
+		DrainTimeout:         drainTimeout,
 	})
 
 	js, _ := json.Marshal(newConfigUUID)
@@ -77,10 +172,58 @@ func (m *Manager) HandleEditProxyConfigs(w http.ResponseWriter, r *http.Request)
 	newName, _ := utils.PostPara(r, "name")
 	listenAddr, _ := utils.PostPara(r, "listenAddr")
 	proxyAddr, _ := utils.PostPara(r, "proxyAddr")
+	loadBalancePolicy, _ := utils.PostPara(r, "loadBalancePolicy")
+	healthCheckInterval, err := utils.PostInt(r, "healthCheckInterval")
+	if err != nil {
+		healthCheckInterval = -1
+	}
 	useTCP, _ := utils.PostBool(r, "useTCP")
 	useUDP, _ := utils.PostBool(r, "useUDP")
 	proxyProtocolVersion, _ := utils.PostInt(r, "proxyProtocolVersion")
 	enableLogging, _ := utils.PostBool(r, "enableLogging")
+	acceptProxyProtocol, _ := utils.PostBool(r, "acceptProxyProtocol")
+	trustedProxyCIDRs, err := parseTrustedProxyCIDRsPara(r, acceptProxyProtocol)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	accessRuleID, _ := utils.PostPara(r, "accessRuleID")
+	maxConnections, err := utils.PostInt(r, "maxConnections")
+	if err != nil {
+		maxConnections = -1
+	}
+	maxConnectionsPerIP, err := utils.PostInt(r, "maxConnectionsPerIP")
+	if err != nil {
+		maxConnectionsPerIP = -1
+	}
+	idleTimeout, err := utils.PostInt(r, "idleTimeout")
+	if err != nil {
+		idleTimeout = -1
+	}
+
+	bandwidthLimit, err := utils.PostInt(r, "bandwidthLimit")
+	if err != nil {
+		bandwidthLimit = -1
+	}
+	bandwidthPerIP, err := utils.PostInt(r, "bandwidthPerIP")
+	if err != nil {
+		bandwidthPerIP = -1
+	}
+	bandwidthPerTarget, err := utils.PostInt(r, "bandwidthPerTarget")
+	if err != nil {
+		bandwidthPerTarget = -1
+	}
+	drainTimeout, err := utils.PostInt(r, "drainTimeout")
+	if err != nil {
+		drainTimeout = -1
+	}
+
+	tlsParas, err := parseTLSParas(r)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
 
 	newTimeoutStr, _ := utils.PostPara(r, "timeout")
 	newTimeout := -1
@@ -97,12 +240,32 @@ func (m *Manager) HandleEditProxyConfigs(w http.ResponseWriter, r *http.Request)
 		InstanceUUID:         configUUID,
 		NewName:              newName,
 		NewListeningAddr:     listenAddr,
-		NewProxyAddr:         proxyAddr,
+		NewProxyTargets:      ParseTargetAddrs(proxyAddr),
+		LoadBalancePolicy:    loadBalancePolicy,
+		HealthCheckInterval:  healthCheckInterval,
 		UseTCP:               useTCP,
 		UseUDP:               useUDP,
 		ProxyProtocolVersion: proxyProtocolVersion,
 		EnableLogging:        enableLogging,
 		NewTimeout:           newTimeout,
+		AcceptProxyProtocol:  acceptProxyProtocol,
+		TrustedProxyCIDRs:    trustedProxyCIDRs,
+		AccessRuleID:         accessRuleID,
+		MaxConnections:       maxConnections,
+		MaxConnectionsPerIP:  maxConnectionsPerIP,
+		IdleTimeout:          idleTimeout,
+		TLSTerminate:         tlsParas.terminate,
+		ClientCABundle:       tlsParas.clientCABundle,
+		RequireClientCert:    tlsParas.requireClientCert,
+		TLSOriginate:         tlsParas.originate,
+		TargetSNI:            tlsParas.targetSNI,
+		TargetCABundle:       tlsParas.targetCABundle,
+		TargetSkipVerify:     tlsParas.targetSkipVerify,
+		TargetClientCertName: tlsParas.targetClientCertName,
+		BandwidthLimit:       int64(bandwidthLimit),
+		BandwidthPerIP:       int64(bandwidthPerIP),
+		BandwidthPerTarget:   int64(bandwidthPerTarget),
+		DrainTimeout:         drainTimeout,
 	}
 
 	// Call the EditConfig method to modify the configuration
@@ -115,6 +278,63 @@ func (m *Manager) HandleEditProxyConfigs(w http.ResponseWriter, r *http.Request)
 	utils.SendOK(w)
 }
 
+// Parse the comma seperated trustedProxyCIDRs POST parameter
+func parseTrustedProxyCIDRsPara(r *http.Request, acceptProxyProtocol bool) ([]string, error) {
+	trustedProxyCIDRs := []string{}
+	trustedProxyCIDRsStr, _ := utils.PostPara(r, "trustedProxyCIDRs")
+	for _, cidr := range strings.Split(trustedProxyCIDRsStr, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr != "" {
+			trustedProxyCIDRs = append(trustedProxyCIDRs, cidr)
+		}
+	}
+
+	if _, err := netutils.ParseTrustedProxyCIDRs(trustedProxyCIDRs); err != nil {
+		return nil, err
+	}
+	if acceptProxyProtocol && len(trustedProxyCIDRs) == 0 {
+		return nil, errors.New("at least one trusted proxy address is required")
+	}
+	return trustedProxyCIDRs, nil
+}
+
+type tlsParas struct {
+	terminate            bool
+	clientCABundle       string
+	requireClientCert    bool
+	originate            bool
+	targetSNI            string
+	targetCABundle       string
+	targetSkipVerify     bool
+	targetClientCertName string
+}
+
+// Parse the TLS termination and origination POST parameters
+func parseTLSParas(r *http.Request) (*tlsParas, error) {
+	paras := tlsParas{}
+	paras.terminate, _ = utils.PostBool(r, "tlsTerminate")
+	paras.clientCABundle, _ = utils.PostPara(r, "clientCABundle")
+	paras.requireClientCert, _ = utils.PostBool(r, "requireClientCert")
+	paras.originate, _ = utils.PostBool(r, "tlsOriginate")
+	paras.targetSNI, _ = utils.PostPara(r, "targetSNI")
+	paras.targetCABundle, _ = utils.PostPara(r, "targetCABundle")
+	paras.targetSkipVerify, _ = utils.PostBool(r, "targetSkipVerify")
+	paras.targetClientCertName, _ = utils.PostPara(r, "targetClientCertName")
+
+	if paras.requireClientCert && strings.TrimSpace(paras.clientCABundle) == "" {
+		return nil, errors.New("client CA bundle is required for client certificate verification")
+	}
+
+	//Check the bundles can be parsed before saving
+	if strings.TrimSpace(paras.clientCABundle) != "" && !x509.NewCertPool().AppendCertsFromPEM([]byte(paras.clientCABundle)) {
+		return nil, errors.New("no valid certificate found in client CA bundle")
+	}
+	if strings.TrimSpace(paras.targetCABundle) != "" && !x509.NewCertPool().AppendCertsFromPEM([]byte(paras.targetCABundle)) {
+		return nil, errors.New("no valid certificate found in target CA bundle")
+	}
+	return &paras, nil
+}
+
 func (m *Manager) HandleListConfigs(w http.ResponseWriter, r *http.Request) {
 	js, _ := json.Marshal(m.Configs)
 	utils.SendJSONResponse(w, string(js))
@@ -206,6 +426,71 @@ func (m *Manager) HandleGetProxyStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	js, _ := json.Marshal(targetConfig)
+	js, _ := json.Marshal(targetConfig.GetStatus())
 	utils.SendJSONResponse(w, string(js))
 }
+
+// Get the runtime state of the targets of a proxy rule
+func (m *Manager) HandleGetTargetStatus(w http.ResponseWriter, r *http.Request) {
+	uuid, err := utils.GetPara(r, "uuid")
+	if err != nil {
+		utils.SendErrorResponse(w, "invalid uuid given")
+		return
+	}
+
+	targetConfig, err := m.GetConfigByUUID(uuid)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	js, _ := json.Marshal(targetConfig.GetTargetStatus())
+	utils.SendJSONResponse(w, string(js))
+}
+
+// List the active TCP connections and UDP sessions of a proxy rule
+func (m *Manager) HandleListSessions(w http.ResponseWriter, r *http.Request) {
+	uuid, err := utils.GetPara(r, "uuid")
+	if err != nil {
+		utils.SendErrorResponse(w, "invalid uuid given")
+		return
+	}
+
+	targetConfig, err := m.GetConfigByUUID(uuid)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	js, _ := json.Marshal(targetConfig.ListSessions())
+	utils.SendJSONResponse(w, string(js))
+}
+
+// Forcibly close an active TCP connection or UDP session of a proxy rule
+func (m *Manager) HandleCloseSession(w http.ResponseWriter, r *http.Request) {
+	uuid, err := utils.PostPara(r, "uuid")
+	if err != nil {
+		utils.SendErrorResponse(w, "invalid uuid given")
+		return
+	}
+
+	sessionID, err := utils.PostPara(r, "id")
+	if err != nil {
+		utils.SendErrorResponse(w, "invalid session id given")
+		return
+	}
+
+	targetConfig, err := m.GetConfigByUUID(uuid)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	err = targetConfig.CloseSession(sessionID)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	utils.SendOK(w)
+}
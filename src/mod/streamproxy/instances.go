@@ -10,11 +10,52 @@ package streamproxy
 import (
 	"errors"
 	"log"
+	"strings"
 	"time"
 )
 
+// relaySettings is a snapshot of the settings read by the running listeners and
+// sessions. It is replaced as a whole on config change so they never see a
+// partially applied config
+type relaySettings struct {
+	name                 string
+	enableLogging        bool
+	proxyProtocolVersion ProxyProtocolVersion
+	timeout              int
+	accessRuleID         string
+	maxConnections       int
+	maxConnectionsPerIP  int
+	idleTimeout          int
+	drainTimeout         int
+}
+
+// Publish the current config to the running listeners and sessions
+func (c *ProxyRelayInstance) publishSettings() {
+	c.runtimeSettings.Store(&relaySettings{
+		name:                 c.Name,
+		enableLogging:        c.EnableLogging,
+		proxyProtocolVersion: c.ProxyProtocolVersion,
+		timeout:              c.Timeout,
+		accessRuleID:         c.AccessRuleID,
+		maxConnections:       c.MaxConnections,
+		maxConnectionsPerIP:  c.MaxConnectionsPerIP,
+		idleTimeout:          c.IdleTimeout,
+		drainTimeout:         c.DrainTimeout,
+	})
+}
+
+// Get the settings published to the running listeners and sessions
+func (c *ProxyRelayInstance) settings() *relaySettings {
+	if s := c.runtimeSettings.Load(); s != nil {
+		return s
+	}
+	//Instance not created by the manager
+	c.publishSettings()
+	return c.runtimeSettings.Load()
+}
+
 func (c *ProxyRelayInstance) LogMsg(message string, originalError error) {
-	if !c.EnableLogging {
+	if !c.settings().enableLogging {
 		return
 	}
 
@@ -32,38 +73,36 @@ func (c *ProxyRelayInstance) Start() error {
 		return errors.New("proxy already running")
 	}
 
-	// Create a stopChan to control the loop
-	tcpStopChan := make(chan bool)
-	udpStopChan := make(chan bool)
-
-	//Start the proxy service
-	if c.UseUDP {
-		c.udpStopChan = udpStopChan
-		go func() {
-			err := c.ForwardUDP(c.ListeningAddress, c.ProxyTargetAddr, udpStopChan)
-			if err != nil {
-				if !c.UseTCP {
-					c.Running = false
-					c.udpStopChan = nil
-					c.parent.SaveConfigToDatabase()
-				}
-				c.parent.logf("[proto:udp] Error starting stream proxy "+c.Name+"("+c.UUID+")", err)
-			}
-		}()
+	specs, err := c.listenerSpecs()
+	if err != nil {
+		return err
 	}
 
-	if c.UseTCP {
-		c.tcpStopChan = tcpStopChan
-		go func() {
-			//Default to transport mode
-			err := c.Port2host(c.ListeningAddress, c.ProxyTargetAddr, tcpStopChan)
-			if err != nil {
-				c.Running = false
-				c.tcpStopChan = nil
-				c.parent.SaveConfigToDatabase()
-				c.parent.logf("[proto:tcp] Error starting stream proxy "+c.Name+"("+c.UUID+")", err)
+	// Create the bandwidth limiters shared by the TCP and UDP proxy
+	c.publishSettings()
+	c.prepareBandwidthLimiters()
+
+	//Bind all the listening ports, rules with port range or port list run one listener per port
+	listeners := []*relayListener{}
+	for _, spec := range specs {
+		l, err := c.bindListener(spec)
+		if err != nil {
+			for _, started := range listeners {
+				c.closeListener(started)
 			}
-		}()
+			c.Running = false
+			c.parent.SaveConfigToDatabase()
+			c.parent.logf("[proto:"+spec.protocol+"] Error starting stream proxy "+c.Name+"("+c.UUID+") on "+spec.address, err)
+			return err
+		}
+		listeners = append(listeners, l)
+	}
+
+	c.listenerLock.Lock()
+	c.listeners = listeners
+	c.listenerLock.Unlock()
+	for _, l := range listeners {
+		go c.serveListener(l)
 	}
 
 	//Successfully spawned off the proxy routine
@@ -74,10 +113,13 @@ func (c *ProxyRelayInstance) Start() error {
 
 // Return if a proxy config is running
 func (c *ProxyRelayInstance) IsRunning() bool {
-	return c.tcpStopChan != nil || c.udpStopChan != nil
+	c.listenerLock.Lock()
+	defer c.listenerLock.Unlock()
+	return len(c.listeners) > 0
 }
 
-// Restart a proxy config
+// Restart a proxy config, this drop all the existing connections.
+// Use Reload to apply config changes to a running proxy
 func (c *ProxyRelayInstance) Restart() {
 	if c.IsRunning() {
 		c.Stop()
@@ -90,16 +132,14 @@ func (c *ProxyRelayInstance) Restart() {
 func (c *ProxyRelayInstance) Stop() {
 	c.parent.logf("Stopping Stream Proxy "+c.Name, nil)
 
-	if c.udpStopChan != nil {
-		c.parent.logf("Stopping UDP for "+c.Name, nil)
-		c.udpStopChan <- true
-		c.udpStopChan = nil
-	}
-
-	if c.tcpStopChan != nil {
-		c.parent.logf("Stopping TCP for "+c.Name, nil)
-		c.tcpStopChan <- true
-		c.tcpStopChan = nil
+	c.listenerLock.Lock()
+	listeners := append(append([]*relayListener{}, c.listeners...), c.drainingListeners...)
+	c.listeners = nil
+	c.drainingListeners = nil
+	c.listenerLock.Unlock()
+	for _, l := range listeners {
+		c.parent.logf("Stopping "+strings.ToUpper(l.protocol)+" for "+c.Name+" on "+l.address, nil)
+		c.closeListener(l)
 	}
 
 	c.parent.logf("Stopped Stream Proxy "+c.Name, nil)
@@ -0,0 +1,194 @@
+package streamproxy
+
+/*
+	limits.go
+
+	Per rule access control, connection limits and idle
+	timeout for stream proxy connections and UDP sessions
+*/
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"imuslab.com/zoraxy/mod/bandwidth"
+)
+
+// ProxyRelayStatus is the config of a proxy rule together with its runtime counters
+type ProxyRelayStatus struct {
+	*ProxyRelayInstance
+	ActiveConnections    int64 //Current number of TCP connections and UDP sessions
+	RejectedByAccessRule int64 //Number of connections rejected by the access rule
+	RejectedByConnLimit  int64 //Number of connections rejected by the connection limits
+	ListeningPorts       int   //Number of ports the rule listen on
+}
+
+// GetStatus return the config and runtime counters of this proxy rule
+func (c *ProxyRelayInstance) GetStatus() *ProxyRelayStatus {
+	c.connLimitLock.Lock()
+	activeConns := c.activeConns
+	c.connLimitLock.Unlock()
+	listeningPorts := 1
+	if _, ports, err := ParseListeningAddress(c.ListeningAddress); err == nil {
+		listeningPorts = len(ports)
+	}
+	return &ProxyRelayStatus{
+		ProxyRelayInstance:   c,
+		ActiveConnections:    activeConns,
+		RejectedByAccessRule: c.rejectedByAccessRule.Load(),
+		RejectedByConnLimit:  c.rejectedByConnLimit.Load(),
+		ListeningPorts:       listeningPorts,
+	}
+}
+
+// Check if the client IP is allowed by the access rule of this proxy rule
+func (c *ProxyRelayInstance) allowAccess(conn net.Conn, clientIP string) bool {
+	if c.parent == nil {
+		return true
+	}
+	if c.parent.Options.AccessRuleHandler != nil {
+		ruleID := c.settings().accessRuleID
+		if ruleID == "" {
+			ruleID = "default"
+		}
+		return c.parent.Options.AccessRuleHandler(ruleID, clientIP)
+	}
+	if conn != nil {
+		return c.parent.Options.AccessControlHandler(conn)
+	}
+	return true
+}
+
+// acquireConnSlot reserve a connection slot for the client IP, return false if
+// the rule or per IP connection limit is reached
+func (c *ProxyRelayInstance) acquireConnSlot(clientIP string) bool {
+	c.connLimitLock.Lock()
+	defer c.connLimitLock.Unlock()
+	if c.connsPerIP == nil {
+		c.connsPerIP = map[string]int{}
+	}
+
+	settings := c.settings()
+	if settings.maxConnections > 0 && c.activeConns >= int64(settings.maxConnections) {
+		c.rejectedByConnLimit.Add(1)
+		return false
+	}
+	if settings.maxConnectionsPerIP > 0 && c.connsPerIP[clientIP] >= settings.maxConnectionsPerIP {
+		c.rejectedByConnLimit.Add(1)
+		return false
+	}
+
+	c.activeConns++
+	c.connsPerIP[clientIP]++
+	return true
+}
+
+// releaseConnSlot free the slot acquired by acquireConnSlot
+func (c *ProxyRelayInstance) releaseConnSlot(clientIP string) {
+	c.connLimitLock.Lock()
+	defer c.connLimitLock.Unlock()
+	c.activeConns--
+	c.connsPerIP[clientIP]--
+	if c.connsPerIP[clientIP] <= 0 {
+		delete(c.connsPerIP, clientIP)
+	}
+}
+
+// Get the idle timeout of this rule, 0 if disabled
+func (c *ProxyRelayInstance) idleTimeout() time.Duration {
+	idleTimeout := c.settings().idleTimeout
+	if idleTimeout <= 0 {
+		return 0
+	}
+	return time.Duration(idleTimeout) * time.Second
+}
+
+func addrIP(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP.String()
+	case *net.UDPAddr:
+		return a.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+/* Idle Timeout */
+
+// idleTracker record the last time data is transferred on a connection pair
+type idleTracker struct {
+	lastActive atomic.Int64
+}
+
+func newIdleTracker() *idleTracker {
+	t := &idleTracker{}
+	t.touch()
+	return t
+}
+
+func (t *idleTracker) touch() {
+	t.lastActive.Store(time.Now().UnixNano())
+}
+
+func (t *idleTracker) idleFor() time.Duration {
+	return time.Since(time.Unix(0, t.lastActive.Load()))
+}
+
+// watch close the connections once no data is transferred for the timeout, until done is closed
+func (t *idleTracker) watch(timeout time.Duration, done chan struct{}, onIdle func()) {
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if t.idleFor() > timeout {
+				onIdle()
+				return
+			}
+		}
+	}
+}
+
+// activityConn update the idle tracker and byte counter on every read,
+// and delay the reads once the session is over its bandwidth limits
+type activityConn struct {
+	net.Conn
+	tracker  *idleTracker
+	counter  *atomic.Int64        //Bytes read from this connection
+	limiters []*bandwidth.Limiter //Bandwidth limiters of the session, can be empty
+	onRead   func(n int64)        //Report the bytes read to the host statistics, can be nil
+	ctx      context.Context      //Abort the bandwidth wait once the session is closed
+	cancel   context.CancelFunc
+}
+
+func (c *activityConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.tracker.touch()
+		c.counter.Add(int64(n))
+		if c.onRead != nil {
+			c.onRead(int64(n))
+		}
+		if len(c.limiters) > 0 {
+			if werr := bandwidth.Wait(c.ctx, n, c.limiters); werr != nil && err == nil {
+				err = werr
+			}
+		}
+	}
+	return n, err
+}
+
+func (c *activityConn) Close() error {
+	if c.cancel != nil {
+		c.cancel()
+	}
+	return c.Conn.Close()
+}
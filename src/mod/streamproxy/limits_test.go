@@ -0,0 +1,90 @@
+package streamproxy
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnectionLimits(t *testing.T) {
+	c := &ProxyRelayInstance{MaxConnections: 3, MaxConnectionsPerIP: 2}
+
+	if !c.acquireConnSlot("10.0.0.1") || !c.acquireConnSlot("10.0.0.1") {
+		t.Fatal("first two connections should be allowed")
+	}
+	if c.acquireConnSlot("10.0.0.1") {
+		t.Error("per IP limit should reject the third connection")
+	}
+	if !c.acquireConnSlot("10.0.0.2") {
+		t.Error("another IP should be allowed")
+	}
+	if c.acquireConnSlot("10.0.0.3") {
+		t.Error("rule limit should reject the fourth connection")
+	}
+
+	c.releaseConnSlot("10.0.0.1")
+	if !c.acquireConnSlot("10.0.0.3") {
+		t.Error("released slot should be reusable")
+	}
+
+	status := c.GetStatus()
+	if status.ActiveConnections != 3 || status.RejectedByConnLimit != 2 {
+		t.Errorf("unexpected counters: active %d, rejected %d", status.ActiveConnections, status.RejectedByConnLimit)
+	}
+}
+
+func TestAccessRuleHandler(t *testing.T) {
+	var checkedRule string
+	c := &ProxyRelayInstance{
+		parent: &Manager{Options: &Options{
+			AccessRuleHandler: func(ruleID string, clientIP string) bool {
+				checkedRule = ruleID
+				return clientIP != "203.0.113.7"
+			},
+		}},
+	}
+
+	if !c.allowAccess(nil, "198.51.100.1") || checkedRule != "default" {
+		t.Error("empty access rule ID should use the default rule")
+	}
+	c.AccessRuleID = "custom"
+	c.publishSettings()
+	if c.allowAccess(nil, "203.0.113.7") || checkedRule != "custom" {
+		t.Error("blocked IP should be rejected by the custom rule")
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	c := &ProxyRelayInstance{IdleTimeout: 1}
+	client, proxySide := net.Pipe()
+	target, targetSide := net.Pipe()
+	defer client.Close()
+	defer target.Close()
+
+	session := c.newSession(nil, "tcp", "client", "target", func() {})
+	done := make(chan struct{})
+	go func() {
+		c.forward(targetSide, proxySide, session)
+		close(done)
+	}()
+
+	//Traffic keep the connection alive
+	go io.Copy(io.Discard, target)
+	for i := 0; i < 3; i++ {
+		client.Write([]byte("ping"))
+		time.Sleep(400 * time.Millisecond)
+	}
+	select {
+	case <-done:
+		t.Fatal("active connection should not be closed")
+	default:
+	}
+
+	//No traffic, connection closed after the idle timeout
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("idle connection was not closed")
+	}
+}
@@ -0,0 +1,404 @@
+package streamproxy
+
+/*
+	listeners.go
+
+	Running listeners of a proxy rule, one for each protocol
+	and listening port. On config change the listeners are
+	reconciled in place instead of restarted:
+
+	- targets and TLS origination are swapped for new connections
+	- new ports are bound before the removed ones are closed
+	- sessions on removed ports or targets drain within the
+	  grace period of the rule
+*/
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	drainCheckInterval  = time.Second //Interval for checking the sessions of draining listeners
+	udpDrainIdleTimeout = time.Minute //Close sessions of draining UDP listeners without traffic for this long
+)
+
+// relayListener is a running TCP or UDP listener on one port of a proxy rule
+type relayListener struct {
+	protocol    string                     //tcp or udp
+	address     string                     //Listening address in host:port
+	tcpListener net.Listener               //TCP listener with PROXY protocol and TLS wrappers
+	udpConn     *net.UDPConn               //UDP listener
+	pool        atomic.Pointer[targetPool] //Targets for new connections
+	targetTLS   atomic.Pointer[tls.Config] //TLS origination config, nil if disabled
+	draining    atomic.Bool                //Draining listeners do not accept new UDP clients
+	healthStop  chan bool                  //Stop the health checker of the current pool
+	lock        sync.Mutex
+	closeOnce   sync.Once
+}
+
+// listenerSpec is a listener wanted by the current config of the rule
+type listenerSpec struct {
+	protocol string
+	address  string
+	targets  []string
+}
+
+func (l *relayListener) key() string {
+	return l.protocol + "/" + l.address
+}
+
+func (s *listenerSpec) key() string {
+	return s.protocol + "/" + s.address
+}
+
+// Check if the listener would conflict with the given spec on the same port
+func (l *relayListener) conflictsWith(s *listenerSpec) bool {
+	if l.protocol != s.protocol {
+		return false
+	}
+	lHost, lPort, err := net.SplitHostPort(l.address)
+	if err != nil {
+		return false
+	}
+	sHost, sPort, err := net.SplitHostPort(s.address)
+	if err != nil {
+		return false
+	}
+	return lPort == sPort && hostsOverlap(lHost, sHost)
+}
+
+// Close the listening socket and the health checker
+func (l *relayListener) close() {
+	l.closeOnce.Do(func() {
+		l.lock.Lock()
+		if l.healthStop != nil {
+			close(l.healthStop)
+			l.healthStop = nil
+		}
+		l.lock.Unlock()
+		if l.tcpListener != nil {
+			l.tcpListener.Close()
+		}
+		if l.udpConn != nil {
+			l.udpConn.Close()
+		}
+	})
+}
+
+// listenerSpecs return the listeners wanted by the current config, one per protocol and port
+func (c *ProxyRelayInstance) listenerSpecs() ([]*listenerSpec, error) {
+	listenAddrs, err := ExpandListeningAddress(c.ListeningAddress)
+	if err != nil {
+		return nil, err
+	}
+	_, ports, _ := ParseListeningAddress(c.ListeningAddress)
+	pools, err := mapTargetPools(c.GetTargets(), ports)
+	if err != nil {
+		return nil, err
+	}
+
+	specs := []*listenerSpec{}
+	for _, protocol := range []string{"tcp", "udp"} {
+		if (protocol == "tcp" && !c.UseTCP) || (protocol == "udp" && !c.UseUDP) {
+			continue
+		}
+		for i, listenAddr := range listenAddrs {
+			specs = append(specs, &listenerSpec{
+				protocol: protocol,
+				address:  listenAddr,
+				targets:  pools[i],
+			})
+		}
+	}
+	return specs, nil
+}
+
+// Bind the listening socket of the spec
+func (c *ProxyRelayInstance) bindListener(spec *listenerSpec) (*relayListener, error) {
+	if spec.protocol == "udp" {
+		return c.listenUDP(spec.address, spec.targets)
+	}
+	return c.listenTCP(spec.address, spec.targets)
+}
+
+// Serve the listener until it is closed
+func (c *ProxyRelayInstance) serveListener(l *relayListener) {
+	if l.protocol == "udp" {
+		c.serveUDP(l)
+		return
+	}
+	c.serveTCP(l)
+}
+
+// updateListener replace the target pool and TLS origination of the listener.
+// Targets kept in the new pool keep their health and connection counters
+func (c *ProxyRelayInstance) updateListener(l *relayListener, targets []string) error {
+	var targetTLSConfig *tls.Config
+	if l.protocol == "tcp" {
+		var err error
+		targetTLSConfig, err = c.buildTargetTLSConfig()
+		if err != nil {
+			return err
+		}
+	}
+
+	pool := newTargetPool(targets, c.LoadBalancePolicy, c.LogMsg)
+	pool.inherit(l.pool.Load())
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.healthStop != nil {
+		close(l.healthStop)
+		l.healthStop = nil
+	}
+	if l.protocol == "tcp" && c.HealthCheckInterval > 0 {
+		l.healthStop = make(chan bool)
+		pool.startHealthCheck(time.Duration(c.HealthCheckInterval)*time.Second, c.dialTimeout(), l.healthStop)
+	}
+	l.pool.Store(pool)
+	l.targetTLS.Store(targetTLSConfig)
+	return nil
+}
+
+// Close the listener and its UDP sessions. Accepted TCP connections are not affected
+func (c *ProxyRelayInstance) closeListener(l *relayListener) {
+	l.close()
+	if l.protocol == "udp" {
+		c.udpClientMap.Range(func(key, value interface{}) bool {
+			conn := value.(*udpClientServerConn)
+			if conn.listener == l {
+				conn.ServerConn.Close()
+			}
+			return true
+		})
+	}
+}
+
+// Get the grace period for existing sessions after a config change, 0 for no limit
+func (c *ProxyRelayInstance) drainTimeout() time.Duration {
+	if drainTimeout := c.settings().drainTimeout; drainTimeout > 0 {
+		return time.Duration(drainTimeout) * time.Second
+	}
+	return 0
+}
+
+// Return the active sessions matching the filter
+func (c *ProxyRelayInstance) filterSessions(filter func(s *streamSession) bool) []*streamSession {
+	results := []*streamSession{}
+	c.sessions.Range(func(key, value interface{}) bool {
+		session := value.(*streamSession)
+		if filter(session) {
+			results = append(results, session)
+		}
+		return true
+	})
+	return results
+}
+
+// drainListener stop the listener from taking new clients and close it once its sessions
+// ended. Sessions still open after the grace period are closed. Caller must hold listenerLock
+func (c *ProxyRelayInstance) drainListener(l *relayListener) {
+	l.draining.Store(true)
+	c.drainingListeners = append(c.drainingListeners, l)
+	if l.protocol == "tcp" {
+		//Stop accepting, the accepted connections are not affected
+		l.close()
+	}
+	c.LogMsg("[-] Draining "+l.protocol+" listener on "+l.address, nil)
+
+	grace := c.drainTimeout()
+	go func() {
+		start := time.Now()
+		ticker := time.NewTicker(drainCheckInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			sessions := c.filterSessions(func(s *streamSession) bool {
+				return s.listener == l
+			})
+			if len(sessions) == 0 {
+				break
+			}
+			if grace > 0 && time.Since(start) >= grace {
+				c.LogMsg("[x] Closing "+strconv.Itoa(len(sessions))+" sessions on "+l.address+" after grace period", nil)
+				for _, s := range sessions {
+					s.closeFunc()
+				}
+				break
+			}
+			if l.protocol == "udp" {
+				//UDP sessions have no end, close the inactive ones
+				for _, s := range sessions {
+					if s.tracker.idleFor() > udpDrainIdleTimeout {
+						s.closeFunc()
+					}
+				}
+			}
+		}
+		c.closeListener(l)
+		c.listenerLock.Lock()
+		for i, draining := range c.drainingListeners {
+			if draining == l {
+				c.drainingListeners = append(c.drainingListeners[:i], c.drainingListeners[i+1:]...)
+				break
+			}
+		}
+		c.listenerLock.Unlock()
+		c.LogMsg("[-] Drained "+l.protocol+" listener on "+l.address, nil)
+	}()
+}
+
+// drainRemovedTargets close the sessions on the listener to targets no longer in its pool
+// after the grace period. Without grace period the sessions are kept until they end
+func (c *ProxyRelayInstance) drainRemovedTargets(l *relayListener, targets []string) {
+	grace := c.drainTimeout()
+	if grace <= 0 {
+		return
+	}
+	current := map[string]bool{}
+	for _, t := range targets {
+		current[t] = true
+	}
+	sessions := c.filterSessions(func(s *streamSession) bool {
+		return s.listener == l && !current[s.targetAddr]
+	})
+	if len(sessions) == 0 {
+		return
+	}
+	time.AfterFunc(grace, func() {
+		for _, s := range sessions {
+			s.closeFunc()
+		}
+	})
+}
+
+// Reload apply the current config to the running listeners without dropping the existing
+// connections. socketChanged rebuild the TCP listeners on the same address, e.g. when the
+// PROXY protocol or TLS termination settings changed. If an error is returned, the running
+// listeners are not changed. Listeners rebuilt on the same address are bound after the old
+// ones are closed, failure on those are logged only
+func (c *ProxyRelayInstance) Reload(socketChanged bool) error {
+	specs, err := c.listenerSpecs()
+	if err != nil {
+		return err
+	}
+	//Check the TLS settings before touching the running listeners
+	if _, err := c.buildServerTLSConfig(); err != nil {
+		return err
+	}
+	if _, err := c.buildTargetTLSConfig(); err != nil {
+		return err
+	}
+
+	c.listenerLock.Lock()
+	defer c.listenerLock.Unlock()
+	current := map[string]*relayListener{}
+	for _, l := range c.listeners {
+		current[l.key()] = l
+	}
+
+	wanted := map[string]bool{}
+	for _, spec := range specs {
+		if _, found := current[spec.key()]; found && !(socketChanged && spec.protocol == "tcp") {
+			wanted[spec.key()] = true
+		}
+	}
+
+	//Bind the new listeners before closing the old ones. Specs that conflict with
+	//a listener being removed are bound after it is closed
+	bound := map[string]*relayListener{}
+	deferred := []*listenerSpec{}
+	for _, spec := range specs {
+		if wanted[spec.key()] {
+			continue
+		}
+		if _, found := current[spec.key()]; found {
+			//Rebuild on the same socket
+			deferred = append(deferred, spec)
+			continue
+		}
+		l, err := c.bindListener(spec)
+		if err != nil {
+			conflict := false
+			for _, old := range c.listeners {
+				if !wanted[old.key()] && old.conflictsWith(spec) {
+					conflict = true
+				}
+			}
+			if conflict {
+				deferred = append(deferred, spec)
+				continue
+			}
+			//Rollback the listeners bound so far
+			for _, newListener := range bound {
+				newListener.close()
+			}
+			return fmt.Errorf("unable to listen on %s: %w", spec.address, err)
+		}
+		bound[spec.key()] = l
+	}
+
+	// Publish the settings and bandwidth limiters used by the sessions
+	c.publishSettings()
+	c.prepareBandwidthLimiters()
+
+	//Swap targets of the kept listeners, only new connections are affected
+	for _, spec := range specs {
+		if !wanted[spec.key()] {
+			continue
+		}
+		l := current[spec.key()]
+		if err := c.updateListener(l, spec.targets); err != nil {
+			c.parent.logf("Unable to update stream proxy "+c.Name+" on "+l.address, err)
+			continue
+		}
+		c.drainRemovedTargets(l, spec.targets)
+	}
+
+	//Drain the removed listeners. Listeners blocking a deferred spec are closed
+	//now, this drop the UDP sessions on them as UDP sessions share the socket
+	for _, l := range c.listeners {
+		if wanted[l.key()] {
+			continue
+		}
+		blocking := false
+		for _, spec := range deferred {
+			if l.conflictsWith(spec) {
+				blocking = true
+			}
+		}
+		if blocking && l.protocol == "udp" {
+			c.closeListener(l)
+			continue
+		}
+		c.drainListener(l)
+	}
+
+	for _, spec := range deferred {
+		l, err := c.bindListener(spec)
+		if err != nil {
+			c.parent.logf("[proto:"+spec.protocol+"] Error starting stream proxy "+c.Name+"("+c.UUID+") on "+spec.address, err)
+			continue
+		}
+		bound[spec.key()] = l
+	}
+
+	//Keep the listeners in config order
+	listeners := []*relayListener{}
+	for _, spec := range specs {
+		if wanted[spec.key()] {
+			listeners = append(listeners, current[spec.key()])
+		} else if l, ok := bound[spec.key()]; ok {
+			listeners = append(listeners, l)
+			go c.serveListener(l)
+		}
+	}
+	c.listeners = listeners
+	c.Running = len(listeners) > 0
+	return nil
+}
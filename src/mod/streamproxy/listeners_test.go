@@ -0,0 +1,203 @@
+package streamproxy
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Start a target that reply its name on connect and echo afterward
+func startNamedEchoTarget(t *testing.T, name string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.Write([]byte(name))
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func freeTCPPort(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+}
+
+// Connect to the proxy and read the name of the selected target
+func dialNamedTarget(t *testing.T, addr string) (net.Conn, string) {
+	var conn net.Conn
+	var err error
+	for retry := 0; retry < 20; retry++ {
+		conn, err = net.Dial("tcp", addr)
+		if err == nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	return conn, string(buf)
+}
+
+// Check the connection is still relayed
+func assertEcho(t *testing.T, conn net.Conn) {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("existing connection dropped: %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("existing connection dropped: %v", err)
+	}
+}
+
+func TestReloadKeepConnections(t *testing.T) {
+	targetA := startNamedEchoTarget(t, "A")
+	targetB := startNamedEchoTarget(t, "B")
+	port1 := freeTCPPort(t)
+	port2 := freeTCPPort(t)
+
+	m := &Manager{Options: &Options{
+		AccessControlHandler: func(net.Conn) bool { return true },
+		ConfigStore:          t.TempDir(),
+	}}
+	configUUID := m.NewConfig(&ProxyRelayOptions{
+		Name:          "reload",
+		ListeningAddr: "127.0.0.1:" + port1,
+		ProxyTargets:  []string{targetA},
+		UseTCP:        true,
+	})
+	c, _ := m.GetConfigByUUID(configUUID)
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+
+	edit := func(listenAddr string, target string, drainTimeout int) {
+		err := m.EditConfig(&ProxyRuleUpdateConfig{
+			InstanceUUID:        configUUID,
+			NewListeningAddr:    listenAddr,
+			NewProxyTargets:     []string{target},
+			HealthCheckInterval: -1,
+			UseTCP:              true,
+			NewTimeout:          -1,
+			MaxConnections:      -1,
+			MaxConnectionsPerIP: -1,
+			IdleTimeout:         -1,
+			BandwidthLimit:      -1,
+			BandwidthPerIP:      -1,
+			BandwidthPerTarget:  -1,
+			DrainTimeout:        drainTimeout,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	connA, name := dialNamedTarget(t, "127.0.0.1:"+port1)
+	defer connA.Close()
+	if name != "A" {
+		t.Fatalf("expected target A, got %s", name)
+	}
+
+	//Changing the target only affect new connections
+	edit("", targetB, -1)
+	assertEcho(t, connA)
+	connB, name := dialNamedTarget(t, "127.0.0.1:"+port1)
+	defer connB.Close()
+	if name != "B" {
+		t.Fatalf("expected target B after reload, got %s", name)
+	}
+
+	//Changing the listening address keep the sessions on the old port
+	edit("127.0.0.1:"+port2, targetB, -1)
+	assertEcho(t, connA)
+	assertEcho(t, connB)
+	conn, name := dialNamedTarget(t, "127.0.0.1:"+port2)
+	conn.Close()
+	if name != "B" {
+		t.Fatalf("expected target B on new port, got %s", name)
+	}
+	if _, err := net.DialTimeout("tcp", "127.0.0.1:"+port1, time.Second); err == nil {
+		t.Error("old listening port should be closed")
+	}
+	if !c.IsRunning() {
+		t.Fatal("proxy should be running after reload")
+	}
+
+	//Sessions on removed ports are closed after the grace period
+	connNew, _ := dialNamedTarget(t, "127.0.0.1:"+port2)
+	defer connNew.Close()
+	edit("127.0.0.1:"+port1, targetB, 1)
+	connNew.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := connNew.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Errorf("session should be closed after the grace period, got %v", err)
+	}
+	//Sessions drained before the grace period is set are kept
+	assertEcho(t, connA)
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+func TestEditConfigRejectPartialChange(t *testing.T) {
+	m := &Manager{Options: &Options{
+		AccessControlHandler: func(net.Conn) bool { return true },
+		ConfigStore:          t.TempDir(),
+	}}
+	configUUID := m.NewConfig(&ProxyRelayOptions{
+		Name:           "partial",
+		ListeningAddr:  "127.0.0.1:" + freeTCPPort(t),
+		ProxyTargets:   []string{"127.0.0.1:1"},
+		UseTCP:         true,
+		MaxConnections: 5,
+	})
+	c, _ := m.GetConfigByUUID(configUUID)
+
+	err := m.EditConfig(&ProxyRuleUpdateConfig{
+		InstanceUUID:        configUUID,
+		NewName:             "renamed",
+		HealthCheckInterval: -1,
+		UseTCP:              true,
+		NewTimeout:          -1,
+		MaxConnections:      10,
+		MaxConnectionsPerIP: -1,
+		IdleTimeout:         -1,
+		BandwidthLimit:      -1,
+		BandwidthPerIP:      -1,
+		BandwidthPerTarget:  -1,
+		DrainTimeout:        -5,
+	})
+	if err == nil {
+		t.Fatal("negative drain timeout should be rejected")
+	}
+	if c.Name != "partial" || c.MaxConnections != 5 || c.settings().maxConnections != 5 {
+		t.Errorf("rejected edit should not change the config, got name %s and max connections %d", c.Name, c.MaxConnections)
+	}
+}
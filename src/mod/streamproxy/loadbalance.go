@@ -0,0 +1,291 @@
+package streamproxy
+
+/*
+	loadbalance.go
+
+	Load balancing of stream proxy connections across a
+	pool of targets. Targets are selected by policy, marked
+	down by TCP connect health checks or failed dials and
+	skipped until they come back online.
+*/
+
+import (
+	"errors"
+	"hash/fnv"
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// LoadBalancePolicy defines how the target of a new connection is selected
+type LoadBalancePolicy string
+
+const (
+	LoadBalanceRoundRobin   LoadBalancePolicy = "roundrobin" //Rotate through the targets
+	LoadBalanceLeastConn    LoadBalancePolicy = "leastconn"  //Pick the target with the least active connections
+	LoadBalanceSourceIPHash LoadBalancePolicy = "iphash"     //Pin each client IP to the same target
+)
+
+const (
+	defaultDialTimeout   = 10 * time.Second //Dial timeout if the rule has no timeout set
+	passiveRetryInterval = 30 * time.Second //Time before retrying a failed target when health check is disabled
+)
+
+// IsValidLoadBalancePolicy check if the given policy is supported
+func IsValidLoadBalancePolicy(policy string) bool {
+	switch LoadBalancePolicy(policy) {
+	case LoadBalanceRoundRobin, LoadBalanceLeastConn, LoadBalanceSourceIPHash:
+		return true
+	}
+	return false
+}
+
+// ParseTargetAddrs split a comma seperated list of target addresses
+func ParseTargetAddrs(addrs string) []string {
+	targets := []string{}
+	for _, addr := range strings.Split(addrs, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr != "" {
+			targets = append(targets, addr)
+		}
+	}
+	return targets
+}
+
+// TargetStatus is the runtime state of a target reported to the UI
+type TargetStatus struct {
+	Address           string
+	Online            bool
+	ActiveConnections int64
+}
+
+type streamTarget struct {
+	Address     string
+	down        atomic.Bool
+	downAt      atomic.Int64 //Unix nano time when the target is marked down
+	activeConns atomic.Int64
+}
+
+type targetPool struct {
+	targets           []*streamTarget
+	policy            LoadBalancePolicy
+	activeHealthCheck bool
+	rrCounter         atomic.Uint64
+	logf              func(message string, err error)
+}
+
+func newTargetPool(addrs []string, policy LoadBalancePolicy, logf func(string, error)) *targetPool {
+	pool := &targetPool{
+		targets: []*streamTarget{},
+		policy:  policy,
+		logf:    logf,
+	}
+	for _, addr := range addrs {
+		pool.targets = append(pool.targets, &streamTarget{Address: strings.TrimSpace(addr)})
+	}
+	return pool
+}
+
+// inherit reuse the targets of the old pool with the same address, so their health
+// state and active connection counters survive a config reload
+func (p *targetPool) inherit(old *targetPool) {
+	if old == nil {
+		return
+	}
+	existing := map[string]*streamTarget{}
+	for _, t := range old.targets {
+		existing[t.Address] = t
+	}
+	for i, t := range p.targets {
+		if oldTarget, ok := existing[t.Address]; ok {
+			p.targets[i] = oldTarget
+		}
+	}
+	p.rrCounter.Store(old.rrCounter.Load())
+}
+
+// Check if the target can be used for new connections
+func (p *targetPool) isUp(t *streamTarget) bool {
+	if !t.down.Load() {
+		return true
+	}
+	if p.activeHealthCheck {
+		//Wait for the health checker to bring it back
+		return false
+	}
+	//No active health check, retry the target after a cool down
+	return time.Since(time.Unix(0, t.downAt.Load())) > passiveRetryInterval
+}
+
+func (p *targetPool) markDown(t *streamTarget, err error) {
+	t.downAt.Store(time.Now().UnixNano())
+	if !t.down.Swap(true) {
+		p.logf("[x] Stream proxy target "+t.Address+" marked down", err)
+	}
+}
+
+func (p *targetPool) markUp(t *streamTarget) {
+	if t.down.Swap(false) {
+		p.logf("[√] Stream proxy target "+t.Address+" is back online", nil)
+	}
+}
+
+// candidates return the targets in the order they should be tried for the given
+// client. Online targets come first, offline targets are kept as last resort
+func (p *targetPool) candidates(clientAddr net.Addr) []*streamTarget {
+	n := len(p.targets)
+	if n == 0 {
+		return []*streamTarget{}
+	}
+
+	//Rotate the target list so the selection start from a different target
+	offset := 0
+	switch p.policy {
+	case LoadBalanceSourceIPHash:
+		offset = int(hashClientIP(clientAddr) % uint32(n))
+	default:
+		offset = int((p.rrCounter.Add(1) - 1) % uint64(n))
+	}
+
+	up := []*streamTarget{}
+	down := []*streamTarget{}
+	for i := 0; i < n; i++ {
+		t := p.targets[(offset+i)%n]
+		if p.isUp(t) {
+			up = append(up, t)
+		} else {
+			down = append(down, t)
+		}
+	}
+
+	if p.policy == LoadBalanceLeastConn {
+		sort.SliceStable(up, func(i, j int) bool {
+			return up[i].activeConns.Load() < up[j].activeConns.Load()
+		})
+	}
+
+	return append(up, down...)
+}
+
+// dial connect to the first reachable target, failover to the next one on error
+func (p *targetPool) dial(clientAddr net.Addr, timeout time.Duration) (net.Conn, *streamTarget, error) {
+	candidates := p.candidates(clientAddr)
+	if len(candidates) == 0 {
+		return nil, nil, errors.New("no proxy target defined")
+	}
+
+	var lastErr error
+	for _, t := range candidates {
+		conn, err := net.DialTimeout("tcp", t.Address, timeout)
+		if err != nil {
+			p.markDown(t, err)
+			lastErr = err
+			continue
+		}
+		if !p.activeHealthCheck {
+			p.markUp(t)
+		}
+		return conn, t, nil
+	}
+	return nil, nil, lastErr
+}
+
+// checkTargets run a TCP connect check on all the targets
+func (p *targetPool) checkTargets(timeout time.Duration) {
+	for _, t := range p.targets {
+		conn, err := net.DialTimeout("tcp", t.Address, timeout)
+		if err != nil {
+			p.markDown(t, err)
+			continue
+		}
+		conn.Close()
+		p.markUp(t)
+	}
+}
+
+// startHealthCheck start the TCP connect health checker until stopChan is closed
+func (p *targetPool) startHealthCheck(interval time.Duration, timeout time.Duration, stopChan chan bool) {
+	p.activeHealthCheck = true
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		p.checkTargets(timeout)
+		for {
+			select {
+			case <-stopChan:
+				return
+			case <-ticker.C:
+				p.checkTargets(timeout)
+			}
+		}
+	}()
+}
+
+func (p *targetPool) status() []*TargetStatus {
+	results := []*TargetStatus{}
+	for _, t := range p.targets {
+		results = append(results, &TargetStatus{
+			Address:           t.Address,
+			Online:            p.isUp(t),
+			ActiveConnections: t.activeConns.Load(),
+		})
+	}
+	return results
+}
+
+func hashClientIP(addr net.Addr) uint32 {
+	ip := ""
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP.String()
+	case *net.UDPAddr:
+		ip = a.IP.String()
+	case nil:
+	default:
+		ip, _, _ = net.SplitHostPort(a.String())
+	}
+	h := fnv.New32a()
+	h.Write([]byte(ip))
+	return h.Sum32()
+}
+
+/* Instance helpers */
+
+// GetTargets return the pool of targets of this proxy rule
+func (c *ProxyRelayInstance) GetTargets() []string {
+	if len(c.ProxyTargets) > 0 {
+		return c.ProxyTargets
+	}
+	if c.ProxyTargetAddr != "" {
+		return []string{c.ProxyTargetAddr}
+	}
+	return []string{}
+}
+
+// GetTargetStatus return the runtime state of the TCP targets
+func (c *ProxyRelayInstance) GetTargetStatus() []*TargetStatus {
+	var pool *targetPool
+	c.listenerLock.Lock()
+	for _, l := range c.listeners {
+		if l.protocol == "tcp" {
+			pool = l.pool.Load()
+			break
+		}
+	}
+	c.listenerLock.Unlock()
+	if pool == nil {
+		//Not running, report the configured targets only
+		pool = newTargetPool(c.GetTargets(), c.LoadBalancePolicy, c.LogMsg)
+	}
+	return pool.status()
+}
+
+// Get the dial timeout of this rule
+func (c *ProxyRelayInstance) dialTimeout() time.Duration {
+	if timeout := c.settings().timeout; timeout > 0 {
+		return time.Duration(timeout) * time.Second
+	}
+	return defaultDialTimeout
+}
@@ -0,0 +1,94 @@
+package streamproxy
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTargetPoolPolicies(t *testing.T) {
+	logf := func(string, error) {}
+	addrs := []string{"10.0.0.1:22", "10.0.0.2:22", "10.0.0.3:22"}
+
+	//Round robin rotate the first candidate
+	pool := newTargetPool(addrs, LoadBalanceRoundRobin, logf)
+	for i := 0; i < 6; i++ {
+		if got := pool.candidates(nil)[0].Address; got != addrs[i%3] {
+			t.Errorf("round robin pick %d: expected %s, got %s", i, addrs[i%3], got)
+		}
+	}
+
+	//Source IP hash always pick the same target for the same client
+	pool = newTargetPool(addrs, LoadBalanceSourceIPHash, logf)
+	client := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 40000}
+	first := pool.candidates(client)[0].Address
+	for i := 0; i < 5; i++ {
+		client.Port++
+		if got := pool.candidates(client)[0].Address; got != first {
+			t.Errorf("source IP hash changed target from %s to %s", first, got)
+		}
+	}
+
+	//Least connections pick the idle target
+	pool = newTargetPool(addrs, LoadBalanceLeastConn, logf)
+	pool.targets[0].activeConns.Store(5)
+	pool.targets[1].activeConns.Store(1)
+	pool.targets[2].activeConns.Store(3)
+	if got := pool.candidates(nil)[0].Address; got != addrs[1] {
+		t.Errorf("least connection expected %s, got %s", addrs[1], got)
+	}
+
+	//Down targets are moved to the end of the list
+	pool = newTargetPool(addrs, LoadBalanceRoundRobin, logf)
+	pool.activeHealthCheck = true
+	pool.markDown(pool.targets[0], nil)
+	candidates := pool.candidates(nil)
+	if candidates[0].Address == addrs[0] || candidates[len(candidates)-1].Address != addrs[0] {
+		t.Error("offline target should only be used as last resort")
+	}
+}
+
+func TestTargetPoolFailover(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	//Reserve a port with nothing listening on it
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadAddr := closed.Addr().String()
+	closed.Close()
+
+	pool := newTargetPool([]string{deadAddr, listener.Addr().String()}, LoadBalanceRoundRobin, func(string, error) {})
+	conn, selected, err := pool.dial(nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if selected.Address != listener.Addr().String() {
+		t.Errorf("expected failover to %s, got %s", listener.Addr().String(), selected.Address)
+	}
+	if !pool.targets[0].down.Load() {
+		t.Error("dead target should be marked down")
+	}
+
+	//Health check bring the target status in sync
+	pool.checkTargets(time.Second)
+	status := pool.status()
+	if !status[1].Online {
+		t.Error("reachable target should be online")
+	}
+}
@@ -0,0 +1,230 @@
+package streamproxy
+
+/*
+	portrange.go
+
+	Port range and port list support for stream proxy rules.
+	A listening address can contain a list of ports and ranges,
+	e.g. 30000-30100 or 127.0.0.1:5000,5002,6000-6010. Each
+	listening port is mapped one-to-one to a port on the target:
+
+	- host              same port as the listening port
+	- host:port         offset from the first listening port
+	- host:start-end    one-to-one with a range of the same size
+*/
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const MaxPortsPerRule = 1000 //Max number of listening ports of a single rule
+
+// ParsePortList parse a comma seperated list of ports and ranges, e.g. 5000,6000-6010
+func ParsePortList(spec string) ([]int, error) {
+	ports := []int{}
+	seen := map[int]bool{}
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		start, end := part, part
+		if i := strings.Index(part, "-"); i > 0 {
+			start, end = strings.TrimSpace(part[:i]), strings.TrimSpace(part[i+1:])
+		}
+		if !isValidPort(start) || !isValidPort(end) {
+			return nil, errors.New("invalid port or port range: " + part)
+		}
+		startPort, _ := strconv.Atoi(start)
+		endPort, _ := strconv.Atoi(end)
+		if startPort > endPort {
+			return nil, errors.New("invalid port range: " + part)
+		}
+		if len(ports)+endPort-startPort+1 > MaxPortsPerRule {
+			return nil, errors.New("too many ports, max " + strconv.Itoa(MaxPortsPerRule) + " ports per rule")
+		}
+
+		for p := startPort; p <= endPort; p++ {
+			if seen[p] {
+				return nil, errors.New("duplicated port " + strconv.Itoa(p))
+			}
+			seen[p] = true
+			ports = append(ports, p)
+		}
+	}
+
+	if len(ports) == 0 {
+		return nil, errors.New("no port given")
+	}
+	return ports, nil
+}
+
+// Split the listening address into host and port spec, host is empty for all interfaces
+func splitListeningAddress(listeningAddr string) (string, string) {
+	listeningAddr = strings.TrimSpace(listeningAddr)
+	i := strings.LastIndex(listeningAddr, ":")
+	if i < 0 {
+		//Port spec only, e.g. 8080 or 30000-30100
+		return "", listeningAddr
+	}
+	host := strings.TrimSuffix(strings.TrimPrefix(listeningAddr[:i], "["), "]")
+	return host, listeningAddr[i+1:]
+}
+
+// ParseListeningAddress return the host and ports of a listening address
+func ParseListeningAddress(listeningAddr string) (string, []int, error) {
+	host, portSpec := splitListeningAddress(listeningAddr)
+	ports, err := ParsePortList(portSpec)
+	if err != nil {
+		return "", nil, err
+	}
+	return host, ports, nil
+}
+
+// ExpandListeningAddress return one host:port address for each listening port
+func ExpandListeningAddress(listeningAddr string) ([]string, error) {
+	host, ports, err := ParseListeningAddress(listeningAddr)
+	if err != nil {
+		return nil, err
+	}
+	if host == "" {
+		host = "0.0.0.0"
+	}
+	results := []string{}
+	for _, p := range ports {
+		results = append(results, net.JoinHostPort(host, strconv.Itoa(p)))
+	}
+	return results, nil
+}
+
+// IsMultiPortAddress return true if the listening address contains more than one port
+func IsMultiPortAddress(listeningAddr string) bool {
+	_, ports, err := ParseListeningAddress(listeningAddr)
+	return err == nil && len(ports) > 1
+}
+
+// MapTargetPorts return the target address for each of the listening ports
+func MapTargetPorts(target string, listenPorts []int) ([]string, error) {
+	target = strings.TrimSpace(target)
+	host, portSpec, err := net.SplitHostPort(target)
+	if err != nil {
+		//No port given, use the same port as the listening port
+		host = strings.TrimSuffix(strings.TrimPrefix(target, "["), "]")
+		portSpec = ""
+	}
+	if host == "" {
+		return nil, errors.New("invalid target address: " + target)
+	}
+
+	results := []string{}
+	if portSpec == "" {
+		for _, p := range listenPorts {
+			results = append(results, net.JoinHostPort(host, strconv.Itoa(p)))
+		}
+		return results, nil
+	}
+
+	targetPorts, err := ParsePortList(portSpec)
+	if err != nil {
+		return nil, err
+	}
+	if len(targetPorts) == 1 {
+		//Map with the offset from the first listening port
+		offset := targetPorts[0] - listenPorts[0]
+		for _, p := range listenPorts {
+			if p+offset < 1 || p+offset > 65535 {
+				return nil, errors.New("target port out of range for listening port " + strconv.Itoa(p))
+			}
+			results = append(results, net.JoinHostPort(host, strconv.Itoa(p+offset)))
+		}
+		return results, nil
+	}
+
+	if len(targetPorts) != len(listenPorts) {
+		return nil, errors.New("target port range of " + target + " does not match the number of listening ports")
+	}
+	for _, p := range targetPorts {
+		results = append(results, net.JoinHostPort(host, strconv.Itoa(p)))
+	}
+	return results, nil
+}
+
+// Map all targets of the rule to each listening port, return the target pool of each port
+func mapTargetPools(targets []string, listenPorts []int) ([][]string, error) {
+	pools := make([][]string, len(listenPorts))
+	for _, target := range targets {
+		mapped, err := MapTargetPorts(target, listenPorts)
+		if err != nil {
+			return nil, err
+		}
+		for i, addr := range mapped {
+			pools[i] = append(pools[i], addr)
+		}
+	}
+	return pools, nil
+}
+
+// ValidatePortMapping check the targets can be mapped to the ports of the listening address
+func ValidatePortMapping(listeningAddr string, targets []string) error {
+	_, ports, err := ParseListeningAddress(listeningAddr)
+	if err != nil {
+		return err
+	}
+	_, err = mapTargetPools(targets, ports)
+	return err
+}
+
+// Check if the two listening hosts can bind to the same port without conflict
+func hostsOverlap(a string, b string) bool {
+	isWildcard := func(h string) bool {
+		return h == "" || h == "0.0.0.0" || h == "::"
+	}
+	return isWildcard(a) || isWildcard(b) || strings.EqualFold(a, b)
+}
+
+// ValidateListeningAddress check the listening address is valid and its ports are not used by
+// the reserved ports or other proxy rules. excludeUUID is the rule being edited, empty for new rule
+func (m *Manager) ValidateListeningAddress(excludeUUID string, listeningAddr string, useTCP bool, useUDP bool) error {
+	host, ports, err := ParseListeningAddress(listeningAddr)
+	if err != nil {
+		return err
+	}
+
+	listening := map[int]bool{}
+	for _, p := range ports {
+		listening[p] = true
+	}
+
+	//Ports used by other services, e.g. the reverse proxy router
+	if useTCP && m.Options.ReservedPorts != nil {
+		for _, reserved := range m.Options.ReservedPorts() {
+			if listening[reserved] {
+				return errors.New("port " + strconv.Itoa(reserved) + " is already used by the reverse proxy or management interface")
+			}
+		}
+	}
+
+	//Ports used by other proxy rules with the same protocol
+	for _, config := range m.Configs {
+		if config.UUID == excludeUUID {
+			continue
+		}
+		if !(useTCP && config.UseTCP) && !(useUDP && config.UseUDP) {
+			continue
+		}
+		otherHost, otherPorts, err := ParseListeningAddress(config.ListeningAddress)
+		if err != nil || !hostsOverlap(host, otherHost) {
+			continue
+		}
+		for _, p := range otherPorts {
+			if listening[p] {
+				return errors.New("port " + strconv.Itoa(p) + " is already used by proxy rule " + config.Name)
+			}
+		}
+	}
+	return nil
+}
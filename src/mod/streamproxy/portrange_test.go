@@ -0,0 +1,162 @@
+package streamproxy
+
+import (
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseListeningAddress(t *testing.T) {
+	host, ports, err := ParseListeningAddress("127.0.0.1:5000,5002,6000-6002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host != "127.0.0.1" || !reflect.DeepEqual(ports, []int{5000, 5002, 6000, 6001, 6002}) {
+		t.Errorf("unexpected result %s %v", host, ports)
+	}
+
+	host, ports, err = ParseListeningAddress("30000-30100")
+	if err != nil || host != "" || len(ports) != 101 {
+		t.Errorf("unexpected result %s %d %v", host, len(ports), err)
+	}
+
+	for _, invalid := range []string{":6010-6000", ":5000,5000", ":0", ":abc", ":1-2000", ""} {
+		if _, _, err := ParseListeningAddress(invalid); err == nil {
+			t.Errorf("%q should be rejected", invalid)
+		}
+	}
+}
+
+func TestMapTargetPorts(t *testing.T) {
+	listenPorts := []int{30000, 30001, 30002}
+	tests := []struct {
+		target   string
+		expected []string
+	}{
+		{"10.0.0.2", []string{"10.0.0.2:30000", "10.0.0.2:30001", "10.0.0.2:30002"}},
+		{"10.0.0.2:40000", []string{"10.0.0.2:40000", "10.0.0.2:40001", "10.0.0.2:40002"}},
+		{"10.0.0.2:5000,6000-6001", []string{"10.0.0.2:5000", "10.0.0.2:6000", "10.0.0.2:6001"}},
+	}
+	for _, test := range tests {
+		mapped, err := MapTargetPorts(test.target, listenPorts)
+		if err != nil {
+			t.Errorf("%s: %v", test.target, err)
+			continue
+		}
+		if !reflect.DeepEqual(mapped, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.target, test.expected, mapped)
+		}
+	}
+
+	if _, err := MapTargetPorts("10.0.0.2:5000-5001", listenPorts); err == nil {
+		t.Error("range size mismatch should be rejected")
+	}
+	if _, err := MapTargetPorts("10.0.0.2:65535", listenPorts); err == nil {
+		t.Error("target port over 65535 should be rejected")
+	}
+}
+
+func TestValidateListeningAddress(t *testing.T) {
+	m := &Manager{
+		Options: &Options{ReservedPorts: func() []int { return []int{443, 8000} }},
+		Configs: []*ProxyRelayInstance{
+			{UUID: "a", Name: "game", ListeningAddress: ":30000-30100", UseUDP: true},
+			{UUID: "b", Name: "local", ListeningAddress: "127.0.0.1:7000", UseTCP: true},
+		},
+	}
+
+	if err := m.ValidateListeningAddress("", ":440-445", true, false); err == nil {
+		t.Error("reserved port should be rejected")
+	}
+	if err := m.ValidateListeningAddress("", ":440-445", false, true); err != nil {
+		t.Errorf("reserved TCP port should be allowed for UDP: %v", err)
+	}
+	if err := m.ValidateListeningAddress("", ":30100,30200", false, true); err == nil {
+		t.Error("overlapping UDP ports should be rejected")
+	}
+	if err := m.ValidateListeningAddress("", ":30100", true, false); err != nil {
+		t.Errorf("TCP port should not conflict with UDP rule: %v", err)
+	}
+	if err := m.ValidateListeningAddress("", "127.0.0.2:7000", true, false); err != nil {
+		t.Errorf("different host should not conflict: %v", err)
+	}
+	if err := m.ValidateListeningAddress("", "0.0.0.0:7000", true, false); err == nil {
+		t.Error("wildcard host should conflict with any host")
+	}
+	if err := m.ValidateListeningAddress("a", ":30000-30050", false, true); err != nil {
+		t.Errorf("rule should not conflict with itself: %v", err)
+	}
+}
+
+func TestMultiPortRelay(t *testing.T) {
+	//Echo targets that reply with their own port
+	freePort := func() int {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		return l.Addr().(*net.TCPAddr).Port
+	}
+	targetPorts := []string{}
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+		targetPorts = append(targetPorts, port)
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				conn.Write([]byte(port))
+				conn.Close()
+			}
+		}()
+	}
+	listenPorts := []string{strconv.Itoa(freePort()), strconv.Itoa(freePort())}
+
+	c := &ProxyRelayInstance{
+		ListeningAddress: "127.0.0.1:" + listenPorts[0] + "," + listenPorts[1],
+		ProxyTargets:     []string{"127.0.0.1:" + targetPorts[0] + "," + targetPorts[1]},
+		UseTCP:           true,
+		parent: &Manager{Options: &Options{
+			AccessControlHandler: func(net.Conn) bool { return true },
+		}},
+	}
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+
+	if status := c.GetStatus(); status.ListeningPorts != 2 {
+		t.Errorf("expected 2 listening ports, got %d", status.ListeningPorts)
+	}
+
+	for i, listenPort := range listenPorts {
+		var conn net.Conn
+		var err error
+		for retry := 0; retry < 20; retry++ {
+			conn, err = net.Dial("tcp", "127.0.0.1:"+listenPort)
+			if err == nil {
+				break
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply, _ := io.ReadAll(conn)
+		conn.Close()
+		if string(reply) != targetPorts[i] {
+			t.Errorf("port %s should map to %s, got %q", listenPort, targetPorts[i], reply)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package streamproxy
+
+/*
+	sessions.go
+
+	Live connection table of the stream proxy. Each active
+	TCP connection and UDP session is tracked with its byte
+	counters, and the totals are recorded into the daily
+	statistic summary once the session ends
+*/
+
+import (
+	"errors"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"imuslab.com/zoraxy/mod/bandwidth"
+	"imuslab.com/zoraxy/mod/statistic"
+)
+
+// SessionInfo is a snapshot of an active TCP connection or UDP session
+type SessionInfo struct {
+	ID           string //Session ID, use for closing the session
+	Protocol     string //tcp or udp
+	ClientAddr   string //Address of the client
+	TargetAddr   string //Address of the selected target
+	StartTime    int64  //Unix time when the session started
+	LastActivity int64  //Unix time of the last transferred data
+	BytesIn      int64  //Bytes sent from the client to the target
+	BytesOut     int64  //Bytes sent from the target to the client
+}
+
+type streamSession struct {
+	id         string
+	protocol   string
+	clientAddr string
+	targetAddr string
+	startTime  time.Time
+	bytesIn    atomic.Int64
+	bytesOut   atomic.Int64
+	tracker    *idleTracker
+	limiters   []*bandwidth.Limiter //Bandwidth limiters shaping this session
+	closeFunc  func()               //Close the underlying connections
+	listener   *relayListener       //Listener accepted this session
+}
+
+func (s *streamSession) info() *SessionInfo {
+	return &SessionInfo{
+		ID:           s.id,
+		Protocol:     s.protocol,
+		ClientAddr:   s.clientAddr,
+		TargetAddr:   s.targetAddr,
+		StartTime:    s.startTime.Unix(),
+		LastActivity: time.Unix(0, s.tracker.lastActive.Load()).Unix(),
+		BytesIn:      s.bytesIn.Load(),
+		BytesOut:     s.bytesOut.Load(),
+	}
+}
+
+// Register a new session into the connection table
+func (c *ProxyRelayInstance) newSession(listener *relayListener, protocol string, clientAddr string, targetAddr string, closeFunc func()) *streamSession {
+	session := &streamSession{
+		id:         uuid.New().String(),
+		protocol:   protocol,
+		clientAddr: clientAddr,
+		targetAddr: targetAddr,
+		startTime:  time.Now(),
+		tracker:    newIdleTracker(),
+		limiters:   c.getBandwidthLimiters(clientAddr, targetAddr),
+		closeFunc:  closeFunc,
+		listener:   listener,
+	}
+	c.sessions.Store(session.id, session)
+	return session
+}
+
+// Remove the session from the connection table and record its traffic
+func (c *ProxyRelayInstance) endSession(session *streamSession) {
+	if _, loaded := c.sessions.LoadAndDelete(session.id); !loaded {
+		return
+	}
+	if c.parent != nil && c.parent.Options.StatisticCollector != nil {
+		c.parent.Options.StatisticCollector.RecordStreamRelay(statistic.StreamRelayInfo{
+			RelayUUID: c.UUID,
+			RelayName: c.settings().name,
+			BytesIn:   session.bytesIn.Load(),
+			BytesOut:  session.bytesOut.Load(),
+		})
+	}
+}
+
+// ListSessions return the active TCP connections and UDP sessions, oldest first
+func (c *ProxyRelayInstance) ListSessions() []*SessionInfo {
+	results := []*SessionInfo{}
+	c.sessions.Range(func(key, value interface{}) bool {
+		results = append(results, value.(*streamSession).info())
+		return true
+	})
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].StartTime < results[j].StartTime
+	})
+	return results
+}
+
+// CloseSession forcibly close an active TCP connection or UDP session
+func (c *ProxyRelayInstance) CloseSession(sessionID string) error {
+	value, ok := c.sessions.Load(sessionID)
+	if !ok {
+		return errors.New("session not found")
+	}
+	session := value.(*streamSession)
+	c.LogMsg("[x] Closing session of "+session.clientAddr+" by request", nil)
+	session.closeFunc()
+	return nil
+}
+
+// GetActiveConnectionCount return the number of active sessions across all proxy rules
+func (m *Manager) GetActiveConnectionCount() int {
+	count := 0
+	for _, config := range m.Configs {
+		config.sessions.Range(func(key, value interface{}) bool {
+			count++
+			return true
+		})
+	}
+	return count
+}
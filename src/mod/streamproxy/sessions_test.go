@@ -0,0 +1,83 @@
+package streamproxy
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSessionTable(t *testing.T) {
+	//Echo target
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+
+	//Reserve a port for the proxy listener
+	reserved, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listenAddr := reserved.Addr().String()
+	reserved.Close()
+
+	c := &ProxyRelayInstance{ProxyTargets: []string{echo.Addr().String()}}
+	stopChan := make(chan bool)
+	go c.Port2host(listenAddr, "", stopChan)
+	defer func() { stopChan <- true }()
+
+	var client net.Conn
+	for i := 0; i < 20; i++ {
+		client, err = net.Dial("tcp", listenAddr)
+		if err == nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	client.Write([]byte("hello"))
+	reply := make([]byte, 5)
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatal(err)
+	}
+
+	sessions := c.ListSessions()
+	if len(sessions) != 1 {
+		t.Fatalf("expected 1 active session, got %d", len(sessions))
+	}
+	if sessions[0].BytesIn != 5 || sessions[0].BytesOut != 5 || sessions[0].TargetAddr != echo.Addr().String() {
+		t.Errorf("unexpected session info: %+v", sessions[0])
+	}
+
+	//Forcibly close the session
+	if err := c.CloseSession(sessions[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	client.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := client.Read(reply); err == nil {
+		t.Error("client connection should be closed")
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for len(c.ListSessions()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if len(c.ListSessions()) != 0 {
+		t.Error("closed session should be removed from the table")
+	}
+}
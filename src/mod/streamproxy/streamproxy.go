@@ -3,6 +3,7 @@ package streamproxy
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net"
 	"os"
 	"path/filepath"
@@ -10,7 +11,10 @@ import (
 	"sync/atomic"
 
 	"github.com/google/uuid"
+	"imuslab.com/zoraxy/mod/hoststats"
 	"imuslab.com/zoraxy/mod/info/logger"
+	"imuslab.com/zoraxy/mod/statistic"
+	"imuslab.com/zoraxy/mod/tlscert"
 	"imuslab.com/zoraxy/mod/utils"
 )
 
@@ -35,24 +39,66 @@ type ProxyRelayOptions struct {
 	Name                 string
 	ListeningAddr        string
 	ProxyAddr            string
+	ProxyTargets         []string
+	LoadBalancePolicy    LoadBalancePolicy
+	HealthCheckInterval  int
 	Timeout              int
 	UseTCP               bool
 	UseUDP               bool
 	ProxyProtocolVersion ProxyProtocolVersion
 	EnableLogging        bool
+	AcceptProxyProtocol  bool
+	TrustedProxyCIDRs    []string
+	AccessRuleID         string
+	MaxConnections       int
+	MaxConnectionsPerIP  int
+	IdleTimeout          int
+	TLSTerminate         bool
+	ClientCABundle       string
+	RequireClientCert    bool
+	TLSOriginate         bool
+	TargetSNI            string
+	TargetCABundle       string
+	TargetSkipVerify     bool
+	TargetClientCertName string
+	BandwidthLimit       int64
+	BandwidthPerIP       int64
+	BandwidthPerTarget   int64
+	DrainTimeout         int
 }
 
 // ProxyRuleUpdateConfig is used to update the proxy rule config
 type ProxyRuleUpdateConfig struct {
-	InstanceUUID         string //The target instance UUID to update
-	NewName              string //New name for the instance, leave empty for no change
-	NewListeningAddr     string //New listening address, leave empty for no change
-	NewProxyAddr         string //New proxy target address, leave empty for no change
-	UseTCP               bool   //Enable TCP proxy, default to false
-	UseUDP               bool   //Enable UDP proxy, default to false
-	ProxyProtocolVersion int    //Enable Proxy Protocol v1/v2, default to disabled
-	EnableLogging        bool   //Enable Logging TCP/UDP Message, default to true
-	NewTimeout           int    //New timeout for the connection, leave -1 for no change
+	InstanceUUID         string   //The target instance UUID to update
+	NewName              string   //New name for the instance, leave empty for no change
+	NewListeningAddr     string   //New listening address, leave empty for no change
+	NewProxyAddr         string   //New proxy target address, leave empty for no change
+	NewProxyTargets      []string //New pool of proxy targets, leave empty for no change
+	LoadBalancePolicy    string   //Target selection policy, leave empty for no change
+	HealthCheckInterval  int      //Health check interval in sec, 0 to disable, leave -1 for no change
+	UseTCP               bool     //Enable TCP proxy, default to false
+	UseUDP               bool     //Enable UDP proxy, default to false
+	ProxyProtocolVersion int      //Enable Proxy Protocol v1/v2, default to disabled
+	EnableLogging        bool     //Enable Logging TCP/UDP Message, default to true
+	NewTimeout           int      //New timeout for the connection, leave -1 for no change
+	AcceptProxyProtocol  bool     //Parse inbound PROXY protocol header from trusted proxies
+	TrustedProxyCIDRs    []string //IP or CIDR of proxies allowed to send PROXY protocol header
+	AccessRuleID         string   //Access rule ID, leave empty for no change
+	MaxConnections       int      //Max concurrent connections, 0 for unlimited, leave -1 for no change
+	MaxConnectionsPerIP  int      //Max concurrent connections per source IP, 0 for unlimited, leave -1 for no change
+	IdleTimeout          int      //Idle timeout in sec, 0 to disable, leave -1 for no change
+	TLSTerminate         bool     //Terminate TLS from clients with certificates from the cert store
+	ClientCABundle       string   //PEM encoded CA bundle for verifying client certificates
+	RequireClientCert    bool     //Reject clients without a valid client certificate
+	TLSOriginate         bool     //Connect to the targets with TLS
+	TargetSNI            string   //SNI and verification hostname for the targets, empty for target host
+	TargetCABundle       string   //PEM encoded CA bundle for verifying the targets, empty for system CAs
+	TargetSkipVerify     bool     //Skip target certificate verification
+	TargetClientCertName string   //Name of the cert in the cert store presented to the targets
+	BandwidthLimit       int64    //Max bytes per second of the rule, 0 for unlimited, leave -1 for no change
+	BandwidthPerIP       int64    //Max bytes per second per client IP, 0 for unlimited, leave -1 for no change
+	BandwidthPerTarget   int64    //Max bytes per second per target, 0 for unlimited, leave -1 for no change
+	DrainTimeout         int      //Grace period in sec for existing connections after a config change, 0 for no limit, leave -1 for no change
 }
 
 type ProxyRelayInstance struct {
@@ -62,37 +108,72 @@ type ProxyRelayInstance struct {
 	Running              bool                 //Status, read only
 	AutoStart            bool                 //If the service suppose to started automatically
 	ListeningAddress     string               //Listening Address, usually 127.0.0.1:port
-	ProxyTargetAddr      string               //Proxy target address
+	ProxyTargetAddr      string               //Proxy target address, the first target of ProxyTargets
+	ProxyTargets         []string             //Pool of proxy target addresses
+	LoadBalancePolicy    LoadBalancePolicy    //Target selection policy, default to round robin
+	HealthCheckInterval  int                  //TCP connect health check interval in sec, 0 to disable
 	UseTCP               bool                 //Enable TCP proxy
 	UseUDP               bool                 //Enable UDP proxy
 	ProxyProtocolVersion ProxyProtocolVersion //Proxy Protocol v1/v2
 	EnableLogging        bool                 //Enable logging for ProxyInstance
 	Timeout              int                  //Timeout for connection in sec
+	AcceptProxyProtocol  bool                 //Parse inbound PROXY protocol v1/v2 header (TCP only)
+	TrustedProxyCIDRs    []string             //IP or CIDR of proxies allowed to send PROXY protocol header
+	AccessRuleID         string               //Access rule applied to the clients, empty for default rule
+	MaxConnections       int                  //Max concurrent connections (TCP) and sessions (UDP), 0 for unlimited
+	MaxConnectionsPerIP  int                  //Max concurrent connections per source IP, 0 for unlimited
+	IdleTimeout          int                  //Close connections without traffic for this many sec, 0 to disable
+	TLSTerminate         bool                 //Terminate TLS from clients, cert selected by SNI (TCP only)
+	ClientCABundle       string               //PEM encoded CA bundle for verifying client certificates
+	RequireClientCert    bool                 //Reject clients without a valid client certificate
+	TLSOriginate         bool                 //Connect to the targets with TLS (TCP only)
+	TargetSNI            string               //SNI and verification hostname for the targets, empty for target host
+	TargetCABundle       string               //PEM encoded CA bundle for verifying the targets, empty for system CAs
+	TargetSkipVerify     bool                 //Skip target certificate verification
+	TargetClientCertName string               //Name of the cert in the cert store presented to the targets
+	BandwidthLimit       int64                //Max bytes per second shared by all connections in both directions, 0 for unlimited
+	BandwidthPerIP       int64                //Max bytes per second for each client IP, 0 for unlimited
+	BandwidthPerTarget   int64                //Max bytes per second for each target, 0 for unlimited
+	DrainTimeout         int                  //Grace period in sec for existing connections after a config change, 0 to wait until they close
 
 	/* Internal */
-	tcpStopChan                 chan bool    //Stop channel for TCP listener
-	udpStopChan                 chan bool    //Stop channel for UDP listener
-	aTobAccumulatedByteTransfer atomic.Int64 //Accumulated byte transfer from A to B
-	bToaAccumulatedByteTransfer atomic.Int64 //Accumulated byte transfer from B to A
-	udpClientMap                sync.Map     //map storing the UDP client-server connections
-	parent                      *Manager     `json:"-"`
+	listeners                   []*relayListener              //Running listeners, one per protocol and port
+	drainingListeners           []*relayListener              //Listeners removed by reload, waiting for their sessions to end
+	listenerLock                sync.Mutex                    //Lock for the listener lists
+	aTobAccumulatedByteTransfer atomic.Int64                  //Accumulated byte transfer from A to B
+	bToaAccumulatedByteTransfer atomic.Int64                  //Accumulated byte transfer from B to A
+	udpClientMap                sync.Map                      //map storing the UDP client-server connections
+	sessions                    sync.Map                      //map storing the active sessions, map[session ID]*streamSession
+	connLimitLock               sync.Mutex                    //Lock for the connection counters
+	activeConns                 int64                         //Current number of connections and UDP sessions
+	connsPerIP                  map[string]int                //Current number of connections per source IP
+	rejectedByAccessRule        atomic.Int64                  //Number of connections rejected by access rule
+	rejectedByConnLimit         atomic.Int64                  //Number of connections rejected by connection limits
+	bandwidthLimiters           atomic.Pointer[limiterSet]    //Bandwidth limiters of the running proxy
+	runtimeSettings             atomic.Pointer[relaySettings] //Settings read by the running listeners and sessions
+	parent                      *Manager                      `json:"-"`
 }
 
 type Options struct {
 	DefaultTimeout       int
 	AccessControlHandler func(net.Conn) bool
-	ConfigStore          string         //Folder to store the config files, will be created if not exists
-	Logger               *logger.Logger //Logger for the stream proxy
+	ConfigStore          string               //Folder to store the config files, will be created if not exists
+	Logger               *logger.Logger       //Logger for the stream proxy
+	StatisticCollector   *statistic.Collector //Statistic collector for recording daily relay traffic
+	TlsManager           *tlscert.Manager     //Cert store for TLS termination and target client certs
+	HostStatsCollector   *hoststats.Collector //Per-host statistics collector for reporting live bandwidth, can be nil
+
+	//Check the client IP against the access rule of a proxy rule, override AccessControlHandler if set
+	AccessRuleHandler func(accessRuleID string, clientIP string) bool
+
+	//Return the TCP ports used by other services, e.g. the reverse proxy router
+	ReservedPorts func() []int
 }
 
 type Manager struct {
 	//Config and stores
 	Options *Options
 	Configs []*ProxyRelayInstance
-
-	//Realtime Statistics
-	Connections int //currently connected connect counts
-
 }
 
 // NewStreamProxy creates a new stream proxy manager with the given options
@@ -125,6 +206,14 @@ func NewStreamProxy(options *Options) (*Manager, error) {
 			continue
 		}
 
+		//Migrate single target rules to target pool
+		if len(thisRelayConfig.ProxyTargets) == 0 && thisRelayConfig.ProxyTargetAddr != "" {
+			thisRelayConfig.ProxyTargets = []string{thisRelayConfig.ProxyTargetAddr}
+		}
+		if thisRelayConfig.LoadBalancePolicy == "" {
+			thisRelayConfig.LoadBalancePolicy = LoadBalanceRoundRobin
+		}
+
 		//Append the config to the list
 		previousRules = append(previousRules, thisRelayConfig)
 	}
@@ -139,13 +228,13 @@ func NewStreamProxy(options *Options) (*Manager, error) {
 
 	//Create a new proxy manager for TCP
 	thisManager := Manager{
-		Options:     options,
-		Connections: 0,
+		Options: options,
 	}
 
 	//Inject manager into the rules
 	for _, rule := range previousRules {
 		rule.parent = &thisManager
+		rule.publishSettings()
 		if rule.Running {
 			//This was previously running. Start it again
 			thisManager.logf("Resuming stream proxy rule "+rule.Name, nil)
@@ -180,23 +269,55 @@ func (m *Manager) NewConfig(config *ProxyRelayOptions) string {
 	bAcc.Store(0)
 	//Generate a new config from options
 	configUUID := uuid.New().String()
+	proxyTargets := config.ProxyTargets
+	if len(proxyTargets) == 0 && config.ProxyAddr != "" {
+		proxyTargets = []string{config.ProxyAddr}
+	}
+	proxyTargetAddr := config.ProxyAddr
+	if proxyTargetAddr == "" && len(proxyTargets) > 0 {
+		proxyTargetAddr = proxyTargets[0]
+	}
+	loadBalancePolicy := config.LoadBalancePolicy
+	if loadBalancePolicy == "" {
+		loadBalancePolicy = LoadBalanceRoundRobin
+	}
 	thisConfig := ProxyRelayInstance{
 		UUID:                        configUUID,
 		Name:                        config.Name,
 		ListeningAddress:            config.ListeningAddr,
-		ProxyTargetAddr:             config.ProxyAddr,
+		ProxyTargetAddr:             proxyTargetAddr,
+		ProxyTargets:                proxyTargets,
+		LoadBalancePolicy:           loadBalancePolicy,
+		HealthCheckInterval:         config.HealthCheckInterval,
 		UseTCP:                      config.UseTCP,
 		UseUDP:                      config.UseUDP,
 		ProxyProtocolVersion:        config.ProxyProtocolVersion,
 		EnableLogging:               config.EnableLogging,
 		Timeout:                     config.Timeout,
-		tcpStopChan:                 nil,
-		udpStopChan:                 nil,
+		AcceptProxyProtocol:         config.AcceptProxyProtocol,
+		TrustedProxyCIDRs:           config.TrustedProxyCIDRs,
+		AccessRuleID:                config.AccessRuleID,
+		MaxConnections:              config.MaxConnections,
+		MaxConnectionsPerIP:         config.MaxConnectionsPerIP,
+		IdleTimeout:                 config.IdleTimeout,
+		TLSTerminate:                config.TLSTerminate,
+		ClientCABundle:              config.ClientCABundle,
+		RequireClientCert:           config.RequireClientCert,
+		TLSOriginate:                config.TLSOriginate,
+		TargetSNI:                   config.TargetSNI,
+		TargetCABundle:              config.TargetCABundle,
+		TargetSkipVerify:            config.TargetSkipVerify,
+		TargetClientCertName:        config.TargetClientCertName,
+		BandwidthLimit:              config.BandwidthLimit,
+		BandwidthPerIP:              config.BandwidthPerIP,
+		BandwidthPerTarget:          config.BandwidthPerTarget,
+		DrainTimeout:                config.DrainTimeout,
 		aTobAccumulatedByteTransfer: aAcc,
 		bToaAccumulatedByteTransfer: bAcc,
 		udpClientMap:                sync.Map{},
 		parent:                      m,
 	}
+	thisConfig.publishSettings()
 	m.Configs = append(m.Configs, &thisConfig)
 	m.SaveConfigToDatabase()
 	return configUUID
@@ -244,38 +365,185 @@ func (m *Manager) EditConfig(newConfig *ProxyRuleUpdateConfig) error {
 		return err
 	}
 
+	//Apply the changes on a copy, the running config is only changed once all of them are valid
+	previousConfig, _ := json.Marshal(foundConfig)
+	previous := &ProxyRelayInstance{}
+	updated := &ProxyRelayInstance{}
+	json.Unmarshal(previousConfig, previous)
+	json.Unmarshal(previousConfig, updated)
+	updated.parent = m
+
 	// Validate and update the fields
 	if newConfig.NewName != "" {
-		foundConfig.Name = newConfig.NewName
+		updated.Name = newConfig.NewName
 	}
 	if newConfig.NewListeningAddr != "" {
-		foundConfig.ListeningAddress = newConfig.NewListeningAddr
+		updated.ListeningAddress = newConfig.NewListeningAddr
+	}
+	if len(newConfig.NewProxyTargets) > 0 {
+		updated.ProxyTargets = newConfig.NewProxyTargets
+		updated.ProxyTargetAddr = newConfig.NewProxyTargets[0]
+	} else if newConfig.NewProxyAddr != "" {
+		updated.ProxyTargets = []string{newConfig.NewProxyAddr}
+		updated.ProxyTargetAddr = newConfig.NewProxyAddr
+	}
+	if newConfig.LoadBalancePolicy != "" {
+		if !IsValidLoadBalancePolicy(newConfig.LoadBalancePolicy) {
+			return errors.New("invalid load balance policy given")
+		}
+		updated.LoadBalancePolicy = LoadBalancePolicy(newConfig.LoadBalancePolicy)
 	}
-	if newConfig.NewProxyAddr != "" {
-		foundConfig.ProxyTargetAddr = newConfig.NewProxyAddr
+	if newConfig.HealthCheckInterval != -1 {
+		if newConfig.HealthCheckInterval < 0 {
+			return errors.New("invalid health check interval given")
+		}
+		updated.HealthCheckInterval = newConfig.HealthCheckInterval
 	}
 
-	foundConfig.UseTCP = newConfig.UseTCP
-	foundConfig.UseUDP = newConfig.UseUDP
-	foundConfig.ProxyProtocolVersion = convertIntToProxyProtocolVersion(newConfig.ProxyProtocolVersion)
-	foundConfig.EnableLogging = newConfig.EnableLogging
+	updated.UseTCP = newConfig.UseTCP
+	updated.UseUDP = newConfig.UseUDP
+	updated.ProxyProtocolVersion = convertIntToProxyProtocolVersion(newConfig.ProxyProtocolVersion)
+	updated.EnableLogging = newConfig.EnableLogging
+	updated.AcceptProxyProtocol = newConfig.AcceptProxyProtocol
+	updated.TrustedProxyCIDRs = newConfig.TrustedProxyCIDRs
+
+	if newConfig.AccessRuleID != "" {
+		updated.AccessRuleID = newConfig.AccessRuleID
+	}
+	if newConfig.MaxConnections != -1 {
+		if newConfig.MaxConnections < 0 {
+			return errors.New("invalid max connections given")
+		}
+		updated.MaxConnections = newConfig.MaxConnections
+	}
+	if newConfig.MaxConnectionsPerIP != -1 {
+		if newConfig.MaxConnectionsPerIP < 0 {
+			return errors.New("invalid max connections per IP given")
+		}
+		updated.MaxConnectionsPerIP = newConfig.MaxConnectionsPerIP
+	}
+	if newConfig.IdleTimeout != -1 {
+		if newConfig.IdleTimeout < 0 {
+			return errors.New("invalid idle timeout given")
+		}
+		updated.IdleTimeout = newConfig.IdleTimeout
+	}
+
+	updated.TLSTerminate = newConfig.TLSTerminate
+	updated.ClientCABundle = newConfig.ClientCABundle
+	updated.RequireClientCert = newConfig.RequireClientCert
+	updated.TLSOriginate = newConfig.TLSOriginate
+	updated.TargetSNI = newConfig.TargetSNI
+	updated.TargetCABundle = newConfig.TargetCABundle
+	updated.TargetSkipVerify = newConfig.TargetSkipVerify
+	updated.TargetClientCertName = newConfig.TargetClientCertName
+
+	if newConfig.BandwidthLimit != -1 {
+		if newConfig.BandwidthLimit < 0 {
+			return errors.New("invalid bandwidth limit given")
+		}
+		updated.BandwidthLimit = newConfig.BandwidthLimit
+	}
+	if newConfig.BandwidthPerIP != -1 {
+		if newConfig.BandwidthPerIP < 0 {
+			return errors.New("invalid bandwidth limit per IP given")
+		}
+		updated.BandwidthPerIP = newConfig.BandwidthPerIP
+	}
+	if newConfig.BandwidthPerTarget != -1 {
+		if newConfig.BandwidthPerTarget < 0 {
+			return errors.New("invalid bandwidth limit per target given")
+		}
+		updated.BandwidthPerTarget = newConfig.BandwidthPerTarget
+	}
 
 	if newConfig.NewTimeout != -1 {
 		if newConfig.NewTimeout < 0 {
 			return errors.New("invalid timeout value given")
 		}
-		foundConfig.Timeout = newConfig.NewTimeout
+		updated.Timeout = newConfig.NewTimeout
 	}
 
-	m.SaveConfigToDatabase()
+	if newConfig.DrainTimeout != -1 {
+		if newConfig.DrainTimeout < 0 {
+			return errors.New("invalid drain timeout given")
+		}
+		updated.DrainTimeout = newConfig.DrainTimeout
+	}
+
+	// Check the listening ports, target mapping and TLS settings of the updated rule
+	if err := m.ValidateListeningAddress(foundConfig.UUID, updated.ListeningAddress, updated.UseTCP, updated.UseUDP); err != nil {
+		return err
+	}
+	if err := ValidatePortMapping(updated.ListeningAddress, updated.GetTargets()); err != nil {
+		return err
+	}
+	if _, err := updated.buildServerTLSConfig(); err != nil {
+		return err
+	}
+	if _, err := updated.buildTargetTLSConfig(); err != nil {
+		return err
+	}
+
+	previousSocketSettings := foundConfig.socketSettings()
+	foundConfig.setConfig(updated)
 
-	//Check if config is running. If yes, restart it
+	//Check if config is running. If yes, apply the change without dropping existing connections.
+	//The running listeners and sessions only see the new settings once Reload succeed
 	if foundConfig.IsRunning() {
-		foundConfig.Restart()
+		err := foundConfig.Reload(foundConfig.socketSettings() != previousSocketSettings)
+		if err != nil {
+			foundConfig.setConfig(previous)
+			m.SaveConfigToDatabase()
+			return err
+		}
+	} else {
+		foundConfig.publishSettings()
 	}
+
+	m.SaveConfigToDatabase()
 	return nil
 }
 
+// setConfig copy the editable settings of the given config into this rule. Running
+// listeners and sessions read the published settings, see publishSettings
+func (c *ProxyRelayInstance) setConfig(from *ProxyRelayInstance) {
+	c.Name = from.Name
+	c.ListeningAddress = from.ListeningAddress
+	c.ProxyTargetAddr = from.ProxyTargetAddr
+	c.ProxyTargets = from.ProxyTargets
+	c.LoadBalancePolicy = from.LoadBalancePolicy
+	c.HealthCheckInterval = from.HealthCheckInterval
+	c.UseTCP = from.UseTCP
+	c.UseUDP = from.UseUDP
+	c.ProxyProtocolVersion = from.ProxyProtocolVersion
+	c.EnableLogging = from.EnableLogging
+	c.Timeout = from.Timeout
+	c.AcceptProxyProtocol = from.AcceptProxyProtocol
+	c.TrustedProxyCIDRs = from.TrustedProxyCIDRs
+	c.AccessRuleID = from.AccessRuleID
+	c.MaxConnections = from.MaxConnections
+	c.MaxConnectionsPerIP = from.MaxConnectionsPerIP
+	c.IdleTimeout = from.IdleTimeout
+	c.TLSTerminate = from.TLSTerminate
+	c.ClientCABundle = from.ClientCABundle
+	c.RequireClientCert = from.RequireClientCert
+	c.TLSOriginate = from.TLSOriginate
+	c.TargetSNI = from.TargetSNI
+	c.TargetCABundle = from.TargetCABundle
+	c.TargetSkipVerify = from.TargetSkipVerify
+	c.TargetClientCertName = from.TargetClientCertName
+	c.BandwidthLimit = from.BandwidthLimit
+	c.BandwidthPerIP = from.BandwidthPerIP
+	c.BandwidthPerTarget = from.BandwidthPerTarget
+	c.DrainTimeout = from.DrainTimeout
+}
+
+// Settings applied on the TCP listening socket, changing them require rebinding the socket
+func (c *ProxyRelayInstance) socketSettings() string {
+	return fmt.Sprint(c.AcceptProxyProtocol, c.TrustedProxyCIDRs, c.TLSTerminate, c.ClientCABundle, c.RequireClientCert)
+}
+
 // Remove the config from file by UUID
 func (m *Manager) RemoveConfig(configUUID string) error {
 	err := os.Remove(filepath.Join(m.Options.ConfigStore, configUUID+".config"))
@@ -1,6 +1,8 @@
 package streamproxy
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
@@ -13,6 +15,7 @@ import (
 	"time"
 
 	proxyproto "github.com/pires/go-proxyproto"
+	"imuslab.com/zoraxy/mod/netutils"
 )
 
 func isValidIP(ip string) bool {
@@ -34,16 +37,17 @@ func isValidPort(port string) bool {
 }
 
 func (c *ProxyRelayInstance) connCopy(conn1 net.Conn, conn2 net.Conn, wg *sync.WaitGroup, accumulator *atomic.Int64) {
+	defer wg.Done()
 	n, err := io.Copy(conn1, conn2)
+	accumulator.Add(n) //Add to accumulator
+	conn1.Close()
 	if err != nil {
+		//Closing conn1 also end the copy in the other direction
 		return
 	}
-	accumulator.Add(n) //Add to accumulator
-	conn1.Close()
 	c.LogMsg("[←] close the connect at local:["+conn1.LocalAddr().String()+"] and remote:["+conn1.RemoteAddr().String()+"]", nil)
 	//conn2.Close()
 	//c.LogMsg("[←] close the connect at local:["+conn2.LocalAddr().String()+"] and remote:["+conn2.RemoteAddr().String()+"]", nil)
-	wg.Done()
 }
 
 func WriteProxyProtocolHeader(dst net.Conn, src net.Conn, version ProxyProtocolVersion) error {
@@ -53,10 +57,15 @@ func WriteProxyProtocolHeader(dst net.Conn, src net.Conn, version ProxyProtocolV
 		return errors.New("invalid TCP address for proxy protocol")
 	}
 
+	transportProtocol := proxyproto.TCPv4
+	if clientAddr.IP.To4() == nil {
+		transportProtocol = proxyproto.TCPv6
+	}
+
 	header := proxyproto.Header{
 		Version:           byte(convertProxyProtocolVersionToInt(version)),
 		Command:           proxyproto.PROXY,
-		TransportProtocol: proxyproto.TCPv4,
+		TransportProtocol: transportProtocol,
 		SourceAddr:        clientAddr,
 		DestinationAddr:   proxyAddr,
 	}
@@ -65,37 +74,65 @@ func WriteProxyProtocolHeader(dst net.Conn, src net.Conn, version ProxyProtocolV
 	return err
 }
 
-func (c *ProxyRelayInstance) forward(conn1 net.Conn, conn2 net.Conn, aTob *atomic.Int64, bToa *atomic.Int64) {
+// forward relay the traffic between the target (conn1) and the client (conn2)
+func (c *ProxyRelayInstance) forward(conn1 net.Conn, conn2 net.Conn, session *streamSession) {
 	msg := fmt.Sprintf("[+] start transmit. [%s],[%s] <-> [%s],[%s]",
 		conn1.LocalAddr().String(), conn1.RemoteAddr().String(),
 		conn2.LocalAddr().String(), conn2.RemoteAddr().String())
 	c.LogMsg(msg, nil)
 
+	if timeout := c.idleTimeout(); timeout > 0 {
+		//Close both side if no data is transferred in either direction
+		done := make(chan struct{})
+		defer close(done)
+		go session.tracker.watch(timeout, done, func() {
+			c.LogMsg("[x] Connection idle for more than "+timeout.String()+", closing", nil)
+			conn1.Close()
+			conn2.Close()
+		})
+	}
+
+	//Count the bytes of this session and shape them with the bandwidth limits
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var onSent, onReceived func(n int64)
+	if c.hostStatsCollector() != nil {
+		onSent = func(n int64) { c.recordTraffic(n, 0) }
+		onReceived = func(n int64) { c.recordTraffic(0, n) }
+	}
+	conn1 = &activityConn{Conn: conn1, tracker: session.tracker, counter: &session.bytesOut, limiters: session.limiters, onRead: onSent, ctx: ctx, cancel: cancel}
+	conn2 = &activityConn{Conn: conn2, tracker: session.tracker, counter: &session.bytesIn, limiters: session.limiters, onRead: onReceived, ctx: ctx, cancel: cancel}
+
 	var wg sync.WaitGroup
 	wg.Add(2)
-	go c.connCopy(conn1, conn2, &wg, aTob)
-	go c.connCopy(conn2, conn1, &wg, bToa)
+	go c.connCopy(conn1, conn2, &wg, &c.aTobAccumulatedByteTransfer)
+	go c.connCopy(conn2, conn1, &wg, &c.bToaAccumulatedByteTransfer)
 	wg.Wait()
 }
 
-func (c *ProxyRelayInstance) accept(listener net.Listener) (net.Conn, error) {
-	conn, err := listener.Accept()
-	if err != nil {
-		return nil, err
+// Check if the accepted connection is allowed by the access control policy and
+// the connection limits. If allowed, the caller must release the connection slot
+// when the connection is closed. For PROXY protocol connections this read the
+// header, so do not call it inside the accept loop
+func (c *ProxyRelayInstance) allowConnection(conn net.Conn, clientIP string) bool {
+	// Check if connection in blacklist or whitelist
+	if !c.allowAccess(conn, clientIP) {
+		c.rejectedByAccessRule.Add(1)
+		time.Sleep(300 * time.Millisecond)
+		conn.Close()
+		c.LogMsg("[x] Connection from "+clientIP+" rejected by access control policy", nil)
+		return false
 	}
 
-	// Check if connection in blacklist or whitelist
-	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
-		if !c.parent.Options.AccessControlHandler(conn) {
-			time.Sleep(300 * time.Millisecond)
-			conn.Close()
-			c.LogMsg("[x] Connection from "+addr.IP.String()+" rejected by access control policy", nil)
-			return nil, errors.New("Connection from " + addr.IP.String() + " rejected by access control policy")
-		}
+	// Check the concurrent connection limits
+	if !c.acquireConnSlot(clientIP) {
+		conn.Close()
+		c.LogMsg("[x] Connection from "+clientIP+" rejected by connection limit", nil)
+		return false
 	}
 
 	c.LogMsg("[√] accept a new client. remote address:["+conn.RemoteAddr().String()+"], local address:["+conn.LocalAddr().String()+"]", nil)
-	return conn, nil
+	return true
 }
 
 func startListener(address string) (net.Listener, error) {
@@ -115,8 +152,33 @@ func startListener(address string) (net.Listener, error) {
 /*
 portA -> server
 server -> portB
+
+targetAddress is used if the rule has no target pool
 */
 func (c *ProxyRelayInstance) Port2host(allowPort string, targetAddress string, stopChan chan bool) error {
+	targets := c.ProxyTargets
+	if len(targets) == 0 {
+		targets = []string{strings.TrimSpace(targetAddress)}
+	}
+	l, err := c.listenTCP(allowPort, targets)
+	if err != nil {
+		return err
+	}
+
+	//Start stop handler
+	go func() {
+		<-stopChan
+		c.LogMsg("[x] Received stop signal. Exiting Port to Host forwarder", nil)
+		c.closeListener(l)
+	}()
+
+	c.serveTCP(l)
+	return nil
+}
+
+// listenTCP bind a TCP listener on a single port of the rule, with the PROXY
+// protocol and TLS termination wrappers applied
+func (c *ProxyRelayInstance) listenTCP(allowPort string, targets []string) (*relayListener, error) {
 	listenerStartingAddr := allowPort
 	if isValidPort(allowPort) {
 		//number only, e.g. 8080
@@ -128,57 +190,113 @@ func (c *ProxyRelayInstance) Port2host(allowPort string, targetAddress string, s
 
 	server, err := startListener(listenerStartingAddr)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	targetAddress = strings.TrimSpace(targetAddress)
+	if c.AcceptProxyProtocol {
+		//Replace the client address with the one in PROXY protocol header from trusted proxies
+		ppListener, err := netutils.NewProxyProtocolListener(server, c.TrustedProxyCIDRs)
+		if err != nil {
+			server.Close()
+			return nil, err
+		}
+		server = ppListener
+	}
 
-	//Start stop handler
-	go func() {
-		<-stopChan
-		c.LogMsg("[x] Received stop signal. Exiting Port to Host forwarder", nil)
+	//TLS termination, the target pool and TLS origination are set by updateListener
+	serverTLSConfig, err := c.buildServerTLSConfig()
+	if err != nil {
 		server.Close()
-	}()
+		return nil, err
+	}
+	if serverTLSConfig != nil {
+		server = tls.NewListener(server, serverTLSConfig)
+	}
+
+	l := &relayListener{
+		protocol:    "tcp",
+		address:     listenerStartingAddr,
+		tcpListener: server,
+	}
+	if err := c.updateListener(l, targets); err != nil {
+		server.Close()
+		return nil, err
+	}
+	return l, nil
+}
 
+// serveTCP accept and forward connections until the listener is closed
+func (c *ProxyRelayInstance) serveTCP(l *relayListener) {
 	//Start blocking loop for accepting connections
 	for {
-		conn, err := c.accept(server)
+		conn, err := l.tcpListener.Accept()
 		if err != nil {
 			if errors.Is(err, net.ErrClosed) {
 				//Terminate by stop chan. Exit listener loop
-				return nil
+				return
 			}
 			//Connection error. Retry
 			continue
 		}
 
-		go func(targetAddress string) {
-			c.LogMsg("[+] start connect host:["+targetAddress+"]", nil)
-			target, err := net.Dial("tcp", targetAddress)
+		go func() {
+			clientIP := addrIP(conn.RemoteAddr())
+			if !c.allowConnection(conn, clientIP) {
+				return
+			}
+			defer c.releaseConnSlot(clientIP)
+
+			if err := serverHandshake(conn); err != nil {
+				c.LogMsg("[x] TLS handshake with ["+conn.RemoteAddr().String()+"] failed", err)
+				conn.Close()
+				return
+			}
+
+			//Pick a target by policy, failover to the next target on dial error.
+			//Target changes on reload only affect connections accepted after it
+			pool := l.pool.Load()
+			target, selected, err := pool.dial(conn.RemoteAddr(), c.dialTimeout())
 			if err != nil {
 				// temporarily unavailable, don't use fatal.
-				c.LogMsg("[x] connect target address ["+targetAddress+"] failed. retry in "+strconv.Itoa(c.Timeout)+" seconds.", nil)
+				c.LogMsg("[x] no target available for connection from ["+conn.RemoteAddr().String()+"]", err)
 				conn.Close()
 				c.LogMsg("[←] close the connect at local:["+conn.LocalAddr().String()+"] and remote:["+conn.RemoteAddr().String()+"]", nil)
-				time.Sleep(time.Duration(c.Timeout) * time.Second)
 				return
 			}
+			targetAddress := selected.Address
 			c.LogMsg("[→] connect target address ["+targetAddress+"] success.", nil)
 
-			if c.ProxyProtocolVersion != ProxyProtocolDisabled {
+			if proxyProtocolVersion := c.settings().proxyProtocolVersion; proxyProtocolVersion != ProxyProtocolDisabled {
 				c.LogMsg("[+] write proxy protocol header to target address ["+targetAddress+"]", nil)
-				err = WriteProxyProtocolHeader(target, conn, c.ProxyProtocolVersion)
+				err = WriteProxyProtocolHeader(target, conn, proxyProtocolVersion)
 				if err != nil {
 					c.LogMsg("[x] Write proxy protocol header failed: "+err.Error(), nil)
 					target.Close()
 					conn.Close()
 					c.LogMsg("[←] close the connect at local:["+conn.LocalAddr().String()+"] and remote:["+conn.RemoteAddr().String()+"]", nil)
-					time.Sleep(time.Duration(c.Timeout) * time.Second)
 					return
 				}
 			}
 
-			c.forward(target, conn, &c.aTobAccumulatedByteTransfer, &c.bToaAccumulatedByteTransfer)
-		}(targetAddress)
+			if targetTLSConfig := l.targetTLS.Load(); targetTLSConfig != nil {
+				tlsTarget, err := originateTLS(target, targetAddress, targetTLSConfig)
+				if err != nil {
+					c.LogMsg("[x] TLS handshake with target address ["+targetAddress+"] failed", err)
+					target.Close()
+					conn.Close()
+					return
+				}
+				target = tlsTarget
+			}
+
+			session := c.newSession(l, "tcp", conn.RemoteAddr().String(), targetAddress, func() {
+				conn.Close()
+				target.Close()
+			})
+			selected.activeConns.Add(1)
+			c.forward(target, conn, session)
+			selected.activeConns.Add(-1)
+			c.endSession(session)
+		}()
 	}
 }
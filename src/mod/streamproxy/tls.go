@@ -0,0 +1,122 @@
+package streamproxy
+
+/*
+	tls.go
+
+	TLS termination and origination for TCP stream proxies.
+	Incoming connections can be terminated with certificates
+	from the cert store (selected by SNI) and optionally be
+	required to present a client certificate. Connections to
+	the targets can be re-encrypted with TLS.
+*/
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+const tlsHandshakeTimeout = 10 * time.Second //Max time for a TLS handshake with client or target
+
+// Build the TLS config for terminating TLS from clients, nil if termination is disabled
+func (c *ProxyRelayInstance) buildServerTLSConfig() (*tls.Config, error) {
+	if !c.TLSTerminate {
+		return nil, nil
+	}
+	if c.parent == nil || c.parent.Options.TlsManager == nil {
+		return nil, errors.New("certificate store not available for TLS termination")
+	}
+
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: c.parent.Options.TlsManager.GetCert,
+	}
+
+	//Client certificate verification
+	if strings.TrimSpace(c.ClientCABundle) != "" {
+		caPool := x509.NewCertPool()
+		if !caPool.AppendCertsFromPEM([]byte(c.ClientCABundle)) {
+			return nil, errors.New("no valid certificate found in client CA bundle")
+		}
+		config.ClientCAs = caPool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if c.RequireClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	} else if c.RequireClientCert {
+		return nil, errors.New("client CA bundle is required for client certificate verification")
+	}
+
+	return config, nil
+}
+
+// Build the TLS config for connecting to the targets, nil if origination is disabled
+func (c *ProxyRelayInstance) buildTargetTLSConfig() (*tls.Config, error) {
+	if !c.TLSOriginate {
+		return nil, nil
+	}
+
+	config := &tls.Config{
+		InsecureSkipVerify: c.TargetSkipVerify,
+		ServerName:         strings.TrimSpace(c.TargetSNI),
+	}
+
+	//Custom CA trust
+	if strings.TrimSpace(c.TargetCABundle) != "" {
+		caPool := x509.NewCertPool()
+		if !caPool.AppendCertsFromPEM([]byte(c.TargetCABundle)) {
+			return nil, errors.New("no valid certificate found in target CA bundle")
+		}
+		config.RootCAs = caPool
+	}
+
+	//Client certificate for mTLS
+	if strings.TrimSpace(c.TargetClientCertName) != "" {
+		if c.parent == nil || c.parent.Options.TlsManager == nil {
+			return nil, errors.New("certificate store not available for loading client certificate")
+		}
+		clientCert, err := c.parent.Options.TlsManager.LoadCertificateByName(c.TargetClientCertName)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{*clientCert}
+	}
+
+	return config, nil
+}
+
+// Complete the TLS handshake with the client before the connection is relayed
+func serverHandshake(conn net.Conn) error {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), tlsHandshakeTimeout)
+	defer cancel()
+	return tlsConn.HandshakeContext(ctx)
+}
+
+// Wrap the target connection with TLS and complete the handshake
+func originateTLS(target net.Conn, targetAddr string, config *tls.Config) (net.Conn, error) {
+	config = config.Clone()
+	if config.ServerName == "" {
+		//Verify against the target hostname
+		host, _, err := net.SplitHostPort(targetAddr)
+		if err != nil {
+			host = targetAddr
+		}
+		config.ServerName = host
+	}
+
+	tlsConn := tls.Client(target, config)
+	ctx, cancel := context.WithTimeout(context.Background(), tlsHandshakeTimeout)
+	defer cancel()
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+	return tlsConn, nil
+}
@@ -0,0 +1,137 @@
+package streamproxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"imuslab.com/zoraxy/mod/tlscert"
+)
+
+// Generate a self-signed certificate for localhost
+func generateTestCert(t *testing.T) (tls.Certificate, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, string(certPEM)
+}
+
+func TestTLSOrigination(t *testing.T) {
+	cert, certPEM := generateTestCert(t)
+
+	//TLS echo target
+	echo, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+
+	reserved, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listenAddr := reserved.Addr().String()
+	reserved.Close()
+
+	c := &ProxyRelayInstance{
+		ProxyTargets:   []string{echo.Addr().String()},
+		TLSOriginate:   true,
+		TargetSNI:      "localhost",
+		TargetCABundle: certPEM,
+	}
+	stopChan := make(chan bool)
+	go c.Port2host(listenAddr, "", stopChan)
+	defer func() { stopChan <- true }()
+
+	var client net.Conn
+	for i := 0; i < 20; i++ {
+		client, err = net.Dial("tcp", listenAddr)
+		if err == nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	//Plain text from the client is encrypted to the target
+	client.Write([]byte("hello"))
+	client.SetReadDeadline(time.Now().Add(3 * time.Second))
+	reply := make([]byte, 5)
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != "hello" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+}
+
+func TestTLSConfigValidation(t *testing.T) {
+	_, certPEM := generateTestCert(t)
+
+	//Termination requires the cert store
+	c := &ProxyRelayInstance{TLSTerminate: true}
+	if _, err := c.buildServerTLSConfig(); err == nil {
+		t.Error("termination without cert store should fail")
+	}
+
+	//Client cert requirement needs a CA bundle to verify against
+	c.parent = &Manager{Options: &Options{TlsManager: &tlscert.Manager{}}}
+	c.RequireClientCert = true
+	if _, err := c.buildServerTLSConfig(); err == nil {
+		t.Error("client cert requirement without CA bundle should fail")
+	}
+	c.ClientCABundle = certPEM
+	config, err := c.buildServerTLSConfig()
+	if err != nil || config.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Errorf("client cert should be required: %v", err)
+	}
+
+	//Origination with custom CA
+	c = &ProxyRelayInstance{TLSOriginate: true, TargetCABundle: "not a cert"}
+	if _, err := c.buildTargetTLSConfig(); err == nil {
+		t.Error("invalid target CA bundle should fail")
+	}
+	c.TargetCABundle = certPEM
+	config, err = c.buildTargetTLSConfig()
+	if err != nil || config.RootCAs == nil {
+		t.Errorf("valid target CA bundle should be loaded: %v", err)
+	}
+}
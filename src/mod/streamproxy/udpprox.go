@@ -9,6 +9,7 @@ import (
 	"time"
 
 	proxyproto "github.com/pires/go-proxyproto"
+	"imuslab.com/zoraxy/mod/bandwidth"
 )
 
 /*
@@ -17,8 +18,11 @@ import (
 
 // Information maintained for each client/server connection
 type udpClientServerConn struct {
-	ClientAddr *net.UDPAddr // Address of the client
-	ServerConn *net.UDPConn // UDP connection to server
+	ClientAddr *net.UDPAddr   // Address of the client
+	ServerConn *net.UDPConn   // UDP connection to server
+	session    *streamSession // Session in the connection table
+	mapKey     string         // Key in the client map, unique per listening port and client
+	listener   *relayListener // Listener receiving packets of this client
 }
 
 // Generate a new connection by opening a UDP connection to the server
@@ -33,40 +37,73 @@ func createNewUDPConn(srvAddr, cliAddr *net.UDPAddr) *udpClientServerConn {
 	return conn
 }
 
-// Start listener, return inbound lisener and proxy target UDP address
-func initUDPConnections(listenAddr string, targetAddress string) (*net.UDPConn, *net.UDPAddr, error) {
+// Start listener, return inbound lisener
+func initUDPConnections(listenAddr string) (*net.UDPConn, error) {
 	// Set up Proxy
 	saddr, err := net.ResolveUDPAddr("udp", listenAddr)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 	inboundConn, err := net.ListenUDP("udp", saddr)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
 	log.Println("[UDP] Proxy listening on " + listenAddr)
+	return inboundConn, nil
+}
 
-	outboundConn, err := net.ResolveUDPAddr("udp", targetAddress)
-	if err != nil {
-		return nil, nil, err
+// Pick the target for a new UDP client by the load balance policy
+func (c *ProxyRelayInstance) pickUDPTarget(pool *targetPool, cliaddr *net.UDPAddr) (*net.UDPAddr, error) {
+	var lastErr error = errors.New("no proxy target defined")
+	for _, t := range pool.candidates(cliaddr) {
+		targetAddr, err := net.ResolveUDPAddr("udp", t.Address)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return targetAddr, nil
 	}
-
-	return inboundConn, outboundConn, nil
+	return nil, lastErr
 }
 
 // Go routine which manages connection from server to single client
 func (c *ProxyRelayInstance) RunUDPConnectionRelay(conn *udpClientServerConn, lisenter *net.UDPConn) {
+	//Release the session once the relay exit
+	defer func() {
+		conn.ServerConn.Close()
+		c.udpClientMap.CompareAndDelete(conn.mapKey, conn)
+		c.releaseConnSlot(conn.ClientAddr.IP.String())
+		c.endSession(conn.session)
+	}()
+
 	var buffer [1500]byte
 	for {
+		idleTimeout := c.idleTimeout()
+		if idleTimeout > 0 {
+			conn.ServerConn.SetReadDeadline(time.Now().Add(idleTimeout / 4))
+		}
+
 		// Read from server
 		n, err := conn.ServerConn.Read(buffer[0:])
 		if err != nil {
 			if errors.Is(err, net.ErrClosed) {
 				return
 			}
+			if idleTimeout > 0 && conn.session.tracker.idleFor() > idleTimeout {
+				c.LogMsg("[UDP] Session of client "+conn.ClientAddr.String()+" idle timeout", nil)
+				return
+			}
+			continue
+		}
+		if !bandwidth.Allow(n, conn.session.limiters) {
+			//Over the bandwidth limit, drop the packet
 			continue
 		}
+		conn.session.tracker.touch()
+		conn.session.bytesOut.Add(int64(n))
+		c.bToaAccumulatedByteTransfer.Add(int64(n))
+		c.recordTraffic(int64(n), 0)
 		// Relay it to client
 		_, err = lisenter.WriteToUDP(buffer[0:n], conn.ClientAddr)
 		if err != nil {
@@ -104,6 +141,27 @@ func WriteProxyProtocolHeaderUDP(conn *net.UDPConn, srcAddr, dstAddr *net.UDPAdd
 }
 
 func (c *ProxyRelayInstance) ForwardUDP(address1, address2 string, stopChan chan bool) error {
+	targets := c.ProxyTargets
+	if len(targets) == 0 {
+		targets = []string{strings.TrimSpace(address2)}
+	}
+	l, err := c.listenUDP(address1, targets)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		//Stop signal received, close the listener and its sessions
+		<-stopChan
+		c.closeListener(l)
+	}()
+
+	c.serveUDP(l)
+	return nil
+}
+
+// listenUDP bind a UDP listener on a single port of the rule
+func (c *ProxyRelayInstance) listenUDP(address1 string, targets []string) (*relayListener, error) {
 	//By default the incoming listen Address is int
 	//We need to add the loopback address into it
 	if isValidPort(address1) {
@@ -115,62 +173,100 @@ func (c *ProxyRelayInstance) ForwardUDP(address1, address2 string, stopChan chan
 		address1 = "0.0.0.0" + address1
 	}
 
-	lisener, targetAddr, err := initUDPConnections(address1, address2)
+	lisener, err := initUDPConnections(address1)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	go func() {
-		//Stop channel receiver
-		for {
-			select {
-			case <-stopChan:
-				//Stop signal received
-				//Stop server -> client forwarder
-				c.CloseAllUDPConnections()
-				//Stop client -> server forwarder
-				//Force close, will terminate ReadFromUDP for inbound listener
-				lisener.Close()
-				return
-			default:
-				time.Sleep(100 * time.Millisecond)
-			}
-		}
-
-	}()
+	l := &relayListener{
+		protocol: "udp",
+		address:  address1,
+		udpConn:  lisener,
+	}
+	if err := c.updateListener(l, targets); err != nil {
+		lisener.Close()
+		return nil, err
+	}
+	return l, nil
+}
 
+// serveUDP relay packets until the listener is closed
+func (c *ProxyRelayInstance) serveUDP(l *relayListener) {
+	lisener := l.udpConn
 	var buffer [1500]byte
 	for {
 		n, cliaddr, err := lisener.ReadFromUDP(buffer[0:])
 		if err != nil {
 			if errors.Is(err, net.ErrClosed) {
 				//Proxy stopped
-				return nil
+				return
 			}
 			continue
 		}
 		c.aTobAccumulatedByteTransfer.Add(int64(n))
 		saddr := cliaddr.String()
-		rawConn, found := c.udpClientMap.Load(saddr)
+		mapKey := l.address + "/" + saddr
+		rawConn, found := c.udpClientMap.Load(mapKey)
 		var conn *udpClientServerConn
+		if found && rawConn.(*udpClientServerConn).listener != l {
+			//Session of a previous listener on the same address
+			found = false
+		}
 		if !found {
+			if l.draining.Load() {
+				//Removed by config reload, only serve the existing clients
+				continue
+			}
+			//Check access rule and connection limits for new client
+			clientIP := cliaddr.IP.String()
+			if !c.allowAccess(nil, clientIP) {
+				c.rejectedByAccessRule.Add(1)
+				c.LogMsg("[UDP] Packet from "+clientIP+" rejected by access control policy", nil)
+				continue
+			}
+			if !c.acquireConnSlot(clientIP) {
+				c.LogMsg("[UDP] Packet from "+clientIP+" rejected by connection limit", nil)
+				continue
+			}
+
+			targetAddr, err := c.pickUDPTarget(l.pool.Load(), cliaddr)
+			if err != nil {
+				c.LogMsg("[UDP] No target available for client "+saddr, err)
+				c.releaseConnSlot(clientIP)
+				continue
+			}
 			conn = createNewUDPConn(targetAddr, cliaddr)
 			if conn == nil {
+				c.releaseConnSlot(clientIP)
 				continue
 			}
-			c.udpClientMap.Store(saddr, conn)
+			serverConn := conn.ServerConn
+			conn.session = c.newSession(l, "udp", saddr, targetAddr.String(), func() {
+				//Relay routine exit and clean up once the server connection is closed
+				serverConn.Close()
+			})
+			conn.mapKey = mapKey
+			conn.listener = l
+			c.udpClientMap.Store(mapKey, conn)
 			c.LogMsg("[UDP] Created new connection for client "+saddr, nil)
 			// Fire up routine to manage new connection
 			go c.RunUDPConnectionRelay(conn, lisener)
 
 			// Send Proxy Protocol header if enabled
-			if c.ProxyProtocolVersion == ProxyProtocolV2 {
+			if c.settings().proxyProtocolVersion == ProxyProtocolV2 {
 				_ = WriteProxyProtocolHeaderUDP(conn.ServerConn, cliaddr, targetAddr)
 			}
 		} else {
 			c.LogMsg("[UDP] Found connection for client "+saddr, nil)
 			conn = rawConn.(*udpClientServerConn)
 		}
+		if !bandwidth.Allow(n, conn.session.limiters) {
+			//Over the bandwidth limit, drop the packet
+			continue
+		}
+		conn.session.tracker.touch()
+		conn.session.bytesIn.Add(int64(n))
+		c.recordTraffic(0, int64(n))
 
 		// Relay to server
 		_, err = conn.ServerConn.Write(buffer[0:n])
@@ -0,0 +1,410 @@
+package certnotify
+
+/*
+	certnotify.go
+
+	Certificate expiry monitor. This scan the cert store periodically
+	and emit certExpiringSoon events when a certificate reaches one
+	of the configured lead times. Renewal results (certRenewed and
+	certRenewalFailed events) are collected together with the expiry
+	warnings and sent to the administrator as an email digest.
+*/
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"html"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"imuslab.com/zoraxy/mod/email"
+	"imuslab.com/zoraxy/mod/eventsystem"
+	"imuslab.com/zoraxy/mod/info/logger"
+	"imuslab.com/zoraxy/mod/plugins/zoraxy_plugin/events"
+	"imuslab.com/zoraxy/mod/utils"
+)
+
+const listenerID = "cert-expiry-notifier"
+
+type Config struct {
+	EmailEnabled bool     //Send email digest when there are expiring certificates or renewal results
+	Recipients   []string //Digest recipients, leave empty to use the SMTP admin address
+	LeadTimes    []int    //Days before expiry to notify, e.g. 30, 14, 7, 1
+}
+
+type Options struct {
+	CertStore      string               //Path of the cert store to monitor
+	ConfigFile     string               //Path to save the notifier config and notification state
+	CheckInterval  int64                //Check interval (seconds), set to 0 for default (1 day)
+	GetEmailSender func() *email.Sender //Return the current SMTP sender
+	GetAdminEmail  func() string        //Return the SMTP admin address
+	Logger         *logger.Logger       //System wide logger
+}
+
+// ExpiringCert is a certificate that reached one of the lead times
+type ExpiringCert struct {
+	CertName string
+	Domains  []string
+	NotAfter time.Time
+	DaysLeft int
+}
+
+// RenewalRecord is a renewal result received from the event system
+type RenewalRecord struct {
+	CertName string
+	Domains  []string
+	Success  bool
+	Error    string
+	Source   string
+	Time     time.Time
+}
+
+type Notifier struct {
+	Config *Config
+	Option *Options
+
+	notified        map[string]int //Cert name and serial to the smallest lead time already notified
+	pendingRenewals []*RenewalRecord
+	lock            sync.Mutex
+	tickerStop      chan bool
+}
+
+// Config file content
+type savedState struct {
+	Config   *Config
+	Notified map[string]int
+}
+
+// NewNotifier create a new certificate expiry notifier, call StartTicker to start periodic checks
+func NewNotifier(option *Options) (*Notifier, error) {
+	if option.CheckInterval <= 0 {
+		option.CheckInterval = 86400
+	}
+
+	n := Notifier{
+		Config: &Config{
+			EmailEnabled: false,
+			Recipients:   []string{},
+			LeadTimes:    []int{30, 14, 7, 1},
+		},
+		Option:          option,
+		notified:        map[string]int{},
+		pendingRenewals: []*RenewalRecord{},
+	}
+
+	if utils.FileExists(option.ConfigFile) {
+		content, err := os.ReadFile(option.ConfigFile)
+		if err != nil {
+			return nil, err
+		}
+		state := savedState{Config: n.Config, Notified: n.notified}
+		err = json.Unmarshal(content, &state)
+		if err != nil {
+			return nil, errors.New("malformed cert expiry notifier config: " + err.Error())
+		}
+		if state.Notified != nil {
+			n.notified = state.Notified
+		}
+	} else {
+		err := n.saveState()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &n, nil
+}
+
+// Subscribe to the certificate renewal events. Call after the event system is initialized
+func (n *Notifier) Subscribe() error {
+	if eventsystem.Publisher == nil {
+		return errors.New("event system not initialized")
+	}
+	err := eventsystem.Publisher.RegisterSubscriberToEvent(n, events.EventCertRenewed)
+	if err != nil {
+		return err
+	}
+	return eventsystem.Publisher.RegisterSubscriberToEvent(n, events.EventCertRenewalFailed)
+}
+
+// GetID implements eventsystem.Listener
+func (n *Notifier) GetID() eventsystem.ListenerID {
+	return listenerID
+}
+
+// Notify implements eventsystem.Listener, renewal results are kept for the next digest
+func (n *Notifier) Notify(event events.Event) error {
+	record := RenewalRecord{
+		Time: time.Unix(event.Timestamp, 0),
+	}
+	switch data := event.Data.(type) {
+	case *events.CertRenewedEvent:
+		record.CertName = data.CertName
+		record.Domains = data.Domains
+		record.Success = true
+		record.Source = data.Source
+	case *events.CertRenewalFailedEvent:
+		record.CertName = data.CertName
+		record.Domains = data.Domains
+		record.Error = data.Error
+		record.Source = data.Source
+	default:
+		return nil
+	}
+
+	n.lock.Lock()
+	n.pendingRenewals = append(n.pendingRenewals, &record)
+	n.lock.Unlock()
+	return nil
+}
+
+// Write config and notification state to disk
+func (n *Notifier) saveState() error {
+	n.lock.Lock()
+	js, err := json.MarshalIndent(savedState{
+		Config:   n.Config,
+		Notified: n.notified,
+	}, "", " ")
+	n.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	os.MkdirAll(filepath.Dir(n.Option.ConfigFile), 0775)
+	return os.WriteFile(n.Option.ConfigFile, js, 0640)
+}
+
+// Get the lead time reached by a certificate with the given days left, return 0 if none
+func (n *Notifier) reachedLeadTime(daysLeft int) int {
+	leadTimes := append([]int{}, n.Config.LeadTimes...)
+	sort.Ints(leadTimes)
+	for _, lead := range leadTimes {
+		if lead > 0 && daysLeft <= lead {
+			return lead
+		}
+	}
+	return 0
+}
+
+// CheckCertificates scan the cert store and return the certificates that reached
+// a new lead time since the last check. certExpiringSoon events are emitted for them
+func (n *Notifier) CheckCertificates() ([]*ExpiringCert, error) {
+	files, err := os.ReadDir(n.Option.CertStore)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []*ExpiringCert{}
+	seen := map[string]bool{}
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".pem" {
+			continue
+		}
+		certName := strings.TrimSuffix(file.Name(), ".pem")
+		content, err := os.ReadFile(filepath.Join(n.Option.CertStore, file.Name()))
+		if err != nil {
+			continue
+		}
+		block, _ := pem.Decode(content)
+		if block == nil {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			continue
+		}
+
+		//Renewed certificates get a new serial and start over
+		key := certName + ":" + cert.SerialNumber.Text(16)
+		seen[key] = true
+
+		daysLeft := int(time.Until(cert.NotAfter).Hours() / 24)
+		lead := n.reachedLeadTime(daysLeft)
+		if lead == 0 {
+			continue
+		}
+
+		n.lock.Lock()
+		lastNotified, ok := n.notified[key]
+		if ok && lastNotified <= lead {
+			n.lock.Unlock()
+			continue
+		}
+		n.notified[key] = lead
+		n.lock.Unlock()
+
+		domains := cert.DNSNames
+		if len(domains) == 0 && cert.Subject.CommonName != "" {
+			domains = []string{cert.Subject.CommonName}
+		}
+		results = append(results, &ExpiringCert{
+			CertName: certName,
+			Domains:  domains,
+			NotAfter: cert.NotAfter,
+			DaysLeft: daysLeft,
+		})
+
+		if eventsystem.Publisher != nil {
+			eventsystem.Publisher.Emit(&events.CertExpiringSoonEvent{
+				CertName: certName,
+				Domains:  domains,
+				NotAfter: cert.NotAfter.Unix(),
+				DaysLeft: daysLeft,
+			})
+		}
+	}
+
+	//Remove state of certificates that no longer exist
+	n.lock.Lock()
+	for key := range n.notified {
+		if !seen[key] {
+			delete(n.notified, key)
+		}
+	}
+	n.lock.Unlock()
+
+	err = n.saveState()
+	return results, err
+}
+
+// CheckAndSendDigest check the certificates and send the email digest if there is anything to report
+func (n *Notifier) CheckAndSendDigest() error {
+	expiring, err := n.CheckCertificates()
+	if err != nil {
+		n.logf("Unable to check certificate expiry", err)
+		return err
+	}
+
+	n.lock.Lock()
+	renewals := n.pendingRenewals
+	n.pendingRenewals = []*RenewalRecord{}
+	n.lock.Unlock()
+
+	for _, cert := range expiring {
+		n.logf("Certificate "+cert.CertName+" expires on "+cert.NotAfter.Format("2006-01-02"), nil)
+	}
+
+	if !n.Config.EmailEnabled || (len(expiring) == 0 && len(renewals) == 0) {
+		return nil
+	}
+
+	err = n.sendDigest(expiring, renewals)
+	if err != nil {
+		n.logf("Unable to send certificate digest email", err)
+		//Keep the renewal records for the next digest
+		n.lock.Lock()
+		n.pendingRenewals = append(renewals, n.pendingRenewals...)
+		n.lock.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Get the digest recipients
+func (n *Notifier) getRecipients() []string {
+	if len(n.Config.Recipients) > 0 {
+		return n.Config.Recipients
+	}
+	if n.Option.GetAdminEmail != nil {
+		if admin := n.Option.GetAdminEmail(); admin != "" {
+			return []string{admin}
+		}
+	}
+	return []string{}
+}
+
+func (n *Notifier) sendDigest(expiring []*ExpiringCert, renewals []*RenewalRecord) error {
+	if n.Option.GetEmailSender == nil {
+		return errors.New("email sender not set")
+	}
+	sender := n.Option.GetEmailSender()
+	if sender == nil || sender.Hostname == "" {
+		return errors.New("SMTP is not configured")
+	}
+	recipients := n.getRecipients()
+	if len(recipients) == 0 {
+		return errors.New("no digest recipient set")
+	}
+
+	content := renderDigest(expiring, renewals)
+	for _, recipient := range recipients {
+		err := sender.SendEmail(recipient, "Certificate Status Digest | Zoraxy", content)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Render the digest email in HTML
+func renderDigest(expiring []*ExpiringCert, renewals []*RenewalRecord) string {
+	var sb strings.Builder
+	sb.WriteString("<h3>Zoraxy Certificate Status Digest</h3>")
+
+	if len(expiring) > 0 {
+		sb.WriteString("<p>The following certificates are expiring soon:</p><table border=\"1\" cellpadding=\"4\" style=\"border-collapse:collapse\">")
+		sb.WriteString("<tr><th>Certificate</th><th>Domains</th><th>Expiry Date</th><th>Days Left</th></tr>")
+		for _, cert := range expiring {
+			sb.WriteString("<tr><td>" + html.EscapeString(cert.CertName) + "</td><td>" + html.EscapeString(strings.Join(cert.Domains, ", ")) + "</td><td>" + cert.NotAfter.Format("2006-01-02 15:04 MST") + "</td><td>" + strconv.Itoa(cert.DaysLeft) + "</td></tr>")
+		}
+		sb.WriteString("</table>")
+	}
+
+	if len(renewals) > 0 {
+		sb.WriteString("<p>Certificate renewal results:</p><table border=\"1\" cellpadding=\"4\" style=\"border-collapse:collapse\">")
+		sb.WriteString("<tr><th>Certificate</th><th>Domains</th><th>Result</th><th>Time</th></tr>")
+		for _, record := range renewals {
+			result := "Renewed"
+			if !record.Success {
+				result = "Failed: " + html.EscapeString(record.Error)
+			}
+			sb.WriteString("<tr><td>" + html.EscapeString(record.CertName) + "</td><td>" + html.EscapeString(strings.Join(record.Domains, ", ")) + "</td><td>" + result + "</td><td>" + record.Time.Format("2006-01-02 15:04 MST") + "</td></tr>")
+		}
+		sb.WriteString("</table>")
+	}
+
+	sb.WriteString("<p>This email is sent by Zoraxy. Please do not reply to this email.</p>")
+	return sb.String()
+}
+
+// StartTicker start the periodic expiry check
+func (n *Notifier) StartTicker() {
+	n.Close()
+	ticker := time.NewTicker(time.Duration(n.Option.CheckInterval) * time.Second)
+	done := make(chan bool)
+	go func() {
+		defer ticker.Stop()
+		//Check once on start so expiries are not missed after a restart
+		n.CheckAndSendDigest()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				n.CheckAndSendDigest()
+			}
+		}
+	}()
+	n.tickerStop = done
+}
+
+// Close stop the expiry check ticker
+func (n *Notifier) Close() {
+	if n.tickerStop != nil {
+		n.tickerStop <- true
+		n.tickerStop = nil
+	}
+}
+
+func (n *Notifier) logf(message string, err error) {
+	if n.Option.Logger == nil {
+		return
+	}
+	n.Option.Logger.PrintAndLog("cert-notify", message, err)
+}
@@ -0,0 +1,141 @@
+package certnotify
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"imuslab.com/zoraxy/mod/plugins/zoraxy_plugin/events"
+)
+
+// Write a self-signed certificate that expires after the given duration
+func writeTestCert(t *testing.T, certStore string, name string, serial int64, validFor time.Duration) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(validFor),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	err = os.WriteFile(filepath.Join(certStore, name+".pem"), certPEM, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestNotifier(t *testing.T, certStore string) *Notifier {
+	t.Helper()
+	n, err := NewNotifier(&Options{
+		CertStore:  certStore,
+		ConfigFile: filepath.Join(t.TempDir(), "cert_notify.json"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestReachedLeadTime(t *testing.T) {
+	n := newTestNotifier(t, t.TempDir())
+	cases := map[int]int{
+		90: 0,
+		30: 30,
+		20: 30,
+		14: 14,
+		3:  7,
+		0:  1,
+	}
+	for daysLeft, expected := range cases {
+		if got := n.reachedLeadTime(daysLeft); got != expected {
+			t.Errorf("reachedLeadTime(%d) = %d, want %d", daysLeft, got, expected)
+		}
+	}
+}
+
+func TestCheckCertificatesNotifyOncePerLeadTime(t *testing.T) {
+	certStore := t.TempDir()
+	writeTestCert(t, certStore, "expiring.example.com", 1, 10*24*time.Hour)
+	writeTestCert(t, certStore, "valid.example.com", 2, 200*24*time.Hour)
+	n := newTestNotifier(t, certStore)
+
+	results, err := n.CheckCertificates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].CertName != "expiring.example.com" {
+		t.Fatalf("expected only expiring.example.com, got %d results", len(results))
+	}
+
+	//Same lead time should not be notified again
+	results, _ = n.CheckCertificates()
+	if len(results) != 0 {
+		t.Fatalf("expected no repeated notification, got %d results", len(results))
+	}
+
+	//Notification state should survive a restart
+	reloaded, err := NewNotifier(n.Option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, _ = reloaded.CheckCertificates()
+	if len(results) != 0 {
+		t.Fatalf("expected no notification after reload, got %d results", len(results))
+	}
+
+	//A renewed certificate (new serial) starts over
+	writeTestCert(t, certStore, "expiring.example.com", 3, 5*24*time.Hour)
+	results, _ = reloaded.CheckCertificates()
+	if len(results) != 1 {
+		t.Fatalf("expected renewed certificate to be notified, got %d results", len(results))
+	}
+}
+
+func TestNotifyCollectsRenewals(t *testing.T) {
+	n := newTestNotifier(t, t.TempDir())
+	n.Notify(events.Event{
+		Name:      events.EventCertRenewalFailed,
+		Timestamp: time.Now().Unix(),
+		Data: &events.CertRenewalFailedEvent{
+			CertName: "a.example.com",
+			Domains:  []string{"a.example.com"},
+			Error:    "rate limited",
+			Source:   "acme-autorenew",
+		},
+	})
+	n.Notify(events.Event{
+		Name:      events.EventCertRenewed,
+		Timestamp: time.Now().Unix(),
+		Data: &events.CertRenewedEvent{
+			CertName: "b.example.com",
+			Domains:  []string{"b.example.com"},
+			Source:   "local-ca",
+		},
+	})
+	if len(n.pendingRenewals) != 2 {
+		t.Fatalf("expected 2 pending renewals, got %d", len(n.pendingRenewals))
+	}
+
+	digest := renderDigest(nil, n.pendingRenewals)
+	if !strings.Contains(digest, "Failed: rate limited") || !strings.Contains(digest, "b.example.com") {
+		t.Fatal("digest does not contain the renewal results")
+	}
+}
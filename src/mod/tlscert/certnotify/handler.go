@@ -0,0 +1,98 @@
+package certnotify
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/mail"
+	"sort"
+	"strconv"
+	"strings"
+
+	"imuslab.com/zoraxy/mod/utils"
+)
+
+/*
+	handler.go
+
+	HTTP handlers for the certificate expiry notifier
+*/
+
+// HandleConfig get or set the notifier config
+func (n *Notifier) HandleConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		js, _ := json.Marshal(n.Config)
+		utils.SendJSONResponse(w, string(js))
+		return
+	} else if r.Method != http.MethodPost {
+		http.Error(w, "405 - Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	emailEnabled, err := utils.PostBool(r, "email")
+	if err == nil {
+		n.Config.EmailEnabled = emailEnabled
+	}
+
+	recipients, err := utils.PostPara(r, "recipients")
+	if err == nil {
+		//Comma seperated email addresses, empty to use the SMTP admin address
+		newRecipients := []string{}
+		for _, recipient := range strings.Split(recipients, ",") {
+			recipient = strings.TrimSpace(recipient)
+			if recipient == "" {
+				continue
+			}
+			if _, err := mail.ParseAddress(recipient); err != nil {
+				utils.SendErrorResponse(w, "invalid email address: "+recipient)
+				return
+			}
+			newRecipients = append(newRecipients, recipient)
+		}
+		n.Config.Recipients = newRecipients
+	}
+
+	leadTimes, err := utils.PostPara(r, "leadTimes")
+	if err == nil {
+		//Comma seperated days, e.g. 30,14,7,1
+		newLeadTimes := []int{}
+		for _, lead := range strings.Split(leadTimes, ",") {
+			lead = strings.TrimSpace(lead)
+			if lead == "" {
+				continue
+			}
+			days, err := strconv.Atoi(lead)
+			if err != nil || days <= 0 || days > 365 {
+				utils.SendErrorResponse(w, "invalid lead time: "+lead)
+				return
+			}
+			newLeadTimes = append(newLeadTimes, days)
+		}
+		if len(newLeadTimes) == 0 {
+			utils.SendErrorResponse(w, "at least one lead time is required")
+			return
+		}
+		sort.Sort(sort.Reverse(sort.IntSlice(newLeadTimes)))
+		n.Config.LeadTimes = newLeadTimes
+	}
+
+	err = n.saveState()
+	if err != nil {
+		utils.SendErrorResponse(w, "unable to save config: "+err.Error())
+		return
+	}
+	utils.SendOK(w)
+}
+
+// HandleCheckNow check the certificates and send the digest immediately
+func (n *Notifier) HandleCheckNow(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "405 - Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	err := n.CheckAndSendDigest()
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	utils.SendOK(w)
+}
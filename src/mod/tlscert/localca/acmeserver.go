@@ -0,0 +1,810 @@
+package localca
+
+/*
+	acmeserver.go
+
+	Minimal ACME (RFC 8555) directory backed by the local CA, so
+	other internal services can request certificates for managed
+	hostnames with their usual ACME client. Only the http-01
+	challenge is supported. Accounts are persisted to disk while
+	orders, authorizations and nonces are kept in memory.
+
+	Most ACME clients require the directory to be served over
+	HTTPS. X-Forwarded-Proto is honored so the directory can be
+	published through a proxy rule to the management interface.
+*/
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"imuslab.com/zoraxy/mod/utils"
+)
+
+const (
+	ACMEPathPrefix      = "/localca/acme" //Path where the ACME directory is mounted on the management interface
+	acmeAccountsFile    = "acme_accounts.json"
+	acmeOrderLifetime   = 24 * time.Hour
+	acmeNonceLifetime   = 1 * time.Hour
+	acmeMaxRequestBytes = 1 << 20
+)
+
+var acmeSignatureAlgorithms = []jose.SignatureAlgorithm{
+	jose.RS256, jose.RS384, jose.RS512,
+	jose.PS256, jose.PS384, jose.PS512,
+	jose.ES256, jose.ES384, jose.ES512,
+	jose.EdDSA,
+}
+
+type acmeIdentifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type acmeProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status"`
+}
+
+type acmeAccount struct {
+	ID      string           `json:"id"`
+	Key     *jose.JSONWebKey `json:"key"`
+	Contact []string         `json:"contact"`
+	Status  string           `json:"status"`
+}
+
+type acmeChallenge struct {
+	ID        string
+	Token     string
+	Status    string
+	Validated time.Time
+	Error     *acmeProblem
+}
+
+type acmeAuthz struct {
+	ID         string
+	AccountID  string
+	Identifier acmeIdentifier
+	Status     string
+	Expires    time.Time
+	Challenge  *acmeChallenge
+}
+
+type acmeOrder struct {
+	ID          string
+	AccountID   string
+	Status      string
+	Expires     time.Time
+	Identifiers []acmeIdentifier
+	AuthzIDs    []string
+	CertPEM     []byte
+}
+
+type acmeServer struct {
+	ca         *LocalCA
+	accounts   map[string]*acmeAccount
+	orders     map[string]*acmeOrder
+	authzs     map[string]*acmeAuthz
+	challenges map[string]*acmeAuthz //Challenge ID to its parent authorization
+	nonces     map[string]time.Time
+	lock       sync.Mutex
+
+	//http-01 validation target port and dialer, can be overwritten for testing
+	http01Port int
+	http01Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+func newAcmeServer(ca *LocalCA) *acmeServer {
+	s := acmeServer{
+		ca:         ca,
+		accounts:   map[string]*acmeAccount{},
+		orders:     map[string]*acmeOrder{},
+		authzs:     map[string]*acmeAuthz{},
+		challenges: map[string]*acmeAuthz{},
+		nonces:     map[string]time.Time{},
+		http01Port: 80,
+		http01Dial: (&net.Dialer{Timeout: 10 * time.Second}).DialContext,
+	}
+
+	//Load accounts from disk
+	accountFile := filepath.Join(ca.Option.ConfigFolder, acmeAccountsFile)
+	if utils.FileExists(accountFile) {
+		content, err := os.ReadFile(accountFile)
+		if err == nil {
+			accounts := []*acmeAccount{}
+			if err := json.Unmarshal(content, &accounts); err == nil {
+				for _, account := range accounts {
+					s.accounts[account.ID] = account
+				}
+			} else {
+				ca.logf("Unable to parse local CA ACME accounts", err)
+			}
+		}
+	}
+	return &s
+}
+
+// HandleACME serve the ACME API, mount this under ACMEPathPrefix without CSRF protection
+func (ca *LocalCA) HandleACME(w http.ResponseWriter, r *http.Request) {
+	if !ca.Config.EnableACME {
+		http.NotFound(w, r)
+		return
+	}
+	ca.acme.ServeHTTP(w, r)
+}
+
+func (s *acmeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, ACMEPathPrefix)
+	endpoint, id, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+
+	if endpoint == "directory" && r.Method == http.MethodGet {
+		s.handleDirectory(w, r)
+		return
+	}
+
+	if endpoint == "new-nonce" && (r.Method == http.MethodHead || r.Method == http.MethodGet) {
+		w.Header().Set("Replay-Nonce", s.newNonce())
+		w.Header().Set("Cache-Control", "no-store")
+		if r.Method == http.MethodGet {
+			w.WriteHeader(http.StatusNoContent)
+		}
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch endpoint {
+	case "new-account":
+		s.handleNewAccount(w, r)
+	case "account":
+		s.handleAccount(w, r, id)
+	case "new-order":
+		s.handleNewOrder(w, r)
+	case "order":
+		s.handleGetOrder(w, r, id)
+	case "authz":
+		s.handleGetAuthz(w, r, id)
+	case "chall":
+		s.handleChallenge(w, r, id)
+	case "finalize":
+		s.handleFinalize(w, r, id)
+	case "cert":
+		s.handleGetCertificate(w, r, id)
+	default:
+		s.writeProblem(w, http.StatusNotFound, "malformed", "unknown ACME endpoint")
+	}
+}
+
+/* URL and response helpers */
+
+func (s *acmeServer) baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + ACMEPathPrefix
+}
+
+func (s *acmeServer) writeJSON(w http.ResponseWriter, status int, location string, v any) {
+	w.Header().Set("Replay-Nonce", s.newNonce())
+	w.Header().Set("Content-Type", "application/json")
+	if location != "" {
+		w.Header().Set("Location", location)
+	}
+	w.WriteHeader(status)
+	js, _ := json.Marshal(v)
+	w.Write(js)
+}
+
+func (s *acmeServer) writeProblem(w http.ResponseWriter, status int, problemType string, detail string) {
+	w.Header().Set("Replay-Nonce", s.newNonce())
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	js, _ := json.Marshal(acmeProblem{
+		Type:   "urn:ietf:params:acme:error:" + problemType,
+		Detail: detail,
+		Status: status,
+	})
+	w.Write(js)
+}
+
+func randomID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+/* Nonce */
+
+func (s *acmeServer) newNonce() string {
+	nonce := randomID()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.nonces) > 10000 {
+		for n, issued := range s.nonces {
+			if time.Since(issued) > acmeNonceLifetime {
+				delete(s.nonces, n)
+			}
+		}
+	}
+	s.nonces[nonce] = time.Now()
+	return nonce
+}
+
+func (s *acmeServer) consumeNonce(nonce string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	issued, ok := s.nonces[nonce]
+	if !ok {
+		return false
+	}
+	delete(s.nonces, nonce)
+	return time.Since(issued) < acmeNonceLifetime
+}
+
+/* JWS verification */
+
+// Verify the JWS request body and return the payload and the requesting account.
+// If allowNewKey is set, requests signed with an embedded JWK (new-account) are accepted,
+// in that case the returned account is nil if the key is not registered
+func (s *acmeServer) verifyRequest(w http.ResponseWriter, r *http.Request, allowNewKey bool) ([]byte, *acmeAccount, *jose.JSONWebKey, bool) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, acmeMaxRequestBytes))
+	if err != nil {
+		s.writeProblem(w, http.StatusBadRequest, "malformed", "unable to read request body")
+		return nil, nil, nil, false
+	}
+
+	jws, err := jose.ParseSigned(string(body), acmeSignatureAlgorithms)
+	if err != nil || len(jws.Signatures) != 1 {
+		s.writeProblem(w, http.StatusBadRequest, "malformed", "invalid JWS")
+		return nil, nil, nil, false
+	}
+	header := jws.Signatures[0].Protected
+
+	if !s.consumeNonce(header.Nonce) {
+		s.writeProblem(w, http.StatusBadRequest, "badNonce", "invalid or expired nonce")
+		return nil, nil, nil, false
+	}
+
+	requestURL, _ := header.ExtraHeaders["url"].(string)
+	if requestURL != s.baseURL(r)+strings.TrimPrefix(r.URL.Path, ACMEPathPrefix) {
+		s.writeProblem(w, http.StatusUnauthorized, "unauthorized", "JWS url header does not match request URL")
+		return nil, nil, nil, false
+	}
+
+	var account *acmeAccount
+	var key *jose.JSONWebKey
+	if header.JSONWebKey != nil {
+		if !allowNewKey || header.KeyID != "" {
+			s.writeProblem(w, http.StatusBadRequest, "malformed", "jwk is only allowed for new-account requests")
+			return nil, nil, nil, false
+		}
+		key = header.JSONWebKey
+		if !key.Valid() || !key.IsPublic() {
+			s.writeProblem(w, http.StatusBadRequest, "badPublicKey", "invalid account key")
+			return nil, nil, nil, false
+		}
+		account = s.getAccountByKey(key)
+	} else {
+		accountID := strings.TrimPrefix(header.KeyID, s.baseURL(r)+"/account/")
+		s.lock.Lock()
+		account = s.accounts[accountID]
+		s.lock.Unlock()
+		if account == nil || header.KeyID == accountID {
+			s.writeProblem(w, http.StatusBadRequest, "accountDoesNotExist", "account not found")
+			return nil, nil, nil, false
+		}
+		key = account.Key
+	}
+
+	payload, err := jws.Verify(key)
+	if err != nil {
+		s.writeProblem(w, http.StatusUnauthorized, "unauthorized", "JWS signature verification failed")
+		return nil, nil, nil, false
+	}
+	return payload, account, key, true
+}
+
+/* Accounts */
+
+func keyThumbprint(key *jose.JSONWebKey) string {
+	thumbprint, err := key.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(thumbprint)
+}
+
+func (s *acmeServer) getAccountByKey(key *jose.JSONWebKey) *acmeAccount {
+	thumbprint := keyThumbprint(key)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, account := range s.accounts {
+		if keyThumbprint(account.Key) == thumbprint {
+			return account
+		}
+	}
+	return nil
+}
+
+func (s *acmeServer) saveAccounts() error {
+	s.lock.Lock()
+	accounts := []*acmeAccount{}
+	for _, account := range s.accounts {
+		accounts = append(accounts, account)
+	}
+	s.lock.Unlock()
+
+	js, err := json.MarshalIndent(accounts, "", " ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(s.ca.Option.ConfigFolder, acmeAccountsFile), js, 0640)
+}
+
+func (s *acmeServer) accountResponse(account *acmeAccount, r *http.Request) map[string]any {
+	return map[string]any{
+		"status":  account.Status,
+		"contact": account.Contact,
+		"orders":  s.baseURL(r) + "/account/" + account.ID + "/orders",
+	}
+}
+
+func (s *acmeServer) handleDirectory(w http.ResponseWriter, r *http.Request) {
+	base := s.baseURL(r)
+	w.Header().Set("Content-Type", "application/json")
+	js, _ := json.Marshal(map[string]any{
+		"newNonce":   base + "/new-nonce",
+		"newAccount": base + "/new-account",
+		"newOrder":   base + "/new-order",
+		"meta": map[string]any{
+			"externalAccountRequired": false,
+		},
+	})
+	w.Write(js)
+}
+
+func (s *acmeServer) handleNewAccount(w http.ResponseWriter, r *http.Request) {
+	payload, account, key, ok := s.verifyRequest(w, r, true)
+	if !ok {
+		return
+	}
+
+	request := struct {
+		Contact              []string `json:"contact"`
+		TermsOfServiceAgreed bool     `json:"termsOfServiceAgreed"`
+		OnlyReturnExisting   bool     `json:"onlyReturnExisting"`
+	}{}
+	if len(payload) > 0 {
+		if err := json.Unmarshal(payload, &request); err != nil {
+			s.writeProblem(w, http.StatusBadRequest, "malformed", "invalid new account request")
+			return
+		}
+	}
+
+	if account != nil {
+		//Key already registered, return the existing account
+		s.writeJSON(w, http.StatusOK, s.baseURL(r)+"/account/"+account.ID, s.accountResponse(account, r))
+		return
+	}
+
+	if request.OnlyReturnExisting {
+		s.writeProblem(w, http.StatusBadRequest, "accountDoesNotExist", "account not found")
+		return
+	}
+
+	account = &acmeAccount{
+		ID:      randomID(),
+		Key:     key,
+		Contact: request.Contact,
+		Status:  "valid",
+	}
+	s.lock.Lock()
+	s.accounts[account.ID] = account
+	s.lock.Unlock()
+	if err := s.saveAccounts(); err != nil {
+		s.ca.logf("Unable to save local CA ACME accounts", err)
+	}
+
+	s.writeJSON(w, http.StatusCreated, s.baseURL(r)+"/account/"+account.ID, s.accountResponse(account, r))
+}
+
+func (s *acmeServer) handleAccount(w http.ResponseWriter, r *http.Request, id string) {
+	_, account, _, ok := s.verifyRequest(w, r, false)
+	if !ok {
+		return
+	}
+	if account.ID != id {
+		s.writeProblem(w, http.StatusUnauthorized, "unauthorized", "account mismatch")
+		return
+	}
+	s.writeJSON(w, http.StatusOK, "", s.accountResponse(account, r))
+}
+
+/* Orders */
+
+// Remove expired orders and their authorizations, caller must hold the lock
+func (s *acmeServer) purgeExpired() {
+	for id, order := range s.orders {
+		if time.Now().After(order.Expires) {
+			for _, authzID := range order.AuthzIDs {
+				if authz, ok := s.authzs[authzID]; ok {
+					delete(s.challenges, authz.Challenge.ID)
+				}
+				delete(s.authzs, authzID)
+			}
+			delete(s.orders, id)
+		}
+	}
+}
+
+// Update the order status from its authorizations, caller must hold the lock
+func (s *acmeServer) refreshOrderStatus(order *acmeOrder) {
+	if order.Status != "pending" {
+		return
+	}
+	if time.Now().After(order.Expires) {
+		order.Status = "invalid"
+		return
+	}
+	allValid := true
+	for _, authzID := range order.AuthzIDs {
+		authz := s.authzs[authzID]
+		if authz == nil || authz.Status == "invalid" {
+			order.Status = "invalid"
+			return
+		}
+		if authz.Status != "valid" {
+			allValid = false
+		}
+	}
+	if allValid {
+		order.Status = "ready"
+	}
+}
+
+func (s *acmeServer) orderResponse(order *acmeOrder, r *http.Request) map[string]any {
+	base := s.baseURL(r)
+	authzURLs := []string{}
+	for _, authzID := range order.AuthzIDs {
+		authzURLs = append(authzURLs, base+"/authz/"+authzID)
+	}
+	resp := map[string]any{
+		"status":         order.Status,
+		"expires":        order.Expires.UTC().Format(time.RFC3339),
+		"identifiers":    order.Identifiers,
+		"authorizations": authzURLs,
+		"finalize":       base + "/finalize/" + order.ID,
+	}
+	if order.Status == "valid" {
+		resp["certificate"] = base + "/cert/" + order.ID
+	}
+	return resp
+}
+
+func (s *acmeServer) handleNewOrder(w http.ResponseWriter, r *http.Request) {
+	payload, account, _, ok := s.verifyRequest(w, r, false)
+	if !ok {
+		return
+	}
+
+	request := struct {
+		Identifiers []acmeIdentifier `json:"identifiers"`
+	}{}
+	if err := json.Unmarshal(payload, &request); err != nil || len(request.Identifiers) == 0 {
+		s.writeProblem(w, http.StatusBadRequest, "malformed", "invalid new order request")
+		return
+	}
+
+	for i, identifier := range request.Identifiers {
+		value := strings.ToLower(strings.TrimSpace(identifier.Value))
+		if identifier.Type != "dns" || strings.HasPrefix(value, "*") {
+			s.writeProblem(w, http.StatusBadRequest, "rejectedIdentifier", "only non-wildcard dns identifiers are supported")
+			return
+		}
+		if !s.ca.IsManagedHostname(value) {
+			s.writeProblem(w, http.StatusBadRequest, "rejectedIdentifier", value+" is not handled by the local CA")
+			return
+		}
+		request.Identifiers[i].Value = value
+	}
+
+	order := &acmeOrder{
+		ID:          randomID(),
+		AccountID:   account.ID,
+		Status:      "pending",
+		Expires:     time.Now().Add(acmeOrderLifetime),
+		Identifiers: request.Identifiers,
+		AuthzIDs:    []string{},
+	}
+
+	s.lock.Lock()
+	s.purgeExpired()
+	for _, identifier := range request.Identifiers {
+		authz := &acmeAuthz{
+			ID:         randomID(),
+			AccountID:  account.ID,
+			Identifier: identifier,
+			Status:     "pending",
+			Expires:    order.Expires,
+			Challenge: &acmeChallenge{
+				ID:     randomID(),
+				Token:  randomID(),
+				Status: "pending",
+			},
+		}
+		s.authzs[authz.ID] = authz
+		s.challenges[authz.Challenge.ID] = authz
+		order.AuthzIDs = append(order.AuthzIDs, authz.ID)
+	}
+	s.orders[order.ID] = order
+	resp := s.orderResponse(order, r)
+	s.lock.Unlock()
+
+	s.writeJSON(w, http.StatusCreated, s.baseURL(r)+"/order/"+order.ID, resp)
+}
+
+func (s *acmeServer) handleGetOrder(w http.ResponseWriter, r *http.Request, id string) {
+	_, account, _, ok := s.verifyRequest(w, r, false)
+	if !ok {
+		return
+	}
+	s.lock.Lock()
+	order := s.orders[id]
+	if order == nil || order.AccountID != account.ID {
+		s.lock.Unlock()
+		s.writeProblem(w, http.StatusNotFound, "malformed", "order not found")
+		return
+	}
+	s.refreshOrderStatus(order)
+	resp := s.orderResponse(order, r)
+	s.lock.Unlock()
+	s.writeJSON(w, http.StatusOK, "", resp)
+}
+
+/* Authorizations and challenges */
+
+func (s *acmeServer) challengeResponse(challenge *acmeChallenge, r *http.Request) map[string]any {
+	resp := map[string]any{
+		"type":   "http-01",
+		"url":    s.baseURL(r) + "/chall/" + challenge.ID,
+		"token":  challenge.Token,
+		"status": challenge.Status,
+	}
+	if !challenge.Validated.IsZero() {
+		resp["validated"] = challenge.Validated.UTC().Format(time.RFC3339)
+	}
+	if challenge.Error != nil {
+		resp["error"] = challenge.Error
+	}
+	return resp
+}
+
+func (s *acmeServer) authzResponse(authz *acmeAuthz, r *http.Request) map[string]any {
+	return map[string]any{
+		"status":     authz.Status,
+		"expires":    authz.Expires.UTC().Format(time.RFC3339),
+		"identifier": authz.Identifier,
+		"challenges": []any{s.challengeResponse(authz.Challenge, r)},
+	}
+}
+
+func (s *acmeServer) handleGetAuthz(w http.ResponseWriter, r *http.Request, id string) {
+	_, account, _, ok := s.verifyRequest(w, r, false)
+	if !ok {
+		return
+	}
+	s.lock.Lock()
+	authz := s.authzs[id]
+	if authz == nil || authz.AccountID != account.ID {
+		s.lock.Unlock()
+		s.writeProblem(w, http.StatusNotFound, "malformed", "authorization not found")
+		return
+	}
+	resp := s.authzResponse(authz, r)
+	s.lock.Unlock()
+	s.writeJSON(w, http.StatusOK, "", resp)
+}
+
+func (s *acmeServer) handleChallenge(w http.ResponseWriter, r *http.Request, id string) {
+	_, account, key, ok := s.verifyRequest(w, r, false)
+	if !ok {
+		return
+	}
+	s.lock.Lock()
+	authz := s.challenges[id]
+	if authz == nil || authz.AccountID != account.ID {
+		s.lock.Unlock()
+		s.writeProblem(w, http.StatusNotFound, "malformed", "challenge not found")
+		return
+	}
+	challenge := authz.Challenge
+	shouldValidate := challenge.Status == "pending"
+	if shouldValidate {
+		challenge.Status = "processing"
+	}
+	domain := authz.Identifier.Value
+	token := challenge.Token
+	s.lock.Unlock()
+
+	if shouldValidate {
+		err := s.validateHTTP01(r.Context(), domain, token, token+"."+keyThumbprint(key))
+		s.lock.Lock()
+		if err != nil {
+			challenge.Status = "invalid"
+			challenge.Error = &acmeProblem{
+				Type:   "urn:ietf:params:acme:error:unauthorized",
+				Detail: err.Error(),
+				Status: http.StatusForbidden,
+			}
+			authz.Status = "invalid"
+			s.ca.logf("Local CA ACME challenge failed for "+domain, err)
+		} else {
+			challenge.Status = "valid"
+			challenge.Validated = time.Now()
+			authz.Status = "valid"
+		}
+		s.lock.Unlock()
+	}
+
+	s.lock.Lock()
+	resp := s.challengeResponse(challenge, r)
+	s.lock.Unlock()
+	w.Header().Set("Link", "<"+s.baseURL(r)+"/authz/"+authz.ID+">;rel=\"up\"")
+	s.writeJSON(w, http.StatusOK, "", resp)
+}
+
+// Fetch the http-01 key authorization from the domain
+func (s *acmeServer) validateHTTP01(ctx context.Context, domain string, token string, keyAuthorization string) error {
+	client := &http.Client{
+		Timeout: 15 * time.Second,
+		Transport: &http.Transport{
+			DialContext: s.http01Dial,
+		},
+	}
+
+	url := "http://" + net.JoinHostPort(domain, strconv.Itoa(s.http01Port)) + "/.well-known/acme-challenge/" + token
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("unexpected status code " + strconv.Itoa(resp.StatusCode) + " from " + url)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(body)) != keyAuthorization {
+		return errors.New("key authorization mismatch from " + url)
+	}
+	return nil
+}
+
+/* Finalize and certificate download */
+
+func (s *acmeServer) handleFinalize(w http.ResponseWriter, r *http.Request, id string) {
+	payload, account, _, ok := s.verifyRequest(w, r, false)
+	if !ok {
+		return
+	}
+
+	request := struct {
+		CSR string `json:"csr"`
+	}{}
+	if err := json.Unmarshal(payload, &request); err != nil {
+		s.writeProblem(w, http.StatusBadRequest, "malformed", "invalid finalize request")
+		return
+	}
+	csrDER, err := base64.RawURLEncoding.DecodeString(request.CSR)
+	if err != nil {
+		s.writeProblem(w, http.StatusBadRequest, "badCSR", "invalid CSR encoding")
+		return
+	}
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		s.writeProblem(w, http.StatusBadRequest, "badCSR", "invalid CSR: "+err.Error())
+		return
+	}
+
+	s.lock.Lock()
+	order := s.orders[id]
+	if order == nil || order.AccountID != account.ID {
+		s.lock.Unlock()
+		s.writeProblem(w, http.StatusNotFound, "malformed", "order not found")
+		return
+	}
+	s.refreshOrderStatus(order)
+	if order.Status != "ready" {
+		s.lock.Unlock()
+		s.writeProblem(w, http.StatusForbidden, "orderNotReady", "order is not ready for finalization")
+		return
+	}
+	order.Status = "processing"
+	identifiers := []string{}
+	for _, identifier := range order.Identifiers {
+		identifiers = append(identifiers, identifier.Value)
+	}
+	s.lock.Unlock()
+
+	//The CSR must request exactly the authorized identifiers
+	requested := map[string]bool{}
+	for _, name := range csr.DNSNames {
+		requested[strings.ToLower(name)] = true
+	}
+	if csr.Subject.CommonName != "" {
+		requested[strings.ToLower(csr.Subject.CommonName)] = true
+	}
+	csrMatches := len(requested) == len(identifiers) && len(csr.IPAddresses) == 0
+	for _, identifier := range identifiers {
+		if !requested[identifier] {
+			csrMatches = false
+		}
+	}
+
+	var chain []byte
+	if csrMatches {
+		chain, err = s.ca.SignCSR(csr, identifiers)
+	} else {
+		err = errors.New("CSR identifiers do not match the order")
+	}
+
+	s.lock.Lock()
+	if err != nil {
+		order.Status = "ready"
+		s.lock.Unlock()
+		s.writeProblem(w, http.StatusBadRequest, "badCSR", err.Error())
+		return
+	}
+	order.Status = "valid"
+	order.CertPEM = chain
+	resp := s.orderResponse(order, r)
+	s.lock.Unlock()
+
+	s.ca.logf("Issued local certificate via ACME for "+strings.Join(identifiers, ", "), nil)
+	s.writeJSON(w, http.StatusOK, s.baseURL(r)+"/order/"+order.ID, resp)
+}
+
+func (s *acmeServer) handleGetCertificate(w http.ResponseWriter, r *http.Request, id string) {
+	_, account, _, ok := s.verifyRequest(w, r, false)
+	if !ok {
+		return
+	}
+	s.lock.Lock()
+	order := s.orders[id]
+	if order == nil || order.AccountID != account.ID || order.Status != "valid" {
+		s.lock.Unlock()
+		s.writeProblem(w, http.StatusNotFound, "malformed", "certificate not found")
+		return
+	}
+	chain := order.CertPEM
+	s.lock.Unlock()
+
+	w.Header().Set("Replay-Nonce", s.newNonce())
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	w.Write(chain)
+}
@@ -0,0 +1,193 @@
+package localca
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"imuslab.com/zoraxy/mod/utils"
+)
+
+/*
+	handler.go
+
+	HTTP handlers for managing the local CA
+*/
+
+type caInfo struct {
+	Subject   string
+	Issuer    string
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+// HandleGetStatus return the local CA config and certificate information
+func (ca *LocalCA) HandleGetStatus(w http.ResponseWriter, r *http.Request) {
+	root := ca.GetRootCertificate()
+	intermediate := ca.GetIntermediateCertificate()
+
+	status := struct {
+		Config       *Config
+		Root         *caInfo
+		Intermediate *caInfo
+		ACMEPath     string
+	}{
+		Config:   ca.Config,
+		ACMEPath: ACMEPathPrefix + "/directory",
+	}
+	if root != nil {
+		status.Root = &caInfo{root.Subject.CommonName, root.Issuer.CommonName, root.NotBefore, root.NotAfter}
+	}
+	if intermediate != nil {
+		status.Intermediate = &caInfo{intermediate.Subject.CommonName, intermediate.Issuer.CommonName, intermediate.NotBefore, intermediate.NotAfter}
+	}
+
+	js, _ := json.Marshal(status)
+	utils.SendJSONResponse(w, string(js))
+}
+
+// HandleSetConfig update the local CA settings
+func (ca *LocalCA) HandleSetConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	enabled, err := utils.PostBool(r, "enabled")
+	if err == nil {
+		ca.Config.Enabled = enabled
+	}
+
+	enableACME, err := utils.PostBool(r, "acme")
+	if err == nil {
+		ca.Config.EnableACME = enableACME
+	}
+
+	suffixes, err := utils.PostPara(r, "suffixes")
+	if err == nil {
+		//Comma seperated list of suffixes, e.g. .lan,.internal
+		newSuffixes := []string{}
+		for _, suffix := range strings.Split(suffixes, ",") {
+			suffix = strings.ToLower(strings.TrimSpace(suffix))
+			if suffix == "" {
+				continue
+			}
+			if !strings.HasPrefix(suffix, ".") {
+				suffix = "." + suffix
+			}
+			newSuffixes = append(newSuffixes, suffix)
+		}
+		ca.Config.AutoIssueSuffixes = newSuffixes
+	}
+
+	validity, err := utils.PostInt(r, "validity")
+	if err == nil {
+		if validity <= 0 || validity > 825 {
+			utils.SendErrorResponse(w, "validity must be between 1 and 825 days")
+			return
+		}
+		ca.Config.LeafValidityDays = validity
+	}
+
+	renewBefore, err := utils.PostInt(r, "renewBefore")
+	if err == nil {
+		if renewBefore < 0 || renewBefore >= ca.Config.LeafValidityDays {
+			utils.SendErrorResponse(w, "renew before days must be smaller than the certificate validity")
+			return
+		}
+		ca.Config.RenewBeforeDays = renewBefore
+	}
+
+	err = ca.SaveConfig()
+	if err != nil {
+		utils.SendErrorResponse(w, "unable to save config: "+err.Error())
+		return
+	}
+	utils.SendOK(w)
+}
+
+// HandleDownloadRoot serve the root certificate for distribution to clients
+func (ca *LocalCA) HandleDownloadRoot(w http.ResponseWriter, r *http.Request) {
+	format, _ := utils.GetPara(r, "format")
+	if format == "der" {
+		w.Header().Set("Content-Disposition", "attachment; filename=\"zoraxy_local_root_ca.crt\"")
+		w.Header().Set("Content-Type", "application/x-x509-ca-cert")
+		w.Write(ca.GetRootCertificate().Raw)
+		return
+	}
+	w.Header().Set("Content-Disposition", "attachment; filename=\"zoraxy_local_root_ca.pem\"")
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Write(ca.GetRootCertificatePEM())
+}
+
+// HandleRegenerateCA generate a new root and intermediate. All managed certificates are re-issued
+func (ca *LocalCA) HandleRegenerateCA(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	err := ca.GenerateCA()
+	if err != nil {
+		utils.SendErrorResponse(w, "unable to generate CA: "+err.Error())
+		return
+	}
+	go ca.CheckAndRenewCertificates()
+	utils.SendOK(w)
+}
+
+// HandleImportCA import a root (and optionally intermediate) certificate and key in PEM format
+func (ca *LocalCA) HandleImportCA(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rootCert, err := utils.PostPara(r, "rootCert")
+	if err != nil {
+		utils.SendErrorResponse(w, "root certificate not given")
+		return
+	}
+	rootKey, _ := utils.PostPara(r, "rootKey")
+	interCert, _ := utils.PostPara(r, "intermediateCert")
+	interKey, _ := utils.PostPara(r, "intermediateKey")
+
+	err = ca.ImportCA([]byte(rootCert), []byte(rootKey), []byte(interCert), []byte(interKey))
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	go ca.CheckAndRenewCertificates()
+	utils.SendOK(w)
+}
+
+// HandleIssueCertificate issue a certificate for the given hostnames into the cert store
+func (ca *LocalCA) HandleIssueCertificate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	domains, err := utils.PostPara(r, "domains")
+	if err != nil {
+		utils.SendErrorResponse(w, "domains not given")
+		return
+	}
+
+	hostnames := []string{}
+	for _, domain := range strings.Split(domains, ",") {
+		domain = strings.TrimSpace(domain)
+		if domain != "" {
+			hostnames = append(hostnames, domain)
+		}
+	}
+
+	certName, err := ca.IssueCertificate(hostnames)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	js, _ := json.Marshal(certName)
+	utils.SendJSONResponse(w, string(js))
+}
@@ -0,0 +1,331 @@
+package localca
+
+/*
+	issue.go
+
+	Issue, renew and sign leaf certificates with the
+	local CA intermediate
+*/
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"imuslab.com/zoraxy/mod/eventsystem"
+	"imuslab.com/zoraxy/mod/plugins/zoraxy_plugin/events"
+	"imuslab.com/zoraxy/mod/utils"
+)
+
+// Convert a domain into the cert store filename (without extension)
+// wildcard domains are stored with a leading underscore, e.g. _.example.lan
+func domainToCertName(domain string) string {
+	domain = strings.TrimSpace(domain)
+	if strings.HasPrefix(domain, "*") {
+		domain = "_" + strings.TrimPrefix(domain, "*")
+	}
+	return domain
+}
+
+// Check and normalize the hostnames for a certificate request
+func normalizeHostnames(hostnames []string) ([]string, error) {
+	results := []string{}
+	seen := map[string]bool{}
+	for _, hostname := range hostnames {
+		hostname = strings.ToLower(strings.TrimSpace(hostname))
+		if hostname == "" || seen[hostname] {
+			continue
+		}
+		if strings.ContainsAny(hostname, "/\\ ") || strings.Contains(hostname, "..") {
+			return nil, errors.New("invalid hostname: " + hostname)
+		}
+		seen[hostname] = true
+		results = append(results, hostname)
+	}
+	if len(results) == 0 {
+		return nil, errors.New("no hostname given")
+	}
+	return results, nil
+}
+
+// Sign a leaf certificate for the given public key and hostnames using the intermediate
+func (ca *LocalCA) signLeaf(publicKey any, hostnames []string, validity time.Duration) ([]byte, error) {
+	ca.caLock.RLock()
+	defer ca.caLock.RUnlock()
+	if ca.intermediateCert == nil || ca.intermediateKey == nil {
+		return nil, errors.New("local CA not initialized")
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: newSerialNumber(),
+		Subject: pkix.Name{
+			CommonName: hostnames[0],
+		},
+		NotBefore:             time.Now().Add(-5 * time.Minute),
+		NotAfter:              time.Now().Add(validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	if template.NotAfter.After(ca.intermediateCert.NotAfter) {
+		template.NotAfter = ca.intermediateCert.NotAfter
+	}
+
+	for _, hostname := range hostnames {
+		if ip := net.ParseIP(hostname); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, hostname)
+		}
+	}
+
+	leafDER, err := x509.CreateCertificate(rand.Reader, template, ca.intermediateCert, publicKey, ca.intermediateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	//Return the full chain (leaf + intermediate) in PEM format
+	leafCert, err := x509.ParseCertificate(leafDER)
+	if err != nil {
+		return nil, err
+	}
+	chain := encodeCertificatePEM(leafCert)
+	chain = append(chain, encodeCertificatePEM(ca.intermediateCert)...)
+	return chain, nil
+}
+
+// Get the leaf certificate validity from config
+func (ca *LocalCA) leafValidity() time.Duration {
+	days := ca.Config.LeafValidityDays
+	if days <= 0 {
+		days = 90
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// SignCSR sign a certificate signing request for the given hostnames, return the PEM chain
+func (ca *LocalCA) SignCSR(csr *x509.CertificateRequest, hostnames []string) ([]byte, error) {
+	if err := csr.CheckSignature(); err != nil {
+		return nil, errors.New("invalid CSR signature: " + err.Error())
+	}
+	hostnames, err := normalizeHostnames(hostnames)
+	if err != nil {
+		return nil, err
+	}
+	return ca.signLeaf(csr.PublicKey, hostnames, ca.leafValidity())
+}
+
+// IssueCertificate issue a certificate for the given hostnames and store it in
+// the cert store using the first hostname as the certificate name.
+// Return the name of the certificate
+func (ca *LocalCA) IssueCertificate(hostnames []string) (string, error) {
+	if ca.Option.TlsManager == nil {
+		return "", errors.New("certificate store not available")
+	}
+
+	hostnames, err := normalizeHostnames(hostnames)
+	if err != nil {
+		return "", err
+	}
+	return ca.issueCertificateAs(domainToCertName(hostnames[0]), hostnames)
+}
+
+// Issue a certificate for the normalized hostnames and store it under the given cert name
+func (ca *LocalCA) issueCertificateAs(certName string, hostnames []string) (string, error) {
+	privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", err
+	}
+
+	chain, err := ca.signLeaf(&privKey.PublicKey, hostnames, ca.leafValidity())
+	if err != nil {
+		return "", err
+	}
+
+	keyPEM, err := encodePrivateKeyPEM(privKey)
+	if err != nil {
+		return "", err
+	}
+
+	certStore := ca.Option.TlsManager.CertStore
+	err = os.WriteFile(filepath.Join(certStore, certName+".pem"), chain, 0644)
+	if err != nil {
+		return "", err
+	}
+	err = os.WriteFile(filepath.Join(certStore, certName+".key"), keyPEM, 0600)
+	if err != nil {
+		return "", err
+	}
+
+	ca.addManagedCert(certName)
+	ca.logf("Issued local certificate for "+strings.Join(hostnames, ", "), nil)
+
+	err = ca.Option.TlsManager.UpdateLoadedCertList()
+	if err != nil {
+		return certName, err
+	}
+	return certName, nil
+}
+
+// AutoIssueForHostnames issue a certificate for the hostnames handled by the local CA
+// if the local CA is enabled and there are no certificates covering them yet.
+// This is called when a new proxy rule is created
+func (ca *LocalCA) AutoIssueForHostnames(hostnames []string) error {
+	if !ca.Config.Enabled || ca.Option.TlsManager == nil {
+		return nil
+	}
+
+	missing := []string{}
+	for _, hostname := range hostnames {
+		hostname = strings.TrimSpace(hostname)
+		if !ca.IsManagedHostname(hostname) {
+			continue
+		}
+		if ca.Option.TlsManager.CertMatchExists(hostname) {
+			continue
+		}
+		missing = append(missing, hostname)
+	}
+
+	if len(missing) == 0 {
+		return nil
+	}
+
+	_, err := ca.IssueCertificate(missing)
+	return err
+}
+
+// Add a certificate to the managed list so it will be auto renewed
+func (ca *LocalCA) addManagedCert(certName string) {
+	ca.configLock.Lock()
+	found := false
+	for _, name := range ca.Config.ManagedCerts {
+		if name == certName {
+			found = true
+			break
+		}
+	}
+	if !found {
+		ca.Config.ManagedCerts = append(ca.Config.ManagedCerts, certName)
+	}
+	ca.configLock.Unlock()
+
+	if !found {
+		if err := ca.SaveConfig(); err != nil {
+			ca.logf("Unable to save local CA config", err)
+		}
+	}
+}
+
+// CheckAndRenewCertificates renew the managed certificates that are going to expire
+// or no longer signed by the current intermediate. Removed certificates are dropped
+// from the managed list
+func (ca *LocalCA) CheckAndRenewCertificates() {
+	if ca.Option.TlsManager == nil {
+		return
+	}
+
+	ca.configLock.Lock()
+	managed := append([]string{}, ca.Config.ManagedCerts...)
+	ca.configLock.Unlock()
+
+	renewBefore := time.Duration(ca.Config.RenewBeforeDays) * 24 * time.Hour
+	intermediate := ca.GetIntermediateCertificate()
+	stillManaged := []string{}
+	for _, certName := range managed {
+		certFile := filepath.Join(ca.Option.TlsManager.CertStore, certName+".pem")
+		if !utils.FileExists(certFile) {
+			//Certificate removed by user
+			continue
+		}
+		stillManaged = append(stillManaged, certName)
+
+		content, err := os.ReadFile(certFile)
+		if err != nil {
+			ca.logf("Unable to read managed certificate "+certName, err)
+			continue
+		}
+		leaf, err := parseCertificatePEM(content)
+		if err != nil {
+			ca.logf("Unable to parse managed certificate "+certName, err)
+			continue
+		}
+
+		needRenew := time.Until(leaf.NotAfter) < renewBefore
+		if intermediate != nil && leaf.CheckSignatureFrom(intermediate) != nil {
+			//CA has been regenerated or imported
+			needRenew = true
+		}
+		if !needRenew {
+			continue
+		}
+
+		hostnames := append([]string{}, leaf.DNSNames...)
+		for _, ip := range leaf.IPAddresses {
+			hostnames = append(hostnames, ip.String())
+		}
+		if len(hostnames) == 0 {
+			hostnames = []string{leaf.Subject.CommonName}
+		}
+		hostnames, err = normalizeHostnames(hostnames)
+		if err == nil {
+			_, err = ca.issueCertificateAs(certName, hostnames)
+		}
+		if err != nil {
+			ca.logf("Failed to renew local certificate "+certName, err)
+			if eventsystem.Publisher != nil {
+				eventsystem.Publisher.Emit(&events.CertRenewalFailedEvent{
+					CertName: certName,
+					Domains:  hostnames,
+					Error:    err.Error(),
+					Source:   "local-ca",
+				})
+			}
+		} else {
+			ca.logf("Renewed local certificate "+certName, nil)
+			if eventsystem.Publisher != nil {
+				eventsystem.Publisher.Emit(&events.CertRenewedEvent{
+					CertName: certName,
+					Domains:  hostnames,
+					NotAfter: time.Now().Add(ca.leafValidity()).Unix(),
+					Source:   "local-ca",
+				})
+			}
+		}
+	}
+
+	if len(stillManaged) != len(managed) {
+		ca.configLock.Lock()
+		ca.Config.ManagedCerts = stillManaged
+		ca.configLock.Unlock()
+		ca.SaveConfig()
+	}
+}
+
+// StartAutoRenewTicker start the ticker that check and renew managed certificates
+func (ca *LocalCA) StartAutoRenewTicker() {
+	ca.Close()
+
+	ticker := time.NewTicker(time.Duration(ca.Option.RenewCheckInterval) * time.Second)
+	done := make(chan bool)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				ca.CheckAndRenewCertificates()
+			}
+		}
+	}()
+	ca.tickerStop = done
+}
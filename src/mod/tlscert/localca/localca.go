@@ -0,0 +1,476 @@
+package localca
+
+/*
+	localca.go
+
+	Local private certificate authority for issuing certificates
+	to internal hostnames (e.g. *.lan, *.internal) that cannot
+	be validated by public ACME CAs. The CA is made of a root
+	and an intermediate. Leaf certificates are signed by the
+	intermediate and written into the tlscert cert store.
+*/
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"imuslab.com/zoraxy/mod/info/logger"
+	"imuslab.com/zoraxy/mod/tlscert"
+	"imuslab.com/zoraxy/mod/utils"
+)
+
+const (
+	rootCertFilename         = "root.pem"
+	rootKeyFilename          = "root.key"
+	intermediateCertFilename = "intermediate.pem"
+	intermediateKeyFilename  = "intermediate.key"
+	configFilename           = "config.json"
+
+	rootValidity         = 10 * 365 * 24 * time.Hour
+	intermediateValidity = 5 * 365 * 24 * time.Hour
+)
+
+type Config struct {
+	Enabled           bool     //Automatically issue certificates for matching hostnames on proxy rule creation
+	AutoIssueSuffixes []string //Hostname suffixes handled by the local CA, e.g. .lan, .internal
+	LeafValidityDays  int      //Validity of issued leaf certificates (days)
+	RenewBeforeDays   int      //Renew leaf certificates this many days before expiry
+	EnableACME        bool     //Expose a minimal ACME directory for other internal services
+	ManagedCerts      []string //Certificate names (in cert store) issued and renewed by the local CA
+}
+
+type Options struct {
+	ConfigFolder       string           //Folder to store the CA keys and config, e.g. ./conf/localca
+	TlsManager         *tlscert.Manager //Cert store where issued certificates are written to
+	Logger             *logger.Logger   //System wide logger
+	RenewCheckInterval int64            //Renew check interval (seconds), set to 0 for default (12 hours)
+}
+
+type LocalCA struct {
+	Config *Config
+	Option *Options
+
+	rootCert         *x509.Certificate
+	intermediateCert *x509.Certificate
+	intermediateKey  crypto.Signer
+	caLock           sync.RWMutex
+	configLock       sync.Mutex
+	tickerStop       chan bool
+	acme             *acmeServer
+}
+
+// NewLocalCA load the local CA from the config folder, a new root and intermediate
+// will be generated if none exists
+func NewLocalCA(option *Options) (*LocalCA, error) {
+	if option.ConfigFolder == "" {
+		return nil, errors.New("config folder not set")
+	}
+	if option.RenewCheckInterval <= 0 {
+		option.RenewCheckInterval = 43200 //12 hours
+	}
+
+	err := os.MkdirAll(option.ConfigFolder, 0775)
+	if err != nil {
+		return nil, err
+	}
+
+	ca := LocalCA{
+		Config: &Config{
+			Enabled:           false,
+			AutoIssueSuffixes: []string{".lan", ".internal"},
+			LeafValidityDays:  90,
+			RenewBeforeDays:   30,
+			ManagedCerts:      []string{},
+		},
+		Option: option,
+	}
+
+	//Load config if exists
+	configFile := filepath.Join(option.ConfigFolder, configFilename)
+	if utils.FileExists(configFile) {
+		content, err := os.ReadFile(configFile)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(content, ca.Config)
+		if err != nil {
+			return nil, errors.New("malformed local CA config: " + err.Error())
+		}
+	} else {
+		err = ca.SaveConfig()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	//Load or generate the CA certificates
+	if utils.FileExists(filepath.Join(option.ConfigFolder, rootCertFilename)) {
+		err = ca.loadCA()
+	} else {
+		err = ca.GenerateCA()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ca.acme = newAcmeServer(&ca)
+	ca.StartAutoRenewTicker()
+	return &ca, nil
+}
+
+// SaveConfig write the current config to disk
+func (ca *LocalCA) SaveConfig() error {
+	ca.configLock.Lock()
+	defer ca.configLock.Unlock()
+	js, err := json.MarshalIndent(ca.Config, "", " ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(ca.Option.ConfigFolder, configFilename), js, 0640)
+}
+
+// GenerateCA create a new root and intermediate, replacing the existing one
+func (ca *LocalCA) GenerateCA() error {
+	rootKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	rootTemplate := &x509.Certificate{
+		SerialNumber: newSerialNumber(),
+		Subject: pkix.Name{
+			CommonName:         "Zoraxy Local Root CA",
+			Organization:       []string{"Zoraxy"},
+			OrganizationalUnit: []string{"Local CA"},
+		},
+		NotBefore:             time.Now().Add(-1 * time.Hour),
+		NotAfter:              time.Now().Add(rootValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLen:            1,
+	}
+
+	rootDER, err := x509.CreateCertificate(rand.Reader, rootTemplate, rootTemplate, &rootKey.PublicKey, rootKey)
+	if err != nil {
+		return err
+	}
+	rootCert, err := x509.ParseCertificate(rootDER)
+	if err != nil {
+		return err
+	}
+
+	return ca.installCA(rootCert, rootKey, nil, nil)
+}
+
+// ImportCA import an existing root (and optionally intermediate) certificate and key in PEM format.
+// If the intermediate is not provided, a new one will be generated under the imported root
+func (ca *LocalCA) ImportCA(rootCertPEM []byte, rootKeyPEM []byte, intermediateCertPEM []byte, intermediateKeyPEM []byte) error {
+	rootCert, err := parseCertificatePEM(rootCertPEM)
+	if err != nil {
+		return errors.New("invalid root certificate: " + err.Error())
+	}
+	if !rootCert.IsCA {
+		return errors.New("root certificate is not a CA certificate")
+	}
+
+	var rootKey crypto.Signer
+	if len(rootKeyPEM) > 0 {
+		rootKey, err = parsePrivateKeyPEM(rootKeyPEM)
+		if err != nil {
+			return errors.New("invalid root private key: " + err.Error())
+		}
+		if !publicKeyMatches(rootCert, rootKey) {
+			return errors.New("root private key does not match the root certificate")
+		}
+	}
+
+	var interCert *x509.Certificate
+	var interKey crypto.Signer
+	if len(intermediateCertPEM) > 0 {
+		interCert, err = parseCertificatePEM(intermediateCertPEM)
+		if err != nil {
+			return errors.New("invalid intermediate certificate: " + err.Error())
+		}
+		interKey, err = parsePrivateKeyPEM(intermediateKeyPEM)
+		if err != nil {
+			return errors.New("invalid intermediate private key: " + err.Error())
+		}
+		if !publicKeyMatches(interCert, interKey) {
+			return errors.New("intermediate private key does not match the intermediate certificate")
+		}
+		if err := interCert.CheckSignatureFrom(rootCert); err != nil {
+			return errors.New("intermediate certificate is not signed by the root: " + err.Error())
+		}
+	} else if rootKey == nil {
+		return errors.New("root private key is required to generate a new intermediate")
+	}
+
+	return ca.installCA(rootCert, rootKey, interCert, interKey)
+}
+
+// Install the given root and intermediate as the active CA and write them to disk.
+// A new intermediate is generated if interCert is nil
+func (ca *LocalCA) installCA(rootCert *x509.Certificate, rootKey crypto.Signer, interCert *x509.Certificate, interKey crypto.Signer) error {
+	if interCert == nil {
+		var err error
+		interKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return err
+		}
+
+		interTemplate := &x509.Certificate{
+			SerialNumber: newSerialNumber(),
+			Subject: pkix.Name{
+				CommonName:         "Zoraxy Local Intermediate CA",
+				Organization:       []string{"Zoraxy"},
+				OrganizationalUnit: []string{"Local CA"},
+			},
+			NotBefore:             time.Now().Add(-1 * time.Hour),
+			NotAfter:              time.Now().Add(intermediateValidity),
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+			MaxPathLenZero:        true,
+		}
+		if interTemplate.NotAfter.After(rootCert.NotAfter) {
+			interTemplate.NotAfter = rootCert.NotAfter
+		}
+
+		interDER, err := x509.CreateCertificate(rand.Reader, interTemplate, rootCert, interKey.Public(), rootKey)
+		if err != nil {
+			return err
+		}
+		interCert, err = x509.ParseCertificate(interDER)
+		if err != nil {
+			return err
+		}
+	}
+
+	//Write everything to disk
+	folder := ca.Option.ConfigFolder
+	err := os.WriteFile(filepath.Join(folder, rootCertFilename), encodeCertificatePEM(rootCert), 0644)
+	if err != nil {
+		return err
+	}
+	if rootKey != nil {
+		rootKeyPEM, err := encodePrivateKeyPEM(rootKey)
+		if err != nil {
+			return err
+		}
+		err = os.WriteFile(filepath.Join(folder, rootKeyFilename), rootKeyPEM, 0600)
+		if err != nil {
+			return err
+		}
+	} else {
+		//Root key not provided (e.g. imported intermediate only). Remove the old key
+		os.Remove(filepath.Join(folder, rootKeyFilename))
+	}
+
+	err = os.WriteFile(filepath.Join(folder, intermediateCertFilename), encodeCertificatePEM(interCert), 0644)
+	if err != nil {
+		return err
+	}
+	interKeyPEM, err := encodePrivateKeyPEM(interKey)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(filepath.Join(folder, intermediateKeyFilename), interKeyPEM, 0600)
+	if err != nil {
+		return err
+	}
+
+	ca.caLock.Lock()
+	ca.rootCert = rootCert
+	ca.intermediateCert = interCert
+	ca.intermediateKey = interKey
+	ca.caLock.Unlock()
+
+	ca.logf("Local CA installed: "+rootCert.Subject.CommonName, nil)
+	return nil
+}
+
+// Load the root and intermediate from disk
+func (ca *LocalCA) loadCA() error {
+	folder := ca.Option.ConfigFolder
+	rootPEM, err := os.ReadFile(filepath.Join(folder, rootCertFilename))
+	if err != nil {
+		return err
+	}
+	rootCert, err := parseCertificatePEM(rootPEM)
+	if err != nil {
+		return errors.New("invalid local CA root certificate: " + err.Error())
+	}
+
+	interPEM, err := os.ReadFile(filepath.Join(folder, intermediateCertFilename))
+	if err != nil {
+		return err
+	}
+	interCert, err := parseCertificatePEM(interPEM)
+	if err != nil {
+		return errors.New("invalid local CA intermediate certificate: " + err.Error())
+	}
+
+	interKeyPEM, err := os.ReadFile(filepath.Join(folder, intermediateKeyFilename))
+	if err != nil {
+		return err
+	}
+	interKey, err := parsePrivateKeyPEM(interKeyPEM)
+	if err != nil {
+		return errors.New("invalid local CA intermediate key: " + err.Error())
+	}
+
+	ca.caLock.Lock()
+	ca.rootCert = rootCert
+	ca.intermediateCert = interCert
+	ca.intermediateKey = interKey
+	ca.caLock.Unlock()
+	return nil
+}
+
+// GetRootCertificatePEM return the root certificate in PEM format for distribution
+func (ca *LocalCA) GetRootCertificatePEM() []byte {
+	ca.caLock.RLock()
+	defer ca.caLock.RUnlock()
+	return encodeCertificatePEM(ca.rootCert)
+}
+
+// GetRootCertificate return the parsed root certificate
+func (ca *LocalCA) GetRootCertificate() *x509.Certificate {
+	ca.caLock.RLock()
+	defer ca.caLock.RUnlock()
+	return ca.rootCert
+}
+
+// GetIntermediateCertificate return the parsed intermediate certificate
+func (ca *LocalCA) GetIntermediateCertificate() *x509.Certificate {
+	ca.caLock.RLock()
+	defer ca.caLock.RUnlock()
+	return ca.intermediateCert
+}
+
+// IsManagedHostname check if the given hostname matches one of the auto issue suffixes
+func (ca *LocalCA) IsManagedHostname(hostname string) bool {
+	hostname = strings.ToLower(strings.TrimSpace(hostname))
+	if hostname == "" {
+		return false
+	}
+	for _, suffix := range ca.Config.AutoIssueSuffixes {
+		suffix = strings.ToLower(strings.TrimSpace(suffix))
+		if suffix == "" {
+			continue
+		}
+		if !strings.HasPrefix(suffix, ".") {
+			suffix = "." + suffix
+		}
+		if strings.HasSuffix(hostname, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Close stop the auto renew ticker
+func (ca *LocalCA) Close() {
+	if ca.tickerStop != nil {
+		ca.tickerStop <- true
+		ca.tickerStop = nil
+	}
+}
+
+func (ca *LocalCA) logf(message string, err error) {
+	if ca.Option.Logger == nil {
+		return
+	}
+	ca.Option.Logger.PrintAndLog("local-ca", message, err)
+}
+
+/* PEM Utilities */
+
+func newSerialNumber() *big.Int {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return big.NewInt(time.Now().UnixNano())
+	}
+	return serial
+}
+
+func encodeCertificatePEM(cert *x509.Certificate) []byte {
+	if cert == nil {
+		return []byte{}
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+}
+
+func encodePrivateKeyPEM(key crypto.Signer) ([]byte, error) {
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+	case *rsa.PrivateKey:
+		return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}), nil
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+func parseCertificatePEM(content []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(content)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("no certificate found in PEM data")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func parsePrivateKeyPEM(content []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, errors.New("no private key found in PEM data")
+	}
+
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, errors.New("unsupported private key type")
+		}
+		return signer, nil
+	}
+	return nil, errors.New("unsupported private key type: " + block.Type)
+}
+
+func publicKeyMatches(cert *x509.Certificate, key crypto.Signer) bool {
+	type comparablePublicKey interface {
+		Equal(crypto.PublicKey) bool
+	}
+	pub, ok := cert.PublicKey.(comparablePublicKey)
+	return ok && pub.Equal(key.Public())
+}
@@ -0,0 +1,249 @@
+package localca
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/go-acme/lego/v4/certificate"
+	"github.com/go-acme/lego/v4/challenge/http01"
+	"github.com/go-acme/lego/v4/lego"
+	"github.com/go-acme/lego/v4/registration"
+	"imuslab.com/zoraxy/mod/info/logger"
+	"imuslab.com/zoraxy/mod/tlscert"
+)
+
+func newTestCA(t *testing.T) *LocalCA {
+	t.Helper()
+	fmtLogger, _ := logger.NewFmtLogger()
+	tlsManager, err := tlscert.NewManager(t.TempDir(), fmtLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := NewLocalCA(&Options{
+		ConfigFolder: t.TempDir(),
+		TlsManager:   tlsManager,
+		Logger:       fmtLogger,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(ca.Close)
+	return ca
+}
+
+// Verify the PEM chain against the CA root
+func verifyChain(t *testing.T, ca *LocalCA, chainPEM []byte, hostname string) *x509.Certificate {
+	t.Helper()
+	certs := []*x509.Certificate{}
+	for {
+		var block *pem.Block
+		block, chainPEM = pem.Decode(chainPEM)
+		if block == nil {
+			break
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) != 2 {
+		t.Fatalf("Expected leaf and intermediate in chain, got %d certificates", len(certs))
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.GetRootCertificate())
+	intermediates := x509.NewCertPool()
+	intermediates.AddCert(certs[1])
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		DNSName:       hostname,
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	if err != nil {
+		t.Fatalf("Chain verification failed: %v", err)
+	}
+	return certs[0]
+}
+
+func TestIssueCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	certName, err := ca.IssueCertificate([]string{"nas.lan", "files.lan"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if certName != "nas.lan" {
+		t.Errorf("Expected cert name nas.lan, got %s", certName)
+	}
+
+	chain, err := os.ReadFile(filepath.Join(ca.Option.TlsManager.CertStore, certName+".pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyChain(t, ca, chain, "files.lan")
+
+	if !ca.Option.TlsManager.CertMatchExists("files.lan") {
+		t.Errorf("Issued certificate not loaded into cert store")
+	}
+	if len(ca.Config.ManagedCerts) != 1 || ca.Config.ManagedCerts[0] != "nas.lan" {
+		t.Errorf("Issued certificate not added to managed list: %v", ca.Config.ManagedCerts)
+	}
+}
+
+func TestAutoIssueForHostnames(t *testing.T) {
+	ca := newTestCA(t)
+
+	//Disabled by default
+	ca.AutoIssueForHostnames([]string{"media.lan"})
+	if ca.Option.TlsManager.CertMatchExists("media.lan") {
+		t.Fatalf("Certificate issued while local CA auto issue is disabled")
+	}
+
+	ca.Config.Enabled = true
+	err := ca.AutoIssueForHostnames([]string{"media.lan", "example.com", "db.internal"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ca.Option.TlsManager.CertMatchExists("media.lan") || !ca.Option.TlsManager.CertMatchExists("db.internal") {
+		t.Errorf("Expected certificate for managed hostnames")
+	}
+	if ca.Option.TlsManager.CertMatchExists("example.com") {
+		t.Errorf("Public hostname should not be issued by local CA")
+	}
+}
+
+func TestRenewAfterCARegenerate(t *testing.T) {
+	ca := newTestCA(t)
+	certName, err := ca.IssueCertificate([]string{"router.lan"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ca.GenerateCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.CheckAndRenewCertificates()
+
+	chain, _ := os.ReadFile(filepath.Join(ca.Option.TlsManager.CertStore, certName+".pem"))
+	verifyChain(t, ca, chain, "router.lan")
+}
+
+func TestImportCA(t *testing.T) {
+	source := newTestCA(t)
+	rootKey, _ := os.ReadFile(filepath.Join(source.Option.ConfigFolder, rootKeyFilename))
+
+	ca := newTestCA(t)
+	err := ca.ImportCA(source.GetRootCertificatePEM(), rootKey, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ca.GetRootCertificate().Equal(source.GetRootCertificate()) {
+		t.Fatalf("Root certificate not imported")
+	}
+
+	certName, err := ca.IssueCertificate([]string{"printer.lan"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain, _ := os.ReadFile(filepath.Join(ca.Option.TlsManager.CertStore, certName+".pem"))
+	verifyChain(t, source, chain, "printer.lan")
+
+	//Mismatched key should be rejected
+	otherKey, _ := os.ReadFile(filepath.Join(ca.Option.ConfigFolder, intermediateKeyFilename))
+	if err := ca.ImportCA(source.GetRootCertificatePEM(), otherKey, nil, nil); err == nil {
+		t.Errorf("Expected error for mismatched root key")
+	}
+}
+
+/* ACME */
+
+type testACMEUser struct {
+	key          crypto.PrivateKey
+	registration *registration.Resource
+}
+
+func (u *testACMEUser) GetEmail() string                        { return "" }
+func (u *testACMEUser) GetRegistration() *registration.Resource { return u.registration }
+func (u *testACMEUser) GetPrivateKey() crypto.PrivateKey        { return u.key }
+
+func TestACMEIssueWithHTTP01(t *testing.T) {
+	ca := newTestCA(t)
+	ca.Config.EnableACME = true
+
+	//Find a free port for the http-01 challenge server started by lego
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	challengePort := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	//Resolve every hostname to the local challenge server
+	ca.acme.http01Port = challengePort
+	ca.acme.http01Dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, "127.0.0.1:"+strconv.Itoa(challengePort))
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(ACMEPathPrefix+"/", ca.HandleACME)
+	server := httptest.NewTLSServer(mux)
+	defer server.Close()
+
+	accountKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	user := &testACMEUser{key: accountKey}
+	config := lego.NewConfig(user)
+	config.CADirURL = server.URL + ACMEPathPrefix + "/directory"
+	config.Certificate.KeyType = certcrypto.EC256
+	config.HTTPClient = server.Client()
+	client, err := lego.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Challenge.SetHTTP01Provider(http01.NewProviderServer("127.0.0.1", strconv.Itoa(challengePort)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reg, err := client.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: true})
+	if err != nil {
+		t.Fatalf("ACME account registration failed: %v", err)
+	}
+	user.registration = reg
+
+	//Public hostnames are rejected
+	_, err = client.Certificate.Obtain(certificate.ObtainRequest{Domains: []string{"example.com"}, Bundle: true})
+	if err == nil {
+		t.Fatalf("Expected order for public hostname to be rejected")
+	}
+
+	cert, err := client.Certificate.Obtain(certificate.ObtainRequest{Domains: []string{"git.lan"}, Bundle: true})
+	if err != nil {
+		t.Fatalf("ACME certificate request failed: %v", err)
+	}
+	verifyChain(t, ca, cert.Certificate, "git.lan")
+
+	//Disabled ACME directory is not reachable
+	ca.Config.EnableACME = false
+	resp, err := server.Client().Get(config.CADirURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 when ACME is disabled, got %d", resp.StatusCode)
+	}
+}
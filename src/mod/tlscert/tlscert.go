@@ -5,6 +5,7 @@ import (
 	"crypto/x509"
 	"embed"
 	"encoding/pem"
+	"errors"
 	"io"
 	"os"
 	"path/filepath"
@@ -25,6 +26,7 @@ type HostSpecificTlsBehavior struct {
 	DisableLegacyCertificateMatching bool              //If legacy certificate matching is disabled for this server name
 	EnableAutoHTTPS                  bool              //If auto HTTPS is enabled for this server name
 	PreferredCertificate             map[string]string //Preferred certificate for this server name, if empty, use the first matching certificate
+	TlsProfile                       *TlsProfile       //TLS handshake profile (ciphers, curves, versions and ALPN), if nil, use global TLS options
 }
 
 type Manager struct {
@@ -205,6 +207,23 @@ func (m *Manager) GetCert(helloInfo *tls.ClientHelloInfo) (*tls.Certificate, err
 	return &cer, nil
 }
 
+// LoadCertificateByName load a certificate key pair from the cert store by its name (filename without extension)
+// This is used for loading client certificates for upstream mTLS
+func (m *Manager) LoadCertificateByName(certName string) (*tls.Certificate, error) {
+	certName = filepath.Base(strings.TrimSpace(certName))
+	pubKey := filepath.Join(m.CertStore, certName+".pem")
+	priKey := filepath.Join(m.CertStore, certName+".key")
+	if !utils.FileExists(pubKey) || !utils.FileExists(priKey) {
+		return nil, errors.New("certificate " + certName + " not found")
+	}
+
+	cer, err := tls.LoadX509KeyPair(pubKey, priKey)
+	if err != nil {
+		return nil, err
+	}
+	return &cer, nil
+}
+
 // GetCertificateByHostname returns the certificate and private key for a given hostname
 func (m *Manager) GetCertificateByHostname(hostname string) (string, string, error) {
 	//Check if the domain corrisponding cert exists
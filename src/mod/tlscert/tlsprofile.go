@@ -0,0 +1,269 @@
+package tlscert
+
+/*
+	tlsprofile.go
+
+	Per-host TLS profiles. A profile defines the cipher suites, curve
+	preferences, protocol versions and ALPN behavior of the TLS handshake
+	for a given server name. Presets follow the Mozilla server side
+	TLS guidelines (modern / intermediate / old).
+*/
+
+import (
+	"crypto/tls"
+	"errors"
+	"strings"
+)
+
+type TlsProfilePreset string
+
+const (
+	TlsProfilePresetDefault      TlsProfilePreset = ""             //Use the global TLS settings
+	TlsProfilePresetModern       TlsProfilePreset = "modern"       //Mozilla modern, TLS 1.3 only
+	TlsProfilePresetIntermediate TlsProfilePreset = "intermediate" //Mozilla intermediate, TLS 1.2 and above with AEAD ciphers
+	TlsProfilePresetOld          TlsProfilePreset = "old"          //Mozilla old, TLS 1.0 and above for legacy clients
+	TlsProfilePresetCustom       TlsProfilePreset = "custom"       //User defined cipher suites, curves and versions
+)
+
+type TlsProfile struct {
+	Preset           TlsProfilePreset //The preset of this profile, custom fields are only used when preset is "custom"
+	CipherSuites     []string         //Cipher suites by IANA name, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 (TLS 1.2 and below only)
+	CurvePreferences []string         //Curves in preferred order, e.g. X25519, P256
+	MinVersion       string           //Minimum TLS version, e.g. 1.2. Leave empty to use global setting
+	MaxVersion       string           //Maximum TLS version, e.g. 1.3. Leave empty for no limit
+	DisableHTTP2     bool             //Do not advertise h2 in ALPN, force HTTP/1.1
+}
+
+// Resolved TLS parameters of a profile, ready to be applied on a tls.Config
+type resolvedTlsProfile struct {
+	cipherSuites     []uint16
+	curvePreferences []tls.CurveID
+	minVersion       uint16
+	maxVersion       uint16
+}
+
+var tlsCurveNames = map[string]tls.CurveID{
+	"X25519":         tls.X25519,
+	"P256":           tls.CurveP256,
+	"P384":           tls.CurveP384,
+	"P521":           tls.CurveP521,
+	"X25519MLKEM768": tls.X25519MLKEM768,
+}
+
+var tlsVersionNames = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+/* Mozilla Server Side TLS presets (v5.7) */
+var (
+	mozillaModernCurves = []string{"X25519", "P256", "P384"}
+
+	mozillaIntermediateCiphers = []string{
+		"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+		"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+		"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+		"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+		"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256",
+		"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256",
+	}
+
+	mozillaOldCiphers = append(append([]string{}, mozillaIntermediateCiphers...),
+		"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256",
+		"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256",
+		"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA",
+		"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA",
+		"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA",
+		"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA",
+		"TLS_RSA_WITH_AES_128_GCM_SHA256",
+		"TLS_RSA_WITH_AES_256_GCM_SHA384",
+		"TLS_RSA_WITH_AES_128_CBC_SHA256",
+		"TLS_RSA_WITH_AES_128_CBC_SHA",
+		"TLS_RSA_WITH_AES_256_CBC_SHA",
+		"TLS_RSA_WITH_3DES_EDE_CBC_SHA",
+	)
+)
+
+// GetTlsProfilePreset return the profile of the given preset name
+func GetTlsProfilePreset(preset TlsProfilePreset) (*TlsProfile, error) {
+	switch preset {
+	case TlsProfilePresetDefault:
+		return &TlsProfile{Preset: TlsProfilePresetDefault}, nil
+	case TlsProfilePresetModern:
+		return &TlsProfile{
+			Preset:           TlsProfilePresetModern,
+			CipherSuites:     []string{},
+			CurvePreferences: mozillaModernCurves,
+			MinVersion:       "1.3",
+		}, nil
+	case TlsProfilePresetIntermediate:
+		return &TlsProfile{
+			Preset:           TlsProfilePresetIntermediate,
+			CipherSuites:     mozillaIntermediateCiphers,
+			CurvePreferences: mozillaModernCurves,
+			MinVersion:       "1.2",
+		}, nil
+	case TlsProfilePresetOld:
+		return &TlsProfile{
+			Preset:           TlsProfilePresetOld,
+			CipherSuites:     mozillaOldCiphers,
+			CurvePreferences: []string{"X25519", "P256", "P384", "P521"},
+			MinVersion:       "1.0",
+		}, nil
+	}
+	return nil, errors.New("unknown TLS profile preset: " + string(preset))
+}
+
+// ListTlsProfilePresets return all the preset profiles, use by the UI
+func ListTlsProfilePresets() []*TlsProfile {
+	results := []*TlsProfile{}
+	for _, preset := range []TlsProfilePreset{TlsProfilePresetModern, TlsProfilePresetIntermediate, TlsProfilePresetOld} {
+		p, _ := GetTlsProfilePreset(preset)
+		results = append(results, p)
+	}
+	return results
+}
+
+// ListSupportedCipherSuites return the IANA names of all cipher suites that can be used in a custom profile
+func ListSupportedCipherSuites() []string {
+	results := []string{}
+	for _, cs := range tls.CipherSuites() {
+		results = append(results, cs.Name)
+	}
+	for _, cs := range tls.InsecureCipherSuites() {
+		results = append(results, cs.Name)
+	}
+	return results
+}
+
+// ListSupportedCurves return the names of all curves that can be used in a custom profile
+func ListSupportedCurves() []string {
+	return []string{"X25519MLKEM768", "X25519", "P256", "P384", "P521"}
+}
+
+// IsDefault return true if this profile does not change the global TLS behavior
+func (p *TlsProfile) IsDefault() bool {
+	return p == nil || p.Preset == TlsProfilePresetDefault && !p.DisableHTTP2
+}
+
+// Validate check if the profile can be resolved into a working TLS config
+func (p *TlsProfile) Validate() error {
+	if p == nil {
+		return nil
+	}
+	_, err := p.resolve()
+	return err
+}
+
+// Resolve the profile (or its preset) into tls package values
+func (p *TlsProfile) resolve() (*resolvedTlsProfile, error) {
+	source := p
+	if p.Preset != TlsProfilePresetCustom {
+		preset, err := GetTlsProfilePreset(p.Preset)
+		if err != nil {
+			return nil, err
+		}
+		source = preset
+	}
+
+	resolved := resolvedTlsProfile{
+		cipherSuites:     []uint16{},
+		curvePreferences: []tls.CurveID{},
+	}
+
+	for _, name := range source.CipherSuites {
+		id, ok := cipherSuiteIdByName(name)
+		if !ok {
+			return nil, errors.New("unsupported cipher suite: " + name)
+		}
+		resolved.cipherSuites = append(resolved.cipherSuites, id)
+	}
+
+	for _, name := range source.CurvePreferences {
+		id, ok := tlsCurveNames[strings.TrimSpace(name)]
+		if !ok {
+			return nil, errors.New("unsupported curve: " + name)
+		}
+		resolved.curvePreferences = append(resolved.curvePreferences, id)
+	}
+
+	if source.MinVersion != "" {
+		v, ok := tlsVersionNames[source.MinVersion]
+		if !ok {
+			return nil, errors.New("invalid minimum TLS version: " + source.MinVersion)
+		}
+		resolved.minVersion = v
+	}
+
+	if source.MaxVersion != "" {
+		v, ok := tlsVersionNames[source.MaxVersion]
+		if !ok {
+			return nil, errors.New("invalid maximum TLS version: " + source.MaxVersion)
+		}
+		resolved.maxVersion = v
+	}
+
+	if resolved.minVersion != 0 && resolved.maxVersion != 0 && resolved.minVersion > resolved.maxVersion {
+		return nil, errors.New("minimum TLS version is greater than maximum TLS version")
+	}
+
+	return &resolved, nil
+}
+
+// ApplyToConfig apply the profile on the given tls config in place.
+// Fields not defined by the profile are left untouched
+func (p *TlsProfile) ApplyToConfig(config *tls.Config) error {
+	if p == nil {
+		return nil
+	}
+
+	if p.DisableHTTP2 {
+		filtered := []string{}
+		for _, proto := range config.NextProtos {
+			if proto != "h2" {
+				filtered = append(filtered, proto)
+			}
+		}
+		config.NextProtos = filtered
+	}
+
+	if p.Preset == TlsProfilePresetDefault {
+		return nil
+	}
+
+	resolved, err := p.resolve()
+	if err != nil {
+		return err
+	}
+
+	if len(resolved.cipherSuites) > 0 {
+		config.CipherSuites = resolved.cipherSuites
+	}
+	if len(resolved.curvePreferences) > 0 {
+		config.CurvePreferences = resolved.curvePreferences
+	}
+	if resolved.minVersion != 0 {
+		config.MinVersion = resolved.minVersion
+	}
+	if resolved.maxVersion != 0 {
+		config.MaxVersion = resolved.maxVersion
+	}
+	return nil
+}
+
+func cipherSuiteIdByName(name string) (uint16, bool) {
+	name = strings.TrimSpace(name)
+	for _, cs := range tls.CipherSuites() {
+		if cs.Name == name {
+			return cs.ID, true
+		}
+	}
+	for _, cs := range tls.InsecureCipherSuites() {
+		if cs.Name == name {
+			return cs.ID, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,212 @@
+package tlscert
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+)
+
+// Start a handshake between a server using the given profile and a client
+// using the given client hello parameters. Return the client connection state
+func handshakeWithProfile(t *testing.T, profile *TlsProfile, clientConfig *tls.Config) (tls.ConnectionState, error) {
+	t.Helper()
+	pubKey, _ := buildinCertStore.ReadFile("localhost.pem")
+	priKey, _ := buildinCertStore.ReadFile("localhost.key")
+	cert, err := tls.X509KeyPair(pubKey, priKey)
+	if err != nil {
+		t.Fatalf("Failed to load test certificate: %v", err)
+	}
+
+	serverConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   []string{"h2", "http/1.1"},
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			if hello.ServerName != "profiled.example.com" {
+				return nil, nil
+			}
+			config := &tls.Config{
+				Certificates: []tls.Certificate{cert},
+				MinVersion:   tls.VersionTLS12,
+				NextProtos:   []string{"h2", "http/1.1"},
+			}
+			if err := profile.ApplyToConfig(config); err != nil {
+				return nil, err
+			}
+			return config, nil
+		},
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create listener: %v", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		serverConn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		server := tls.Server(serverConn, serverConfig)
+		server.Handshake()
+		server.Close()
+	}()
+
+	clientConn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect to test server: %v", err)
+	}
+	defer clientConn.Close()
+
+	clientConfig.InsecureSkipVerify = true
+	client := tls.Client(clientConn, clientConfig)
+	err = client.Handshake()
+	return client.ConnectionState(), err
+}
+
+func TestTlsProfilePresetsValid(t *testing.T) {
+	for _, preset := range []TlsProfilePreset{TlsProfilePresetDefault, TlsProfilePresetModern, TlsProfilePresetIntermediate, TlsProfilePresetOld} {
+		profile, err := GetTlsProfilePreset(preset)
+		if err != nil {
+			t.Fatalf("Failed to load preset %q: %v", preset, err)
+		}
+		if err := profile.Validate(); err != nil {
+			t.Errorf("Preset %q is invalid: %v", preset, err)
+		}
+	}
+
+	if _, err := GetTlsProfilePreset("unknown"); err == nil {
+		t.Errorf("Expected error for unknown preset")
+	}
+}
+
+func TestTlsProfileCustomValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		profile *TlsProfile
+		wantErr bool
+	}{
+		{"valid custom", &TlsProfile{Preset: TlsProfilePresetCustom, CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}, CurvePreferences: []string{"X25519"}, MinVersion: "1.2", MaxVersion: "1.3"}, false},
+		{"unknown cipher", &TlsProfile{Preset: TlsProfilePresetCustom, CipherSuites: []string{"TLS_FOO"}}, true},
+		{"unknown curve", &TlsProfile{Preset: TlsProfilePresetCustom, CurvePreferences: []string{"P999"}}, true},
+		{"invalid version", &TlsProfile{Preset: TlsProfilePresetCustom, MinVersion: "2.0"}, true},
+		{"min above max", &TlsProfile{Preset: TlsProfilePresetCustom, MinVersion: "1.3", MaxVersion: "1.2"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.profile.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTlsProfileModernRejectsTls12(t *testing.T) {
+	profile, _ := GetTlsProfilePreset(TlsProfilePresetModern)
+	_, err := handshakeWithProfile(t, profile, &tls.Config{
+		ServerName: "profiled.example.com",
+		MaxVersion: tls.VersionTLS12,
+	})
+	if err == nil {
+		t.Fatalf("Expected TLS 1.2 client hello to be rejected by modern profile")
+	}
+
+	state, err := handshakeWithProfile(t, profile, &tls.Config{
+		ServerName: "profiled.example.com",
+	})
+	if err != nil {
+		t.Fatalf("Expected TLS 1.3 handshake to succeed: %v", err)
+	}
+	if state.Version != tls.VersionTLS13 {
+		t.Errorf("Expected TLS 1.3, got %x", state.Version)
+	}
+}
+
+func TestTlsProfileCipherSuiteSelection(t *testing.T) {
+	profile := &TlsProfile{
+		Preset:       TlsProfilePresetCustom,
+		CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"},
+		MaxVersion:   "1.2",
+	}
+
+	//Client only offer a cipher not in the profile
+	_, err := handshakeWithProfile(t, profile, &tls.Config{
+		ServerName:   "profiled.example.com",
+		MaxVersion:   tls.VersionTLS12,
+		CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+	})
+	if err == nil {
+		t.Fatalf("Expected handshake to fail with no shared cipher suite")
+	}
+
+	//Client offer the cipher in the profile
+	state, err := handshakeWithProfile(t, profile, &tls.Config{
+		ServerName: "profiled.example.com",
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+	if state.Version != tls.VersionTLS12 {
+		t.Errorf("Expected max version TLS 1.2, got %x", state.Version)
+	}
+	if state.CipherSuite != tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384 {
+		t.Errorf("Expected cipher suite %s, got %s", tls.CipherSuiteName(tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384), tls.CipherSuiteName(state.CipherSuite))
+	}
+}
+
+func TestTlsProfileCurvePreferences(t *testing.T) {
+	profile := &TlsProfile{
+		Preset:           TlsProfilePresetCustom,
+		CurvePreferences: []string{"P384"},
+	}
+
+	_, err := handshakeWithProfile(t, profile, &tls.Config{
+		ServerName:       "profiled.example.com",
+		CurvePreferences: []tls.CurveID{tls.X25519},
+	})
+	if err == nil {
+		t.Fatalf("Expected handshake to fail with no shared curve")
+	}
+
+	_, err = handshakeWithProfile(t, profile, &tls.Config{
+		ServerName:       "profiled.example.com",
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP384},
+	})
+	if err != nil {
+		t.Fatalf("Expected handshake with P384 to succeed: %v", err)
+	}
+}
+
+func TestTlsProfileALPN(t *testing.T) {
+	//Default profile with h2 disabled
+	profile := &TlsProfile{DisableHTTP2: true}
+	state, err := handshakeWithProfile(t, profile, &tls.Config{
+		ServerName: "profiled.example.com",
+		NextProtos: []string{"h2", "http/1.1"},
+	})
+	if err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+	if state.NegotiatedProtocol != "http/1.1" {
+		t.Errorf("Expected http/1.1, got %q", state.NegotiatedProtocol)
+	}
+
+	//Other hosts are not affected by the profile
+	state, err = handshakeWithProfile(t, profile, &tls.Config{
+		ServerName: "other.example.com",
+		NextProtos: []string{"h2", "http/1.1"},
+	})
+	if err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+	if state.NegotiatedProtocol != "h2" {
+		t.Errorf("Expected h2, got %q", state.NegotiatedProtocol)
+	}
+}
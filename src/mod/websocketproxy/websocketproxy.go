@@ -58,6 +58,7 @@ type WebsocketProxy struct {
 // Additional options for websocket proxy runtime
 type Options struct {
 	SkipTLSValidation  bool                         //Skip backend TLS validation
+	TLSClientConfig    *tls.Config                  //Custom backend TLS config (custom CA, mTLS, SNI override), nil for default
 	SkipOriginCheck    bool                         //Skip origin check
 	CopyAllHeaders     bool                         //Copy all headers from incoming request to backend request
 	UserDefinedHeaders []*rewrite.UserDefinedHeader //User defined headers
@@ -146,11 +147,16 @@ func (w *WebsocketProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 
 	dialer := w.Dialer
 	if w.Dialer == nil {
-		if w.Options.SkipTLSValidation {
+		if w.Options.TLSClientConfig != nil {
+			//Use the upstream specific TLS config
+			customDialer := *websocket.DefaultDialer
+			customDialer.TLSClientConfig = w.Options.TLSClientConfig.Clone()
+			dialer = &customDialer
+		} else if w.Options.SkipTLSValidation {
 			//Disable TLS secure check if target allow skip verification
-			bypassDialer := websocket.DefaultDialer
+			bypassDialer := *websocket.DefaultDialer
 			bypassDialer.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
-			dialer = bypassDialer
+			dialer = &bypassDialer
 		} else {
 			//Just use the default dialer come with gorilla websocket
 			dialer = DefaultDialer
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+/*
+	rbac.go
+
+	Resource scoping of operators limited to proxy rules
+	with some tags. The role checks are done in the auth router
+*/
+
+// Request parameter naming the proxy rule changed by each API
+var proxyRuleParameters = map[string]string{
+	"/api/proxy/toggle":                        "ep",
+	"/api/proxy/edit":                          "rootname",
+	"/api/proxy/setAlias":                      "ep",
+	"/api/proxy/setTlsConfig":                  "ep",
+	"/api/proxy/setHostname":                   "oldHostname",
+	"/api/proxy/del":                           "ep",
+	"/api/proxy/updateCredentials":             "ep",
+	"/api/proxy/upstream/add":                  "ep",
+	"/api/proxy/upstream/setPriority":          "ep",
+	"/api/proxy/upstream/update":               "ep",
+	"/api/proxy/upstream/remove":               "ep",
+	"/api/proxy/vdir/add":                      "endpoint",
+	"/api/proxy/vdir/edit":                     "path",
+	"/api/proxy/vdir/del":                      "path",
+	"/api/proxy/header/add":                    "domain",
+	"/api/proxy/header/remove":                 "domain",
+	"/api/proxy/header/handleHSTS":             "domain",
+	"/api/proxy/header/handleHopByHop":         "domain",
+	"/api/proxy/header/handleHostOverwrite":    "domain",
+	"/api/proxy/header/handlePermissionPolicy": "domain",
+	"/api/proxy/header/handleWsHeaderBehavior": "domain",
+	"/api/proxy/auth/exceptions/add":           "ep",
+	"/api/proxy/auth/exceptions/delete":        "ep",
+	"/api/proxy/auth/groups":                   "ep",
+	"/api/proxy/auth/ldap":                     "ep",
+	"/api/proxy/auth/oidc":                     "ep",
+	"/api/proxy/auth/portal":                   "ep",
+	"/api/proxy/auth/jwt":                      "ep",
+	"/api/proxy/cache/set":                     "hostname",
+	"/api/cert/tlsProfile":                     "ep",
+}
+
+// Parse the comma separated tags in the same way as the add and edit APIs
+func parseTagsParameter(r *http.Request) []string {
+	tags := []string{}
+	for _, tag := range strings.Split(r.Form.Get("tags"), ",") {
+		tag = strings.TrimSpace(tag)
+		if tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+func hasAllowedTag(tags []string, allowedTags []string) bool {
+	return slices.ContainsFunc(tags, func(tag string) bool {
+		return slices.Contains(allowedTags, tag)
+	})
+}
+
+// Check if the request only changes proxy rules tagged with one of the allowed tags
+func checkProxyRuleScope(r *http.Request, allowedTags []string) error {
+	if err := r.ParseForm(); err != nil {
+		return errors.New("invalid request")
+	}
+	if r.URL.Path == "/api/proxy/add" {
+		//New rules must be tagged so the operator can still manage them
+		if !hasAllowedTag(parseTagsParameter(r), allowedTags) {
+			return errors.New("new proxy rule must be tagged with " + strings.Join(allowedTags, " or "))
+		}
+		return nil
+	}
+
+	parameter, ok := proxyRuleParameters[r.URL.Path]
+	if !ok {
+		return errors.New("API changes settings outside of the allowed proxy rules")
+	}
+	if strings.EqualFold(r.Form.Get("type"), "root") {
+		return errors.New("default site cannot be changed by scoped operators")
+	}
+	rule, err := dynamicProxyRouter.LoadProxy(r.Form.Get(parameter))
+	if err != nil {
+		return errors.New("proxy rule not found")
+	}
+	if !hasAllowedTag(rule.Tags, allowedTags) {
+		return errors.New("proxy rule " + rule.RootOrMatchingDomain + " is not tagged with " + strings.Join(allowedTags, " or "))
+	}
+	if r.URL.Path == "/api/proxy/edit" && !hasAllowedTag(parseTagsParameter(r), allowedTags) {
+		return errors.New("proxy rule must stay tagged with " + strings.Join(allowedTags, " or "))
+	}
+	return nil
+}
@@ -5,17 +5,21 @@ import (
 	"net"
 	"net/http"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
 
+	"golang.org/x/net/http/httpguts"
 	"imuslab.com/zoraxy/mod/auth"
+	"imuslab.com/zoraxy/mod/auth/sso/oauth2"
 	"imuslab.com/zoraxy/mod/dynamicproxy"
 	"imuslab.com/zoraxy/mod/dynamicproxy/loadbalance"
 	"imuslab.com/zoraxy/mod/dynamicproxy/permissionpolicy"
 	"imuslab.com/zoraxy/mod/dynamicproxy/rewrite"
 	"imuslab.com/zoraxy/mod/netutils"
+	"imuslab.com/zoraxy/mod/streamproxy"
 	"imuslab.com/zoraxy/mod/tlscert"
 	"imuslab.com/zoraxy/mod/uptime"
 	"imuslab.com/zoraxy/mod/utils"
@@ -81,6 +85,14 @@ func ReverseProxyInit() {
 		SystemWideLogger.Println("Port 80 listener disabled")
 	}
 
+	acceptProxyProtocol := false
+	trustedProxyCIDRs := []string{}
+	sysdb.Read("settings", "acceptProxyProtocol", &acceptProxyProtocol)
+	sysdb.Read("settings", "trustedProxyCIDRs", &trustedProxyCIDRs)
+	if acceptProxyProtocol {
+		SystemWideLogger.Println("Inbound PROXY protocol enabled. Trusted proxies: " + strings.Join(trustedProxyCIDRs, ", "))
+	}
+
 	forceHttpsRedirect := true
 	sysdb.Read("settings", "redirect", &forceHttpsRedirect)
 	if forceHttpsRedirect {
@@ -106,6 +118,9 @@ func ReverseProxyInit() {
 		NoCache:            developmentMode,
 		ListenOnPort80:     listenOnPort80,
 		ForceHttpsRedirect: forceHttpsRedirect,
+		/* Inbound PROXY Protocol */
+		AcceptProxyProtocol: acceptProxyProtocol,
+		TrustedProxyCIDRs:   trustedProxyCIDRs,
 		/* Routing Service Managers */
 		TlsManager:         tlsCertManager,
 		RedirectRuleTable:  redirectTable,
@@ -115,11 +130,17 @@ func ReverseProxyInit() {
 		AccessController:   accessController,
 		ForwardAuthRouter:  forwardAuthRouter,
 		OAuth2Router:       oauth2Router,
+		UserDirectory:      userDirectory,
+		SSOPortal:          ssoPortal,
+		JWTValidator:       jwtValidator,
+		LDAPAuthenticator:  ldapAuthenticator,
 		LoadBalancer:       loadBalancer,
+		HostStatsCollector: hostStatsCollector,
 		PluginManager:      pluginManager,
 		/* Utilities */
 		DevelopmentMode: *development_build,
 		Logger:          SystemWideLogger,
+		SaveEndpoint:    SaveReverseProxyConfig,
 	})
 
 	if err != nil {
@@ -212,7 +233,7 @@ func ReverseProxyHandleOnOff(w http.ResponseWriter, r *http.Request) {
 }
 
 func ReverseProxyHandleAddEndpoint(w http.ResponseWriter, r *http.Request) {
-	eptype, err := utils.PostPara(r, "type") //Support root and host
+	eptype, err := utils.PostPara(r, "type") //Support root, host and passthrough
 	if err != nil {
 		utils.SendErrorResponse(w, "type not defined")
 		return
@@ -291,6 +312,14 @@ func ReverseProxyHandleAddEndpoint(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Bandwidth limits in bytes per second, 0 for unlimited
+	bandwidthLimit, _ := utils.PostInt(r, "bwlimit")
+	bandwidthLimitPerIP, _ := utils.PostInt(r, "bwlimitip")
+	if bandwidthLimit < 0 || bandwidthLimitPerIP < 0 {
+		utils.SendErrorResponse(w, "bandwidth limit cannot be negative")
+		return
+	}
+
 	// Bypass WebSocket Origin Check
 	strbpwsorg, _ := utils.PostPara(r, "bpwsorg")
 	if strbpwsorg == "" {
@@ -319,9 +348,14 @@ func ReverseProxyHandleAddEndpoint(w http.ResponseWriter, r *http.Request) {
 
 		//Convert and hash the passwords
 		for _, credObj := range preProcessCredentials {
+			passwordHash, err := auth.HashPassword(credObj.Password)
+			if err != nil {
+				utils.SendErrorResponse(w, "unable to hash password of "+credObj.Username)
+				return
+			}
 			basicAuthCredentials = append(basicAuthCredentials, &dynamicproxy.BasicAuthCredentials{
 				Username:     credObj.Username,
-				PasswordHash: auth.Hash(credObj.Password),
+				PasswordHash: passwordHash,
 			})
 		}
 	}
@@ -416,6 +450,9 @@ func ReverseProxyHandleAddEndpoint(w http.ResponseWriter, r *http.Request) {
 			// Rate Limit
 			RequireRateLimit: requireRateLimit,
 			RateLimit:        int64(proxyRateLimit),
+			// Bandwidth Shaping
+			BandwidthLimit:      int64(bandwidthLimit),
+			BandwidthLimitPerIP: int64(bandwidthLimitPerIP),
 
 			Tags:                 tags,
 			DisableUptimeMonitor: !enableUtm,
@@ -428,6 +465,74 @@ func ReverseProxyHandleAddEndpoint(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		dynamicProxyRouter.AddProxyRouteToRuntime(preparedEndpoint)
+		proxyEndpointCreated = &thisProxyEndpoint
+	case "passthrough":
+		//TLS passthrough, match by SNI and forward the raw TCP connection to upstream
+		rootOrMatchingDomain, err := utils.PostPara(r, "rootname")
+		if err != nil {
+			utils.SendErrorResponse(w, "hostname not defined")
+			return
+		}
+		rootOrMatchingDomain = strings.ToLower(strings.TrimSpace(rootOrMatchingDomain))
+
+		aliasHostnames := []string{}
+		if strings.Contains(rootOrMatchingDomain, ",") {
+			matchingDomains := strings.Split(rootOrMatchingDomain, ",")
+			rootOrMatchingDomain = strings.TrimSpace(matchingDomains[0])
+			for _, aliasHostname := range matchingDomains[1:] {
+				aliasHostnames = append(aliasHostnames, strings.TrimSpace(aliasHostname))
+			}
+		}
+
+		//Upstream must be a host:port pair as there is no protocol default
+		if _, _, err := net.SplitHostPort(endpoint); err != nil {
+			utils.SendErrorResponse(w, "passthrough upstream must be in host:port format")
+			return
+		}
+
+		proxyProtocolVersion, err := utils.PostInt(r, "proxyProtocol")
+		if err != nil {
+			proxyProtocolVersion = 0
+		}
+		if proxyProtocolVersion < 0 || proxyProtocolVersion > 2 {
+			utils.SendErrorResponse(w, "invalid PROXY protocol version")
+			return
+		}
+
+		thisProxyEndpoint := dynamicproxy.ProxyEndpoint{
+			ProxyType:            dynamicproxy.ProxyTypeTlsPassthrough,
+			RootOrMatchingDomain: rootOrMatchingDomain,
+			MatchingDomainAlias:  aliasHostnames,
+			ActiveOrigins: []*loadbalance.Upstream{
+				{
+					OriginIpOrDomain: endpoint,
+					Weight:           1,
+				},
+			},
+			InactiveOrigins:          []*loadbalance.Upstream{},
+			AccessFilterUUID:         accessRuleID,
+			TlsOptions:               tlscert.GetDefaultHostSpecificTlsBehavior(),
+			PassthroughProxyProtocol: streamproxy.ProxyProtocolVersion(proxyProtocolVersion),
+			VirtualDirectories:       []*dynamicproxy.VirtualDirectoryEndpoint{},
+			AuthenticationProvider: &dynamicproxy.AuthenticationProvider{
+				AuthMethod:              dynamicproxy.AuthMethodNone,
+				BasicAuthCredentials:    []*dynamicproxy.BasicAuthCredentials{},
+				BasicAuthExceptionRules: []*dynamicproxy.BasicAuthExceptionRule{},
+			},
+			HeaderRewriteRules: dynamicproxy.GetDefaultHeaderRewriteRules(),
+			Tags:               tags,
+			//HTTP uptime check do not work on TLS passthrough upstreams
+			DisableUptimeMonitor: true,
+			DisableLogging:       disableLog,
+		}
+
+		preparedEndpoint, err := dynamicProxyRouter.PrepareProxyRoute(&thisProxyEndpoint)
+		if err != nil {
+			utils.SendErrorResponse(w, "unable to prepare proxy route to target endpoint: "+err.Error())
+			return
+		}
+
 		dynamicProxyRouter.AddProxyRouteToRuntime(preparedEndpoint)
 		proxyEndpointCreated = &thisProxyEndpoint
 	case "root":
@@ -497,6 +602,15 @@ func ReverseProxyHandleAddEndpoint(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	//Issue certificates for internal hostnames from the local CA
+	if localCA != nil && eptype == "host" {
+		hostnames := append([]string{proxyEndpointCreated.RootOrMatchingDomain}, proxyEndpointCreated.MatchingDomainAlias...)
+		err = localCA.AutoIssueForHostnames(hostnames)
+		if err != nil {
+			SystemWideLogger.PrintAndLog("local-ca", "Unable to issue certificate for new proxy rule", err)
+		}
+	}
+
 	//Update utm if exists
 	UpdateUptimeMonitorTargets()
 
@@ -571,6 +685,16 @@ func ReverseProxyHandleEditEndpoint(w http.ResponseWriter, r *http.Request) {
 		proxyRateLimit = 1000
 	}
 
+	// Bandwidth limits in bytes per second, leave empty for no change
+	bandwidthLimit, err := utils.PostInt(r, "bwlimit")
+	if err != nil {
+		bandwidthLimit = -1
+	}
+	bandwidthLimitPerIP, err := utils.PostInt(r, "bwlimitip")
+	if err != nil {
+		bandwidthLimitPerIP = -1
+	}
+
 	// Disable chunked Encoding
 	disableChunkedEncoding, _ := utils.PostBool(r, "dChunkedEnc")
 
@@ -609,18 +733,40 @@ func ReverseProxyHandleEditEndpoint(w http.ResponseWriter, r *http.Request) {
 		newProxyEndpoint.AuthenticationProvider.AuthMethod = dynamicproxy.AuthMethodForward
 	} else if authProviderType == 3 {
 		newProxyEndpoint.AuthenticationProvider.AuthMethod = dynamicproxy.AuthMethodOauth2
+	} else if authProviderType == 4 {
+		newProxyEndpoint.AuthenticationProvider.AuthMethod = dynamicproxy.AuthMethodSSOPortal
+	} else if authProviderType == 5 {
+		newProxyEndpoint.AuthenticationProvider.AuthMethod = dynamicproxy.AuthMethodJWT
 	} else {
 		newProxyEndpoint.AuthenticationProvider.AuthMethod = dynamicproxy.AuthMethodNone
 	}
 
 	newProxyEndpoint.RequireRateLimit = requireRateLimit
 	newProxyEndpoint.RateLimit = proxyRateLimit
+	if bandwidthLimit >= 0 {
+		newProxyEndpoint.BandwidthLimit = int64(bandwidthLimit)
+	}
+	if bandwidthLimitPerIP >= 0 {
+		newProxyEndpoint.BandwidthLimitPerIP = int64(bandwidthLimitPerIP)
+	}
 	newProxyEndpoint.UseStickySession = useStickySession
 	newProxyEndpoint.DisableUptimeMonitor = disbleUtm
 	newProxyEndpoint.DisableChunkedTransferEncoding = disableChunkedEncoding
 	newProxyEndpoint.DisableLogging = disableLogging
 	newProxyEndpoint.Tags = tags
 
+	//PROXY protocol header sent to upstream in TLS passthrough mode
+	if newProxyEndpoint.ProxyType == dynamicproxy.ProxyTypeTlsPassthrough {
+		proxyProtocolVersion, err := utils.PostInt(r, "proxyProtocol")
+		if err == nil {
+			if proxyProtocolVersion < 0 || proxyProtocolVersion > 2 {
+				utils.SendErrorResponse(w, "invalid PROXY protocol version")
+				return
+			}
+			newProxyEndpoint.PassthroughProxyProtocol = streamproxy.ProxyProtocolVersion(proxyProtocolVersion)
+		}
+	}
+
 	//Prepare to replace the current routing rule
 	readyRoutingRule, err := dynamicProxyRouter.PrepareProxyRoute(newProxyEndpoint)
 	if err != nil {
@@ -734,11 +880,19 @@ func ReverseProxyHandleSetTlsConfig(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if newTlsConfig.PreferredCertificate == nil {
+	if newTlsConfig.PreferredCertificate == nil && ept.TlsOptions != nil {
 		//No update needed, reuse the current TLS config
 		newTlsConfig.PreferredCertificate = ept.TlsOptions.PreferredCertificate
 	}
 
+	if newTlsConfig.TlsProfile == nil && ept.TlsOptions != nil {
+		//TLS profile not given, keep the current one
+		newTlsConfig.TlsProfile = ept.TlsOptions.TlsProfile
+	} else if err := newTlsConfig.TlsProfile.Validate(); err != nil {
+		utils.SendErrorResponse(w, "Invalid TLS profile given: "+err.Error())
+		return
+	}
+
 	ept.TlsOptions = newTlsConfig
 
 	//Prepare to replace the current routing rule
@@ -950,9 +1104,14 @@ func UpdateProxyBasicAuthCredentials(w http.ResponseWriter, r *http.Request) {
 				}
 			} else {
 				//This username have given password
+				passwordHash, err := auth.HashPassword(credential.Password)
+				if err != nil {
+					utils.SendErrorResponse(w, "unable to hash password of "+credential.Username)
+					return
+				}
 				mergedCredentials = append(mergedCredentials, &dynamicproxy.BasicAuthCredentials{
 					Username:     credential.Username,
-					PasswordHash: auth.Hash(credential.Password),
+					PasswordHash: passwordHash,
 				})
 			}
 		}
@@ -971,6 +1130,420 @@ func UpdateProxyBasicAuthCredentials(w http.ResponseWriter, r *http.Request) {
 
 }
 
+/*
+Get or set the user directory groups that are allowed to access a basic auth endpoint
+
+if request is GET, the handler will return the group IDs of the endpoint
+if request is POST, groups is a comma seperated list of group IDs, empty to clear
+*/
+func UpdateProxyBasicAuthGroups(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		ep, err := utils.GetPara(r, "ep")
+		if err != nil {
+			utils.SendErrorResponse(w, "Invalid ep given")
+			return
+		}
+
+		targetProxy, err := dynamicProxyRouter.LoadProxy(ep)
+		if err != nil {
+			utils.SendErrorResponse(w, err.Error())
+			return
+		}
+
+		groupIDs := targetProxy.AuthenticationProvider.BasicAuthGroupIDs
+		if groupIDs == nil {
+			groupIDs = []string{}
+		}
+		js, _ := json.Marshal(groupIDs)
+		utils.SendJSONResponse(w, string(js))
+
+	} else if r.Method == http.MethodPost {
+		ep, err := utils.PostPara(r, "ep")
+		if err != nil {
+			utils.SendErrorResponse(w, "Invalid ep given")
+			return
+		}
+
+		targetProxy, err := dynamicProxyRouter.LoadProxy(ep)
+		if err != nil {
+			utils.SendErrorResponse(w, err.Error())
+			return
+		}
+
+		groups, _ := utils.PostPara(r, "groups")
+		groupIDs := []string{}
+		for _, groupID := range strings.Split(groups, ",") {
+			groupID = strings.TrimSpace(groupID)
+			if groupID == "" || slices.Contains(groupIDs, groupID) {
+				continue
+			}
+			if !userDirectory.GroupExists(groupID) {
+				utils.SendErrorResponse(w, "Group not found: "+groupID)
+				return
+			}
+			groupIDs = append(groupIDs, groupID)
+		}
+
+		targetProxy.AuthenticationProvider.BasicAuthGroupIDs = groupIDs
+
+		//Save it to file
+		SaveReverseProxyConfig(targetProxy)
+
+		//Replace runtime configuration
+		targetProxy.UpdateToRuntime()
+		utils.SendOK(w)
+	} else {
+		http.Error(w, "invalid usage", http.StatusMethodNotAllowed)
+	}
+}
+
+/*
+Get or set the LDAP directory access of a basic auth endpoint
+
+if request is GET, the handler will return if LDAP users are allowed and the allowed groups
+if request is POST, enabled is true or false and groups is a newline seperated list of
+group DNs or common names, empty to allow all directory users
+*/
+func UpdateProxyBasicAuthLDAP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		ep, err := utils.GetPara(r, "ep")
+		if err != nil {
+			utils.SendErrorResponse(w, "Invalid ep given")
+			return
+		}
+
+		targetProxy, err := dynamicProxyRouter.LoadProxy(ep)
+		if err != nil {
+			utils.SendErrorResponse(w, err.Error())
+			return
+		}
+
+		groups := targetProxy.AuthenticationProvider.BasicAuthLDAPGroups
+		if groups == nil {
+			groups = []string{}
+		}
+		js, _ := json.Marshal(map[string]interface{}{
+			"Enabled":          targetProxy.AuthenticationProvider.BasicAuthLDAP,
+			"Groups":           groups,
+			"DirectoryEnabled": ldapAuthenticator.GetSettings().Enabled,
+		})
+		utils.SendJSONResponse(w, string(js))
+
+	} else if r.Method == http.MethodPost {
+		ep, err := utils.PostPara(r, "ep")
+		if err != nil {
+			utils.SendErrorResponse(w, "Invalid ep given")
+			return
+		}
+
+		enabled, err := utils.PostBool(r, "enabled")
+		if err != nil {
+			utils.SendErrorResponse(w, "enabled not defined")
+			return
+		}
+
+		targetProxy, err := dynamicProxyRouter.LoadProxy(ep)
+		if err != nil {
+			utils.SendErrorResponse(w, err.Error())
+			return
+		}
+
+		groups := []string{}
+		for _, group := range strings.Split(r.Form.Get("groups"), "\n") {
+			group = strings.TrimSpace(group)
+			if group == "" || slices.Contains(groups, group) {
+				continue
+			}
+			groups = append(groups, group)
+		}
+
+		targetProxy.AuthenticationProvider.BasicAuthLDAP = enabled
+		targetProxy.AuthenticationProvider.BasicAuthLDAPGroups = groups
+
+		//Save it to file
+		SaveReverseProxyConfig(targetProxy)
+
+		//Replace runtime configuration
+		targetProxy.UpdateToRuntime()
+		utils.SendOK(w)
+	} else {
+		http.Error(w, "invalid usage", http.StatusMethodNotAllowed)
+	}
+}
+
+// Split a comma seperated list and remove empty entries
+func splitCommaList(list string) []string {
+	results := []string{}
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			results = append(results, item)
+		}
+	}
+	return results
+}
+
+/*
+Get or set the OIDC provider, access rules and claim headers of an OAuth2 endpoint
+
+if request is GET, the handler will return the OIDC settings of the endpoint
+if request is POST, provider select the OIDC provider (empty for default),
+groups, roles and domains are comma seperated allow lists and headers is
+a JSON object of claim name to upstream header name
+*/
+func UpdateProxyOIDCSettings(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		ep, err := utils.GetPara(r, "ep")
+		if err != nil {
+			utils.SendErrorResponse(w, "Invalid ep given")
+			return
+		}
+
+		targetProxy, err := dynamicProxyRouter.LoadProxy(ep)
+		if err != nil {
+			utils.SendErrorResponse(w, err.Error())
+			return
+		}
+
+		authProvider := targetProxy.AuthenticationProvider
+		js, _ := json.Marshal(map[string]interface{}{
+			"ProviderID":          authProvider.OAuth2ProviderID,
+			"AllowedGroups":       authProvider.OAuth2AllowedGroups,
+			"AllowedRoles":        authProvider.OAuth2AllowedRoles,
+			"AllowedEmailDomains": authProvider.OAuth2AllowedEmailDomains,
+			"ClaimHeaders":        authProvider.OAuth2ClaimHeaders,
+		})
+		utils.SendJSONResponse(w, string(js))
+
+	} else if r.Method == http.MethodPost {
+		ep, err := utils.PostPara(r, "ep")
+		if err != nil {
+			utils.SendErrorResponse(w, "Invalid ep given")
+			return
+		}
+
+		targetProxy, err := dynamicProxyRouter.LoadProxy(ep)
+		if err != nil {
+			utils.SendErrorResponse(w, err.Error())
+			return
+		}
+
+		providerID, _ := utils.PostPara(r, "provider")
+		if providerID == oauth2.DefaultProviderID {
+			providerID = ""
+		}
+		if !oauth2Router.ProviderExists(providerID) {
+			utils.SendErrorResponse(w, "OIDC provider not found")
+			return
+		}
+
+		claimHeaders := map[string]string{}
+		if headers, err := utils.PostPara(r, "headers"); err == nil {
+			if err := json.Unmarshal([]byte(headers), &claimHeaders); err != nil {
+				utils.SendErrorResponse(w, "Malformed claim header mapping")
+				return
+			}
+		}
+		for claim, header := range claimHeaders {
+			if strings.TrimSpace(claim) == "" || !httpguts.ValidHeaderFieldName(header) {
+				utils.SendErrorResponse(w, "Invalid claim header mapping: "+claim+" -> "+header)
+				return
+			}
+		}
+
+		groups, _ := utils.PostPara(r, "groups")
+		roles, _ := utils.PostPara(r, "roles")
+		domains, _ := utils.PostPara(r, "domains")
+
+		authProvider := targetProxy.AuthenticationProvider
+		authProvider.OAuth2ProviderID = providerID
+		authProvider.OAuth2AllowedGroups = splitCommaList(groups)
+		authProvider.OAuth2AllowedRoles = splitCommaList(roles)
+		authProvider.OAuth2AllowedEmailDomains = splitCommaList(domains)
+		authProvider.OAuth2ClaimHeaders = claimHeaders
+
+		//Save it to file
+		SaveReverseProxyConfig(targetProxy)
+
+		//Replace runtime configuration
+		targetProxy.UpdateToRuntime()
+		utils.SendOK(w)
+	} else {
+		http.Error(w, "invalid usage", http.StatusMethodNotAllowed)
+	}
+}
+
+/*
+Get or set the users allowed to access an SSO portal endpoint
+
+if request is GET, the handler will return the allowed users of the endpoint
+if request is POST, users is a comma seperated list of Zoraxy usernames,
+empty to allow all users
+*/
+func UpdateProxySSOPortalUsers(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		ep, err := utils.GetPara(r, "ep")
+		if err != nil {
+			utils.SendErrorResponse(w, "Invalid ep given")
+			return
+		}
+
+		targetProxy, err := dynamicProxyRouter.LoadProxy(ep)
+		if err != nil {
+			utils.SendErrorResponse(w, err.Error())
+			return
+		}
+
+		allowedUsers := targetProxy.AuthenticationProvider.SSOPortalAllowedUsers
+		if allowedUsers == nil {
+			allowedUsers = []string{}
+		}
+		js, _ := json.Marshal(allowedUsers)
+		utils.SendJSONResponse(w, string(js))
+
+	} else if r.Method == http.MethodPost {
+		ep, err := utils.PostPara(r, "ep")
+		if err != nil {
+			utils.SendErrorResponse(w, "Invalid ep given")
+			return
+		}
+
+		targetProxy, err := dynamicProxyRouter.LoadProxy(ep)
+		if err != nil {
+			utils.SendErrorResponse(w, err.Error())
+			return
+		}
+
+		users, _ := utils.PostPara(r, "users")
+		allowedUsers := splitCommaList(users)
+		for _, username := range allowedUsers {
+			if !authAgent.UserExists(username) {
+				utils.SendErrorResponse(w, "User not found: "+username)
+				return
+			}
+		}
+
+		targetProxy.AuthenticationProvider.SSOPortalAllowedUsers = allowedUsers
+
+		//Save it to file
+		SaveReverseProxyConfig(targetProxy)
+
+		//Replace runtime configuration
+		targetProxy.UpdateToRuntime()
+		utils.SendOK(w)
+	} else {
+		http.Error(w, "invalid usage", http.StatusMethodNotAllowed)
+	}
+}
+
+/*
+Get or set the bearer token validation settings of a JWT endpoint
+
+if request is GET, the handler will return the JWT settings of the endpoint
+if request is POST, jwks is a newline seperated list of JWKS URLs, keys is a
+JSON array of PEM or JWK static keys, issuers and audiences are comma seperated
+allow lists, claims is a JSON object of claim name to allowed values and
+headers is a JSON object of claim name to upstream header name
+*/
+func UpdateProxyJWTSettings(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		ep, err := utils.GetPara(r, "ep")
+		if err != nil {
+			utils.SendErrorResponse(w, "Invalid ep given")
+			return
+		}
+
+		targetProxy, err := dynamicProxyRouter.LoadProxy(ep)
+		if err != nil {
+			utils.SendErrorResponse(w, err.Error())
+			return
+		}
+
+		authProvider := targetProxy.AuthenticationProvider
+		js, _ := json.Marshal(map[string]interface{}{
+			"JwksURLs":       authProvider.JWTJwksURLs,
+			"StaticKeys":     authProvider.JWTStaticKeys,
+			"Issuers":        authProvider.JWTIssuers,
+			"Audiences":      authProvider.JWTAudiences,
+			"RequiredClaims": authProvider.JWTRequiredClaims,
+			"ClaimHeaders":   authProvider.JWTClaimHeaders,
+		})
+		utils.SendJSONResponse(w, string(js))
+
+	} else if r.Method == http.MethodPost {
+		ep, err := utils.PostPara(r, "ep")
+		if err != nil {
+			utils.SendErrorResponse(w, "Invalid ep given")
+			return
+		}
+
+		targetProxy, err := dynamicProxyRouter.LoadProxy(ep)
+		if err != nil {
+			utils.SendErrorResponse(w, err.Error())
+			return
+		}
+
+		jwksURLs, _ := utils.PostPara(r, "jwks")
+		staticKeys := []string{}
+		if keys, err := utils.PostPara(r, "keys"); err == nil {
+			if err := json.Unmarshal([]byte(keys), &staticKeys); err != nil {
+				utils.SendErrorResponse(w, "Malformed static keys")
+				return
+			}
+		}
+		requiredClaims := map[string][]string{}
+		if claims, err := utils.PostPara(r, "claims"); err == nil {
+			if err := json.Unmarshal([]byte(claims), &requiredClaims); err != nil {
+				utils.SendErrorResponse(w, "Malformed required claims")
+				return
+			}
+		}
+		for claim := range requiredClaims {
+			if strings.TrimSpace(claim) == "" {
+				utils.SendErrorResponse(w, "Required claim name cannot be empty")
+				return
+			}
+		}
+		claimHeaders := map[string]string{}
+		if headers, err := utils.PostPara(r, "headers"); err == nil {
+			if err := json.Unmarshal([]byte(headers), &claimHeaders); err != nil {
+				utils.SendErrorResponse(w, "Malformed claim header mapping")
+				return
+			}
+		}
+		for claim, header := range claimHeaders {
+			if strings.TrimSpace(claim) == "" || !httpguts.ValidHeaderFieldName(header) {
+				utils.SendErrorResponse(w, "Invalid claim header mapping: "+claim+" -> "+header)
+				return
+			}
+		}
+		issuers, _ := utils.PostPara(r, "issuers")
+		audiences, _ := utils.PostPara(r, "audiences")
+
+		authProvider := *targetProxy.AuthenticationProvider
+		authProvider.JWTJwksURLs = strings.Fields(jwksURLs)
+		authProvider.JWTStaticKeys = staticKeys
+		authProvider.JWTIssuers = splitCommaList(issuers)
+		authProvider.JWTAudiences = splitCommaList(audiences)
+		authProvider.JWTRequiredClaims = requiredClaims
+		authProvider.JWTClaimHeaders = claimHeaders
+		if err := authProvider.JWTPolicy().Validate(); err != nil {
+			utils.SendErrorResponse(w, err.Error())
+			return
+		}
+		*targetProxy.AuthenticationProvider = authProvider
+
+		//Save it to file
+		SaveReverseProxyConfig(targetProxy)
+
+		//Replace runtime configuration
+		targetProxy.UpdateToRuntime()
+		utils.SendOK(w)
+	} else {
+		http.Error(w, "invalid usage", http.StatusMethodNotAllowed)
+	}
+}
+
 // List, Update or Remove the exception paths for basic auth.
 func ListProxyBasicAuthExceptionPaths(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
@@ -1417,6 +1990,51 @@ func HandleUpdateHttpsRedirect(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Handle inbound PROXY protocol setting of the main listeners
+func HandleInboundProxyProtocol(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		js, _ := json.Marshal(map[string]interface{}{
+			"enabled":      dynamicProxyRouter.Option.AcceptProxyProtocol,
+			"trustedCIDRs": dynamicProxyRouter.Option.TrustedProxyCIDRs,
+		})
+		utils.SendJSONResponse(w, string(js))
+	} else if r.Method == http.MethodPost {
+		enabled, err := utils.PostBool(r, "enable")
+		if err != nil {
+			utils.SendErrorResponse(w, "enable state not set")
+			return
+		}
+
+		//Comma seperated list of IP or CIDR, e.g. 10.0.0.0/8,192.168.1.10
+		trustedCIDRs := []string{}
+		trustedCIDRsStr, _ := utils.PostPara(r, "trustedCIDRs")
+		for _, cidr := range strings.Split(trustedCIDRsStr, ",") {
+			cidr = strings.TrimSpace(cidr)
+			if cidr != "" {
+				trustedCIDRs = append(trustedCIDRs, cidr)
+			}
+		}
+
+		if _, err := netutils.ParseTrustedProxyCIDRs(trustedCIDRs); err != nil {
+			utils.SendErrorResponse(w, err.Error())
+			return
+		}
+		if enabled && len(trustedCIDRs) == 0 {
+			utils.SendErrorResponse(w, "at least one trusted proxy address is required")
+			return
+		}
+
+		sysdb.Write("settings", "acceptProxyProtocol", enabled)
+		sysdb.Write("settings", "trustedProxyCIDRs", trustedCIDRs)
+		SystemWideLogger.Println("Updating inbound PROXY protocol setting")
+		dynamicProxyRouter.UpdateProxyProtocolSetting(enabled, trustedCIDRs)
+
+		utils.SendOK(w)
+	} else {
+		http.Error(w, "405 - Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
 // Handle checking if the current user is accessing via the reverse proxied interface
 // Of the management interface.
 func HandleManagementProxyCheck(w http.ResponseWriter, r *http.Request) {
@@ -8,6 +8,7 @@ import (
 	"strings"
 
 	"github.com/gorilla/csrf"
+	"imuslab.com/zoraxy/mod/auth"
 	"imuslab.com/zoraxy/mod/sshprox"
 )
 
@@ -44,6 +45,9 @@ func FSHandler(handler http.Handler) http.Handler {
 
 		//For Plugin Routing
 		if strings.HasPrefix(r.URL.Path, "/plugin.ui/") {
+			if requireAuth && !authAgent.CheckUserAccess(w, r, "/plugin.ui/") {
+				return
+			}
 			//Extract the plugin ID from the request path
 			parts := strings.Split(r.URL.Path, "/")
 			if len(parts) > 2 {
@@ -59,6 +63,9 @@ func FSHandler(handler http.Handler) http.Handler {
 		//For WebSSH Routing
 		//Example URL Path: /web.ssh/{{instance_uuid}}/*
 		if strings.HasPrefix(r.URL.Path, "/web.ssh/") {
+			if requireAuth && !authAgent.CheckUserAccess(w, r, "/web.ssh/") {
+				return
+			}
 			requestPath := r.URL.Path
 			parts := strings.Split(requestPath, "/")
 			if !strings.HasSuffix(requestPath, "/") && len(parts) == 3 {
@@ -71,8 +78,14 @@ func FSHandler(handler http.Handler) http.Handler {
 				fmt.Println(instanceUUID)
 
 				//Rewrite the url so the proxy knows how to serve stuffs
+				//Sessions can only be used by the user who opened it
+				owner, err := authAgent.GetUserName(w, r)
+				if err != nil {
+					owner = "unknown"
+				}
+
 				r.URL, _ = sshprox.RewriteURL("/web.ssh/"+instanceUUID, r.RequestURI)
-				webSshManager.HandleHttpByInstanceId(instanceUUID, w, r)
+				webSshManager.HandleHttpByInstanceId(instanceUUID, owner, w, r)
 			} else {
 				fmt.Println(parts)
 				http.Error(w, "Invalid Usage", http.StatusInternalServerError)
@@ -89,6 +102,18 @@ func FSHandler(handler http.Handler) http.Handler {
 	})
 }
 
+// Skip CSRF check for requests with API token. Browsers cannot attach the
+// Authorization header cross-site without CORS, and the auth agent never
+// fallback to the session cookie on these requests
+func skipCSRFForAPIToken(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auth.IsAPITokenRequest(r) {
+			r = csrf.UnsafeSkipCheck(r)
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
 func isHTMLFilePath(requestURI string) bool {
 	return strings.HasSuffix(requestURI, ".html") || strings.HasSuffix(requestURI, "/")
 }
@@ -32,4 +32,13 @@ func registerBuildInRoutingRules() {
 		UseSystemAccessControl: false,
 	})
 
+	//Built-in SSO portal
+	//Serve the login portal on the portal domain if enabled
+	dynamicProxyRouter.AddRoutingRules(&dynamicproxy.RoutingRule{
+		ID:                     "sso-portal",
+		MatchRule:              ssoPortal.IsPortalRequest,
+		RoutingHandler:         ssoPortal.ServeHTTP,
+		Enabled:                true,
+		UseSystemAccessControl: false,
+	})
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"log"
+	"net"
 	"net/http"
 	"net/netip"
 	"os"
@@ -11,6 +12,7 @@ import (
 	"time"
 
 	"imuslab.com/zoraxy/mod/auth/sso/oauth2"
+	"imuslab.com/zoraxy/mod/email"
 	"imuslab.com/zoraxy/mod/eventsystem"
 
 	"github.com/gorilla/csrf"
@@ -18,6 +20,10 @@ import (
 	"imuslab.com/zoraxy/mod/acme"
 	"imuslab.com/zoraxy/mod/auth"
 	"imuslab.com/zoraxy/mod/auth/sso/forward"
+	"imuslab.com/zoraxy/mod/auth/sso/jwtauth"
+	"imuslab.com/zoraxy/mod/auth/sso/ldapauth"
+	"imuslab.com/zoraxy/mod/auth/sso/portal"
+	"imuslab.com/zoraxy/mod/auth/userdir"
 	"imuslab.com/zoraxy/mod/database"
 	"imuslab.com/zoraxy/mod/database/dbinc"
 	"imuslab.com/zoraxy/mod/dockerux"
@@ -38,6 +44,8 @@ import (
 	"imuslab.com/zoraxy/mod/hoststats"
 	"imuslab.com/zoraxy/mod/streamproxy"
 	"imuslab.com/zoraxy/mod/tlscert"
+	"imuslab.com/zoraxy/mod/tlscert/certnotify"
+	"imuslab.com/zoraxy/mod/tlscert/localca"
 	"imuslab.com/zoraxy/mod/webserv"
 )
 
@@ -136,6 +144,10 @@ func startupSequence() {
 		//Not logged in. Redirecting to login page
 		http.Redirect(w, r, "/login.html", http.StatusTemporaryRedirect)
 	})
+	if *disableTwoFactor {
+		authAgent.TwoFactorDisabled = true
+		SystemWideLogger.PrintAndLog("auth", "Two-factor authentication is disabled by start parameter", nil)
+	}
 
 	// Create an API key manager for plugin authentication
 	pluginApiKeyManager = auth.NewAPIKeyManager()
@@ -195,6 +207,34 @@ func startupSequence() {
 		Database: sysdb,
 	})
 
+	userDirectory, err = userdir.NewDirectory(&userdir.Options{
+		Database: sysdb,
+		Logger:   SystemWideLogger,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	ssoPortal, err = portal.NewPortal(&portal.PortalOptions{
+		AuthAgent: authAgent,
+		Database:  sysdb,
+		Logger:    SystemWideLogger,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	jwtValidator = jwtauth.NewValidator(SystemWideLogger)
+
+	ldapAuthenticator, err = ldapauth.NewAuthenticator(&ldapauth.Options{
+		Database: sysdb,
+		Logger:   SystemWideLogger,
+	})
+	if err != nil {
+		panic(err)
+	}
+	authAgent.ExternalAuthenticator = ldapAuthenticator
+
 	//Create a statistic collector
 	statisticCollector, err = statistic.NewStatisticCollector(statistic.CollectorOption{
 		Database: sysdb,
@@ -303,13 +343,43 @@ func startupSequence() {
 	}
 
 	//Create WebSSH Manager
-	webSshManager = sshprox.NewSSHProxyManager()
+	webSshManager = sshprox.NewSSHProxyManager(&sshprox.Options{
+		Database:      sysdb,
+		Logger:        SystemWideLogger,
+		AllowLoopback: *allowSshLoopback,
+	})
 
 	//Create TCP Proxy Manager
 	streamProxyManager, err = streamproxy.NewStreamProxy(&streamproxy.Options{
-		AccessControlHandler: accessController.DefaultAccessRule.AllowConnectionAccess,
-		ConfigStore:          CONF_STREAM_PROXY,
-		Logger:               SystemWideLogger,
+		AccessRuleHandler: func(accessRuleID string, clientIP string) bool {
+			accessRule, err := accessController.GetAccessRuleByID(accessRuleID)
+			if err != nil {
+				//Access rule removed, fallback to default
+				accessRule = accessController.DefaultAccessRule
+			}
+			return accessRule.AllowIpAccess(clientIP)
+		},
+		ConfigStore:        CONF_STREAM_PROXY,
+		StatisticCollector: statisticCollector,
+		TlsManager:         tlsCertManager,
+		HostStatsCollector: hostStatsCollector,
+		Logger:             SystemWideLogger,
+		ReservedPorts: func() []int {
+			ports := []int{}
+			if dynamicProxyRouter != nil && dynamicProxyRouter.Option != nil {
+				ports = append(ports, dynamicProxyRouter.Option.Port)
+				if dynamicProxyRouter.Option.ListenOnPort80 {
+					ports = append(ports, 80)
+				}
+			}
+			_, webUIPortString, err := net.SplitHostPort(*webUIPort)
+			if err == nil {
+				if portInt, err := strconv.Atoi(webUIPortString); err == nil {
+					ports = append(ports, portInt)
+				}
+			}
+			return ports
+		},
 	})
 	if err != nil {
 		panic(err)
@@ -357,6 +427,20 @@ func startupSequence() {
 		log.Fatal(err)
 	}
 
+	/*
+		Local CA
+
+		Issue certificates for internal hostnames (e.g. .lan / .internal)
+	*/
+	localCA, err = localca.NewLocalCA(&localca.Options{
+		ConfigFolder: CONF_LOCAL_CA,
+		TlsManager:   tlsCertManager,
+		Logger:       SystemWideLogger,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	/*
 		Plugin Manager
 	*/
@@ -397,6 +481,29 @@ func startupSequence() {
 	*/
 	eventsystem.InitEventSystem(SystemWideLogger)
 
+	/*
+		Certificate Expiry Notifier
+
+		Emit expiry events and send renewal / expiry digest via SMTP
+	*/
+	certNotifier, err = certnotify.NewNotifier(&certnotify.Options{
+		CertStore:  CONF_CERT_STORE,
+		ConfigFile: CONF_CERT_NOTIFY,
+		GetEmailSender: func() *email.Sender {
+			return EmailSender
+		},
+		GetAdminEmail: loadSMTPAdminAddr,
+		Logger:        SystemWideLogger,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = certNotifier.Subscribe()
+	if err != nil {
+		SystemWideLogger.PrintAndLog("cert-notify", "Failed to subscribe to certificate renewal events", err)
+	}
+	certNotifier.StartTicker()
+
 	//Sync latest plugin list from the plugin store
 	go func() {
 		err = pluginManager.UpdateDownloadablePluginList()
@@ -467,6 +574,12 @@ func ShutdownSeq() {
 	if acmeAutoRenewer != nil {
 		acmeAutoRenewer.Close()
 	}
+	if localCA != nil {
+		localCA.Close()
+	}
+	if certNotifier != nil {
+		certNotifier.Close()
+	}
 
 	if accessController != nil {
 		SystemWideLogger.Println("Closing Access Controller")
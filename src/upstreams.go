@@ -92,20 +92,54 @@ func ReverseProxyUpstreamAdd(w http.ResponseWriter, r *http.Request) {
 		maxConn = 0
 	}
 
+	//Max response bytes per second from this upstream, set to 0 for unlimited
+	bandwidthLimit, err := utils.PostInt(r, "bwlimit")
+	if err != nil {
+		bandwidthLimit = 0
+	} else if bandwidthLimit < 0 {
+		utils.SendErrorResponse(w, "invalid bandwidth limit given")
+		return
+	}
+
 	requireTLS, _ := utils.PostBool(r, "tls")
 	skipTlsValidation, _ := utils.PostBool(r, "tlsval")
 	bpwsorg, _ := utils.PostBool(r, "bpwsorg")
 	preactivate, _ := utils.PostBool(r, "active")
 
+	//Optional upstream TLS settings
+	caBundle, _ := utils.PostPara(r, "cabundle")
+	clientCert, _ := utils.PostPara(r, "clientcert")
+	sniOverride, _ := utils.PostPara(r, "sni")
+	spkiPins := []string{}
+	if pins, err := utils.PostPara(r, "spkipins"); err == nil {
+		for _, pin := range strings.Split(pins, ",") {
+			if strings.TrimSpace(pin) != "" {
+				spkiPins = append(spkiPins, strings.TrimSpace(pin))
+			}
+		}
+	}
+
 	//Create a new upstream object
 	newUpstream := loadbalance.Upstream{
 		OriginIpOrDomain:         upstreamOrigin,
 		RequireTLS:               requireTLS,
 		SkipCertValidations:      skipTlsValidation,
 		SkipWebSocketOriginCheck: bpwsorg,
+		CustomCABundle:           caBundle,
+		ClientCertName:           clientCert,
+		SNIOverride:              sniOverride,
+		PinnedSPKIHashes:         spkiPins,
 		Weight:                   1,
 		MaxConn:                  maxConn,
 		RespTimeout:              int64(respTimeout),
+		BandwidthLimit:           int64(bandwidthLimit),
+	}
+
+	//Make sure the TLS settings are valid before adding to runtime
+	_, err = newUpstream.BuildTLSClientConfig(tlsCertManager)
+	if err != nil {
+		utils.SendErrorResponse(w, "invalid upstream TLS settings: "+err.Error())
+		return
 	}
 
 	//Add the new upstream to endpoint
@@ -178,6 +212,18 @@ func ReverseProxyUpstreamUpdate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if newUpstream.BandwidthLimit < 0 {
+		utils.SendErrorResponse(w, "invalid bandwidth limit given")
+		return
+	}
+
+	//Validate the TLS settings before replacing the old upstream
+	_, err = newUpstream.BuildTLSClientConfig(tlsCertManager)
+	if err != nil {
+		utils.SendErrorResponse(w, "invalid upstream TLS settings: "+err.Error())
+		return
+	}
+
 	//Replace the old upstream with the new one
 	err = targetEndpoint.RemoveUpstreamOrigin(originIP)
 	if err != nil {
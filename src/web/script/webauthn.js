@@ -0,0 +1,63 @@
+/*
+    WebAuthn.js
+
+    Convert the WebAuthn options from the server into
+    browser credential requests and encode the results
+    as base64url form fields for the login APIs
+
+*/
+
+function webauthnSupported(){
+    return window.PublicKeyCredential !== undefined && navigator.credentials !== undefined;
+}
+
+function webauthnDecode(value){
+    let base64 = value.replace(/-/g, "+").replace(/_/g, "/");
+    while (base64.length % 4 != 0){
+        base64 += "=";
+    }
+    return Uint8Array.from(atob(base64), c => c.charCodeAt(0)).buffer;
+}
+
+function webauthnEncode(buffer){
+    let binary = "";
+    new Uint8Array(buffer).forEach(b => binary += String.fromCharCode(b));
+    return btoa(binary).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+}
+
+//Register a new credential with the creation options from /api/auth/2fa/webauthn/register/begin
+function webauthnCreate(options){
+    options.challenge = webauthnDecode(options.challenge);
+    options.user.id = webauthnDecode(options.user.id);
+    options.excludeCredentials = options.excludeCredentials.map(function(c){
+        return {type: c.type, id: webauthnDecode(c.id)};
+    });
+    return navigator.credentials.create({publicKey: options}).then(function(credential){
+        let publicKey = credential.response.getPublicKey();
+        if (publicKey == null){
+            throw new Error("This security key use an unsupported algorithm");
+        }
+        return {
+            clientDataJSON: webauthnEncode(credential.response.clientDataJSON),
+            authenticatorData: webauthnEncode(credential.response.getAuthenticatorData()),
+            publicKey: webauthnEncode(publicKey),
+            publicKeyAlgorithm: credential.response.getPublicKeyAlgorithm(),
+        };
+    });
+}
+
+//Sign a login challenge with the request options from /api/auth/login/webauthn/begin
+function webauthnGet(options){
+    options.challenge = webauthnDecode(options.challenge);
+    options.allowCredentials = options.allowCredentials.map(function(c){
+        return {type: c.type, id: webauthnDecode(c.id)};
+    });
+    return navigator.credentials.get({publicKey: options}).then(function(credential){
+        return {
+            id: webauthnEncode(credential.rawId),
+            clientDataJSON: webauthnEncode(credential.response.clientDataJSON),
+            authenticatorData: webauthnEncode(credential.response.authenticatorData),
+            signature: webauthnEncode(credential.response.signature),
+        };
+    });
+}
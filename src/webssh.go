@@ -4,8 +4,8 @@ import (
 	"encoding/json"
 	"net/http"
 	"strconv"
-	"strings"
 
+	"imuslab.com/zoraxy/mod/netutils"
 	"imuslab.com/zoraxy/mod/sshprox"
 	"imuslab.com/zoraxy/mod/utils"
 )
@@ -31,7 +31,8 @@ func HandleCreateProxySession(w http.ResponseWriter, r *http.Request) {
 
 	username, err := utils.PostPara(r, "username")
 	if err != nil {
-		username = ""
+		utils.SendErrorResponse(w, "username cannot be empty")
+		return
 	}
 
 	port, err := strconv.Atoi(portString)
@@ -49,21 +50,34 @@ func HandleCreateProxySession(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	//Check if the target is a valid ssh endpoint
-	if !sshprox.IsSSHConnectable(ipaddr, port) {
-		utils.SendErrorResponse(w, ipaddr+":"+strconv.Itoa(port)+" is not a valid SSH server")
+	//Credentials, password or private key with optional passphrase
+	credentials := &sshprox.Credentials{Username: username}
+	authMethod, _ := utils.PostPara(r, "authMethod")
+	switch authMethod {
+	case "", "password":
+		credentials.Password, _ = utils.PostPara(r, "password")
+	case "key":
+		privateKey, err := utils.PostPara(r, "privateKey")
+		if err != nil {
+			utils.SendErrorResponse(w, "private key cannot be empty")
+			return
+		}
+		credentials.PrivateKey = []byte(privateKey)
+		credentials.Passphrase, _ = utils.PostPara(r, "passphrase")
+	default:
+		utils.SendErrorResponse(w, "invalid auth method given")
 		return
 	}
 
-	//Create a new proxy instance
-	instance, err := webSshManager.NewSSHProxy("./tmp/gotty")
+	//Record who open this session for the audit log
+	owner, err := authAgent.GetUserName(w, r)
 	if err != nil {
-		utils.SendErrorResponse(w, strings.ReplaceAll(err.Error(), "\\", "/"))
-		return
+		owner = "unknown"
 	}
+	clientIP := netutils.GetRequesterIPUntrusted(r)
 
-	//Create an ssh process to the target address
-	err = instance.CreateNewConnection(webSshManager.GetNextPort(), username, ipaddr, port)
+	//Connect and authenticate with the remote server
+	instance, err := webSshManager.NewSession(ipaddr, port, credentials, owner, clientIP)
 	if err != nil {
 		utils.SendErrorResponse(w, err.Error())
 		return
@@ -105,3 +119,68 @@ func HandleWebSshSupportCheck(w http.ResponseWriter, r *http.Request) {
 		utils.SendJSONResponse(w, string(js))
 	}
 }
+
+// List the active web ssh sessions
+func HandleListWebSshSessions(w http.ResponseWriter, r *http.Request) {
+	js, _ := json.Marshal(webSshManager.ListSessions())
+	utils.SendJSONResponse(w, string(js))
+}
+
+// Close an active web ssh session by its UUID
+func HandleCloseWebSshSession(w http.ResponseWriter, r *http.Request) {
+	sessionID, err := utils.PostPara(r, "uuid")
+	if err != nil {
+		utils.SendErrorResponse(w, "invalid uuid given")
+		return
+	}
+
+	instance, err := webSshManager.GetInstanceById(sessionID)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	closedBy, err := authAgent.GetUserName(w, r)
+	if err != nil {
+		closedBy = "unknown"
+	}
+	instance.Close("closed by " + closedBy)
+	utils.SendOK(w)
+}
+
+// List the trusted SSH server host keys
+func HandleListWebSshHostKeys(w http.ResponseWriter, r *http.Request) {
+	js, _ := json.Marshal(webSshManager.ListKnownHosts())
+	utils.SendJSONResponse(w, string(js))
+}
+
+// Remove a trusted host key, so a server with changed key can be connected again
+func HandleRemoveWebSshHostKey(w http.ResponseWriter, r *http.Request) {
+	address, err := utils.PostPara(r, "address")
+	if err != nil {
+		utils.SendErrorResponse(w, "invalid address given")
+		return
+	}
+
+	err = webSshManager.RemoveKnownHost(address)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	utils.SendOK(w)
+}
+
+// Get the web ssh audit log, newest first
+func HandleWebSshAuditLog(w http.ResponseWriter, r *http.Request) {
+	limit, err := utils.GetPara(r, "limit")
+	if err != nil {
+		limit = "0"
+	}
+	limitInt, err := strconv.Atoi(limit)
+	if err != nil {
+		utils.SendErrorResponse(w, "invalid limit given")
+		return
+	}
+	js, _ := json.Marshal(webSshManager.ListAuditLog(limitInt))
+	utils.SendJSONResponse(w, string(js))
+}